@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// logCommandRestartDelay is the least time between two starts of the log
+// command; lines logged while it is down and cannot be restarted yet are dropped
+var logCommandRestartDelay = time.Second
+
+// commandWriter writes to the stdin of a shell command, such as
+// "logger -t pbp", restarting the command when it has exited. Failures are
+// reported on stderr rather than returned, so they never break logging.
+type commandWriter struct {
+	command string
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	exited  chan struct{}
+	started time.Time
+}
+
+// newCommandWriter starts command and returns a writer to its stdin
+func newCommandWriter(command string) (*commandWriter, error) {
+	w := &commandWriter{command: command}
+	if err := w.start(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// start runs the command through the platform shell
+func (w *commandWriter) start() error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", w.command)
+	} else {
+		cmd = exec.Command("sh", "-c", w.command)
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("log command %q: %w", w.command, err)
+	}
+	w.started = time.Now()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start log command %q: %w", w.command, err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	w.cmd, w.stdin, w.exited = cmd, stdin, exited
+	return nil
+}
+
+// running reports whether the command has not exited yet
+func (w *commandWriter) running() bool {
+	if w.exited == nil {
+		return false
+	}
+	select {
+	case <-w.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// restart starts the command again once logCommandRestartDelay has passed
+// since its last start
+func (w *commandWriter) restart() bool {
+	if time.Since(w.started) < logCommandRestartDelay {
+		return false
+	}
+	if w.stdin != nil {
+		w.stdin.Close()
+	}
+	fmt.Fprintf(os.Stderr, "log command %q exited, restarting it\n", w.command)
+	if err := w.start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// Write sends p to the command, restarting it first if it has exited. It
+// always reports success: p is dropped when the command cannot take it.
+func (w *commandWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.running() && !w.restart() {
+		return len(p), nil
+	}
+	if _, err := w.stdin.Write(p); err != nil {
+		// the command died since the check above
+		if w.restart() {
+			_, _ = w.stdin.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Close closes the command's stdin and waits for it to exit
+func (w *commandWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stdin == nil {
+		return nil
+	}
+	err := w.stdin.Close()
+	<-w.exited
+	return err
+}
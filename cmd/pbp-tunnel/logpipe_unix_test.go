@@ -0,0 +1,68 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForFile polls path until it contains want
+func waitForFile(t *testing.T, path, want string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		data, _ := os.ReadFile(path)
+		if strings.Contains(string(data), want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %q; want it to contain %q", path, data, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSetupLogging_LogCommand(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "piped.log")
+	setupLogging("file", dir, "cat >> "+out)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+
+	log.Printf("[*] hello through the log command")
+	waitForFile(t, out, "hello through the log command")
+	waitForFile(t, filepath.Join(dir, "pbp-tunnel.log"), "hello through the log command")
+}
+
+func TestCommandWriter_RestartsExitedCommand(t *testing.T) {
+	orig := logCommandRestartDelay
+	logCommandRestartDelay = 0
+	t.Cleanup(func() { logCommandRestartDelay = orig })
+
+	out := filepath.Join(t.TempDir(), "piped.log")
+	w, err := newCommandWriter("cat >> " + out)
+	if err != nil {
+		t.Fatalf("newCommandWriter: %v", err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("first line\n"))
+	waitForFile(t, out, "first line")
+
+	w.mu.Lock()
+	w.cmd.Process.Kill()
+	<-w.exited
+	w.mu.Unlock()
+
+	if n, err := w.Write([]byte("second line\n")); n != len("second line\n") || err != nil {
+		t.Errorf("Write after the command exited = %d, %v; want all bytes and no error", n, err)
+	}
+	waitForFile(t, out, "second line")
+}
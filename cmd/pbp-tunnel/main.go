@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -8,16 +11,26 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/poweredbypump/pbp-tunnel/internal/client"
 	"github.com/poweredbypump/pbp-tunnel/internal/config"
 	"github.com/poweredbypump/pbp-tunnel/internal/server"
 	"github.com/poweredbypump/pbp-tunnel/internal/util"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
 )
 
 var Version = "dev"
 
+// Exit codes for client failures, so orchestrators can tell them apart
+const (
+	exitRetriesExhausted = 2
+	exitInvalidConfig    = 3
+	exitAuthFailed       = 4
+)
+
 type LogMode int
 
 const (
@@ -33,12 +46,15 @@ func main() {
 	debugFlag := flag.Bool("debug", false, "Enable debug monitoring")
 	logging := flag.String("logging", "console", "Logging mode: both, file, console")
 	logFile := flag.String("logfile", "", "Path to log file (if logging mode is 'file' or 'both')")
+	logCommand := flag.String("log-command", "", "Shell command receiving the logs on its stdin, e.g. \"logger -t pbp\"")
+	configFormat := flag.String("config-format", "", "Config file format: json, yaml or toml (default: from the file extension)")
 
 	flag.Usage = util.PrintHelp
 
 	flag.Parse()
 
-	setupLogging(*logging, *logFile)
+	setupLogging(*logging, *logFile, *logCommand)
+	config.ConfigFormat = *configFormat
 
 	if *versionFlag {
 		fmt.Printf("pbp-tunnel (version %s)\n", Version)
@@ -46,6 +62,8 @@ func main() {
 		return
 	}
 
+	server.Version = Version
+
 	if *debugFlag {
 		go monitorGoroutines()
 	}
@@ -60,7 +78,8 @@ func main() {
 				log.Fatal("client configuration missing in config file")
 			}
 			if err := client.Run(cfg.Client); err != nil {
-				log.Fatalf("Client error: %v", err)
+				log.Printf("Client error: %v", err)
+				os.Exit(clientExitCode(err))
 			}
 			return
 
@@ -86,18 +105,26 @@ func main() {
 	case "client":
 		flag.Usage = util.PrintClientHelp
 
-		overrideCfg := config.LoadClientConfig()
-		err := client.Run(overrideCfg)
+		overrideCfg, err := config.LoadClientConfig()
+		if err != nil {
+			log.Printf("Client error: %v", err)
+			os.Exit(exitInvalidConfig)
+		}
+		err = client.Run(overrideCfg)
 
 		if err != nil {
-			log.Fatalf("Client error: %v", err)
+			log.Printf("Client error: %v", err)
+			os.Exit(clientExitCode(err))
 		}
 
 	case "server":
 		flag.Usage = util.PrintServerHelp
 
-		overrideCfg := config.LoadServerConfig()
-		err := server.Run(overrideCfg)
+		overrideCfg, err := config.LoadServerConfig()
+		if err != nil {
+			log.Fatalf("Server error: %v", err)
+		}
+		err = server.Run(overrideCfg)
 
 		if err != nil {
 			log.Fatalf("Server error: %v", err)
@@ -109,11 +136,60 @@ func main() {
 			log.Fatalf("Error generating config template: %v", err)
 		}
 
+	case "hash-password":
+		in := io.Reader(os.Stdin)
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			fmt.Fprint(os.Stderr, "Password: ")
+			pass, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				log.Fatalf("Error reading password: %v", err)
+			}
+			in = bytes.NewReader(pass)
+		}
+		hash, err := hashPassword(in)
+		if err != nil {
+			log.Fatalf("Error hashing password: %v", err)
+		}
+		fmt.Println(hash)
+
 	default:
 		log.Fatalf("Unknown command: %s", cmd)
 	}
 }
 
+// hashPassword returns the bcrypt hash of the password on the first line of r,
+// for the server's password_hash
+func hashPassword(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("read password: %w", err)
+	}
+	pass := strings.TrimRight(line, "\r\n")
+	if pass == "" {
+		return "", errors.New("empty password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// clientExitCode maps a client.Run error to the process exit code
+func clientExitCode(err error) int {
+	switch {
+	case errors.Is(err, client.ErrAuthFailed):
+		return exitAuthFailed
+	case errors.Is(err, client.ErrInvalidConfig):
+		return exitInvalidConfig
+	case errors.Is(err, client.ErrRetriesExhausted):
+		return exitRetriesExhausted
+	default:
+		return 1
+	}
+}
+
 // monitorGoroutines periodically logs the number of active goroutines and memory usage.
 // This function runs as a goroutine when debug mode is enabled.
 func monitorGoroutines() {
@@ -134,7 +210,8 @@ func monitorGoroutines() {
 // Parameters:
 //   - quietMode: logging mode ("file", "console", or "both")
 //   - logDirOverride: custom log directory path (uses default if empty)
-func setupLogging(quietMode string, logDirOverride string) {
+//   - logCommand: shell command also receiving the logs on its stdin, restarted if it exits (none if empty)
+func setupLogging(quietMode string, logDirOverride string, logCommand string) {
 	var mode LogMode
 
 	switch quietMode {
@@ -163,15 +240,23 @@ func setupLogging(quietMode string, logDirOverride string) {
 		log.Fatalf("Failed to open log file: %v", err)
 	}
 
+	var output io.Writer
 	switch mode {
 	case LogFileOnly:
-		log.SetOutput(file)
+		output = file
 	case LogConsoleOnly:
-		log.SetOutput(os.Stdout)
+		output = os.Stdout
 	default: // LogBoth
-		multiWriter := io.MultiWriter(os.Stdout, file)
-		log.SetOutput(multiWriter)
+		output = io.MultiWriter(os.Stdout, file)
+	}
+	if logCommand != "" {
+		pipe, err := newCommandWriter(logCommand)
+		if err != nil {
+			log.Fatalf("Failed to set up log command: %v", err)
+		}
+		output = io.MultiWriter(output, pipe)
 	}
+	log.SetOutput(output)
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/poweredbypump/pbp-tunnel/internal/client"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestClientExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "retries exhausted", err: fmt.Errorf("%w: after 5 attempts", client.ErrRetriesExhausted), want: exitRetriesExhausted},
+		{name: "invalid config", err: fmt.Errorf("%w: endpoint is required", client.ErrInvalidConfig), want: exitInvalidConfig},
+		{name: "auth failure", err: fmt.Errorf("%w: ssh: unable to authenticate", client.ErrAuthFailed), want: exitAuthFailed},
+		{name: "other error", err: errors.New("session error"), want: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := clientExitCode(tc.err); got != tc.want {
+				t.Errorf("clientExitCode(%v) = %d; want %d", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	for _, in := range []string{"s3cret", "s3cret\n", "s3cret\r\nignored\n"} {
+		hash, err := hashPassword(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("hashPassword(%q) error = %v", in, err)
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte("s3cret")); err != nil {
+			t.Errorf("hashPassword(%q) = %q, which does not match s3cret: %v", in, hash, err)
+		}
+	}
+
+	if _, err := hashPassword(strings.NewReader("\n")); err == nil {
+		t.Error("hashPassword of an empty line error = nil; want error")
+	}
+}
@@ -5,9 +5,11 @@ go 1.25
 toolchain go1.25.1
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/mattn/go-isatty v0.0.20
 	golang.org/x/crypto v0.37.0
 	golang.org/x/term v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/sys v0.32.0 // indirect
+require golang.org/x/sys v0.32.0
@@ -0,0 +1,41 @@
+package client
+
+import "time"
+
+// retryBudgetRefill is how long the retry budget takes to regain one token
+var retryBudgetRefill = time.Minute
+
+// retryBudget is a token bucket bounding reconnects over time: each one takes
+// a token and tokens come back one per refill, up to capacity. Unlike the
+// retry counter, it is not reset by a successful session, so a connection
+// that keeps flapping runs it dry. A nil budget never runs out.
+type retryBudget struct {
+	capacity int
+	tokens   float64
+	refill   time.Duration
+	last     time.Time
+}
+
+// newRetryBudget returns a full budget of capacity tokens, or nil for capacity 0
+func newRetryBudget(capacity int, refill time.Duration, now time.Time) *retryBudget {
+	if capacity <= 0 {
+		return nil
+	}
+	return &retryBudget{capacity: capacity, tokens: float64(capacity), refill: refill, last: now}
+}
+
+// take spends a token at now, reporting false when none is left
+func (b *retryBudget) take(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(float64(b.capacity), b.tokens+float64(elapsed)/float64(b.refill))
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -1,42 +1,120 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand/v2"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/poweredbypump/pbp-tunnel/internal/config"
+	"github.com/poweredbypump/pbp-tunnel/internal/protocol"
+	"github.com/poweredbypump/pbp-tunnel/internal/util"
 	"golang.org/x/crypto/ssh"
 )
 
-const (
-	ErrSuccess         uint32 = 0
-	ErrPortUnavailable uint32 = 1
-	ErrIPNotAllowed    uint32 = 2
-	ErrPortOutOfRange  uint32 = 3
-	ErrInternal        uint32 = 4
-	ErrMask            uint32 = 0x80000000
+// maxTraceIDLength bounds the trace ID frame sent by the server
+const maxTraceIDLength = 64
+
+// ErrRequestedPortUnavailable is returned when the server cannot assign the
+// explicitly requested remote port because it is already in use
+var ErrRequestedPortUnavailable = errors.New("server: requested port unavailable")
+
+// ErrServerWarmingUp is returned when the server defers port assignment
+// while it warms up after a restart; the client retries later
+var ErrServerWarmingUp = errors.New("server: warming up, retry later")
+
+// ErrPortQuotaExceeded is returned when the client's IP already holds as many
+// ports as the server allows; the client retries once one is released
+var ErrPortQuotaExceeded = errors.New("server: port quota of this address exceeded")
+
+// ErrServerOverloaded is returned when the server sheds load and refuses new
+// forwards for now; the client retries later
+var ErrServerOverloaded = errors.New("server: overloaded, retry later")
+
+// ErrServerDraining is returned when the server is being drained and refuses
+// new forwards; the client retries, typically reaching a replacement node
+var ErrServerDraining = errors.New("server: draining, retry later")
+
+// ErrHandshakeConnClosed is returned when the SSH connection drops before the
+// handshake completes, as opposed to the server cutting the handshake short
+var ErrHandshakeConnClosed = errors.New("connection closed during handshake")
+
+// errSessionClosed marks the end of an established session: the client
+// reconnects after it, whatever broke the connection
+var errSessionClosed = errors.New("session closed")
+
+// handshakeCloseGrace is how long a handshake read hitting EOF waits for the
+// SSH connection to report it is closed
+var handshakeCloseGrace = 100 * time.Millisecond
+
+// Error categories returned by Run, so callers can tell why the client gave up
+var (
+	ErrInvalidConfig    = errors.New("invalid client parameters")
+	ErrAuthFailed       = errors.New("authentication failed")
+	ErrRetriesExhausted = errors.New("reconnect attempts exhausted")
 )
 
+// reconnectDelay is the pause between connection attempts
+var reconnectDelay = 5 * time.Second
+
+// maxBackoffDoublings caps the reconnect backoff after short sessions at
+// reconnectDelay << maxBackoffDoublings
+const maxBackoffDoublings = 5
+
+// dialLocal connects to the local service
+var dialLocal = net.Dial
+
+// closeDrainTimeout bounds how long Close waits for in-flight forwards
+var closeDrainTimeout = 10 * time.Second
+
 // ClientSession holds state for a running SSH tunnel session
 type ClientSession struct {
 	Connection        *ssh.Client
+	ProtocolVersion   uint32
 	AssignedPort      int
+	PublicURL         string
+	ServerVersion     string
 	LocalAddress      string
+	LocalFallbacks    []string
+	targets           *targetPool
+	LocalTLS          *tls.Config
+	TCPNoDelay        *bool
+	LocalDialRetries  int
+	LocalDialInterval time.Duration
 	Active            bool
 	Lock              sync.Mutex
 	ConnectionCount   int
+	CompletedCount    int
 	ActiveConnections sync.WaitGroup
+	// BytesToLocal and BytesToServer count the bytes relayed by the session's forwards
+	BytesToLocal  atomic.Uint64
+	BytesToServer atomic.Uint64
+	// MaxConcurrentForwards caps ConnectionCount - CompletedCount (0 = unlimited)
+	MaxConcurrentForwards int
 }
 
 // Run establishes the SSH connection and manages retries, handshake, and forwarding
 func Run(cpOverride *config.ClientParameters) error {
+	return RunContext(context.Background(), cpOverride)
+}
+
+// RunContext is Run bound to ctx: cancelling it closes the active session,
+// stops accepting forwards and returns ctx.Err() instead of retrying
+func RunContext(ctx context.Context, cpOverride *config.ClientParameters) error {
 	var cp config.ClientParameters
 
 	if cpOverride == nil {
@@ -45,51 +123,147 @@ func Run(cpOverride *config.ClientParameters) error {
 		flag.StringVar(&cp.Username, config.CpKeyUsername, config.CpDefaultUsername, "SSH username")
 		flag.StringVar(&cp.Password, config.CpKeyPassword, config.CpDefaultPassword, "SSH password")
 		flag.StringVar(&cp.PrivateKeyPath, config.CpKeyPrivateKeyPath, config.CpDefaultPrivateKeyPath, "Private key path (optional)")
+		flag.StringVar(&cp.CertificatePath, config.CpKeyCertificatePath, config.CpDefaultCertificatePath, "SSH certificate for the private key (optional)")
+		flag.StringVar(&cp.PreferredAuth, config.CpKeyPreferredAuth, config.CpDefaultPreferredAuth, "Auth method offered first when both are set (key, password or auto)")
 		flag.StringVar(&cp.HostKeyPath, config.CpKeyHostKeyPath, config.CpDefaultHostKeyPath, "Known host key file (optional)")
 		flag.StringVar(&cp.LocalHost, config.CpKeyLocalHost, config.CpDefaultLocalHost, "Local address to forward")
 		flag.IntVar(&cp.LocalPort, config.CpKeyLocalPort, config.CpDefaultLocalPort, "Local port to forward")
-		flag.StringVar(&cp.RemoteHost, config.CpKeyRemoteHost, config.CpDefaultRemoteHost, "Remote host to expose (unused)")
+		flag.Var(&cp.LocalPortFallbacks, config.CpKeyLocalFallbacks, "Local ports tried in order when the local port refuses (comma-separated)")
+		flag.StringVar(&cp.LocalTargetFile, config.CpKeyLocalTargetFile, config.CpDefaultLocalTargetFile, "File holding host:port of the local service, re-read on every reconnect (optional)")
+		flag.StringVar(&cp.RemoteHost, config.CpKeyRemoteHost, config.CpDefaultRemoteHost, "Host the server should bind the remote port on (default: server's choice)")
 		flag.IntVar(&cp.RemotePort, config.CpKeyRemotePort, config.CpDefaultRemotePort, "Remote port to request (0 = random)")
 		flag.IntVar(&cp.HostKeyLevel, config.CpKeyHostKeyLevel, config.CpDefaultHostKeyLevel, "Host key level (0=no check,1=warn,2=strict)")
 		flag.Var(&cp.AllowedIPs, config.CpKeyAllowedIPs, "Allowed IPs (comma-separated)")
+		flag.Uint64Var(&cp.RekeyThreshold, config.CpKeyRekeyThreshold, config.CpDefaultRekeyThreshold, "Bytes sent or received before rekeying (0 = default)")
+		flag.Var(&cp.Ciphers, config.CpKeyCiphers, "SSH ciphers offered, in order of preference (comma-separated)")
+		flag.IntVar(&cp.MaxRetries, config.CpKeyMaxRetries, config.CpDefaultMaxRetries, "Connection attempts before giving up")
+		flag.IntVar(&cp.RetryBudget, config.CpKeyRetryBudget, config.CpDefaultRetryBudget, "Reconnects allowed in a burst, regained one per minute (0 = unlimited)")
+		flag.BoolVar(&cp.FixedPortFailFast, config.CpKeyFixedPortFailFast, config.CpDefaultFixedPortFailFast, "Exit instead of retrying when the requested remote port is unavailable")
+		cp.ConnectTimeout = config.CpDefaultConnectTimeout
+		flag.Var(&cp.ConnectTimeout, config.CpKeyConnectTimeout, "Timeout for connecting and completing the SSH handshake (e.g. 10s)")
+		flag.Var(&cp.StartupSplay, config.CpKeyStartupSplay, "Random delay below this before the first connection attempt (e.g. 30s)")
+		cp.MinSessionDuration = config.CpDefaultMinSessionTime
+		flag.Var(&cp.MinSessionDuration, config.CpKeyMinSessionTime, "Sessions ending sooner back off reconnects instead of retrying at once")
+		flag.Var(&cp.MaxClockSkew, config.CpKeyMaxClockSkew, "Warn when the server clock differs by more than this (e.g. 30s, 0 = no check)")
+		flag.StringVar(&cp.HealthAddr, config.CpKeyHealthAddr, config.CpDefaultHealthAddr, "Address serving /healthz and /readyz probes (optional, e.g. :8081)")
+		flag.StringVar(&cp.MetricsAddr, config.CpKeyMetricsAddr, config.CpDefaultMetricsAddr, "Address serving Prometheus /metrics alone (optional, e.g. :9100)")
+		flag.StringVar(&cp.MetricsAuthUser, config.CpKeyMetricsAuthUser, config.CpDefaultMetricsAuthUser, "Basic auth user required on the health and metrics endpoints (optional)")
+		flag.StringVar(&cp.MetricsAuthPass, config.CpKeyMetricsAuthPass, config.CpDefaultMetricsAuthPass, "Basic auth password required on the health and metrics endpoints (optional)")
+		flag.StringVar(&cp.RegisterWebhook, config.CpKeyRegisterWebhook, config.CpDefaultRegisterWebhook, "URL notified of the assigned port (POST) and of session end (DELETE)")
+		flag.StringVar(&cp.PortOutputFile, config.CpKeyPortOutputFile, config.CpDefaultPortOutputFile, "File the assigned port is written to, removed when the session ends (optional)")
+		flag.StringVar(&cp.RegisterLabel, config.CpKeyRegisterLabel, config.CpDefaultRegisterLabel, "Label sent to the registration webhook")
+		flag.BoolVar(&cp.LocalTLS, config.CpKeyLocalTLS, config.CpDefaultLocalTLS, "Connect to the local service over TLS")
+		flag.StringVar(&cp.LocalTLSServerName, config.CpKeyLocalTLSServer, config.CpDefaultLocalTLSServer, "Server name verified on the local service (default: local host)")
+		flag.StringVar(&cp.LocalTLSCA, config.CpKeyLocalTLSCA, config.CpDefaultLocalTLSCA, "CA bundle for the local service certificate (default: system roots)")
+		flag.BoolVar(&cp.LocalTLSInsecure, config.CpKeyLocalTLSInsecure, config.CpDefaultLocalTLSInsecure, "Skip verification of the local service certificate")
+		flag.IntVar(&cp.LocalDialRetries, config.CpKeyLocalDialRetries, config.CpDefaultLocalDialRetries, "Extra attempts to connect to a refusing local service per forward")
+		cp.LocalDialInterval = config.CpDefaultLocalDialInterval
+		flag.Var(&cp.LocalDialInterval, config.CpKeyLocalDialInterval, "Pause between local service connection attempts (e.g. 250ms)")
+		flag.IntVar(&cp.MaxConcurrentForwards, config.CpKeyMaxForwards, config.CpDefaultMaxForwards, "Reject forwards beyond this many in flight (0 = unlimited)")
+		logConfig := flag.Bool(config.CpKeyLogConfig, config.CpDefaultLogConfig, "Log a redacted summary of the configuration at startup")
+		flag.IntVar(&cp.SocketReadBuffer, config.CpKeySocketReadBuffer, config.CpDefaultSocketReadBuffer, "Receive buffer size of the SSH connection's socket in bytes (0 = OS default)")
+		flag.IntVar(&cp.SocketWriteBuffer, config.CpKeySocketWriteBuffer, config.CpDefaultSocketWriteBuffer, "Send buffer size of the SSH connection's socket in bytes (0 = OS default)")
+		noDelay := flag.Bool(config.CpKeyTCPNoDelay, config.CpDefaultTCPNoDelay, "Set TCP_NODELAY on connections to the local service (false enables Nagle's algorithm)")
 		flag.Parse()
+		cp.LogConfig = logConfig
+		cp.TCPNoDelay = noDelay
 	} else {
 		cp = *cpOverride
 	}
 
 	// Validate configuration
 	if err := cp.Validate(); err != nil {
-		return fmt.Errorf("invalid client parameters: %w", err)
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	if cp.ShouldLogConfig() {
+		log.Printf("[*] Client config: %s", cp.Summary())
+	}
+	var health *healthServer
+	if cp.HealthAddr != "" || cp.MetricsAddr != "" {
+		var err error
+		if health, err = startHealthServer(cp.HealthAddr, cp.MetricsAddr, cp.MetricsAuthUser, cp.MetricsAuthPass); err != nil {
+			return fmt.Errorf("health server: %w", err)
+		}
+		defer health.shutdown()
 	}
 
-	const (
-		maxRetries = 5
-		retryDelay = 5 * time.Second
-	)
+	maxRetries := cp.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = config.CpDefaultMaxRetries
+	}
+	if delay := splayDelay(time.Duration(cp.StartupSplay)); delay > 0 {
+		log.Printf("[*] Delaying first connection by %v (startup splay %v)", delay.Round(time.Millisecond), time.Duration(cp.StartupSplay))
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+
+	minSession := time.Duration(cp.MinSessionDuration)
+	if minSession == 0 {
+		minSession = time.Duration(config.CpDefaultMinSessionTime)
+	}
 	retry := 1
+	shortSessions := 0
+	budget := newRetryBudget(cp.RetryBudget, retryBudgetRefill, time.Now())
+	var lastErr error
 
-	for {
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if attempt > 1 && !budget.take(time.Now()) {
+			return fmt.Errorf("%w: retry budget of %d reconnects spent after %d attempts: %w", ErrRetriesExhausted, cp.RetryBudget, attempt-1, lastErr)
+		}
 		log.Printf("[*] Connecting to %s:%d (attempt %d/%d)", cp.Endpoint, cp.EndpointPort, retry, maxRetries)
 
 		sshCfg, addr, err := config.GetClientConfig(&cp)
 		if err != nil {
 			log.Printf("[-] Config error: %v", err)
+			lastErr = fmt.Errorf("%w: %w", ErrInvalidConfig, err)
 		} else {
-			clientConn, err := ssh.Dial("tcp", addr, sshCfg)
+			clientConn, err := dialSSH(ctx, addr, sshCfg, cp.SocketReadBuffer, cp.SocketWriteBuffer)
 			if err != nil {
 				log.Printf("[-] Dial error: %v", err)
+				lastErr = err
+				if isAuthFailure(err) {
+					lastErr = fmt.Errorf("%w: %w", ErrAuthFailed, err)
+				}
 			} else {
 				// Run session
-				session := &ClientSession{
-					Connection:   clientConn,
-					LocalAddress: fmt.Sprintf("%s:%d", cp.LocalHost, cp.LocalPort),
-					Active:       true,
+				session := newClientSession(clientConn, &cp)
+				health.setSession(session)
+				started := time.Now()
+				err := session.runSession(ctx, &cp)
+				health.setSession(nil)
+				if ctx.Err() != nil {
+					session.ActiveConnections.Wait()
+					clientConn.Close()
+					return ctx.Err()
 				}
 
-				if err := session.runSession(&cp); err != nil {
+				lastErr = errSessionClosed
+				if err != nil {
+					lastErr = err
 					log.Printf("[-] Session error: %v", err)
 					clientConn.Close()
-					if !strings.Contains(err.Error(), "An existing connection was forcibly closed by the remote host") {
+					if errors.Is(err, ErrRequestedPortUnavailable) {
+						if cp.FixedPortFailFast {
+							return fmt.Errorf("remote port %d unavailable, not retrying: %w", cp.RemotePort, err)
+						}
+						// the server may still hold the port for a previous session
+					} else if errors.Is(err, ErrServerWarmingUp) {
+						// retry once the server accepts port requests again
+					} else if errors.Is(err, ErrPortQuotaExceeded) {
+						// another session from this address may release its port
+					} else if errors.Is(err, ErrServerOverloaded) {
+						// retry once the server is back below its low-water marks
+					} else if errors.Is(err, ErrServerDraining) {
+						// the server is going away: reconnect to its replacement
+					} else if errors.Is(err, ErrHandshakeConnClosed) {
+						// the connection dropped, not the server: reconnect
+					} else if errors.Is(err, errSessionClosed) {
+						// the port was assigned before the connection broke: reconnect
+					} else if !strings.Contains(err.Error(), "An existing connection was forcibly closed by the remote host") {
 						return err
 					}
 				}
@@ -97,8 +271,19 @@ func Run(cpOverride *config.ClientParameters) error {
 				session.ActiveConnections.Wait()
 				clientConn.Close()
 
-				log.Printf("[*] Session closed, retrying in %v...", retryDelay)
-				time.Sleep(retryDelay)
+				// a session ending right away counts as a failure: back off instead of hammering the server
+				delay := reconnectDelay
+				if lasted := time.Since(started); lasted < minSession {
+					shortSessions++
+					delay = backoffDelay(shortSessions)
+					log.Printf("[*] Session lasted %v, under %v, backing off", lasted.Round(time.Millisecond), minSession)
+				} else {
+					shortSessions = 0
+				}
+				log.Printf("[*] Session closed, retrying in %v...", delay)
+				if err := sleepContext(ctx, delay); err != nil {
+					return err
+				}
 				retry = 1
 				continue
 			}
@@ -106,17 +291,253 @@ func Run(cpOverride *config.ClientParameters) error {
 
 		if retry < maxRetries {
 			retry++
-			time.Sleep(retryDelay)
+			if err := sleepContext(ctx, reconnectDelay); err != nil {
+				return err
+			}
 			continue
 		}
-		return fmt.Errorf("failed to establish SSH connection after %d attempts", maxRetries)
+		if errors.Is(lastErr, ErrInvalidConfig) || errors.Is(lastErr, ErrAuthFailed) {
+			return fmt.Errorf("%w (after %d attempts)", lastErr, maxRetries)
+		}
+		return fmt.Errorf("%w: failed to establish SSH connection after %d attempts: %w", ErrRetriesExhausted, maxRetries, lastErr)
+	}
+}
+
+// backoffDelay returns the reconnect delay after n consecutive short sessions,
+// doubling from reconnectDelay up to maxBackoffDoublings times
+func backoffDelay(n int) time.Duration {
+	return reconnectDelay << min(n, maxBackoffDoublings)
+}
+
+// splayDelay returns a random duration in [0, splay), or 0 when splay is not positive
+func splayDelay(splay time.Duration) time.Duration {
+	if splay <= 0 {
+		return 0
+	}
+	return rand.N(splay)
+}
+
+// sleepContext pauses for d, returning ctx.Err() early if ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isAuthFailure reports whether a dial error comes from the server rejecting our credentials
+func isAuthFailure(err error) bool {
+	// x/crypto/ssh has no typed error for this
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// RunConn runs a single tunnel session over an already established connection
+// instead of dialing the configured endpoint. It does not retry: it returns once
+// the session ends, which makes it suitable for alternative transports.
+func RunConn(conn net.Conn, cp *config.ClientParameters) error {
+	if cp == nil {
+		return fmt.Errorf("%w: missing configuration", ErrInvalidConfig)
+	}
+	if err := cp.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	sshCfg, addr, err := config.GetClientConfig(cp)
+	if err != nil {
+		return fmt.Errorf("config error: %w", err)
+	}
+
+	clientConn, err := handshakeSSH(conn, addr, sshCfg)
+	if err != nil {
+		return fmt.Errorf("ssh handshake: %w", err)
+	}
+	defer clientConn.Close()
+
+	session := newClientSession(clientConn, cp)
+	err = session.runSession(context.Background(), cp)
+	session.ActiveConnections.Wait()
+
+	return err
+}
+
+// dialSSH connects to addr and performs the SSH handshake, both bounded by cfg.Timeout.
+// Unlike ssh.Dial, a server that accepts TCP but stalls the handshake cannot hang it.
+// The socket buffers are sized to readBuffer/writeBuffer first (0 = OS default).
+func dialSSH(ctx context.Context, addr string, cfg *ssh.ClientConfig, readBuffer, writeBuffer int) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: cfg.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := util.SetSocketBuffers(conn, readBuffer, writeBuffer); err != nil {
+		log.Printf("[-] Socket buffers for %s: %v", addr, err)
+	}
+	clientConn, err := handshakeSSH(conn, addr, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return clientConn, nil
+}
+
+// handshakeSSH runs the SSH handshake over conn with a deadline of cfg.Timeout
+func handshakeSSH(conn net.Conn, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	if cfg.Timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(cfg.Timeout)); err != nil {
+			return nil, err
+		}
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// newClientSession creates an active session bound to the given SSH client
+func newClientSession(clientConn *ssh.Client, cp *config.ClientParameters) *ClientSession {
+	interval := time.Duration(cp.LocalDialInterval)
+	if interval == 0 {
+		interval = time.Duration(config.CpDefaultLocalDialInterval)
+	}
+	local := localTarget(cp)
+	return &ClientSession{
+		Connection:            clientConn,
+		LocalAddress:          local,
+		LocalFallbacks:        localFallbacks(local, cp.LocalPortFallbacks),
+		targets:               newTargetPool(cp.LocalTargets),
+		TCPNoDelay:            cp.TCPNoDelay,
+		LocalDialRetries:      cp.LocalDialRetries,
+		LocalDialInterval:     interval,
+		Active:                true,
+		MaxConcurrentForwards: cp.MaxConcurrentForwards,
+	}
+}
+
+// ready reports whether the session is active with a port assigned
+func (s *ClientSession) ready() bool {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.Active && s.AssignedPort != 0
+}
+
+// activeForwards returns the number of forwards in flight
+func (s *ClientSession) activeForwards() int {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.ConnectionCount - s.CompletedCount
+}
+
+// assignedPort returns the remote port assigned to the session
+func (s *ClientSession) assignedPort() int {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.AssignedPort
+}
+
+// Close ends the session: new forwards are rejected, the SSH connection is
+// closed and in-flight forwards get up to closeDrainTimeout to finish
+func (s *ClientSession) Close() error {
+	s.Lock.Lock()
+	s.Active = false
+	s.Lock.Unlock()
+
+	var err error
+	if s.Connection != nil {
+		err = s.Connection.Close()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.ActiveConnections.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return err
+	case <-time.After(closeDrainTimeout):
+		s.Lock.Lock()
+		inFlight := s.ConnectionCount - s.CompletedCount
+		s.Lock.Unlock()
+		return fmt.Errorf("%d forwards still active after %v", inFlight, closeDrainTimeout)
+	}
+}
+
+// localFallbacks returns the addresses of ports on the host of local, tried in
+// order when local refuses a forward
+func localFallbacks(local string, ports []int) []string {
+	host, _, err := net.SplitHostPort(local)
+	if err != nil || len(ports) == 0 {
+		return nil
+	}
+	addrs := make([]string, len(ports))
+	for i, p := range ports {
+		addrs[i] = net.JoinHostPort(host, strconv.Itoa(p))
 	}
+	return addrs
 }
 
-// runSession handles the handshake and incoming forwards for a connected SSH session
-func (s *ClientSession) runSession(cp *config.ClientParameters) error {
-	// 1) Open a channel for handshake
-	ch, reqs, err := s.Connection.OpenChannel("direct-tcpip", nil)
+// localTarget returns the local service address for a new session. With a
+// LocalTargetFile it is re-read on every session, falling back to
+// LocalHost:LocalPort when the file is missing or invalid.
+func localTarget(cp *config.ClientParameters) string {
+	fallback := net.JoinHostPort(cp.LocalHost, strconv.Itoa(cp.LocalPort))
+	if cp.LocalTargetFile == "" {
+		return fallback
+	}
+
+	data, err := os.ReadFile(cp.LocalTargetFile)
+	if err != nil {
+		log.Printf("[-] Read local target file: %v, using %s", err, fallback)
+		return fallback
+	}
+	target := strings.TrimSpace(string(data))
+	host, port, err := net.SplitHostPort(target)
+	if p, perr := strconv.Atoi(port); err != nil || host == "" || perr != nil || p <= 0 || p > 65535 {
+		log.Printf("[-] Invalid local target %q in %s, using %s", target, cp.LocalTargetFile, fallback)
+		return fallback
+	}
+	log.Printf("[*] Local target %s (from %s)", target, cp.LocalTargetFile)
+	return target
+}
+
+// negotiateProtocolVersion agrees on the highest protocol version supported by both peers
+func (s *ClientSession) negotiateProtocolVersion() uint32 {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], protocol.Version)
+
+	ok, reply, err := s.Connection.SendRequest(protocol.VersionRequest, true, payload[:])
+	if err != nil || !ok || len(reply) < 4 {
+		return 1
+	}
+	return min(binary.BigEndian.Uint32(reply), protocol.Version)
+}
+
+// runSession handles the handshake and incoming forwards for a connected SSH session.
+// It returns once the connection ends or ctx is cancelled, and only after the
+// forward-accepting goroutine has exited.
+func (s *ClientSession) runSession(ctx context.Context, cp *config.ClientParameters) error {
+	// 0) Agree on a protocol version
+	localTLS, err := config.GetLocalTLSConfig(cp)
+	if err != nil {
+		return fmt.Errorf("local TLS config: %w", err)
+	}
+	s.LocalTLS = localTLS
+	s.ProtocolVersion = s.negotiateProtocolVersion()
+	log.Printf("[*] Using protocol version %d", s.ProtocolVersion)
+
+	// 1) Open a channel for handshake, addressed to the requested remote port
+	payload := protocol.NewDirectTCPIP(nil, s.Connection.LocalAddr())
+	payload.DestAddr, payload.DestPort = cp.RemoteHost, uint32(cp.RemotePort)
+	ch, reqs, err := s.Connection.OpenChannel("direct-tcpip", payload.Marshal())
 	if err != nil {
 		return fmt.Errorf("open handshake channel: %w", err)
 	}
@@ -127,16 +548,21 @@ func (s *ClientSession) runSession(cp *config.ClientParameters) error {
 
 	// 2) Read handshake response
 	if _, err := io.ReadFull(ch, hb[:]); err != nil {
-		return fmt.Errorf("handshake read error: %w", err)
+		return s.handshakeReadError("handshake read error", err)
 	}
-	code := binary.BigEndian.Uint32(hb[:])
+	code := protocol.ErrorCode(binary.BigEndian.Uint32(hb[:]))
 	switch code {
-	case ErrSuccess:
+	case protocol.ErrSuccess:
 		log.Printf("[+] Handshake OK")
-	case ErrIPNotAllowed:
-		return fmt.Errorf("server rejected IP: code %d", code)
+	case protocol.ErrIPNotAllowed:
+		return fmt.Errorf("server rejected IP: code %d (%s)", code, code)
+	case protocol.ErrMask | protocol.ErrProtocolMismatch:
+		if _, err := io.ReadFull(ch, hb[:]); err != nil {
+			return fmt.Errorf("server rejected protocol version %d", s.ProtocolVersion)
+		}
+		return fmt.Errorf("server requires protocol version %d or later, client speaks %d", binary.BigEndian.Uint32(hb[:]), s.ProtocolVersion)
 	default:
-		return fmt.Errorf("handshake failed with code %d", code)
+		return fmt.Errorf("handshake failed with code %d (%s)", code, code)
 	}
 
 	// 3) Send whitelist
@@ -156,96 +582,405 @@ func (s *ClientSession) runSession(cp *config.ClientParameters) error {
 
 	// 4) Read whitelist confirmation
 	if _, err := io.ReadFull(ch, hb[:]); err != nil {
-		return fmt.Errorf("whitelist confirm read error: %w", err)
+		return s.handshakeReadError("whitelist confirm read error", err)
 	}
-	if binary.BigEndian.Uint32(hb[:]) != ErrSuccess {
-		return fmt.Errorf("whitelist rejected by server")
+	if code := protocol.ErrorCode(binary.BigEndian.Uint32(hb[:])); code != protocol.ErrSuccess {
+		return fmt.Errorf("whitelist rejected by server: %s", code)
 	}
 	log.Printf("[+] Whitelist accepted by server")
 
-	// 5) Request port
+	// 5) Request port, then bind host if the server understands it
 	log.Printf("[*] Requesting remote port %d", cp.RemotePort)
 	binary.BigEndian.PutUint32(hb[:], uint32(cp.RemotePort))
 	if _, err := ch.Write(hb[:]); err != nil {
 		return fmt.Errorf("send port request: %w", err)
 	}
+	if s.ProtocolVersion >= protocol.VersionBindHost {
+		binary.BigEndian.PutUint32(hb[:], uint32(len(cp.RemoteHost)))
+		if _, err := ch.Write(append(hb[:], cp.RemoteHost...)); err != nil {
+			return fmt.Errorf("send bind host request: %w", err)
+		}
+		if cp.RemoteHost != "" {
+			log.Printf("[*] Requesting bind host %s", cp.RemoteHost)
+		}
+	} else if cp.RemoteHost != "" {
+		log.Printf("[-] Server speaks protocol %d, remote_host %s is ignored", s.ProtocolVersion, cp.RemoteHost)
+	}
 
 	// 6) Read assigned port or error
 	if _, err := io.ReadFull(ch, hb[:]); err != nil {
-		return fmt.Errorf("read port response error: %w", err)
+		return s.handshakeReadError("read port response error", err)
 	}
 	val := binary.BigEndian.Uint32(hb[:])
-	if val&ErrMask != 0 {
-		errCode := val &^ ErrMask
+	if code := protocol.ErrorCode(val); code&protocol.ErrMask != 0 {
+		errCode := code &^ protocol.ErrMask
 		switch errCode {
-		case ErrPortUnavailable:
+		case protocol.ErrPortUnavailable:
+			if cp.RemotePort != 0 {
+				return fmt.Errorf("%w: port %d", ErrRequestedPortUnavailable, cp.RemotePort)
+			}
 			return fmt.Errorf("server: no available ports")
-		case ErrPortOutOfRange:
+		case protocol.ErrPortOutOfRange:
 			return fmt.Errorf("server: port out of range")
-		case ErrInternal:
+		case protocol.ErrInternal:
 			return fmt.Errorf("server: internal error")
+		case protocol.ErrWarmingUp:
+			return ErrServerWarmingUp
+		case protocol.ErrDraining:
+			return ErrServerDraining
+		case protocol.ErrBindHostNotAllowed:
+			return fmt.Errorf("server: bind host %q not allowed", cp.RemoteHost)
+		case protocol.ErrPortQuota:
+			return ErrPortQuotaExceeded
+		case protocol.ErrOverloaded:
+			return ErrServerOverloaded
+		case protocol.ErrPortRequired:
+			return fmt.Errorf("%w: server requires an explicit remote port", ErrInvalidConfig)
 		default:
-			return fmt.Errorf("server error code %d", errCode)
+			return fmt.Errorf("server error code %d (%s)", errCode, errCode)
+		}
+	}
+	var publicURL string
+	if s.ProtocolVersion >= protocol.VersionPublicURL {
+		u, err := readPublicURL(ch)
+		if err != nil {
+			return s.handshakeReadError("read public url error", err)
+		}
+		publicURL = u
+	}
+	if s.ProtocolVersion >= protocol.VersionServerTime {
+		var tb [8]byte
+		if _, err := io.ReadFull(ch, tb[:]); err != nil {
+			return s.handshakeReadError("read server time error", err)
+		}
+		serverTime := time.UnixMilli(int64(binary.BigEndian.Uint64(tb[:])))
+		checkClockSkew(serverTime, time.Now(), time.Duration(cp.MaxClockSkew))
+	}
+	var serverVersion string
+	if s.ProtocolVersion >= protocol.VersionServerInfo {
+		v, err := readServerVersion(ch)
+		if err != nil {
+			return s.handshakeReadError("read server version error", err)
+		}
+		serverVersion = v
+		if v != "" {
+			log.Printf("[*] Server version %s", v)
 		}
 	}
+	s.Lock.Lock()
 	s.AssignedPort = int(val)
+	s.PublicURL = publicURL
+	s.ServerVersion = serverVersion
+	s.Lock.Unlock()
 	log.Printf("[+] Assigned remote port %d (local %s)", s.AssignedPort, s.LocalAddress)
+	if publicURL != "" {
+		log.Printf("[+] Public URL: %s", publicURL)
+	}
 
-	// 7) Handle forwarded connections
+	// 7) Handle forwarded connections until the session ends
+	ctx, cancel := context.WithCancel(ctx)
+	forwardsDone := make(chan struct{})
 	go func() {
-		for newCh := range s.Connection.HandleChannelOpen("direct-tcpip") {
-			if !s.Active {
-				newCh.Reject(ssh.ConnectionFailed, "session closed")
-				continue
-			}
-			ch2, reqs2, err := newCh.Accept()
-			if err != nil {
-				log.Printf("[-] Accept forwarded channel: %v", err)
-				continue
-			}
-			go ssh.DiscardRequests(reqs2)
-
-			s.Lock.Lock()
-			s.ConnectionCount++
-			id := s.ConnectionCount
-			s.Lock.Unlock()
+		defer close(forwardsDone)
+		s.acceptForwards(ctx, s.Connection.HandleChannelOpen("direct-tcpip"))
+	}()
+	defer func() {
+		cancel()
+		<-forwardsDone
+	}()
+	stopClose := context.AfterFunc(ctx, func() { s.Connection.Close() })
+	defer stopClose()
 
-			s.ActiveConnections.Add(1)
-			log.Printf("[*] Forward #%d incoming", id)
-			go s.handleForward(ch2, id)
+	// 8) Publish the port for local scripts, removing it once the session ends
+	if cp.PortOutputFile != "" {
+		if err := writePortFile(cp.PortOutputFile, s.AssignedPort); err != nil {
+			log.Printf("[-] Write port file %s: %v", cp.PortOutputFile, err)
+		} else {
+			defer removePortFile(cp.PortOutputFile)
 		}
+	}
+
+	// 9) Register with the service registry, deregistering once the session ends
+	if cp.RegisterWebhook != "" {
+		payload := RegistrationPayload{Endpoint: cp.Endpoint, Port: s.AssignedPort, Label: cp.RegisterLabel}
+		notifyWebhook(http.MethodPost, cp.RegisterWebhook, payload)
+		defer notifyWebhook(http.MethodDelete, cp.RegisterWebhook, payload)
+	}
+
+	// Wait for session end: EOF or a closed conn is the normal end of a session
+	if err := s.Connection.Wait(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("%w: %w", errSessionClosed, err)
+	}
+	return nil
+}
+
+// checkClockSkew warns when serverTime, read at local time now, is more than
+// limit away from it (0 = no check). Skew is only diagnosed: SSH certificates
+// and TLS on the local side are what it breaks.
+func checkClockSkew(serverTime, now time.Time, limit time.Duration) {
+	if limit <= 0 {
+		return
+	}
+	skew := now.Sub(serverTime)
+	if skew.Abs() > limit {
+		log.Printf("[-] Local clock is %v off the server clock, over max clock skew %v; check time sync on both hosts", skew.Round(time.Millisecond), limit)
+	}
+}
+
+// maxPublicURLLength bounds the public URL a server may send
+const maxPublicURLLength = 4096
+
+// maxServerVersionLength bounds the version string a server may send
+const maxServerVersionLength = 256
+
+// readPublicURL reads the length-prefixed public URL the server sends after the port
+func readPublicURL(r io.Reader) (string, error) {
+	return readString(r, maxPublicURLLength, "public url")
+}
+
+// readServerVersion reads the length-prefixed version the server sends after its clock
+func readServerVersion(r io.Reader) (string, error) {
+	return readString(r, maxServerVersionLength, "server version")
+}
+
+// readString reads a string sent as a 4-byte length and its bytes, refusing
+// lengths above limit
+func readString(r io.Reader, limit uint32, name string) (string, error) {
+	var hb [4]byte
+	if _, err := io.ReadFull(r, hb[:]); err != nil {
+		return "", err
+	}
+	length := binary.BigEndian.Uint32(hb[:])
+	if length > limit {
+		return "", fmt.Errorf("%s too long: %d bytes", name, length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// handshakeReadError wraps a failed handshake read. EOF on a connection that
+// turns out to be closed becomes ErrHandshakeConnClosed; EOF on a live one is
+// the server ending the handshake channel early.
+func (s *ClientSession) handshakeReadError(what string, err error) error {
+	if (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) && s.connClosed(handshakeCloseGrace) {
+		return fmt.Errorf("%s: %w", what, ErrHandshakeConnClosed)
+	}
+	return fmt.Errorf("%s: %w", what, err)
+}
+
+// connClosed reports whether the SSH connection closes within grace. The
+// channels of a dropped connection see EOF just before Wait returns.
+func (s *ClientSession) connClosed(grace time.Duration) bool {
+	closed := make(chan struct{})
+	go func() {
+		s.Connection.Wait()
+		close(closed)
 	}()
+	select {
+	case <-closed:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
+
+// acceptForwards accepts forwarded channels until ctx is cancelled or chans
+// closes, then marks the session inactive so no forward is accepted after
+// shutdown begins
+func (s *ClientSession) acceptForwards(ctx context.Context, chans <-chan ssh.NewChannel) {
+	defer func() {
+		s.Lock.Lock()
+		s.Active = false
+		s.Lock.Unlock()
+	}()
+
+	for {
+		var newCh ssh.NewChannel
+		select {
+		case <-ctx.Done():
+			return
+		case ch, ok := <-chans:
+			if !ok {
+				return
+			}
+			newCh = ch
+		}
+
+		s.Lock.Lock()
+		active := s.Active
+		inFlight := s.ConnectionCount - s.CompletedCount
+		s.Lock.Unlock()
+		if !active {
+			newCh.Reject(ssh.ConnectionFailed, "session closed")
+			continue
+		}
+		if s.MaxConcurrentForwards > 0 && inFlight >= s.MaxConcurrentForwards {
+			log.Printf("[-] Rejecting forward: %d in flight (max %d)", inFlight, s.MaxConcurrentForwards)
+			newCh.Reject(ssh.ResourceShortage, "too many concurrent forwards")
+			continue
+		}
+		ch2, reqs2, err := newCh.Accept()
+		if err != nil {
+			log.Printf("[-] Accept forwarded channel: %v", err)
+			continue
+		}
+		go ssh.DiscardRequests(reqs2)
 
-	// Wait for session end
-	return s.Connection.Wait()
+		s.Lock.Lock()
+		s.ConnectionCount++
+		id := s.ConnectionCount
+		s.Lock.Unlock()
+
+		s.ActiveConnections.Add(1)
+		log.Printf("[*] Forward #%d incoming", id)
+		go s.handleForward(ch2, id)
+	}
 }
 
 // handleForward manages a single forwarded connection
 func (s *ClientSession) handleForward(ch ssh.Channel, id int) {
 	defer ch.Close()
 	defer s.ActiveConnections.Done()
+	defer func() {
+		s.Lock.Lock()
+		s.CompletedCount++
+		s.Lock.Unlock()
+	}()
+	go discardExtendedData(ch, id)
 
-	localConn, err := net.Dial("tcp", s.LocalAddress)
+	// servers predating trace IDs leave it at "-"
+	traceID := "-"
+	if s.ProtocolVersion >= protocol.VersionTraceID {
+		var err error
+		traceID, err = readTraceID(ch)
+		if err != nil {
+			log.Printf("[-] Read trace ID for forward #%d: %v", id, err)
+			return
+		}
+		log.Printf("[*] Forward #%d linked to server forward (trace=%s)", id, traceID)
+	}
+
+	tcpConn, err := s.dialLocalService(id)
 	if err != nil {
-		log.Printf("[-] Connect to local %s: %v", s.LocalAddress, err)
+		log.Printf("[-] Connect to local %s for forward #%d (trace=%s): %v", s.LocalAddress, id, traceID, err)
 		return
 	}
-	defer localConn.Close()
+	defer tcpConn.Close()
+	if err := util.SetNoDelay(tcpConn, s.TCPNoDelay); err != nil {
+		log.Printf("[-] Set TCP_NODELAY for forward #%d: %v", id, err)
+	}
+
+	var localConn net.Conn = tcpConn
+	var tlsConn *tls.Conn
+	if s.LocalTLS != nil {
+		tlsConn = tls.Client(tcpConn, s.LocalTLS)
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("[-] TLS handshake with local %s: %v", s.LocalAddress, err)
+			return
+		}
+		localConn = tlsConn
+	}
 
+	// a reset local service or a broken channel fails one copy only: closing the
+	// local conn and the channel as well ends the copy still reading the other
+	abort := func(dir string, err error) {
+		// net.ErrClosed: the other copy aborted first and closed localConn
+		if !errors.Is(err, net.ErrClosed) {
+			log.Printf("[-] Copy to %s for forward #%d failed, closing (trace=%s): %v", dir, id, traceID, err)
+		}
+		localConn.Close()
+		ch.Close()
+	}
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		n, _ := io.Copy(localConn, ch)
-		log.Printf("[*] Copied %d bytes to local for forward #%d", n, id)
-		localConn.(*net.TCPConn).CloseRead()
+		n, err := io.Copy(countingWriter{localConn, &s.BytesToLocal, &bytesToLocal}, ch)
+		log.Printf("[*] Copied %d bytes to local for forward #%d (trace=%s)", n, id, traceID)
+		if err != nil {
+			abort("local", err)
+		} else if tlsConn != nil {
+			tlsConn.CloseWrite()
+		} else {
+			tcpConn.(*net.TCPConn).CloseRead()
+		}
 	}()
 	go func() {
 		defer wg.Done()
-		n, _ := io.Copy(ch, localConn)
-		log.Printf("[*] Copied %d bytes to server for forward #%d", n, id)
-		ch.CloseWrite()
+		n, err := io.Copy(countingWriter{ch, &s.BytesToServer, &bytesToServer}, localConn)
+		log.Printf("[*] Copied %d bytes to server for forward #%d (trace=%s)", n, id, traceID)
+		if err != nil {
+			abort("server", err)
+		} else {
+			ch.CloseWrite()
+		}
 	}()
 	wg.Wait()
-	log.Printf("[+] Forward #%d closed", id)
+	log.Printf("[+] Forward #%d closed (trace=%s)", id, traceID)
+}
+
+// dialLocalService connects to the local service, retrying up to
+// LocalDialRetries times so a briefly unavailable service (e.g. restarting)
+// doesn't drop the forward. Validate bounds both the retries and the interval.
+// Should it still refuse, LocalFallbacks are each tried once, in order.
+// The latency of the successful dial is logged and recorded in localDialLatency.
+// With LocalTargets configured, dialLocalTargets picks the service instead.
+func (s *ClientSession) dialLocalService(id int) (net.Conn, error) {
+	if s.targets != nil {
+		return s.dialLocalTargets(id)
+	}
+	addr := s.LocalAddress
+	start := time.Now()
+	conn, err := dialLocal("tcp", addr)
+	for attempt := 1; err != nil && attempt <= s.LocalDialRetries; attempt++ {
+		log.Printf("[*] Local %s unavailable for forward #%d (%v), retry %d/%d in %v",
+			addr, id, err, attempt, s.LocalDialRetries, s.LocalDialInterval)
+		time.Sleep(s.LocalDialInterval)
+		start = time.Now()
+		conn, err = dialLocal("tcp", addr)
+	}
+	for _, fallback := range s.LocalFallbacks {
+		if err == nil || !errors.Is(err, syscall.ECONNREFUSED) {
+			break
+		}
+		log.Printf("[*] Local %s refused forward #%d, trying fallback %s", addr, id, fallback)
+		addr = fallback
+		start = time.Now()
+		conn, err = dialLocal("tcp", addr)
+	}
+	if err == nil {
+		latency := time.Since(start)
+		localDialLatency.observe(latency)
+		log.Printf("[*] Local %s accepted forward #%d in %v", addr, id, latency)
+	}
+	return conn, err
+}
+
+// discardExtendedData drains the extended-data (stderr) stream of a forward,
+// which is unused but shares the channel window: left unread, it would stall
+// the forwarded data once the window is used up
+func discardExtendedData(ch ssh.Channel, id int) {
+	if n, _ := io.Copy(io.Discard, ch.Stderr()); n > 0 {
+		log.Printf("[*] Discarded %d bytes of extended data for forward #%d", n, id)
+	}
+}
+
+// readTraceID reads the trace ID frame the server sends at the start of a back-channel
+func readTraceID(r io.Reader) (string, error) {
+	var hb [4]byte
+	if _, err := io.ReadFull(r, hb[:]); err != nil {
+		return "", fmt.Errorf("read trace ID length: %w", err)
+	}
+	length := binary.BigEndian.Uint32(hb[:])
+	if length > maxTraceIDLength {
+		return "", fmt.Errorf("trace ID too long: %d bytes", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", fmt.Errorf("read trace ID: %w", err)
+	}
+	return string(buf), nil
 }
@@ -1,18 +1,33 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/poweredbypump/pbp-tunnel/internal/config"
+	"github.com/poweredbypump/pbp-tunnel/internal/protocol"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -37,52 +52,1692 @@ func (c *stubChannel) SendRequest(name string, wantReply bool, payload []byte) (
 }
 func (c *stubChannel) Stderr() io.ReadWriter { return c.w }
 
-// stubConn implements ssh.Conn for testing runSession
+// stubConn implements ssh.Conn for testing runSession. It answers the
+// protocol version request with version, when set.
 type stubConn struct {
-	data []byte
+	data    []byte
+	version uint32
 }
 
 // SendRequest satisfies ssh.Conn interface for global requests
 func (s *stubConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	if name == protocol.VersionRequest && s.version != 0 {
+		return true, binary.BigEndian.AppendUint32(nil, s.version), nil
+	}
 	return false, nil, nil
 }
-func (s *stubConn) OpenChannel(name string, payload []byte) (ssh.Channel, <-chan *ssh.Request, error) {
-	reader := bytes.NewReader(s.data)
-	ch := &stubChannel{r: reader, w: &bytes.Buffer{}}
-	reqs := make(chan *ssh.Request)
-	close(reqs)
-	return ch, reqs, nil
+func (s *stubConn) OpenChannel(name string, payload []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	reader := bytes.NewReader(s.data)
+	ch := &stubChannel{r: reader, w: &bytes.Buffer{}}
+	reqs := make(chan *ssh.Request)
+	close(reqs)
+	return ch, reqs, nil
+}
+func (s *stubConn) Close() error                  { return nil }
+func (s *stubConn) Wait() error                   { return nil }
+func (s *stubConn) User() string                  { return "" }
+func (s *stubConn) SessionID() []byte             { return nil }
+func (s *stubConn) ClientVersion() []byte         { return nil }
+func (s *stubConn) ServerVersion() []byte         { return nil }
+func (s *stubConn) RemoteAddr() net.Addr          { return stubAddr{} }
+func (s *stubConn) LocalAddr() net.Addr           { return stubAddr{} }
+func (s *stubConn) Permissions() *ssh.Permissions { return nil }
+
+// helper to build handshake frames
+func buildFrames(frames ...uint32) []byte {
+	buf := &bytes.Buffer{}
+	for _, f := range frames {
+		_ = binary.Write(buf, binary.BigEndian, f)
+	}
+	return buf.Bytes()
+}
+
+func newSSHClient(conn ssh.Conn) *ssh.Client {
+	// channels and requests channels are unused by runSession
+	return ssh.NewClient(conn, make(chan ssh.NewChannel), make(chan *ssh.Request))
+}
+
+// --- Tests for run ---
+func TestRun_InvalidParameters(t *testing.T) {
+	cp := &config.ClientParameters{}
+	err := Run(cp)
+	if err == nil || !strings.Contains(err.Error(), "invalid client parameters") {
+		t.Fatalf("Run() error = %v; want invalid client parameters", err)
+	}
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Run() error = %v; want ErrInvalidConfig", err)
+	}
+}
+
+// fastReconnect shortens the delay between connection attempts for the test
+func fastReconnect(t *testing.T) {
+	prev := reconnectDelay
+	reconnectDelay = 10 * time.Millisecond
+	t.Cleanup(func() { reconnectDelay = prev })
+}
+
+func TestRun_RetriesExhausted(t *testing.T) {
+	fastReconnect(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	cp := validClientParameters()
+	cp.Endpoint = addr.IP.String()
+	cp.EndpointPort = addr.Port
+	cp.MaxRetries = 2
+
+	err = Run(cp)
+	if !errors.Is(err, ErrRetriesExhausted) || !strings.Contains(err.Error(), "after 2 attempts") {
+		t.Errorf("Run() error = %v; want ErrRetriesExhausted after 2 attempts", err)
+	}
+}
+
+func TestSplayDelay_WithinBound(t *testing.T) {
+	if d := splayDelay(0); d != 0 {
+		t.Errorf("splayDelay(0) = %v; want 0", d)
+	}
+	const splay = 50 * time.Millisecond
+	for i := 0; i < 1000; i++ {
+		if d := splayDelay(splay); d < 0 || d >= splay {
+			t.Fatalf("splayDelay(%v) = %v; want in [0, %v)", splay, d, splay)
+		}
+	}
+}
+
+func TestRunContext_StartupSplay(t *testing.T) {
+	fastReconnect(t)
+	logs := captureLog(t)
+
+	// splay 0: the first attempt is not delayed
+	cp := validClientParameters()
+	cp.Endpoint = "127.0.0.1"
+	cp.EndpointPort = 1
+	cp.MaxRetries = 1
+	if err := RunContext(context.Background(), cp); !errors.Is(err, ErrRetriesExhausted) {
+		t.Fatalf("RunContext() error = %v; want ErrRetriesExhausted", err)
+	}
+	if strings.Contains(logs.String(), "Delaying first connection") {
+		t.Errorf("first connection delayed without a splay:\n%s", logs.String())
+	}
+
+	// a long splay is cut short by cancellation, before any attempt
+	cp.StartupSplay = config.Duration(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := RunContext(ctx, cp); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RunContext() error = %v; want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RunContext returned after %v; want prompt return on cancellation", elapsed)
+	}
+	if strings.Count(logs.String(), "Connecting to") != 1 {
+		t.Errorf("connection attempted during the splay:\n%s", logs.String())
+	}
+}
+
+func TestRun_AuthFailure(t *testing.T) {
+	fastReconnect(t)
+	addr, accepted := listenTunnelServer(t, 4242)
+
+	cp := validClientParameters()
+	cp.Endpoint = addr.IP.String()
+	cp.EndpointPort = addr.Port
+	cp.Password = "wrong"
+	cp.MaxRetries = 2
+
+	err := Run(cp)
+	if !errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrRetriesExhausted) {
+		t.Errorf("Run() error = %v; want ErrAuthFailed", err)
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("server accepted %d connections; want 2", n)
+	}
+}
+
+// tcpPipe returns both ends of a loopback TCP connection. Unlike net.Pipe it is
+// buffered, which the SSH version exchange needs since both peers write first.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c2 := <-accepted
+	if c2 == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return c1, c2
+}
+
+// testServerConfig builds an SSH server config accepting user/pass with a fresh Ed25519 host key
+func testServerConfig(t *testing.T) *ssh.ServerConfig {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("host key signer: %v", err)
+	}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(pass) == "pass" {
+				return nil, nil
+			}
+			return nil, errors.New("denied")
+		},
+	}
+	cfg.AddHostKey(signer)
+	return cfg
+}
+
+// serveTunnelHandshake runs a real SSH server over nc which answers the tunnel
+// handshake by assigning port, then closes the connection.
+func serveTunnelHandshake(t *testing.T, nc net.Conn, port uint32) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		sshConn, chans, reqs, err := ssh.NewServerConn(nc, testServerConfig(t))
+		if err != nil {
+			done <- err
+			return
+		}
+		defer sshConn.Close()
+		go ssh.DiscardRequests(reqs)
+
+		newCh := <-chans
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		go ssh.DiscardRequests(chReqs)
+
+		var hb [4]byte
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrSuccess))
+		ch.Write(hb[:])
+
+		// whitelist count and entries
+		io.ReadFull(ch, hb[:])
+		for i := binary.BigEndian.Uint32(hb[:]); i > 0; i-- {
+			io.ReadFull(ch, hb[:])
+			io.ReadFull(ch, make([]byte, binary.BigEndian.Uint32(hb[:])))
+		}
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrSuccess))
+		ch.Write(hb[:])
+
+		// requested port
+		if _, err := io.ReadFull(ch, hb[:]); err != nil {
+			done <- err
+			return
+		}
+		binary.BigEndian.PutUint32(hb[:], port)
+		_, err = ch.Write(hb[:])
+		done <- err
+	}()
+	return done
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use as a log output
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog redirects the standard logger to a buffer for the duration of the test
+func captureLog(t *testing.T) *syncBuffer {
+	buf := &syncBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+func validClientParameters() *config.ClientParameters {
+	return &config.ClientParameters{
+		Endpoint:     "pipe",
+		EndpointPort: 22,
+		Username:     "user",
+		Password:     "pass",
+		LocalHost:    "localhost",
+		LocalPort:    8080,
+		RemoteHost:   "localhost",
+	}
+}
+
+func TestRunConn_InvalidParameters(t *testing.T) {
+	c1, _ := tcpPipe(t)
+	err := RunConn(c1, &config.ClientParameters{})
+	if err == nil || !strings.Contains(err.Error(), "invalid client parameters") {
+		t.Fatalf("RunConn() error = %v; want invalid client parameters", err)
+	}
+}
+
+func TestRunConn_Session(t *testing.T) {
+	logs := captureLog(t)
+	clientEnd, serverEnd := tcpPipe(t)
+	serverDone := serveTunnelHandshake(t, serverEnd, 4242)
+
+	cp := validClientParameters()
+	cp.AllowedIPs = []string{"10.0.0.1"}
+
+	runDone := make(chan error, 1)
+	go func() { runDone <- RunConn(clientEnd, cp) }()
+
+	select {
+	case err := <-runDone:
+		// the server closes the connection once the port has been assigned
+		if err != nil {
+			t.Errorf("RunConn error = %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunConn did not return")
+	}
+
+	select {
+	case err := <-serverDone:
+		if err != nil {
+			t.Errorf("server error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not complete the handshake")
+	}
+
+	if !strings.Contains(logs.String(), "Assigned remote port 4242") {
+		t.Errorf("expected assigned port in logs, got:\n%s", logs.String())
+	}
+}
+
+func TestRunConn_HandshakeChannelPayload(t *testing.T) {
+	clientEnd, serverEnd := tcpPipe(t)
+	payloads := make(chan []byte, 1)
+	go func() {
+		sshConn, chans, reqs, err := ssh.NewServerConn(serverEnd, testServerConfig(t))
+		if err != nil {
+			payloads <- nil
+			return
+		}
+		defer sshConn.Close()
+		go ssh.DiscardRequests(reqs)
+		newCh := <-chans
+		payloads <- newCh.ExtraData()
+		newCh.Reject(ssh.Prohibited, "test")
+	}()
+
+	cp := validClientParameters()
+	cp.RemotePort = 9000
+	go RunConn(clientEnd, cp)
+
+	var b []byte
+	select {
+	case b = <-payloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no handshake channel opened")
+	}
+	got, err := protocol.ParseDirectTCPIP(b)
+	if err != nil {
+		t.Fatalf("ParseDirectTCPIP() error = %v", err)
+	}
+	origin := clientEnd.LocalAddr().(*net.TCPAddr)
+	want := protocol.DirectTCPIP{DestAddr: "localhost", DestPort: 9000, OriginAddr: origin.IP.String(), OriginPort: uint32(origin.Port)}
+	if got != want {
+		t.Errorf("payload = %+v; want %+v", got, want)
+	}
+}
+
+func TestRunConn_AuthFailure(t *testing.T) {
+	clientEnd, serverEnd := tcpPipe(t)
+	serveTunnelHandshake(t, serverEnd, 4242)
+
+	cp := validClientParameters()
+	cp.Password = "wrong"
+
+	err := RunConn(clientEnd, cp)
+	if err == nil || !strings.Contains(err.Error(), "ssh handshake") {
+		t.Errorf("RunConn error = %v; want ssh handshake error", err)
+	}
+}
+
+// silentListener accepts TCP connections but never sends the SSH banner
+func silentListener(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDialSSH_StalledHandshakeTimesOut(t *testing.T) {
+	addr := silentListener(t)
+
+	cp := validClientParameters()
+	cp.ConnectTimeout = config.Duration(200 * time.Millisecond)
+	sshCfg, _, err := config.GetClientConfig(cp)
+	if err != nil {
+		t.Fatalf("GetClientConfig: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := dialSSH(context.Background(), addr, sshCfg, 0, 0)
+		if c != nil {
+			c.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected handshake timeout, got nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dialSSH hung on a server that never sends its banner")
+	}
+}
+
+func TestRunConn_StalledHandshakeTimesOut(t *testing.T) {
+	clientEnd, _ := tcpPipe(t)
+
+	cp := validClientParameters()
+	cp.ConnectTimeout = config.Duration(200 * time.Millisecond)
+
+	start := time.Now()
+	err := RunConn(clientEnd, cp)
+	if err == nil || !strings.Contains(err.Error(), "ssh handshake") {
+		t.Errorf("RunConn error = %v; want ssh handshake error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RunConn took %v; want it bounded by the connect timeout", elapsed)
+	}
+}
+
+// listenTunnelServer accepts SSH connections on a loopback listener and answers
+// each tunnel handshake with the given port frame. It returns the listener
+// address and a counter of accepted connections.
+func listenTunnelServer(t *testing.T, port uint32) (*net.TCPAddr, *atomic.Int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			serveTunnelHandshake(t, nc, port)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr), &accepted
+}
+
+func TestRetryBudget_Refills(t *testing.T) {
+	if b := newRetryBudget(0, time.Minute, time.Now()); b != nil || !b.take(time.Now()) {
+		t.Fatalf("budget 0 = %v; want nil, never running out", b)
+	}
+
+	now := time.Now()
+	b := newRetryBudget(2, time.Minute, now)
+	if !b.take(now) || !b.take(now) {
+		t.Fatal("full budget of 2 refused a reconnect")
+	}
+	if b.take(now.Add(30 * time.Second)) {
+		t.Error("budget allowed a reconnect before regaining a token")
+	}
+	if !b.take(now.Add(time.Minute)) {
+		t.Error("budget refused a reconnect after regaining a token")
+	}
+	// tokens never accrue beyond the capacity
+	later := now.Add(time.Hour)
+	if !b.take(later) || !b.take(later) || b.take(later) {
+		t.Error("budget did not refill to exactly its capacity")
+	}
+}
+
+func TestRun_RetryBudgetStopsFlapping(t *testing.T) {
+	fastReconnect(t)
+	// every handshake is refused, which resets the retry counter
+	addr, accepted := listenTunnelServer(t, uint32(protocol.ErrMask|protocol.ErrPortUnavailable))
+
+	cp := validClientParameters()
+	cp.Endpoint = addr.IP.String()
+	cp.EndpointPort = addr.Port
+	cp.RemotePort = 50000
+	cp.MinSessionDuration = config.Duration(time.Millisecond)
+	cp.RetryBudget = 3
+
+	done := make(chan error, 1)
+	go func() { done <- Run(cp) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrRetriesExhausted) || !strings.Contains(err.Error(), "retry budget of 3") {
+			t.Errorf("Run() error = %v; want ErrRetriesExhausted by the retry budget", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run kept reconnecting past its retry budget")
+	}
+	// the first connection plus one per token
+	if n := accepted.Load(); n != 4 {
+		t.Errorf("server accepted %d connections; want 4", n)
+	}
+}
+
+func TestRun_RetryBudgetStopsDroppedSessions(t *testing.T) {
+	fastReconnect(t)
+	// every session gets its port, then the server drops the connection
+	addr, accepted := listenTunnelServer(t, 50000)
+
+	cp := validClientParameters()
+	cp.Endpoint = addr.IP.String()
+	cp.EndpointPort = addr.Port
+	cp.RemotePort = 50000
+	cp.MinSessionDuration = config.Duration(time.Millisecond)
+	cp.RetryBudget = 3
+
+	done := make(chan error, 1)
+	go func() { done <- Run(cp) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrRetriesExhausted) || !errors.Is(err, errSessionClosed) {
+			t.Errorf("Run() error = %v; want ErrRetriesExhausted after closed sessions", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run kept reconnecting past its retry budget")
+	}
+	if n := accepted.Load(); n != 4 {
+		t.Errorf("server accepted %d connections; want 4", n)
+	}
+}
+
+func TestRun_FixedPortFailFast(t *testing.T) {
+	addr, accepted := listenTunnelServer(t, uint32(protocol.ErrMask|protocol.ErrPortUnavailable))
+
+	cp := validClientParameters()
+	cp.Endpoint = addr.IP.String()
+	cp.EndpointPort = addr.Port
+	cp.RemotePort = 50000
+	cp.FixedPortFailFast = true
+
+	done := make(chan error, 1)
+	go func() { done <- Run(cp) }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrRequestedPortUnavailable) || !strings.Contains(err.Error(), "not retrying") {
+			t.Errorf("Run error = %v; want non-retryable requested port unavailable", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run kept retrying with FixedPortFailFast enabled")
+	}
+
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("server accepted %d connections; want 1", n)
+	}
+}
+
+func TestRunContext_ShortSessionsBackOff(t *testing.T) {
+	fastReconnect(t)
+	logs := captureLog(t)
+	// every session ends right after the handshake: the port is never available
+	addr, accepted := listenTunnelServer(t, uint32(protocol.ErrMask|protocol.ErrPortUnavailable))
+
+	cp := validClientParameters()
+	cp.Endpoint = addr.IP.String()
+	cp.EndpointPort = addr.Port
+	cp.RemotePort = 50000
+	cp.MinSessionDuration = config.Duration(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+	if err := RunContext(ctx, cp); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RunContext() error = %v; want context.DeadlineExceeded", err)
+	}
+
+	var delays []time.Duration
+	for _, m := range regexp.MustCompile(`Session closed, retrying in (\S+)\.\.\.`).FindAllStringSubmatch(logs.String(), -1) {
+		d, err := time.ParseDuration(m[1])
+		if err != nil {
+			t.Fatalf("parse delay %q: %v", m[1], err)
+		}
+		delays = append(delays, d)
+	}
+	if len(delays) < 3 {
+		t.Fatalf("got %d reconnects; want at least 3:\n%s", len(delays), logs.String())
+	}
+	for i, d := range delays {
+		if want := backoffDelay(i + 1); d != want {
+			t.Errorf("reconnect %d delayed %v; want %v", i+1, d, want)
+		}
+	}
+	// without backoff the 10ms delay would allow dozens of attempts
+	if n := accepted.Load(); n > 8 {
+		t.Errorf("server accepted %d connections in 600ms; want backoff to limit them", n)
+	}
+}
+
+func TestRunContext_DroppedSessionsBackOff(t *testing.T) {
+	fastReconnect(t)
+	logs := captureLog(t)
+	// every session gets its port, then the server drops the connection
+	addr, _ := listenTunnelServer(t, 50000)
+
+	cp := validClientParameters()
+	cp.Endpoint = addr.IP.String()
+	cp.EndpointPort = addr.Port
+	cp.RemotePort = 50000
+	cp.MinSessionDuration = config.Duration(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+	if err := RunContext(ctx, cp); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RunContext() error = %v; want context.DeadlineExceeded", err)
+	}
+
+	matches := regexp.MustCompile(`Session closed, retrying in (\S+)\.\.\.`).FindAllStringSubmatch(logs.String(), -1)
+	if len(matches) < 3 {
+		t.Fatalf("got %d reconnects; want at least 3:\n%s", len(matches), logs.String())
+	}
+	for i, m := range matches {
+		if want := backoffDelay(i + 1).String(); m[1] != want {
+			t.Errorf("reconnect %d delayed %s; want %s", i+1, m[1], want)
+		}
+	}
+}
+
+func TestRunContext_RetriesDrainingServer(t *testing.T) {
+	fastReconnect(t)
+	logs := captureLog(t)
+	addr, accepted := listenTunnelServer(t, uint32(protocol.ErrMask|protocol.ErrDraining))
+
+	cp := validClientParameters()
+	cp.Endpoint = addr.IP.String()
+	cp.EndpointPort = addr.Port
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := RunContext(ctx, cp); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RunContext() error = %v; want context.DeadlineExceeded", err)
+	}
+	if n := accepted.Load(); n < 2 {
+		t.Errorf("server accepted %d connections; want the client to reconnect after a drain:\n%s", n, logs.String())
+	}
+}
+
+func TestRun_LogsRedactedConfig(t *testing.T) {
+	logs := captureLog(t)
+	addr, _ := listenTunnelServer(t, uint32(protocol.ErrMask|protocol.ErrPortUnavailable))
+
+	cp := validClientParameters()
+	cp.Endpoint = addr.IP.String()
+	cp.EndpointPort = addr.Port
+	cp.RemotePort = 50000
+	cp.FixedPortFailFast = true
+
+	_ = Run(cp)
+
+	var line string
+	for _, l := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(l, "Client config:") {
+			line = l
+			break
+		}
+	}
+	if line == "" {
+		t.Fatalf("no config summary in logs:\n%s", logs.String())
+	}
+	for _, want := range []string{
+		fmt.Sprintf("endpoint=%s", addr), "user=user", "auth=password",
+		"local=localhost:8080", "remote=localhost:50000", "whitelist=0", "host_key_level=0",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("summary %q missing %q", line, want)
+		}
+	}
+	if strings.Contains(strings.Replace(line, "auth=password", "", 1), cp.Password) {
+		t.Errorf("summary %q leaks the password", line)
+	}
+}
+
+func TestRun_LogConfigDisabled(t *testing.T) {
+	logs := captureLog(t)
+	addr, _ := listenTunnelServer(t, uint32(protocol.ErrMask|protocol.ErrPortUnavailable))
+
+	cp := validClientParameters()
+	cp.Endpoint = addr.IP.String()
+	cp.EndpointPort = addr.Port
+	cp.RemotePort = 50000
+	cp.FixedPortFailFast = true
+	disabled := false
+	cp.LogConfig = &disabled
+
+	_ = Run(cp)
+	if strings.Contains(logs.String(), "Client config:") {
+		t.Errorf("expected no config summary with LogConfig disabled, got:\n%s", logs.String())
+	}
+}
+
+// webhookCall is a request received by recordWebhook
+type webhookCall struct {
+	method  string
+	payload RegistrationPayload
+}
+
+// recordWebhook starts an HTTP server recording webhook calls. The first
+// failures requests are answered with 500.
+func recordWebhook(t *testing.T, failures int) (string, func() []webhookCall) {
+	var mu sync.Mutex
+	var calls []webhookCall
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p RegistrationPayload
+		_ = json.NewDecoder(r.Body).Decode(&p)
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, webhookCall{r.Method, p})
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	prev := webhookRetryDelay
+	webhookRetryDelay = 10 * time.Millisecond
+	t.Cleanup(func() { webhookRetryDelay = prev })
+
+	return srv.URL, func() []webhookCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookCall(nil), calls...)
+	}
+}
+
+func TestRunConn_RegisterWebhook(t *testing.T) {
+	url, calls := recordWebhook(t, 0)
+	clientEnd, serverEnd := tcpPipe(t)
+	serveTunnelHandshake(t, serverEnd, 4242)
+
+	cp := validClientParameters()
+	cp.RegisterWebhook = url
+	cp.RegisterLabel = "web"
+
+	// the server closes the connection once the port has been assigned
+	_ = RunConn(clientEnd, cp)
+
+	want := RegistrationPayload{Endpoint: "pipe", Port: 4242, Label: "web"}
+	got := calls()
+	if len(got) != 2 {
+		t.Fatalf("got %d webhook calls; want register and deregister: %+v", len(got), got)
+	}
+	if got[0].method != http.MethodPost || got[0].payload != want {
+		t.Errorf("register call = %+v; want POST %+v", got[0], want)
+	}
+	if got[1].method != http.MethodDelete || got[1].payload != want {
+		t.Errorf("deregister call = %+v; want DELETE %+v", got[1], want)
+	}
+}
+
+func TestNotifyWebhook_RetriesAndFailsSoftly(t *testing.T) {
+	url, calls := recordWebhook(t, 1)
+	notifyWebhook(http.MethodPost, url, RegistrationPayload{Endpoint: "example.com", Port: 1})
+	if n := len(calls()); n != 2 {
+		t.Errorf("got %d calls; want a retry after the first failure", n)
+	}
+
+	url, calls = recordWebhook(t, webhookAttempts)
+	notifyWebhook(http.MethodPost, url, RegistrationPayload{Endpoint: "example.com", Port: 1})
+	if n := len(calls()); n != webhookAttempts {
+		t.Errorf("got %d calls; want %d attempts before giving up", n, webhookAttempts)
+	}
+}
+
+// pipeChannel implements ssh.Channel over in-memory pipes, standing in for a forwarded channel
+type pipeChannel struct {
+	io.Reader
+	io.Writer
+}
+
+func (c *pipeChannel) Close() error      { return nil }
+func (c *pipeChannel) CloseWrite() error { return nil }
+func (c *pipeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+func (c *pipeChannel) Stderr() io.ReadWriter {
+	return struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(""), io.Discard}
+}
+
+func TestHandleForward_LocalTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "tls=%v", r.TLS != nil)
+	}))
+	defer backend.Close()
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	if err := os.WriteFile(caPath, caPEM, 0600); err != nil {
+		t.Fatalf("write CA: %v", err)
+	}
+
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	tlsCfg, err := config.GetLocalTLSConfig(&config.ClientParameters{LocalHost: host, LocalTLS: true, LocalTLSCA: caPath})
+	if err != nil {
+		t.Fatalf("GetLocalTLSConfig: %v", err)
+	}
+	s := &ClientSession{LocalAddress: net.JoinHostPort(host, port), LocalTLS: tlsCfg, ProtocolVersion: 1}
+
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	s.ActiveConnections.Add(1)
+	go s.handleForward(&pipeChannel{Reader: reqR, Writer: respW}, 1)
+
+	// the server side of the tunnel only ever sees plaintext
+	go fmt.Fprintf(reqW, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+	resp, err := http.ReadResponse(bufio.NewReader(respR), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, resp.ContentLength))
+	if string(body) != "tls=true" {
+		t.Errorf("body = %q; want tls=true", body)
+	}
+
+	reqW.Close()
+	go io.Copy(io.Discard, respR)
+	s.ActiveConnections.Wait()
+}
+
+func TestHandleForward_RetriesRefusedLocalDial(t *testing.T) {
+	// the first dial goes to a closed port, as if the service were restarting
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	var dials int
+	prev := dialLocal
+	dialLocal = func(network, addr string) (net.Conn, error) {
+		dials++
+		if dials == 1 {
+			return net.Dial(network, closedAddr)
+		}
+		return net.Dial(network, addr)
+	}
+	t.Cleanup(func() { dialLocal = prev })
+
+	s := &ClientSession{
+		LocalAddress:      backend.Addr().String(),
+		LocalDialRetries:  2,
+		LocalDialInterval: 10 * time.Millisecond,
+		ProtocolVersion:   1,
+	}
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	s.ActiveConnections.Add(1)
+	go s.handleForward(&pipeChannel{Reader: reqR, Writer: respW}, 1)
+
+	go reqW.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(respR, buf); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echo = %q; want ping", buf)
+	}
+	if dials != 2 {
+		t.Errorf("dials = %d; want 2", dials)
+	}
+
+	reqW.Close()
+	go io.Copy(io.Discard, respR)
+	s.ActiveConnections.Wait()
+}
+
+func TestHandleForward_LocalPortFallback(t *testing.T) {
+	logs := captureLog(t)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closedAddr := closed.Addr().String()
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	// the first fallback refuses too, the second serves the forward
+	backendPort := backend.Addr().(*net.TCPAddr).Port
+	s := &ClientSession{
+		LocalAddress:    closedAddr,
+		LocalFallbacks:  localFallbacks(closedAddr, []int{closedPort, backendPort}),
+		ProtocolVersion: 1,
+	}
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	s.ActiveConnections.Add(1)
+	go s.handleForward(&pipeChannel{Reader: reqR, Writer: respW}, 1)
+
+	go reqW.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(respR, buf); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echo = %q; want ping", buf)
+	}
+
+	reqW.Close()
+	go io.Copy(io.Discard, respR)
+	s.ActiveConnections.Wait()
+	if want := fmt.Sprintf("Local %s accepted forward #1", backend.Addr()); !strings.Contains(logs.String(), want) {
+		t.Errorf("log missing %q:\n%s", want, logs.String())
+	}
+}
+
+func TestTargetPool_WeightedDistribution(t *testing.T) {
+	pool := newTargetPool([]config.WeightedTarget{
+		{Addr: "127.0.0.1:8081", Weight: 1},
+		{Addr: "127.0.0.1:8082", Weight: 3},
+		{Addr: "127.0.0.1:8083"},
+	})
+	const picks = 10000
+	counts := make(map[string]int)
+	for i := 0; i < picks; i++ {
+		counts[pool.pick(nil)]++
+	}
+	// weights 1, 3 and 1 (the default) share out a fifth, three fifths and a fifth
+	for addr, want := range map[string]float64{"127.0.0.1:8081": 0.2, "127.0.0.1:8082": 0.6, "127.0.0.1:8083": 0.2} {
+		if got := float64(counts[addr]) / picks; got < want-0.05 || got > want+0.05 {
+			t.Errorf("%s picked %.3f of the time; want about %.1f", addr, got, want)
+		}
+	}
+}
+
+func TestHandleForward_LocalTargetFailover(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deadAddr := closed.Addr().String()
+	closed.Close()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	var deadDials int
+	prev := dialLocal
+	dialLocal = func(network, addr string) (net.Conn, error) {
+		if addr == deadAddr {
+			deadDials++
+		}
+		return net.Dial(network, addr)
+	}
+	t.Cleanup(func() { dialLocal = prev })
+
+	// the dead target outweighs the live one, yet every forward must land
+	s := &ClientSession{
+		ProtocolVersion: 1,
+		targets: newTargetPool([]config.WeightedTarget{
+			{Addr: deadAddr, Weight: 100},
+			{Addr: backend.Addr().String(), Weight: 1},
+		}),
+	}
+	for id := 1; id <= 5; id++ {
+		reqR, reqW := io.Pipe()
+		respR, respW := io.Pipe()
+		s.ActiveConnections.Add(1)
+		go s.handleForward(&pipeChannel{Reader: reqR, Writer: respW}, id)
+
+		go reqW.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(respR, buf); err != nil {
+			t.Fatalf("forward #%d: read echo: %v", id, err)
+		}
+		reqW.Close()
+		go io.Copy(io.Discard, respR)
+		s.ActiveConnections.Wait()
+	}
+	// once it failed, the dead target is skipped during its cooldown
+	if deadDials != 1 {
+		t.Errorf("dials to the failed target = %d; want 1", deadDials)
+	}
+}
+
+func TestHandleForward_DrainsExtendedData(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	c1, c2 := tcpPipe(t)
+	serverConn := make(chan ssh.Conn, 1)
+	go func() {
+		sc, chans, reqs, err := ssh.NewServerConn(c2, testServerConfig(t))
+		if err != nil {
+			serverConn <- nil
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for range chans {
+			}
+		}()
+		serverConn <- sc
+	}()
+	cc, chans, reqs, err := ssh.NewClientConn(c1, "", &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.Password("pass")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	defer cc.Close()
+	go ssh.DiscardRequests(reqs)
+	sc := <-serverConn
+	if sc == nil {
+		t.Fatal("server handshake failed")
+	}
+	defer sc.Close()
+
+	s := &ClientSession{LocalAddress: backend.Addr().String(), ProtocolVersion: 1}
+	go func() {
+		for newCh := range chans {
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(chReqs)
+			s.ActiveConnections.Add(1)
+			go s.handleForward(ch, 1)
+		}
+	}()
+
+	ch, chReqs, err := sc.OpenChannel("direct-tcpip", nil)
+	if err != nil {
+		t.Fatalf("open channel: %v", err)
+	}
+	go ssh.DiscardRequests(chReqs)
+
+	// more extended data than the channel window holds: unless the client
+	// drains it, the window never reopens and the forward stalls
+	stderrDone := make(chan error, 1)
+	go func() {
+		_, err := ch.Stderr().Write(make([]byte, 4<<20))
+		stderrDone <- err
+	}()
+	select {
+	case err := <-stderrDone:
+		if err != nil {
+			t.Fatalf("write extended data: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("extended data write stalled")
+	}
+
+	if _, err := ch.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(ch, buf); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echo = %q; want ping", buf)
+	}
+
+	ch.Close()
+	s.ActiveConnections.Wait()
+}
+
+func TestHandleForward_LocalResetClosesBothDirections(t *testing.T) {
+	logs := captureLog(t)
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 4)
+		io.ReadFull(conn, buf)
+		// a zero linger makes Close reset the connection instead of ending it cleanly
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}()
+
+	c1, c2 := tcpPipe(t)
+	serverConn := make(chan ssh.Conn, 1)
+	go func() {
+		sc, chans, reqs, err := ssh.NewServerConn(c2, testServerConfig(t))
+		if err != nil {
+			serverConn <- nil
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for range chans {
+			}
+		}()
+		serverConn <- sc
+	}()
+	cc, chans, reqs, err := ssh.NewClientConn(c1, "", &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.Password("pass")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	defer cc.Close()
+	go ssh.DiscardRequests(reqs)
+	sc := <-serverConn
+	if sc == nil {
+		t.Fatal("server handshake failed")
+	}
+	defer sc.Close()
+
+	s := &ClientSession{LocalAddress: backend.Addr().String(), ProtocolVersion: 1}
+	accepted := make(chan struct{})
+	go func() {
+		for newCh := range chans {
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(chReqs)
+			s.ActiveConnections.Add(1)
+			go s.handleForward(ch, 1)
+			close(accepted)
+		}
+	}()
+
+	ch, chReqs, err := sc.OpenChannel("direct-tcpip", nil)
+	if err != nil {
+		t.Fatalf("open channel: %v", err)
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(chReqs)
+	if _, err := ch.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// Wait must not start before the forward has been added
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forward channel never accepted")
+	}
+	// the server side never closes the channel: only the reset may end the forward
+	done := make(chan struct{})
+	go func() {
+		s.ActiveConnections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("forward still open after the local service reset:\n%s", logs.String())
+	}
+}
+
+func TestAcceptForwards_MaxConcurrentForwards(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	c1, c2 := tcpPipe(t)
+	serverConn := make(chan ssh.Conn, 1)
+	go func() {
+		sc, chans, reqs, err := ssh.NewServerConn(c2, testServerConfig(t))
+		if err != nil {
+			serverConn <- nil
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for range chans {
+			}
+		}()
+		serverConn <- sc
+	}()
+	cc, chans, reqs, err := ssh.NewClientConn(c1, "", &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.Password("pass")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	defer cc.Close()
+	go ssh.DiscardRequests(reqs)
+	sc := <-serverConn
+	if sc == nil {
+		t.Fatal("server handshake failed")
+	}
+	defer sc.Close()
+
+	const limit = 2
+	s := &ClientSession{
+		LocalAddress:          backend.Addr().String(),
+		ProtocolVersion:       1,
+		Active:                true,
+		MaxConcurrentForwards: limit,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.acceptForwards(ctx, chans)
+
+	var open []ssh.Channel
+	for i := 0; i < limit; i++ {
+		ch, chReqs, err := sc.OpenChannel("direct-tcpip", nil)
+		if err != nil {
+			t.Fatalf("open channel %d: %v", i+1, err)
+		}
+		go ssh.DiscardRequests(chReqs)
+		open = append(open, ch)
+	}
+
+	_, _, err = sc.OpenChannel("direct-tcpip", nil)
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.ResourceShortage {
+		t.Fatalf("open channel %d: err = %v; want resource shortage", limit+1, err)
+	}
+
+	for _, ch := range open {
+		ch.Close()
+	}
+	s.ActiveConnections.Wait()
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.ConnectionCount != limit || s.CompletedCount != limit {
+		t.Errorf("counts = %d/%d; want %d/%d", s.ConnectionCount, s.CompletedCount, limit, limit)
+	}
+}
+
+func TestClientSession_Close(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	c1, c2 := tcpPipe(t)
+	serverConn := make(chan ssh.Conn, 1)
+	go func() {
+		sc, chans, reqs, err := ssh.NewServerConn(c2, testServerConfig(t))
+		if err != nil {
+			serverConn <- nil
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for range chans {
+			}
+		}()
+		serverConn <- sc
+	}()
+	cc, chans, reqs, err := ssh.NewClientConn(c1, "", &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.Password("pass")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	sc := <-serverConn
+	if sc == nil {
+		t.Fatal("server handshake failed")
+	}
+	defer sc.Close()
+
+	client := ssh.NewClient(cc, chans, reqs)
+	s := &ClientSession{
+		Connection:      client,
+		LocalAddress:    backend.Addr().String(),
+		ProtocolVersion: 1,
+		Active:          true,
+	}
+	acceptDone := make(chan struct{})
+	go func() {
+		s.acceptForwards(context.Background(), client.HandleChannelOpen("direct-tcpip"))
+		close(acceptDone)
+	}()
+
+	ch, chReqs, err := sc.OpenChannel("direct-tcpip", nil)
+	if err != nil {
+		t.Fatalf("open channel: %v", err)
+	}
+	go ssh.DiscardRequests(chReqs)
+	if _, err := ch.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(ch, make([]byte, 4)); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+
+	closeDone := make(chan error, 1)
+	go func() { closeDone <- s.Close() }()
+	select {
+	case err := <-closeDone:
+		if err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+
+	if s.ready() {
+		t.Error("session still ready after Close")
+	}
+	s.Lock.Lock()
+	if s.CompletedCount != s.ConnectionCount {
+		t.Errorf("completed %d of %d forwards; want all drained", s.CompletedCount, s.ConnectionCount)
+	}
+	s.Lock.Unlock()
+	select {
+	case <-acceptDone:
+	case <-time.After(5 * time.Second):
+		t.Error("acceptForwards still running after Close")
+	}
+	if _, _, err := sc.OpenChannel("direct-tcpip", nil); err == nil {
+		t.Error("forward opened after Close")
+	}
+}
+
+// freshDialLatency replaces localDialLatency with an empty histogram for the test
+func freshDialLatency(t *testing.T) *latencyHistogram {
+	prev := localDialLatency
+	localDialLatency = newLatencyHistogram(localDialLatencyBuckets)
+	t.Cleanup(func() { localDialLatency = prev })
+	return localDialLatency
 }
-func (s *stubConn) Close() error                  { return nil }
-func (s *stubConn) Wait() error                   { return nil }
-func (s *stubConn) User() string                  { return "" }
-func (s *stubConn) SessionID() []byte             { return nil }
-func (s *stubConn) ClientVersion() []byte         { return nil }
-func (s *stubConn) ServerVersion() []byte         { return nil }
-func (s *stubConn) RemoteAddr() net.Addr          { return stubAddr{} }
-func (s *stubConn) LocalAddr() net.Addr           { return stubAddr{} }
-func (s *stubConn) Permissions() *ssh.Permissions { return nil }
 
-// helper to build handshake frames
-func buildFrames(frames ...uint32) []byte {
-	buf := &bytes.Buffer{}
-	for _, f := range frames {
-		_ = binary.Write(buf, binary.BigEndian, f)
+func TestHandleForward_RecordsLocalDialLatency(t *testing.T) {
+	hist := freshDialLatency(t)
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	// a local service slow to accept
+	prev := dialLocal
+	dialLocal = func(network, addr string) (net.Conn, error) {
+		time.Sleep(60 * time.Millisecond)
+		return net.Dial(network, addr)
+	}
+	t.Cleanup(func() { dialLocal = prev })
+
+	s := &ClientSession{LocalAddress: backend.Addr().String(), ProtocolVersion: 1}
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	s.ActiveConnections.Add(1)
+	go s.handleForward(&pipeChannel{Reader: reqR, Writer: respW}, 1)
+
+	go reqW.Write([]byte("ping"))
+	if _, err := io.ReadFull(respR, make([]byte, 4)); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	reqW.Close()
+	go io.Copy(io.Discard, respR)
+	s.ActiveConnections.Wait()
+
+	var out strings.Builder
+	hist.writePrometheus(&out, "pbp_tunnel_client_local_dial_latency_seconds", "test")
+	if !strings.Contains(out.String(), "pbp_tunnel_client_local_dial_latency_seconds_count 1\n") {
+		t.Errorf("histogram = %s; want one observation", out.String())
+	}
+	// 60ms lands above the 50ms bucket and within the 100ms one
+	if !strings.Contains(out.String(), `_bucket{le="0.05"} 0`) || !strings.Contains(out.String(), `_bucket{le="0.1"} 1`) {
+		t.Errorf("histogram = %s; want the observation between 50ms and 100ms", out.String())
 	}
-	return buf.Bytes()
 }
 
-func newSSHClient(conn ssh.Conn) *ssh.Client {
-	// channels and requests channels are unused by runSession
-	return ssh.NewClient(conn, make(chan ssh.NewChannel), make(chan *ssh.Request))
+func TestHealthServer_Metrics(t *testing.T) {
+	hist := freshDialLatency(t)
+	hist.observe(3 * time.Millisecond)
+	hist.observe(2 * time.Second)
+
+	h, err := startHealthServer("127.0.0.1:0", "", "", "")
+	if err != nil {
+		t.Fatalf("startHealthServer: %v", err)
+	}
+	defer h.shutdown()
+	resp, err := http.Get("http://" + h.addr.String() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, want := range []string{
+		"# TYPE pbp_tunnel_client_local_dial_latency_seconds histogram",
+		`pbp_tunnel_client_local_dial_latency_seconds_bucket{le="0.001"} 0`,
+		`pbp_tunnel_client_local_dial_latency_seconds_bucket{le="0.005"} 1`,
+		`pbp_tunnel_client_local_dial_latency_seconds_bucket{le="1"} 1`,
+		`pbp_tunnel_client_local_dial_latency_seconds_bucket{le="2.5"} 2`,
+		`pbp_tunnel_client_local_dial_latency_seconds_bucket{le="+Inf"} 2`,
+		"pbp_tunnel_client_local_dial_latency_seconds_sum 2.003",
+		"pbp_tunnel_client_local_dial_latency_seconds_count 2",
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("/metrics missing %q:\n%s", want, body)
+		}
+	}
 }
 
-// --- Tests for run ---
-func TestRun_InvalidParameters(t *testing.T) {
-	cp := &config.ClientParameters{}
-	err := Run(cp)
-	if err == nil || !strings.Contains(err.Error(), "invalid client parameters") {
-		t.Fatalf("Run() error = %v; want invalid client parameters", err)
+func TestNewClientSession_IPv6LocalHost(t *testing.T) {
+	cp := validClientParameters()
+	cp.LocalHost = "::1"
+	if got := newClientSession(nil, cp).LocalAddress; got != "[::1]:8080" {
+		t.Errorf("LocalAddress = %q; want [::1]:8080", got)
+	}
+}
+
+func TestNewClientSession_RereadsLocalTargetFile(t *testing.T) {
+	targetFile := filepath.Join(t.TempDir(), "target")
+	cp := validClientParameters()
+	cp.LocalTargetFile = targetFile
+
+	// missing file: fall back to local_host/local_port
+	if got := newClientSession(nil, cp).LocalAddress; got != "localhost:8080" {
+		t.Errorf("LocalAddress without file = %q; want localhost:8080", got)
+	}
+
+	for _, target := range []string{"127.0.0.1:9001", "127.0.0.1:9002"} {
+		if err := os.WriteFile(targetFile, []byte(target+"\n"), 0600); err != nil {
+			t.Fatalf("write target file: %v", err)
+		}
+		if got := newClientSession(nil, cp).LocalAddress; got != target {
+			t.Errorf("LocalAddress = %q; want %q after the file changed", got, target)
+		}
+	}
+
+	os.WriteFile(targetFile, []byte("not-an-address"), 0600)
+	if got := newClientSession(nil, cp).LocalAddress; got != "localhost:8080" {
+		t.Errorf("LocalAddress with invalid file = %q; want localhost:8080", got)
+	}
+}
+
+// probe returns the status code of GET url
+func probe(t *testing.T, url string) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHealthServer_Endpoints(t *testing.T) {
+	h, err := startHealthServer("127.0.0.1:0", "", "", "")
+	if err != nil {
+		t.Fatalf("startHealthServer: %v", err)
+	}
+	defer h.shutdown()
+	base := "http://" + h.addr.String()
+
+	if code := probe(t, base+"/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d; want 200", code)
+	}
+	if code := probe(t, base+"/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz while disconnected = %d; want 503", code)
+	}
+
+	h.setSession(&ClientSession{Active: true, AssignedPort: 4242})
+	if code := probe(t, base+"/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz while connected = %d; want 200", code)
+	}
+
+	h.setSession(nil)
+	if code := probe(t, base+"/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz after disconnect = %d; want 503", code)
+	}
+	if code := probe(t, base+"/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz after disconnect = %d; want 200", code)
+	}
+}
+
+func TestRun_HealthServerStopsOnExit(t *testing.T) {
+	fastReconnect(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	healthAddr := ln.Addr().String()
+	ln.Close()
+
+	cp := validClientParameters()
+	cp.Endpoint = "127.0.0.1"
+	cp.EndpointPort = 1
+	cp.MaxRetries = 1
+	cp.HealthAddr = healthAddr
+
+	if err := Run(cp); !errors.Is(err, ErrRetriesExhausted) {
+		t.Fatalf("Run() error = %v; want ErrRetriesExhausted", err)
+	}
+	if _, err := http.Get("http://" + healthAddr + "/healthz"); err == nil {
+		t.Error("health server still answering after Run returned")
+	}
+}
+
+func TestRun_MetricsServerStopsOnExit(t *testing.T) {
+	fastReconnect(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	metricsAddr := ln.Addr().String()
+	ln.Close()
+
+	cp := validClientParameters()
+	cp.Endpoint = "127.0.0.1"
+	cp.EndpointPort = 1
+	cp.MaxRetries = 1
+	cp.MetricsAddr = metricsAddr
+
+	if err := Run(cp); !errors.Is(err, ErrRetriesExhausted) {
+		t.Fatalf("Run() error = %v; want ErrRetriesExhausted", err)
+	}
+	if _, err := http.Get("http://" + metricsAddr + "/metrics"); err == nil {
+		t.Error("metrics server still answering after Run returned")
+	}
+}
+
+// scrape returns the body of the metrics endpoint at addr
+func scrape(t *testing.T, addr net.Addr) string {
+	resp, err := http.Get("http://" + addr.String() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestMetricsServer_ReflectsSession(t *testing.T) {
+	oldLocal, oldServer := bytesToLocal.Swap(0), bytesToServer.Swap(0)
+	t.Cleanup(func() {
+		bytesToLocal.Store(oldLocal)
+		bytesToServer.Store(oldServer)
+	})
+
+	h, err := startHealthServer("", "127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatalf("startHealthServer: %v", err)
+	}
+	defer h.shutdown()
+	if code := probe(t, "http://"+h.metricsAddr.String()+"/healthz"); code != http.StatusNotFound {
+		t.Errorf("/healthz on the metrics address = %d; want 404", code)
+	}
+
+	body := scrape(t, h.metricsAddr)
+	for _, want := range []string{
+		"pbp_tunnel_client_connected 0",
+		"pbp_tunnel_client_reconnects_total 0",
+		"pbp_tunnel_client_active_forwards 0",
+		"pbp_tunnel_client_assigned_port 0",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics while disconnected missing %q:\n%s", want, body)
+		}
+	}
+
+	h.setSession(&ClientSession{})
+	s := &ClientSession{Active: true, AssignedPort: 4242, ConnectionCount: 3, CompletedCount: 1}
+	h.setSession(s)
+	countingWriter{io.Discard, &s.BytesToLocal, &bytesToLocal}.Write(make([]byte, 100))
+	countingWriter{io.Discard, &s.BytesToServer, &bytesToServer}.Write(make([]byte, 42))
+
+	body = scrape(t, h.metricsAddr)
+	for _, want := range []string{
+		"# TYPE pbp_tunnel_client_connected gauge",
+		"pbp_tunnel_client_connected 1",
+		"# TYPE pbp_tunnel_client_reconnects_total counter",
+		"pbp_tunnel_client_reconnects_total 1",
+		"pbp_tunnel_client_active_forwards 2",
+		`pbp_tunnel_client_bytes_total{direction="to_local"} 100`,
+		`pbp_tunnel_client_bytes_total{direction="to_server"} 42`,
+		"pbp_tunnel_client_assigned_port 4242",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics while connected missing %q:\n%s", want, body)
+		}
+	}
+	if got := s.GetMetrics()["bytes_to_local"]; got != uint64(100) {
+		t.Errorf("GetMetrics()[bytes_to_local] = %v; want 100", got)
 	}
 }
 
@@ -90,16 +1745,59 @@ func TestRun_InvalidParameters(t *testing.T) {
 func TestRunSession_HandshakeReadError(t *testing.T) {
 	conn := &stubConn{data: []byte{}}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	if err == nil || !strings.Contains(err.Error(), "handshake read error") {
 		t.Errorf("runSession error = %v; want handshake read error", err)
 	}
 }
 
+func TestRunSession_HandshakeConnClosed(t *testing.T) {
+	c1, c2 := tcpPipe(t)
+	go func() {
+		sshConn, chans, reqs, err := ssh.NewServerConn(c2, testServerConfig(t))
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		// accept the handshake channel, then drop the whole connection
+		if newCh, ok := <-chans; ok {
+			newCh.Accept()
+		}
+		sshConn.Close()
+	}()
+	cc, chans, reqs, err := ssh.NewClientConn(c1, "", &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.Password("pass")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	client := ssh.NewClient(cc, chans, reqs)
+	defer client.Close()
+
+	s := &ClientSession{Connection: client, LocalAddress: "localhost:0"}
+	err = s.runSession(context.Background(), &config.ClientParameters{})
+	if !errors.Is(err, ErrHandshakeConnClosed) {
+		t.Errorf("runSession error = %v; want ErrHandshakeConnClosed", err)
+	}
+}
+
+func TestRunSession_HandshakeTruncated(t *testing.T) {
+	// the channel ends while the connection stays up: a protocol-level EOF
+	conn := &blockingConn{closed: make(chan struct{})}
+	defer conn.Close()
+	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
+	err := s.runSession(context.Background(), &config.ClientParameters{})
+	if err == nil || errors.Is(err, ErrHandshakeConnClosed) || !errors.Is(err, io.EOF) {
+		t.Errorf("runSession error = %v; want handshake read EOF on a live connection", err)
+	}
+}
+
 func TestRunSession_IPNotAllowed(t *testing.T) {
-	conn := &stubConn{data: buildFrames(ErrIPNotAllowed)}
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrIPNotAllowed))}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	if err == nil || !strings.Contains(err.Error(), "server rejected IP") {
 		t.Errorf("runSession error = %v; want server rejected IP", err)
 	}
@@ -108,56 +1806,104 @@ func TestRunSession_IPNotAllowed(t *testing.T) {
 func TestRunSession_HandshakeFailed(t *testing.T) {
 	conn := &stubConn{data: buildFrames(99)}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	if err == nil || !strings.Contains(err.Error(), "handshake failed with code 99") {
 		t.Errorf("runSession error = %v; want handshake failed with code 99", err)
 	}
 }
 
+func TestRunSession_ProtocolMismatch(t *testing.T) {
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrMask|protocol.ErrProtocolMismatch), 3)}
+	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
+	err := s.runSession(context.Background(), &config.ClientParameters{})
+	if err == nil || !strings.Contains(err.Error(), "requires protocol version 3 or later, client speaks 1") {
+		t.Errorf("runSession error = %v; want protocol version requirement", err)
+	}
+}
+
 func TestRunSession_WhitelistRejected(t *testing.T) {
-	conn := &stubConn{data: buildFrames(ErrSuccess, 1)}
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), 1)}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
-	err := s.runSession(&config.ClientParameters{AllowedIPs: []string{"1.2.3.4"}})
+	err := s.runSession(context.Background(), &config.ClientParameters{AllowedIPs: []string{"1.2.3.4"}})
 	if err == nil || !strings.Contains(err.Error(), "whitelist rejected by server") {
 		t.Errorf("runSession error = %v; want whitelist rejected by server", err)
 	}
 }
 
+func TestRunSession_WhitelistEmptyRejected(t *testing.T) {
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrWhitelistEmpty))}
+	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
+	err := s.runSession(context.Background(), &config.ClientParameters{AllowedIPs: []string{""}})
+	if err == nil || err.Error() != "whitelist rejected by server: whitelist empty" {
+		t.Errorf("runSession error = %v; want whitelist rejected by server: whitelist empty", err)
+	}
+}
+
 func TestRunSession_PortUnavailable(t *testing.T) {
-	mask := ErrMask | ErrPortUnavailable
-	conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, mask)}
+	mask := uint32(protocol.ErrMask | protocol.ErrPortUnavailable)
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), mask)}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	if err == nil || !strings.Contains(err.Error(), "no available ports") {
 		t.Errorf("runSession error = %v; want no available ports", err)
 	}
 }
 
+func TestRunSession_RequestedPortUnavailable(t *testing.T) {
+	mask := uint32(protocol.ErrMask | protocol.ErrPortUnavailable)
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), mask)}
+	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
+	err := s.runSession(context.Background(), &config.ClientParameters{RemotePort: 50000})
+	if !errors.Is(err, ErrRequestedPortUnavailable) {
+		t.Errorf("runSession error = %v; want ErrRequestedPortUnavailable", err)
+	}
+}
+
 func TestRunSession_PortOutOfRange(t *testing.T) {
-	mask := ErrMask | ErrPortOutOfRange
-	conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, mask)}
+	mask := uint32(protocol.ErrMask | protocol.ErrPortOutOfRange)
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), mask)}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	if err == nil || !strings.Contains(err.Error(), "port out of range") {
 		t.Errorf("runSession error = %v; want port out of range", err)
 	}
 }
 
 func TestRunSession_InternalError(t *testing.T) {
-	mask := ErrMask | ErrInternal
-	conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, mask)}
+	mask := uint32(protocol.ErrMask | protocol.ErrInternal)
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), mask)}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	if err == nil || !strings.Contains(err.Error(), "internal error") {
 		t.Errorf("runSession error = %v; want internal error", err)
 	}
 }
 
+func TestRunSession_ServerWarmingUp(t *testing.T) {
+	mask := uint32(protocol.ErrMask | protocol.ErrWarmingUp)
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), mask)}
+	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
+	err := s.runSession(context.Background(), &config.ClientParameters{})
+	if !errors.Is(err, ErrServerWarmingUp) {
+		t.Errorf("runSession error = %v; want ErrServerWarmingUp", err)
+	}
+}
+
+func TestRunSession_ServerDraining(t *testing.T) {
+	mask := uint32(protocol.ErrMask | protocol.ErrDraining)
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), mask)}
+	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
+	err := s.runSession(context.Background(), &config.ClientParameters{})
+	if !errors.Is(err, ErrServerDraining) {
+		t.Errorf("runSession error = %v; want ErrServerDraining", err)
+	}
+}
+
 func TestRunSession_UnknownServerError(t *testing.T) {
-	mask := ErrMask | 42
-	conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, mask)}
+	mask := uint32(protocol.ErrMask | 42)
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), mask)}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	if err == nil || !strings.Contains(err.Error(), "server error code 42") {
 		t.Errorf("runSession error = %v; want server error code 42", err)
 	}
@@ -165,9 +1911,9 @@ func TestRunSession_UnknownServerError(t *testing.T) {
 
 func TestRunSession_Success(t *testing.T) {
 	port := uint32(4242)
-	conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, port)}
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), port)}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	if err != nil {
 		t.Errorf("runSession unexpected error: %v", err)
 	}
@@ -176,9 +1922,112 @@ func TestRunSession_Success(t *testing.T) {
 	}
 }
 
+func TestRunSession_PortOutputFile(t *testing.T) {
+	conn := &blockingConn{
+		stubConn: stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 4242)},
+		closed:   make(chan struct{}),
+	}
+	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
+	path := filepath.Join(t.TempDir(), "port")
+
+	done := make(chan error, 1)
+	go func() { done <- s.runSession(context.Background(), &config.ClientParameters{PortOutputFile: path}) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if data, err := os.ReadFile(path); err == nil {
+			if string(data) != "4242\n" {
+				t.Errorf("port file = %q; want 4242", data)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("port file not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn.Close()
+	<-done
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("port file after session end: %v; want removed", err)
+	}
+	if matches, _ := filepath.Glob(path + ".tmp-*"); len(matches) != 0 {
+		t.Errorf("temp files left behind: %v", matches)
+	}
+}
+
+// blockingConn is a stubConn whose Wait blocks until Close, like a live session
+type blockingConn struct {
+	stubConn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *blockingConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+func (c *blockingConn) Wait() error { <-c.closed; return io.EOF }
+
+// acceptForwardsRunning reports whether an acceptForwards goroutine is alive
+func acceptForwardsRunning() bool {
+	buf := make([]byte, 1<<20)
+	return strings.Contains(string(buf[:runtime.Stack(buf, true)]), "(*ClientSession).acceptForwards")
+}
+
+func TestRunSession_ForwardGoroutineExitsWithSession(t *testing.T) {
+	// newSSHClient never closes the channel-open stream, so only the session
+	// ending can stop the goroutine
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 4242)}
+	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0", Active: true}
+	if err := s.runSession(context.Background(), &config.ClientParameters{}); err != nil {
+		t.Fatalf("runSession: %v", err)
+	}
+	if acceptForwardsRunning() {
+		t.Error("acceptForwards still running after runSession returned")
+	}
+	if s.ready() {
+		t.Error("session still active after runSession returned")
+	}
+}
+
+func TestRunSession_ContextCancelEndsSession(t *testing.T) {
+	conn := &blockingConn{
+		stubConn: stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 4242)},
+		closed:   make(chan struct{}),
+	}
+	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0", Active: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.runSession(ctx, &config.ClientParameters{}) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("session never became ready")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runSession did not return after cancellation")
+	}
+	if acceptForwardsRunning() {
+		t.Error("acceptForwards still running after cancellation")
+	}
+	if s.ready() {
+		t.Error("session still active after cancellation")
+	}
+}
+
 func TestRunSession_WhitelistSending(t *testing.T) {
 	// Create a stub connection that returns success for handshake and whitelist
-	conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, 8080)}
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 8080)}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:8888"}
 
 	// Create parameters with multiple whitelist entries
@@ -187,7 +2036,7 @@ func TestRunSession_WhitelistSending(t *testing.T) {
 		RemotePort: 8080,
 	}
 
-	err := s.runSession(params)
+	err := s.runSession(context.Background(), params)
 	if err != nil {
 		t.Errorf("runSession with whitelist unexpected error: %v", err)
 	}
@@ -200,7 +2049,7 @@ func TestRunSession_WhitelistSending(t *testing.T) {
 
 // Test sending whitelist with zero entries
 func TestRunSession_EmptyWhitelist(t *testing.T) {
-	conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, 8080)}
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 8080)}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
 
 	params := &config.ClientParameters{
@@ -208,7 +2057,7 @@ func TestRunSession_EmptyWhitelist(t *testing.T) {
 		RemotePort: 8080,
 	}
 
-	err := s.runSession(params)
+	err := s.runSession(context.Background(), params)
 	if err != nil {
 		t.Errorf("runSession with empty whitelist unexpected error: %v", err)
 	}
@@ -222,10 +2071,10 @@ func TestRunSession_EmptyWhitelist(t *testing.T) {
 func TestRunSession_WhitelistConfirmReadError(t *testing.T) {
 	// Create response with success for handshake but no whitelist confirmation
 	// This truncated response will cause a read error when trying to read whitelist confirmation
-	conn := &stubConn{data: buildFrames(ErrSuccess)}
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess))}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
 
-	err := s.runSession(&config.ClientParameters{AllowedIPs: []string{"1.2.3.4"}})
+	err := s.runSession(context.Background(), &config.ClientParameters{AllowedIPs: []string{"1.2.3.4"}})
 	if err == nil || !strings.Contains(err.Error(), "whitelist confirm read error") {
 		t.Errorf("runSession error = %v; want whitelist confirm read error", err)
 	}
@@ -233,7 +2082,7 @@ func TestRunSession_WhitelistConfirmReadError(t *testing.T) {
 
 // Test avec des entrées de liste blanche de tailles différentes
 func TestRunSession_VaryingWhitelistEntrySizes(t *testing.T) {
-	conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, 8080)}
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 8080)}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
 
 	// Tester avec des entrées très courtes, longues, et normales
@@ -249,7 +2098,7 @@ func TestRunSession_VaryingWhitelistEntrySizes(t *testing.T) {
 		RemotePort: 8080,
 	}
 
-	err := s.runSession(params)
+	err := s.runSession(context.Background(), params)
 	if err != nil {
 		t.Errorf("runSession with varying whitelist entry sizes failed: %v", err)
 	}
@@ -261,7 +2110,7 @@ func TestRunSession_VaryingWhitelistEntrySizes(t *testing.T) {
 
 // Test avec de nombreuses entrées de liste blanche (performance)
 func TestRunSession_LargeWhitelist(t *testing.T) {
-	conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, 8080)}
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 8080)}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
 
 	// Générer un grand nombre d'entrées
@@ -277,7 +2126,7 @@ func TestRunSession_LargeWhitelist(t *testing.T) {
 	}
 
 	start := time.Now()
-	err := s.runSession(params)
+	err := s.runSession(context.Background(), params)
 	duration := time.Since(start)
 
 	if err != nil {
@@ -307,9 +2156,9 @@ func TestRunSession_PortBoundaries(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			var responseData []byte
 			if tc.expectErr {
-				responseData = buildFrames(ErrSuccess, ErrSuccess, ErrMask|ErrPortOutOfRange)
+				responseData = buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), uint32(protocol.ErrMask|protocol.ErrPortOutOfRange))
 			} else {
-				responseData = buildFrames(ErrSuccess, ErrSuccess, tc.port)
+				responseData = buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), tc.port)
 			}
 
 			conn := &stubConn{data: responseData}
@@ -319,7 +2168,7 @@ func TestRunSession_PortBoundaries(t *testing.T) {
 				RemotePort: int(tc.port),
 			}
 
-			err := s.runSession(params)
+			err := s.runSession(context.Background(), params)
 
 			if tc.expectErr {
 				if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
@@ -339,10 +2188,10 @@ func TestRunSession_PortBoundaries(t *testing.T) {
 
 func TestRunSession_PortResponseReadError(t *testing.T) {
 	// Create response with success for handshake and whitelist but no port response
-	conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess)}
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess))}
 	s := &ClientSession{Connection: newSSHClient(conn), LocalAddress: "localhost:0"}
 
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	if err == nil || !strings.Contains(err.Error(), "read port response error") {
 		t.Errorf("runSession error = %v; want read port response error", err)
 	}
@@ -502,7 +2351,7 @@ func TestRunSession_ConcurrentSessions(t *testing.T) {
 			defer wg.Done()
 
 			port := uint32(8080 + sessionID)
-			conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, port)}
+			conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), port)}
 			s := &ClientSession{
 				Connection:   newSSHClient(conn),
 				LocalAddress: fmt.Sprintf("localhost:%d", 9000+sessionID),
@@ -513,7 +2362,7 @@ func TestRunSession_ConcurrentSessions(t *testing.T) {
 				AllowedIPs: []string{fmt.Sprintf("192.168.1.%d", sessionID%255)},
 			}
 
-			err := s.runSession(params)
+			err := s.runSession(context.Background(), params)
 			if err != nil {
 				errors <- fmt.Errorf("session %d failed: %v", sessionID, err)
 				return
@@ -594,7 +2443,7 @@ func TestRunSession_ReadTimeout(t *testing.T) {
 	}
 
 	conn := &stubConnWithCustomChannel{
-		stubConn: stubConn{data: buildFrames(ErrSuccess)},
+		stubConn: stubConn{data: buildFrames(uint32(protocol.ErrSuccess))},
 		channel:  slowChannel,
 	}
 
@@ -605,7 +2454,7 @@ func TestRunSession_ReadTimeout(t *testing.T) {
 
 	// Le test devrait se terminer rapidement avec une erreur de timeout
 	start := time.Now()
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	duration := time.Since(start)
 
 	if err == nil {
@@ -631,16 +2480,16 @@ func TestRunSession_NetworkRecovery(t *testing.T) {
 		LocalAddress: "localhost:0",
 	}
 
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	if err == nil {
 		t.Error("Expected error from failed connection but got nil")
 	}
 
 	// Deuxième essai avec succès
-	successConn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, 8080)}
+	successConn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 8080)}
 	s.Connection = newSSHClient(successConn)
 
-	err = s.runSession(&config.ClientParameters{})
+	err = s.runSession(context.Background(), &config.ClientParameters{})
 	if err != nil {
 		t.Errorf("Expected success after connection recovery but got: %v", err)
 	}
@@ -659,6 +2508,7 @@ func TestClientSession_Metrics(t *testing.T) {
 		Active:          true,
 		ConnectionCount: 0,
 		AssignedPort:    8080,
+		PublicURL:       "https://service.example.com:8080",
 	}
 
 	// Métriques initiales
@@ -668,6 +2518,7 @@ func TestClientSession_Metrics(t *testing.T) {
 		"active":           true,
 		"connection_count": 0,
 		"assigned_port":    8080,
+		"public_url":       "https://service.example.com:8080",
 	}
 
 	for key, expected := range expectedMetrics {
@@ -687,9 +2538,42 @@ func TestClientSession_Metrics(t *testing.T) {
 	}
 }
 
+func TestRunSession_ServerVersion(t *testing.T) {
+	logs := captureLog(t)
+	frames := buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 8080, 0)
+	frames = binary.BigEndian.AppendUint64(frames, uint64(time.Now().UnixMilli()))
+	frames = binary.BigEndian.AppendUint32(frames, uint32(len("1.4.2")))
+	frames = append(frames, "1.4.2"...)
+	conn := &stubConn{data: frames, version: protocol.VersionServerInfo}
+	s := &ClientSession{
+		Connection:   newSSHClient(conn),
+		LocalAddress: "localhost:0",
+	}
+
+	if err := s.runSession(context.Background(), &config.ClientParameters{}); err != nil {
+		t.Fatalf("runSession error: %v", err)
+	}
+	if s.ProtocolVersion != protocol.VersionServerInfo {
+		t.Fatalf("ProtocolVersion = %d; want %d", s.ProtocolVersion, protocol.VersionServerInfo)
+	}
+	if v := s.GetMetrics()["server_version"]; v != "1.4.2" {
+		t.Errorf("server_version = %v; want 1.4.2", v)
+	}
+	if !strings.Contains(logs.String(), "Server version 1.4.2") {
+		t.Errorf("expected server version in logs, got:\n%s", logs.String())
+	}
+}
+
+func TestReadServerVersion_TooLong(t *testing.T) {
+	frame := binary.BigEndian.AppendUint32(nil, maxServerVersionLength+1)
+	if _, err := readServerVersion(bytes.NewReader(frame)); err == nil || !strings.Contains(err.Error(), "server version too long") {
+		t.Errorf("readServerVersion error = %v; want server version too long", err)
+	}
+}
+
 // Test de monitoring de performance
 func TestRunSession_PerformanceMonitoring(t *testing.T) {
-	conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, 8080)}
+	conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 8080)}
 	s := &ClientSession{
 		Connection:   newSSHClient(conn),
 		LocalAddress: "localhost:0",
@@ -697,7 +2581,7 @@ func TestRunSession_PerformanceMonitoring(t *testing.T) {
 
 	// Mesurer le temps d'exécution
 	start := time.Now()
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	duration := time.Since(start)
 
 	if err != nil {
@@ -719,13 +2603,13 @@ func TestClientSession_MemoryLeak(t *testing.T) {
 	const iterations = 100
 
 	for i := 0; i < iterations; i++ {
-		conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, uint32(8080+i))}
+		conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), uint32(8080+i))}
 		s := &ClientSession{
 			Connection:   newSSHClient(conn),
 			LocalAddress: fmt.Sprintf("localhost:%d", 9000+i),
 		}
 
-		err := s.runSession(&config.ClientParameters{})
+		err := s.runSession(context.Background(), &config.ClientParameters{})
 		if err != nil {
 			t.Errorf("Iteration %d failed: %v", i, err)
 		}
@@ -820,13 +2704,13 @@ func TestRunSession_ConfigValidation(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, 8080)}
+			conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 8080)}
 			s := &ClientSession{
 				Connection:   newSSHClient(conn),
 				LocalAddress: "localhost:0",
 			}
 
-			err := s.runSession(tc.params)
+			err := s.runSession(context.Background(), tc.params)
 
 			if tc.wantErr != "" {
 				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
@@ -937,19 +2821,6 @@ func (s *stubConnWithRetry) OpenChannel(name string, payload []byte) (ssh.Channe
 	return ch, reqs, nil
 }
 
-// Extension de ClientSession pour les métriques
-func (s *ClientSession) GetMetrics() map[string]interface{} {
-	s.Lock.Lock()
-	defer s.Lock.Unlock()
-
-	return map[string]interface{}{
-		"local_address":    s.LocalAddress,
-		"active":           s.Active,
-		"connection_count": s.ConnectionCount,
-		"assigned_port":    s.AssignedPort,
-	}
-}
-
 // Test de connexion qui simule des tentatives avec échecs puis succès
 func TestRunSession_ConnectionFailure(t *testing.T) {
 	conn := &stubConnWithFailure{
@@ -961,7 +2832,7 @@ func TestRunSession_ConnectionFailure(t *testing.T) {
 		LocalAddress: "localhost:0",
 	}
 
-	err := s.runSession(&config.ClientParameters{})
+	err := s.runSession(context.Background(), &config.ClientParameters{})
 	if err == nil {
 		t.Error("Expected error from failed connection")
 	}
@@ -976,13 +2847,13 @@ func TestRunSession_ConnectionFailure(t *testing.T) {
 func BenchmarkRunSession(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, 8080)}
+		conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 8080)}
 		s := &ClientSession{
 			Connection:   newSSHClient(conn),
 			LocalAddress: "localhost:0",
 		}
 
-		err := s.runSession(&config.ClientParameters{})
+		err := s.runSession(context.Background(), &config.ClientParameters{})
 		if err != nil {
 			b.Fatalf("Benchmark failed: %v", err)
 		}
@@ -1004,15 +2875,87 @@ func BenchmarkWhitelistProcessing(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		conn := &stubConn{data: buildFrames(ErrSuccess, ErrSuccess, 8080)}
+		conn := &stubConn{data: buildFrames(uint32(protocol.ErrSuccess), uint32(protocol.ErrSuccess), 8080)}
 		s := &ClientSession{
 			Connection:   newSSHClient(conn),
 			LocalAddress: "localhost:0",
 		}
 
-		err := s.runSession(params)
+		err := s.runSession(context.Background(), params)
 		if err != nil {
 			b.Fatalf("Benchmark failed: %v", err)
 		}
 	}
 }
+
+func TestHealthServer_BasicAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		user, pass string // configured credentials
+		reqUser    string
+		reqPass    string
+		sendAuth   bool
+		want       int
+	}{
+		{"no auth configured", "", "", "", "", false, http.StatusOK},
+		{"authorized", "prom", "s3cret", "prom", "s3cret", true, http.StatusOK},
+		{"missing credentials", "prom", "s3cret", "", "", false, http.StatusUnauthorized},
+		{"wrong password", "prom", "s3cret", "prom", "guess", true, http.StatusUnauthorized},
+		{"wrong user", "prom", "s3cret", "admin", "s3cret", true, http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := startHealthServer("127.0.0.1:0", "", tc.user, tc.pass)
+			if err != nil {
+				t.Fatalf("startHealthServer: %v", err)
+			}
+			defer h.shutdown()
+
+			for _, path := range []string{"/healthz", "/readyz"} {
+				req, _ := http.NewRequest(http.MethodGet, "http://"+h.addr.String()+path, nil)
+				if tc.sendAuth {
+					req.SetBasicAuth(tc.reqUser, tc.reqPass)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("GET %s: %v", path, err)
+				}
+				resp.Body.Close()
+				want := tc.want
+				if path == "/readyz" && want == http.StatusOK {
+					want = http.StatusServiceUnavailable // no session
+				}
+				if resp.StatusCode != want {
+					t.Errorf("%s = %d; want %d", path, resp.StatusCode, want)
+				}
+				if want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+					t.Errorf("%s: 401 without WWW-Authenticate", path)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		server   time.Time
+		limit    time.Duration
+		wantWarn bool
+	}{
+		{"server-behind", now.Add(-2 * time.Minute), 30 * time.Second, true},
+		{"server-ahead", now.Add(2 * time.Minute), 30 * time.Second, true},
+		{"within-limit", now.Add(10 * time.Second), 30 * time.Second, false},
+		{"no-check", now.Add(time.Hour), 0, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLog(t)
+			checkClockSkew(tc.server, now, tc.limit)
+			if got := strings.Contains(logs.String(), "off the server clock"); got != tc.wantWarn {
+				t.Errorf("warned = %v; want %v (logs: %q)", got, tc.wantWarn, logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// healthShutdownTimeout bounds the graceful shutdown of the health server
+const healthShutdownTimeout = 5 * time.Second
+
+// healthServer answers liveness and readiness probes and serves the metrics
+// of the client
+type healthServer struct {
+	srvs        []*http.Server
+	addr        net.Addr // probes and metrics, nil without a health address
+	metricsAddr net.Addr // metrics alone, nil without a metrics address
+	session     atomic.Pointer[ClientSession]
+	sessions    atomic.Uint64
+}
+
+// startHealthServer serves /healthz, /readyz and /metrics on addr, and
+// /metrics alone on metricsAddr, until shutdown is called. Either address may
+// be empty. With a non-empty user, requests must carry matching HTTP Basic
+// credentials.
+func startHealthServer(addr, metricsAddr, user, pass string) (*healthServer, error) {
+	h := &healthServer{}
+	if addr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", h.handleHealthz)
+		mux.HandleFunc("/readyz", h.handleReadyz)
+		mux.HandleFunc("/metrics", h.handleMetrics)
+		ln, err := h.serve(addr, mux, user, pass)
+		if err != nil {
+			return nil, err
+		}
+		h.addr = ln
+		log.Printf("[+] Health endpoints listening on %s", h.addr)
+	}
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", h.handleMetrics)
+		ln, err := h.serve(metricsAddr, mux, user, pass)
+		if err != nil {
+			h.shutdown()
+			return nil, err
+		}
+		h.metricsAddr = ln
+		log.Printf("[+] Metrics listening on %s", h.metricsAddr)
+	}
+	return h, nil
+}
+
+// serve starts an HTTP server for mux on addr and returns its address
+func (h *healthServer) serve(addr string, mux *http.ServeMux, user, pass string) (net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", addr, err)
+	}
+	var handler http.Handler = mux
+	if user != "" {
+		handler = basicAuth(mux, user, pass)
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+	h.srvs = append(h.srvs, srv)
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("[-] Health server: %v", err)
+		}
+	}()
+	return ln.Addr(), nil
+}
+
+// setSession records the current session, or nil while disconnected.
+// It is a no-op on a nil server, so callers need not check HealthAddr.
+func (h *healthServer) setSession(s *ClientSession) {
+	if h == nil {
+		return
+	}
+	if s != nil {
+		h.sessions.Add(1)
+	}
+	h.session.Store(s)
+}
+
+// shutdown stops the health and metrics servers, letting in-flight requests finish
+func (h *healthServer) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), healthShutdownTimeout)
+	defer cancel()
+	for _, srv := range h.srvs {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("[-] Health server shutdown: %v", err)
+		}
+	}
+}
+
+// handleHealthz reports that the process is alive
+func (h *healthServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether a session is connected with a port assigned
+func (h *healthServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	s := h.session.Load()
+	if s == nil || !s.ready() {
+		http.Error(w, "not connected", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok: port %d\n", s.assignedPort())
+}
+
+// handleMetrics exposes the client metrics in the Prometheus text format
+func (h *healthServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	var connected, activeForwards, port int
+	if s := h.session.Load(); s != nil {
+		if s.ready() {
+			connected = 1
+		}
+		activeForwards, port = s.activeForwards(), s.assignedPort()
+	}
+	writeMetric(w, "pbp_tunnel_client_connected", "gauge", "Whether a session is connected with a port assigned.", connected)
+	writeMetric(w, "pbp_tunnel_client_reconnects_total", "counter", "Sessions established after the first one.", max(h.sessions.Load(), 1)-1)
+	writeMetric(w, "pbp_tunnel_client_active_forwards", "gauge", "Forwarded connections in flight in the current session.", activeForwards)
+	fmt.Fprintf(w, "# HELP pbp_tunnel_client_bytes_total Bytes relayed by forwarded connections, across sessions.\n# TYPE pbp_tunnel_client_bytes_total counter\n")
+	fmt.Fprintf(w, "pbp_tunnel_client_bytes_total{direction=\"to_local\"} %d\n", bytesToLocal.Load())
+	fmt.Fprintf(w, "pbp_tunnel_client_bytes_total{direction=\"to_server\"} %d\n", bytesToServer.Load())
+	writeMetric(w, "pbp_tunnel_client_assigned_port", "gauge", "Remote port assigned to the current session, 0 while disconnected.", port)
+	localDialLatency.writePrometheus(w, "pbp_tunnel_client_local_dial_latency_seconds", "Time the local service took to accept a forwarded connection.")
+}
+
+// writeMetric writes a single-sample metric in the Prometheus text format
+func writeMetric[T int | uint64](w io.Writer, name, kind, help string, value T) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+// basicAuth rejects requests without the given Basic credentials with 401.
+// Credentials are compared as SHA-256 digests in constant time, so neither
+// their content nor their length leaks through timing.
+func basicAuth(next http.Handler, user, pass string) http.Handler {
+	wantUser, wantPass := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(pass))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		gotUser, gotPass := sha256.Sum256([]byte(u)), sha256.Sum256([]byte(p))
+		userOK := subtle.ConstantTimeCompare(gotUser[:], wantUser[:])
+		passOK := subtle.ConstantTimeCompare(gotPass[:], wantPass[:])
+		if !ok || userOK&passOK != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pbp-tunnel"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// localDialLatencyBuckets are the upper bounds of the local dial latency
+// histogram buckets
+var localDialLatencyBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+// localDialLatency records how long the local service takes to accept
+// forwarded connections, across sessions
+var localDialLatency = newLatencyHistogram(localDialLatencyBuckets)
+
+// bytesToLocal and bytesToServer count the bytes relayed by forwards, across sessions
+var bytesToLocal, bytesToServer atomic.Uint64
+
+// countingWriter adds the number of bytes written to w to both session and total
+type countingWriter struct {
+	w       io.Writer
+	session *atomic.Uint64
+	total   *atomic.Uint64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.session.Add(uint64(n))
+	c.total.Add(uint64(n))
+	return n, err
+}
+
+// latencyHistogram counts durations into buckets with fixed upper bounds
+type latencyHistogram struct {
+	mu     sync.Mutex
+	bounds []time.Duration
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    time.Duration
+	count  uint64
+}
+
+// newLatencyHistogram returns an empty histogram with the given ascending bounds
+func newLatencyHistogram(bounds []time.Duration) *latencyHistogram {
+	return &latencyHistogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// observe records d in the first bucket whose bound is at least d
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += d
+	h.count++
+}
+
+// writePrometheus writes the histogram as name in the Prometheus text format,
+// in seconds
+func (h *latencyHistogram) writePrometheus(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum.Seconds(), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// GetMetrics returns the state of the session by metric name
+func (s *ClientSession) GetMetrics() map[string]interface{} {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	return map[string]interface{}{
+		"local_address":    s.LocalAddress,
+		"active":           s.Active,
+		"connection_count": s.ConnectionCount,
+		"assigned_port":    s.AssignedPort,
+		"public_url":       s.PublicURL,
+		"server_version":   s.ServerVersion,
+		"bytes_to_local":   s.BytesToLocal.Load(),
+		"bytes_to_server":  s.BytesToServer.Load(),
+	}
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/poweredbypump/pbp-tunnel/internal/config"
+)
+
+// targetFailCooldown is how long a local target that refused a forward is
+// skipped while healthier targets remain
+var targetFailCooldown = 10 * time.Second
+
+// targetPool spreads forwards over weighted local targets
+type targetPool struct {
+	mu      sync.Mutex
+	targets []poolTarget
+}
+
+// poolTarget is a local target of a targetPool; failedUntil is when its last
+// dial failure stops counting against it
+type poolTarget struct {
+	addr        string
+	weight      int
+	failedUntil time.Time
+}
+
+// newTargetPool returns a pool over targets, or nil when there are none
+func newTargetPool(targets []config.WeightedTarget) *targetPool {
+	if len(targets) == 0 {
+		return nil
+	}
+	p := &targetPool{targets: make([]poolTarget, len(targets))}
+	for i, t := range targets {
+		p.targets[i] = poolTarget{addr: t.Addr, weight: max(t.Weight, 1)}
+	}
+	return p
+}
+
+// pick returns a target not in tried by weighted random selection, preferring
+// targets that have not failed recently. It returns "" once all were tried.
+func (p *targetPool) pick(tried map[string]bool) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var healthy, untried []poolTarget
+	for _, t := range p.targets {
+		if tried[t.addr] {
+			continue
+		}
+		untried = append(untried, t)
+		if now.After(t.failedUntil) {
+			healthy = append(healthy, t)
+		}
+	}
+	if len(healthy) > 0 {
+		return pickWeighted(healthy)
+	}
+	if len(untried) > 0 {
+		return pickWeighted(untried)
+	}
+	return ""
+}
+
+// pickWeighted returns the address of one of targets, with a probability
+// proportional to its weight
+func pickWeighted(targets []poolTarget) string {
+	total := 0
+	for _, t := range targets {
+		total += t.weight
+	}
+	n := rand.IntN(total)
+	for _, t := range targets {
+		if n < t.weight {
+			return t.addr
+		}
+		n -= t.weight
+	}
+	return targets[len(targets)-1].addr
+}
+
+// markFailed skips addr for targetFailCooldown while other targets are healthy
+func (p *targetPool) markFailed(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.targets {
+		if p.targets[i].addr == addr {
+			p.targets[i].failedUntil = time.Now().Add(targetFailCooldown)
+		}
+	}
+}
+
+// dialLocalTargets connects forward id to one of s.targets, failing over to
+// the other targets, each tried once, when one cannot be reached
+func (s *ClientSession) dialLocalTargets(id int) (net.Conn, error) {
+	tried := make(map[string]bool)
+	var lastErr error
+	for addr := s.targets.pick(tried); addr != ""; addr = s.targets.pick(tried) {
+		tried[addr] = true
+		start := time.Now()
+		conn, err := dialLocal("tcp", addr)
+		if err == nil {
+			latency := time.Since(start)
+			localDialLatency.observe(latency)
+			log.Printf("[*] Local %s accepted forward #%d in %v", addr, id, latency)
+			return conn, nil
+		}
+		log.Printf("[-] Local target %s failed for forward #%d: %v", addr, id, err)
+		s.targets.markFailed(addr)
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// webhookAttempts is how many times a webhook call is tried before giving up
+const webhookAttempts = 3
+
+var (
+	// webhookRetryDelay is the pause between failed webhook attempts
+	webhookRetryDelay = 2 * time.Second
+	// webhookClient sends registration webhooks
+	webhookClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// RegistrationPayload tells a service registry where the tunnelled service is reachable
+type RegistrationPayload struct {
+	Endpoint string `json:"endpoint"`
+	Port     int    `json:"port"`
+	Label    string `json:"label"`
+}
+
+// notifyWebhook sends payload to url with method (POST to register, DELETE to deregister).
+// Failures are logged, never returned: the tunnel works without the registry.
+func notifyWebhook(method, url string, payload RegistrationPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[-] Webhook %s: encode payload: %v", method, err)
+		return
+	}
+
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		err = sendWebhook(method, url, body)
+		if err == nil {
+			log.Printf("[+] Webhook %s %s:%d succeeded", method, payload.Endpoint, payload.Port)
+			return
+		}
+		log.Printf("[-] Webhook %s failed (attempt %d/%d): %v", method, attempt, webhookAttempts, err)
+		if attempt < webhookAttempts {
+			time.Sleep(webhookRetryDelay)
+		}
+	}
+}
+
+// sendWebhook performs a single webhook request; any non-2xx status is an error
+func sendWebhook(method, url string, body []byte) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
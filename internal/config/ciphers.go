@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+
+	"golang.org/x/sys/cpu"
+)
+
+// SSH cipher names, as negotiated by golang.org/x/crypto/ssh
+const (
+	CipherAES128GCM        = "aes128-gcm@openssh.com"
+	CipherAES256GCM        = "aes256-gcm@openssh.com"
+	CipherChaCha20Poly1305 = "chacha20-poly1305@openssh.com"
+	CipherAES128CTR        = "aes128-ctr"
+	CipherAES192CTR        = "aes192-ctr"
+	CipherAES256CTR        = "aes256-ctr"
+)
+
+// SupportedCiphers lists the ciphers accepted in Ciphers
+var SupportedCiphers = []string{
+	CipherAES128GCM, CipherAES256GCM, CipherChaCha20Poly1305,
+	CipherAES128CTR, CipherAES192CTR, CipherAES256CTR,
+}
+
+// aesHardware reports whether the CPU accelerates AES-GCM, checked the way
+// crypto/tls does it. Without it ChaCha20-Poly1305 is several times faster.
+var aesHardware = (cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ) ||
+	(cpu.ARM64.HasAES && cpu.ARM64.HasPMULL) ||
+	(cpu.S390X.HasAES && cpu.S390X.HasAESCTR && cpu.S390X.HasGHASH) ||
+	runtime.GOARCH == "ppc64le"
+
+// DefaultCiphers returns the ciphers offered when Ciphers is empty: the AEAD
+// ciphers first, ChaCha20-Poly1305 leading them on CPUs without AES
+// acceleration, then AES-CTR for older peers
+func DefaultCiphers() []string {
+	if aesHardware {
+		return slices.Clone(SupportedCiphers)
+	}
+	return []string{
+		CipherChaCha20Poly1305, CipherAES128GCM, CipherAES256GCM,
+		CipherAES128CTR, CipherAES192CTR, CipherAES256CTR,
+	}
+}
+
+// ciphersOrDefault returns ciphers, or DefaultCiphers when it is empty
+func ciphersOrDefault(ciphers []string) []string {
+	if len(ciphers) == 0 {
+		return DefaultCiphers()
+	}
+	return ciphers
+}
+
+// validateCiphers rejects ciphers missing from SupportedCiphers
+func validateCiphers(ciphers []string) error {
+	for _, c := range ciphers {
+		if !slices.Contains(SupportedCiphers, c) {
+			return fmt.Errorf("ciphers: unsupported cipher %q", c)
+		}
+	}
+	return nil
+}
@@ -1,66 +1,238 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/poweredbypump/pbp-tunnel/internal/protocol"
 	"github.com/poweredbypump/pbp-tunnel/internal/util"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const DefaultEndpointPort int = 52135
 
 const (
-	CpKeyEndpoint       string = "endpoint"
-	CpKeyEndpointPort   string = "port"
-	CpKeyUsername       string = "username"
-	CpKeyPassword       string = "password"
-	CpKeyPrivateKeyPath string = "identity"
-	CpKeyHostKeyPath    string = "host-key"
-	CpKeyLocalHost      string = "local-host"
-	CpKeyLocalPort      string = "local-port"
-	CpKeyRemoteHost     string = "remote-host"
-	CpKeyRemotePort     string = "remote-port"
-	CpKeyHostKeyLevel   string = "host-key-level"
-	CpKeyAllowedIPs     string = "allowed-ips"
-
-	CpDefaultEndpoint       string = ""
-	CpDefaultEndpointPort          = DefaultEndpointPort
-	CpDefaultUsername       string = ""
-	CpDefaultPassword       string = ""
-	CpDefaultPrivateKeyPath string = ""
-	CpDefaultHostKeyPath    string = ""
-	CpDefaultLocalHost      string = "localhost"
-	CpDefaultLocalPort      int    = 80
-	CpDefaultRemoteHost     string = "localhost"
-	CpDefaultRemotePort     int    = 0
-	CpDefaultHostKeyLevel   int    = 2
-
-	SpKeyBindAddress        string = "bind"
-	SpKeyBindPort           string = "port"
-	SpKeyPortRangeStart     string = "port-range-start"
-	SpKeyPortRangeEnd       string = "port-range-end"
-	SpKeyUsername           string = "username"
-	SpKeyPassword           string = "password"
-	SpKeyPrivateRsaPath     string = "private-rsa-path"
-	SpKeyPrivateEcdsaPath   string = "private-ecdsa-path"
-	SpKeyPrivateEd25519Path string = "private-ed25519-path"
-	SpKeyAuthorizedKeysPath string = "authorized-keys-path"
-	SpKeyAllowedIPS         string = "allowed-ips"
-
-	SpDefaultBindAddress    string = "0.0.0.0"
-	SpDefaultBindPort       int    = DefaultEndpointPort
-	SpDefaultPortRangeStart int    = 49152
-	SpDefaultPortRangeEnd   int    = 65535
-	SpDefaultUsername       string = ""
-	SpDefaultPassword       string = ""
-	SpDefaultPrivateRsa     string = "id_rsa"
-	SpDefaultPrivateEcdsa   string = ""
-	SpDefaultPrivateEd25519 string = ""
-	SpDefaultAuthorizedKeys string = ""
+	CpKeyEndpoint          string = "endpoint"
+	CpKeyEndpointPort      string = "port"
+	CpKeyUsername          string = "username"
+	CpKeyPassword          string = "password"
+	CpKeyPrivateKeyPath    string = "identity"
+	CpKeyCertificatePath   string = "certificate"
+	CpKeyHostKeyPath       string = "host-key"
+	CpKeyLocalHost         string = "local-host"
+	CpKeyLocalPort         string = "local-port"
+	CpKeyLocalFallbacks    string = "local-port-fallbacks"
+	CpKeyRemoteHost        string = "remote-host"
+	CpKeyRemotePort        string = "remote-port"
+	CpKeyHostKeyLevel      string = "host-key-level"
+	CpKeyAllowedIPs        string = "allowed-ips"
+	CpKeyRekeyThreshold    string = "rekey-threshold"
+	CpKeyCiphers           string = "ciphers"
+	CpKeyFixedPortFailFast string = "fixed-port-fail-fast"
+	CpKeyMaxRetries        string = "max-retries"
+	CpKeyLocalTargetFile   string = "local-target-file"
+	CpKeyHealthAddr        string = "health-addr"
+	CpKeyMetricsAddr       string = "metrics-addr"
+	CpKeyConnectTimeout    string = "connect-timeout"
+	CpKeyLogConfig         string = "log-config"
+	CpKeyRegisterWebhook   string = "register-webhook"
+	CpKeyRegisterLabel     string = "register-label"
+	CpKeyPortOutputFile    string = "port-output-file"
+	CpKeyLocalTLS          string = "local-tls"
+	CpKeyLocalTLSServer    string = "local-tls-server-name"
+	CpKeyLocalTLSCA        string = "local-tls-ca"
+	CpKeyLocalTLSInsecure  string = "local-tls-insecure"
+	CpKeyLocalDialRetries  string = "local-dial-retries"
+	CpKeyLocalDialInterval string = "local-dial-retry-interval"
+	CpKeyMetricsAuthUser   string = "metrics-auth-user"
+	CpKeyMetricsAuthPass   string = "metrics-auth-pass"
+	CpKeyStartupSplay      string = "startup-splay"
+	CpKeyMinSessionTime    string = "min-session-duration"
+	CpKeyMaxForwards       string = "max-concurrent-forwards"
+	CpKeyTCPNoDelay        string = "tcp-nodelay"
+	CpKeyMaxClockSkew      string = "max-clock-skew"
+	CpKeySocketReadBuffer  string = "socket-read-buffer"
+	CpKeySocketWriteBuffer string = "socket-write-buffer"
+	CpKeyPreferredAuth     string = "preferred-auth"
+	CpKeyRetryBudget       string = "retry-budget"
+
+	CpDefaultEndpoint          string = ""
+	CpDefaultEndpointPort             = DefaultEndpointPort
+	CpDefaultUsername          string = ""
+	CpDefaultPassword          string = ""
+	CpDefaultPrivateKeyPath    string = ""
+	CpDefaultCertificatePath   string = ""
+	CpDefaultHostKeyPath       string = ""
+	CpDefaultLocalHost         string = "localhost"
+	CpDefaultLocalPort         int    = 80
+	CpDefaultRemoteHost        string = ""
+	CpDefaultRemotePort        int    = 0
+	CpDefaultHostKeyLevel      int    = 2
+	CpDefaultRekeyThreshold    uint64 = 0
+	CpDefaultFixedPortFailFast bool   = false
+	CpDefaultMaxRetries        int    = 5
+	CpDefaultLocalTargetFile   string = ""
+	CpDefaultHealthAddr        string = ""
+	CpDefaultMetricsAddr       string = ""
+	CpDefaultConnectTimeout           = Duration(10 * time.Second)
+	CpDefaultLogConfig         bool   = true
+	CpDefaultRegisterWebhook   string = ""
+	CpDefaultRegisterLabel     string = ""
+	CpDefaultPortOutputFile    string = ""
+	CpDefaultLocalTLS          bool   = false
+	CpDefaultLocalTLSServer    string = ""
+	CpDefaultLocalTLSCA        string = ""
+	CpDefaultLocalTLSInsecure  bool   = false
+	CpDefaultLocalDialRetries  int    = 0
+	CpDefaultLocalDialInterval        = Duration(250 * time.Millisecond)
+	CpDefaultMetricsAuthUser   string = ""
+	CpDefaultMetricsAuthPass   string = ""
+	CpDefaultStartupSplay             = Duration(0)
+	CpDefaultMinSessionTime           = Duration(10 * time.Second)
+	CpDefaultMaxForwards       int    = 0
+	CpDefaultTCPNoDelay        bool   = true
+	CpDefaultMaxClockSkew             = Duration(0)
+	CpDefaultSocketReadBuffer  int    = 0
+	CpDefaultSocketWriteBuffer int    = 0
+	CpDefaultPreferredAuth     string = "auto"
+	CpDefaultRetryBudget       int    = 0
+
+	// MaxLocalDialRetries and MaxLocalDialInterval bound how long a forward
+	// may wait for the local service before the remote peer is dropped
+	MaxLocalDialRetries  int      = 10
+	MaxLocalDialInterval Duration = Duration(2 * time.Second)
+
+	// MaxSocketBuffer bounds the socket buffer sizes requested for SSH connections
+	MaxSocketBuffer int = 64 << 20
+
+	SpKeyBindAddress               string = "bind"
+	SpKeyBindPort                  string = "port"
+	SpKeyListenNetwork             string = "listen-network"
+	SpKeyPortRangeStart            string = "port-range-start"
+	SpKeyPortRangeEnd              string = "port-range-end"
+	SpKeyStablePortByUser          string = "stable-port-by-user"
+	SpKeyRequireExplicitPort       string = "require-explicit-port"
+	SpKeyPublicBaseURL             string = "public-base-url"
+	SpKeyUsername                  string = "username"
+	SpKeyPassword                  string = "password"
+	SpKeyPasswordHash              string = "password-hash"
+	SpKeyPrivateRsaPath            string = "private-rsa-path"
+	SpKeyPrivateEcdsaPath          string = "private-ecdsa-path"
+	SpKeyPrivateEd25519Path        string = "private-ed25519-path"
+	SpKeyAuthorizedKeysPath        string = "authorized-keys-path"
+	SpKeyTrustedUserCAKeys         string = "trusted-user-ca-keys"
+	SpKeyAuthorizedKeysRefresh     string = "authorized-keys-refresh"
+	SpKeyAllowInsecureKeysURL      string = "allow-insecure-keys-url"
+	SpKeyAuthCommand               string = "auth-command"
+	SpKeyAllowedIPS                string = "allowed-ips"
+	SpKeyAllowedBindHosts          string = "allowed-bind-hosts"
+	SpKeyDeniedIPs                 string = "denied-ips"
+	SpKeyAllowClientWhitelistWiden string = "allow-client-whitelist-widen"
+	SpKeyForwardBindByUser         string = "forward-bind-by-user"
+	SpKeyPortPools                 string = "port-pools"
+	SpKeyUserPoolMap               string = "user-pool-map"
+	SpKeyRekeyThreshold            string = "rekey-threshold"
+	SpKeyCiphers                   string = "ciphers"
+	SpKeyPortReleaseGrace          string = "port-release-grace"
+	SpKeyWarmupPeriod              string = "warmup-period"
+	SpKeyStateFilePath             string = "state-file"
+	SpKeyMaxConnsPerForward        string = "max-conns-per-forward"
+	SpKeyMaxPortsPerIP             string = "max-ports-per-ip"
+	SpKeyHighWaterForwards         string = "high-water-forwards"
+	SpKeyLowWaterForwards          string = "low-water-forwards"
+	SpKeyHighWaterHeapBytes        string = "high-water-heap-bytes"
+	SpKeyForwardBufferBytes        string = "forward-buffer-bytes"
+	SpKeyProtocolPeekBytes         string = "protocol-peek-bytes"
+	SpKeyHTTPAccessLog             string = "http-access-log"
+	SpKeySessionByteQuota          string = "session-byte-quota"
+	SpKeyNodeName                  string = "node-name"
+	SpKeyRunAsUser                 string = "run-as-user"
+	SpKeyRunAsGroup                string = "run-as-group"
+	SpKeyPidFile                   string = "pid-file"
+	SpKeyConfigWatchInterval       string = "config-watch-interval"
+	SpKeyMinClientProtocol         string = "min-client-protocol"
+	SpKeyTolerateExtraChannels     string = "tolerate-extra-channels"
+	SpKeyAllowPortSharing          string = "allow-port-sharing"
+	SpKeyLogSampleRate             string = "log-sample-rate"
+	SpKeyMaxWhitelistEntriesTotal  string = "max-whitelist-entries-total"
+	SpKeyMaxWhitelistCount         string = "max-whitelist-count"
+	SpKeyMaxUptime                 string = "max-uptime"
+	SpKeyMaxConnDuration           string = "max-conn-duration"
+	SpKeyTCPNoDelay                string = "tcp-nodelay"
+	SpKeySocketReadBuffer          string = "socket-read-buffer"
+	SpKeySocketWriteBuffer         string = "socket-write-buffer"
+	SpKeyMaxConnectionAge          string = "max-connection-age"
+
+	SpDefaultBindAddress               string   = "0.0.0.0"
+	SpDefaultBindPort                  int      = DefaultEndpointPort
+	SpDefaultListenNetwork             string   = "tcp"
+	SpDefaultPortRangeStart            int      = 49152
+	SpDefaultPortRangeEnd              int      = 65535
+	SpDefaultStablePortByUser          bool     = false
+	SpDefaultRequireExplicitPort       bool     = false
+	SpDefaultPublicBaseURL             string   = ""
+	SpDefaultUsername                  string   = ""
+	SpDefaultPassword                  string   = ""
+	SpDefaultPasswordHash              string   = ""
+	SpDefaultPrivateRsa                string   = "id_rsa"
+	SpDefaultPrivateEcdsa              string   = ""
+	SpDefaultPrivateEd25519            string   = ""
+	SpDefaultAuthorizedKeys            string   = ""
+	SpDefaultTrustedUserCAKeys         string   = ""
+	SpDefaultAuthorizedKeysRefresh     Duration = 0
+	SpDefaultAllowInsecureKeysURL      bool     = false
+	SpDefaultAuthCommand               string   = ""
+	SpDefaultRekeyThreshold            uint64   = 0
+	SpDefaultPortReleaseGrace          Duration = 0
+	SpDefaultWarmupPeriod              Duration = 0
+	SpDefaultStateFilePath             string   = ""
+	SpDefaultMaxConnsPerForward        int      = 0
+	SpDefaultMaxPortsPerIP             int      = 0
+	SpDefaultHighWaterForwards         int      = 0
+	SpDefaultLowWaterForwards          int      = 0
+	SpDefaultHighWaterHeapBytes        uint64   = 0
+	SpDefaultForwardBufferBytes        int      = 0
+	SpDefaultProtocolPeekBytes         int      = 0
+	SpDefaultHTTPAccessLog             bool     = false
+	SpDefaultSessionByteQuota          uint64   = 0
+	SpDefaultNodeName                  string   = ""
+	SpDefaultRunAsUser                 string   = ""
+	SpDefaultRunAsGroup                string   = ""
+	SpDefaultPidFile                   string   = ""
+	SpDefaultConfigWatchInterval       Duration = 0
+	SpDefaultAllowClientWhitelistWiden bool     = false
+	SpDefaultMinClientProtocol         int      = 0
+	SpDefaultTolerateExtraChannels     bool     = false
+	SpDefaultAllowPortSharing          bool     = false
+	SpDefaultLogSampleRate             float64  = 0
+	SpDefaultMaxWhitelistEntriesTotal  int      = 0
+	SpDefaultMaxWhitelistCount         int      = 0
+	SpDefaultMaxUptime                 Duration = 0
+	SpDefaultMaxConnDuration           Duration = 0
+	SpDefaultTCPNoDelay                bool     = true
+	SpDefaultSocketReadBuffer          int      = 0
+	SpDefaultSocketWriteBuffer         int      = 0
+	SpDefaultMaxConnectionAge          Duration = 0
 )
 
+// Bounds for a non-zero SSH rekey threshold, in bytes.
+// Zero keeps the golang.org/x/crypto/ssh default.
+const (
+	MinRekeyThreshold uint64 = 1 << 20 // 1 MiB
+	MaxRekeyThreshold uint64 = 1 << 40 // 1 TiB
+)
+
+// MaxProtocolPeekBytes bounds the bytes read ahead of a forwarded connection for protocol detection
+const MaxProtocolPeekBytes = 64 << 10
+
 // StringArray is a flag.Stringer implementation for multiple values
 // used for JSON unmarshalling and environment parsing
 // Represents a list of IPs allowed for forwarding
@@ -76,6 +248,138 @@ func (s *StringArray) Set(value string) error {
 	return nil
 }
 
+// IntArray is a flag.Value holding a list of integers, given as
+// comma-separated values (e.g. "8081,8082")
+type IntArray []int
+
+func (a *IntArray) String() string {
+	parts := make([]string, len(*a))
+	for i, n := range *a {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (a *IntArray) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", part)
+		}
+		*a = append(*a, n)
+	}
+	return nil
+}
+
+// StringMap is a flag.Value holding key=value pairs, given as
+// comma-separated entries (e.g. "alice=10.0.0.1,bob=10.0.0.2")
+type StringMap map[string]string
+
+func (m *StringMap) String() string {
+	keys := make([]string, 0, len(*m))
+	for k := range *m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + (*m)[k]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *StringMap) Set(value string) error {
+	if *m == nil {
+		*m = make(StringMap)
+	}
+	for _, pair := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			return fmt.Errorf("invalid entry %q, expected key=value", pair)
+		}
+		(*m)[k] = v
+	}
+	return nil
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// PortPoolMap is a flag.Value holding named port ranges, given as
+// comma-separated entries (e.g. "team-a=50000-50099,team-b=50100-50199")
+type PortPoolMap map[string]PortRange
+
+func (m *PortPoolMap) String() string {
+	names := make([]string, 0, len(*m))
+	for name := range *m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		r := (*m)[name]
+		pairs[i] = fmt.Sprintf("%s=%d-%d", name, r.Start, r.End)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *PortPoolMap) Set(value string) error {
+	if *m == nil {
+		*m = make(PortPoolMap)
+	}
+	for _, pair := range strings.Split(value, ",") {
+		name, ports, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		start, end, dash := strings.Cut(strings.TrimSpace(ports), "-")
+		s, serr := strconv.Atoi(start)
+		e, eerr := strconv.Atoi(end)
+		if !ok || !dash || name == "" || serr != nil || eerr != nil {
+			return fmt.Errorf("invalid entry %q, expected name=start-end", pair)
+		}
+		(*m)[name] = PortRange{Start: s, End: e}
+	}
+	return nil
+}
+
+// Duration is a time.Duration usable as a flag value and encoded in JSON as a
+// string such as "30s" or "1m30s". Plain JSON numbers are read as seconds.
+type Duration time.Duration
+
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(value string) error {
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return d.Set(value)
+}
+
 // AppConfig is the root JSON structure for full config files
 // Type indicates "client" or "server"
 type AppConfig struct {
@@ -87,19 +391,138 @@ type AppConfig struct {
 // ClientParameters holds configuration for the SSH client
 // Fields may be set via JSON file or environment variables
 // Endpoint and EndpointPort specify the SSH server to connect to
+// CertificatePath is an SSH user certificate (*-cert.pub) presented with the PrivateKeyPath key
+// Ciphers lists the SSH ciphers offered, in order of preference (empty = DefaultCiphers)
+// PreferredAuth orders the auth methods when both Password and PrivateKeyPath are set: key, password
+// or auto, which offers the password first (empty = CpDefaultPreferredAuth)
+// RemoteHost asks the server to bind the forwarded port on this host, which the server
+// must list in its AllowedBindHosts (empty = the server's bind address)
+// FixedPortFailFast stops retrying when the requested RemotePort is taken
+// LocalTargetFile holds host:port of the local service, re-read on every session (overrides LocalHost/LocalPort)
+// LocalPortFallbacks are tried in order on the local host when the local service refuses a forward
+// LocalTargets spread forwards over several local services by weight (empty = LocalHost/LocalPort)
+// MaxRetries bounds consecutive connection attempts (0 = CpDefaultMaxRetries)
+// RetryBudget bounds reconnects across sessions: each takes one of this many tokens, which come back one per
+// minute, and the client gives up once none is left (0 = unlimited)
+// ConnectTimeout bounds the TCP dial and the SSH handshake (0 = CpDefaultConnectTimeout)
+// StartupSplay delays the first connection attempt by a random duration below it, spreading a fleet rollout
+// MinSessionDuration: sessions ending sooner count as failures and back off reconnects (0 = CpDefaultMinSessionTime)
+// HealthAddr serves /healthz and /readyz for liveness and readiness probes, and /metrics
+// MetricsAddr serves /metrics alone, in the Prometheus text format
+// MetricsAuthUser/MetricsAuthPass require HTTP Basic auth on the HealthAddr and MetricsAddr endpoints when set
+// RegisterWebhook is notified of the assigned port, labelled with RegisterLabel
+// PortOutputFile receives the assigned port as plain text for the duration of each session
+// LogConfig logs a redacted summary of the configuration at startup (nil = CpDefaultLogConfig)
+// LocalTLS dials the local service over TLS, verified against LocalTLSServerName (default LocalHost)
+// and LocalTLSCA (default system roots) unless LocalTLSInsecure is set
+// LocalDialRetries redials a refusing local service up to this many times, LocalDialInterval apart
+// (0 = CpDefaultLocalDialInterval)
+// MaxConcurrentForwards rejects forwards from the server beyond this many in flight (0 = unlimited)
+// TCPNoDelay sets TCP_NODELAY on connections to the local service (nil = Go default, on)
+// MaxClockSkew logs a warning when the server clock differs from the local one by more than this (0 = no check)
+// SocketReadBuffer/SocketWriteBuffer size the socket buffers of the SSH connection, in bytes (0 = OS default)
 type ClientParameters struct {
-	Endpoint       string      `json:"endpoint,omitempty"`
-	EndpointPort   int         `json:"port,omitempty"`
-	Username       string      `json:"username,omitempty"`
-	Password       string      `json:"password,omitempty"`
-	PrivateKeyPath string      `json:"identity,omitempty"`
-	HostKeyPath    string      `json:"host_key,omitempty"`
-	LocalHost      string      `json:"local_host,omitempty"`
-	LocalPort      int         `json:"local_port,omitempty"`
-	RemoteHost     string      `json:"remote_host,omitempty"`
-	RemotePort     int         `json:"remote_port,omitempty"`
-	HostKeyLevel   int         `json:"host_key_level,omitempty"`
-	AllowedIPs     StringArray `json:"allowed_ips,omitempty"`
+	Endpoint              string           `json:"endpoint,omitempty"`
+	EndpointPort          int              `json:"port,omitempty"`
+	Username              string           `json:"username,omitempty"`
+	Password              string           `json:"password,omitempty"`
+	PrivateKeyPath        string           `json:"identity,omitempty"`
+	CertificatePath       string           `json:"certificate,omitempty"`
+	PreferredAuth         string           `json:"preferred_auth,omitempty"`
+	HostKeyPath           string           `json:"host_key,omitempty"`
+	LocalHost             string           `json:"local_host,omitempty"`
+	LocalPort             int              `json:"local_port,omitempty"`
+	LocalPortFallbacks    IntArray         `json:"local_port_fallbacks,omitempty"`
+	LocalTargets          []WeightedTarget `json:"local_targets,omitempty"`
+	LocalTargetFile       string           `json:"local_target_file,omitempty"`
+	RemoteHost            string           `json:"remote_host,omitempty"`
+	RemotePort            int              `json:"remote_port,omitempty"`
+	HostKeyLevel          int              `json:"host_key_level,omitempty"`
+	AllowedIPs            StringArray      `json:"allowed_ips,omitempty"`
+	RekeyThreshold        uint64           `json:"rekey_threshold,omitempty"`
+	Ciphers               StringArray      `json:"ciphers,omitempty"`
+	FixedPortFailFast     bool             `json:"fixed_port_fail_fast,omitempty"`
+	MaxRetries            int              `json:"max_retries,omitempty"`
+	RetryBudget           int              `json:"retry_budget,omitempty"`
+	ConnectTimeout        Duration         `json:"connect_timeout,omitempty"`
+	LogConfig             *bool            `json:"log_config,omitempty"`
+	HealthAddr            string           `json:"health_addr,omitempty"`
+	MetricsAddr           string           `json:"metrics_addr,omitempty"`
+	RegisterWebhook       string           `json:"register_webhook,omitempty"`
+	RegisterLabel         string           `json:"register_label,omitempty"`
+	PortOutputFile        string           `json:"port_output_file,omitempty"`
+	LocalTLS              bool             `json:"local_tls,omitempty"`
+	LocalTLSServerName    string           `json:"local_tls_server_name,omitempty"`
+	LocalTLSCA            string           `json:"local_tls_ca,omitempty"`
+	LocalTLSInsecure      bool             `json:"local_tls_insecure,omitempty"`
+	LocalDialRetries      int              `json:"local_dial_retries,omitempty"`
+	LocalDialInterval     Duration         `json:"local_dial_retry_interval,omitempty"`
+	MetricsAuthUser       string           `json:"metrics_auth_user,omitempty"`
+	MetricsAuthPass       string           `json:"metrics_auth_pass,omitempty"`
+	StartupSplay          Duration         `json:"startup_splay,omitempty"`
+	MinSessionDuration    Duration         `json:"min_session_duration,omitempty"`
+	MaxConcurrentForwards int              `json:"max_concurrent_forwards,omitempty"`
+	TCPNoDelay            *bool            `json:"tcp_nodelay,omitempty"`
+	MaxClockSkew          Duration         `json:"max_clock_skew,omitempty"`
+	SocketReadBuffer      int              `json:"socket_read_buffer,omitempty"`
+	SocketWriteBuffer     int              `json:"socket_write_buffer,omitempty"`
+}
+
+// WeightedTarget is one local service of LocalTargets. Each forward picks a
+// target with a probability proportional to its Weight (0 = 1).
+type WeightedTarget struct {
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// redactedSecret replaces secret values in redacted copies
+const redactedSecret = "[redacted]"
+
+// Redacted returns a copy of the parameters with secrets masked, safe to log
+func (cp *ClientParameters) Redacted() ClientParameters {
+	redacted := *cp
+	if redacted.Password != "" {
+		redacted.Password = redactedSecret
+	}
+	if redacted.MetricsAuthPass != "" {
+		redacted.MetricsAuthPass = redactedSecret
+	}
+	redacted.AllowedIPs = append(StringArray(nil), cp.AllowedIPs...)
+	redacted.LocalTargets = append([]WeightedTarget(nil), cp.LocalTargets...)
+	return redacted
+}
+
+// ShouldLogConfig reports whether the configuration summary is logged at startup
+func (cp *ClientParameters) ShouldLogConfig() bool {
+	if cp.LogConfig == nil {
+		return CpDefaultLogConfig
+	}
+	return *cp.LogConfig
+}
+
+// Summary describes the effective configuration on one line, without secrets
+func (cp *ClientParameters) Summary() string {
+	r := cp.Redacted()
+
+	var auth []string
+	if r.Password != "" {
+		auth = append(auth, "password")
+	}
+	if r.PrivateKeyPath != "" {
+		auth = append(auth, "key "+r.PrivateKeyPath)
+	}
+	if r.CertificatePath != "" {
+		auth = append(auth, "cert "+r.CertificatePath)
+	}
+	hostKey := r.HostKeyPath
+	if hostKey == "" {
+		hostKey = "none"
+	}
+
+	return fmt.Sprintf("endpoint=%s:%d user=%s auth=%s local=%s:%d remote=%s:%d whitelist=%d host_key=%s host_key_level=%d",
+		r.Endpoint, r.EndpointPort, r.Username, strings.Join(auth, "+"),
+		r.LocalHost, r.LocalPort, r.RemoteHost, r.RemotePort,
+		len(r.AllowedIPs), hostKey, r.HostKeyLevel)
 }
 
 // Validate ensures the ClientParameters contains all required fields and valid values
@@ -116,42 +539,255 @@ func (cp *ClientParameters) Validate() error {
 	if cp.PrivateKeyPath == "" && cp.Password == "" {
 		return fmt.Errorf("either private_key or password must be set")
 	}
+	if cp.CertificatePath != "" && cp.PrivateKeyPath == "" {
+		return fmt.Errorf("certificate requires private_key")
+	}
+	switch cp.PreferredAuth {
+	case "", "auto", "key", "password":
+	default:
+		return fmt.Errorf("preferred_auth must be key, password or auto")
+	}
 	if cp.LocalHost == "" {
 		return fmt.Errorf("local_host is required")
 	}
 	if cp.LocalPort <= 0 || cp.LocalPort > 65535 {
 		return fmt.Errorf("local_port must be between 1 and 65535")
 	}
-	if cp.RemoteHost == "" {
-		return fmt.Errorf("remote_host is required")
+	for _, p := range cp.LocalPortFallbacks {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("local_port_fallbacks must be between 1 and 65535")
+		}
+	}
+	for i, t := range cp.LocalTargets {
+		_, port, err := net.SplitHostPort(t.Addr)
+		if n, perr := strconv.Atoi(port); err != nil || perr != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("local_targets[%d]: addr must be host:port", i)
+		}
+		if t.Weight < 0 {
+			return fmt.Errorf("local_targets[%d]: weight must not be negative", i)
+		}
+	}
+	if cp.RemoteHost != "" {
+		if _, _, err := net.SplitHostPort(cp.RemoteHost); err == nil || strings.ContainsAny(cp.RemoteHost, " /") {
+			return fmt.Errorf("remote_host must be a host name or IP without a port")
+		}
 	}
 	if cp.RemotePort < 0 || cp.RemotePort > 65535 {
 		return fmt.Errorf("remote_port must be between 0 and 65535")
 	}
+	if err := validateRekeyThreshold(cp.RekeyThreshold); err != nil {
+		return err
+	}
+	if err := validateCiphers(cp.Ciphers); err != nil {
+		return err
+	}
+	if cp.ConnectTimeout < 0 {
+		return fmt.Errorf("connect_timeout must not be negative")
+	}
+	if cp.MaxRetries < 0 {
+		return fmt.Errorf("max_retries must not be negative")
+	}
+	if cp.RetryBudget < 0 {
+		return fmt.Errorf("retry_budget must not be negative")
+	}
+	if cp.StartupSplay < 0 {
+		return fmt.Errorf("startup_splay must not be negative")
+	}
+	if cp.MinSessionDuration < 0 {
+		return fmt.Errorf("min_session_duration must not be negative")
+	}
+	if cp.MaxClockSkew < 0 {
+		return fmt.Errorf("max_clock_skew must not be negative")
+	}
+	if err := validateSocketBuffers(cp.SocketReadBuffer, cp.SocketWriteBuffer); err != nil {
+		return err
+	}
+	if cp.MaxConcurrentForwards < 0 {
+		return fmt.Errorf("max_concurrent_forwards must not be negative")
+	}
+	if cp.LocalDialRetries < 0 || cp.LocalDialRetries > MaxLocalDialRetries {
+		return fmt.Errorf("local_dial_retries must be between 0 and %d", MaxLocalDialRetries)
+	}
+	if cp.LocalDialInterval < 0 || cp.LocalDialInterval > MaxLocalDialInterval {
+		return fmt.Errorf("local_dial_retry_interval must be between 0 and %v", time.Duration(MaxLocalDialInterval))
+	}
+	if cp.RegisterWebhook != "" {
+		if u, err := url.Parse(cp.RegisterWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("register_webhook must be an http or https URL")
+		}
+	}
+	if cp.MetricsAddr != "" && cp.MetricsAddr == cp.HealthAddr {
+		return fmt.Errorf("metrics_addr must differ from health_addr, which serves /metrics too")
+	}
+	if (cp.MetricsAuthUser == "") != (cp.MetricsAuthPass == "") {
+		return fmt.Errorf("metrics_auth_user and metrics_auth_pass must be set together")
+	}
+	if !cp.LocalTLS && (cp.LocalTLSServerName != "" || cp.LocalTLSCA != "" || cp.LocalTLSInsecure) {
+		return fmt.Errorf("local_tls_server_name, local_tls_ca and local_tls_insecure require local_tls")
+	}
 	return nil
 }
 
 // ServerParameters holds configuration for the SSH server
-// BindAddress and BindPort specify where forwarded connections land
+// BindAddress and BindPort specify where forwarded connections land (BindPort 0 = picked by the OS)
+// ListenNetwork is the network of the SSH and forward listeners: tcp, tcp4 or tcp6 (empty = SpDefaultListenNetwork)
 // PortRangeStart/End restrict which ports may be assigned
+// StablePortByUser gives clients requesting port 0 a port derived from their username, when free
+// PortPools partition PortRangeStart/End into named, non-overlapping ranges; UserPoolMap assigns SSH users
+// to a pool by name, and their ports are taken from it instead of the whole range
+// RequireExplicitPort refuses clients requesting port 0 instead of picking a port for them
+// PublicBaseURL is where clients are told their port is reachable, with {port} replaced by the
+// assigned port (e.g. https://service.example.com:{port})
 // Multiple host key files may be provided
 // AllowedIPs lists source IPs permitted to use the reverse tunnel
-// AuthorizedKeysPath specifies the path to client public keys
+// DeniedIPs lists source IPs always rejected, even when AllowedIPs matches them
+// Forward peers must match both AllowedIPs and the client whitelist, unless
+// AllowClientWhitelistWiden lets the client whitelist replace AllowedIPs
+// AllowedBindHosts lists the hosts a client may request through its RemoteHost;
+// when empty, requested hosts are ignored
+// ForwardBindByUser overrides BindAddress for the forwarded ports of specific SSH users
+// Ciphers lists the SSH ciphers accepted, in order of preference (empty = DefaultCiphers)
+// AuthorizedKeysPath specifies the path to client public keys, or an http(s) URL serving them
+// AuthorizedKeysRefresh reloads the authorized keys, files and URLs alike, this often (0 = at startup only)
+// AllowInsecureKeysURL accepts keys served at plain http:// URLs, which anyone on the path can replace
+// TrustedUserCAKeys lists CA public keys whose user certificates are accepted, in authorized_keys format
 // Username/Password define SSH login credentials
+// PasswordHash is a bcrypt hash of the password, set instead of Password to keep it out of plaintext
+// Users lists further SSH accounts, each with its own bcrypt password hash and/or authorized keys
+// AuthCommand validates passwords instead: it is run with the username in PBP_TUNNEL_AUTH_USER
+// and the password on stdin, exit status 0 accepting the login
 // PrivateRsaPath, PrivateEcdsaPath, PrivateEd25519Path are host key files
+// PortReleaseGrace keeps a disconnected client's port reserved for a quick reconnect
+// WarmupPeriod asks clients to retry their port request for this long after startup
+// MaxConnsPerForward caps concurrent connections per assigned port; further ones queue
+// MaxPortsPerIP caps the ports held at once by the clients of one source IP, backups included (0 = unlimited)
+// HighWaterForwards sheds load once this many ports are assigned: new forwards are refused with a retryable
+// code until the assigned ports drop to LowWaterForwards (0 = disabled; LowWaterForwards 0 = 90% of it)
+// HighWaterHeapBytes sheds load the same way while the Go heap is over this size, until it drops below 90% of it
+// (0 = disabled)
+// MaxConnDuration closes a forwarded connection once it has been open this long, active or not (0 = unlimited)
+// TCPNoDelay sets TCP_NODELAY on accepted forwarded connections (nil = Go default, on)
+// SocketReadBuffer/SocketWriteBuffer size the socket buffers of accepted SSH connections, in bytes (0 = OS default)
+// MaxConnectionAge recycles a client SSH connection once it is this old: its port stops accepting,
+// open forwards get a grace period to finish, then the connection is closed and the client reconnects (0 = unlimited)
+// ForwardBufferBytes buffers service -> client data per connection to absorb short client stalls
+// ProtocolPeekBytes reads up to this many bytes of each forwarded connection to detect its protocol
+// (HTTP, TLS or raw TCP), then replays them to the client (0 = disabled)
+// HTTPAccessLog logs a Common Log Format line for each forwarded connection detected as HTTP,
+// from its first request line; it requires ProtocolPeekBytes
+// SessionByteQuota closes an SSH connection once its forwards relayed this many bytes in total (0 = unlimited)
+// NodeName tags every server log line and the metrics, to tell servers apart in aggregated logs (empty = hostname)
+// StateFilePath is where the active forwards are exported as JSON
+// RunAsUser/RunAsGroup name the account the server switches to once its listener is bound
+// MinClientProtocol rejects clients negotiating an older protocol version (0 = any)
+// TolerateExtraChannels accepts and immediately closes "session" channels instead of rejecting them
+// AllowPortSharing registers a client requesting a port already in use as a backup of the client serving it;
+// forwards go to the first client, failing over to backups in the order they joined
+// LogSampleRate is the fraction of forward open/close events logged; errors and rejections are always logged
+// (0 = every event)
+// MaxWhitelistEntriesTotal caps the client whitelist entries held across all sessions; a session that would
+// exceed it is refused during the handshake (0 = unlimited)
+// MaxWhitelistCount caps the entries of a single client whitelist, checked before any entry is read (0 = unlimited)
+// PidFile receives the server PID while it runs and is removed on SIGINT/SIGTERM
+// ConfigWatchInterval polls the config file for changes and reloads AllowedIPs and DeniedIPs from it (0 = disabled)
+// MaxUptime drains the server and returns from Run once it has been up this long, for scheduled restarts (0 = unlimited)
+// OnReady is called once the SSH listener accepts connections, for programs embedding the server; it is not
+// part of the config file
 
 type ServerParameters struct {
-	BindAddress        string      `json:"bind,omitempty"`
-	BindPort           int         `json:"port,omitempty"`
-	PortRangeStart     int         `json:"port_range_start,omitempty"`
-	PortRangeEnd       int         `json:"port_range_end,omitempty"`
-	Username           string      `json:"username,omitempty"`
-	Password           string      `json:"password,omitempty"`
-	PrivateRsaPath     string      `json:"private_rsa_path,omitempty"`
-	PrivateEcdsaPath   string      `json:"private_ecdsa_path,omitempty"`
-	PrivateEd25519Path string      `json:"private_ed25519_path,omitempty"`
-	AuthorizedKeysPath string      `json:"authorized_keys_path,omitempty"`
-	AllowedIPs         StringArray `json:"allowed_ips,omitempty"`
+	BindAddress               string      `json:"bind,omitempty"`
+	BindPort                  int         `json:"port,omitempty"`
+	ListenNetwork             string      `json:"listen_network,omitempty"`
+	PortRangeStart            int         `json:"port_range_start,omitempty"`
+	PortRangeEnd              int         `json:"port_range_end,omitempty"`
+	StablePortByUser          bool        `json:"stable_port_by_user,omitempty"`
+	PortPools                 PortPoolMap `json:"port_pools,omitempty"`
+	UserPoolMap               StringMap   `json:"user_pool_map,omitempty"`
+	RequireExplicitPort       bool        `json:"require_explicit_port,omitempty"`
+	PublicBaseURL             string      `json:"public_base_url,omitempty"`
+	Username                  string      `json:"username,omitempty"`
+	Password                  string      `json:"password,omitempty"`
+	PasswordHash              string      `json:"password_hash,omitempty"`
+	Users                     []UserCred  `json:"users,omitempty"`
+	PrivateRsaPath            string      `json:"private_rsa_path,omitempty"`
+	PrivateEcdsaPath          string      `json:"private_ecdsa_path,omitempty"`
+	PrivateEd25519Path        string      `json:"private_ed25519_path,omitempty"`
+	AuthorizedKeysPath        string      `json:"authorized_keys_path,omitempty"`
+	TrustedUserCAKeys         string      `json:"trusted_user_ca_keys,omitempty"`
+	AuthorizedKeysRefresh     Duration    `json:"authorized_keys_refresh,omitempty"`
+	AllowInsecureKeysURL      bool        `json:"allow_insecure_keys_url,omitempty"`
+	AuthCommand               string      `json:"auth_command,omitempty"`
+	AllowedIPs                StringArray `json:"allowed_ips,omitempty"`
+	DeniedIPs                 StringArray `json:"denied_ips,omitempty"`
+	AllowedBindHosts          StringArray `json:"allowed_bind_hosts,omitempty"`
+	AllowClientWhitelistWiden bool        `json:"allow_client_whitelist_widen,omitempty"`
+	ForwardBindByUser         StringMap   `json:"forward_bind_by_user,omitempty"`
+	RekeyThreshold            uint64      `json:"rekey_threshold,omitempty"`
+	Ciphers                   StringArray `json:"ciphers,omitempty"`
+	PortReleaseGrace          Duration    `json:"port_release_grace,omitempty"`
+	WarmupPeriod              Duration    `json:"warmup_period,omitempty"`
+	MaxConnsPerForward        int         `json:"max_conns_per_forward,omitempty"`
+	MaxPortsPerIP             int         `json:"max_ports_per_ip,omitempty"`
+	HighWaterForwards         int         `json:"high_water_forwards,omitempty"`
+	LowWaterForwards          int         `json:"low_water_forwards,omitempty"`
+	HighWaterHeapBytes        uint64      `json:"high_water_heap_bytes,omitempty"`
+	MaxConnDuration           Duration    `json:"max_conn_duration,omitempty"`
+	TCPNoDelay                *bool       `json:"tcp_nodelay,omitempty"`
+	SocketReadBuffer          int         `json:"socket_read_buffer,omitempty"`
+	SocketWriteBuffer         int         `json:"socket_write_buffer,omitempty"`
+	MaxConnectionAge          Duration    `json:"max_connection_age,omitempty"`
+	ForwardBufferBytes        int         `json:"forward_buffer_bytes,omitempty"`
+	ProtocolPeekBytes         int         `json:"protocol_peek_bytes,omitempty"`
+	HTTPAccessLog             bool        `json:"http_access_log,omitempty"`
+	SessionByteQuota          uint64      `json:"session_byte_quota,omitempty"`
+	NodeName                  string      `json:"node_name,omitempty"`
+	StateFilePath             string      `json:"state_file,omitempty"`
+	RunAsUser                 string      `json:"run_as_user,omitempty"`
+	RunAsGroup                string      `json:"run_as_group,omitempty"`
+	PidFile                   string      `json:"pid_file,omitempty"`
+	ConfigWatchInterval       Duration    `json:"config_watch_interval,omitempty"`
+	MinClientProtocol         int         `json:"min_client_protocol,omitempty"`
+	TolerateExtraChannels     bool        `json:"tolerate_extra_channels,omitempty"`
+	AllowPortSharing          bool        `json:"allow_port_sharing,omitempty"`
+	LogSampleRate             float64     `json:"log_sample_rate,omitempty"`
+	MaxWhitelistEntriesTotal  int         `json:"max_whitelist_entries_total,omitempty"`
+	MaxWhitelistCount         int         `json:"max_whitelist_count,omitempty"`
+	MaxUptime                 Duration    `json:"max_uptime,omitempty"`
+	OnReady                   func()      `json:"-"`
+}
+
+// UserCred is one SSH account of the server. PasswordHash is a bcrypt hash of
+// its password; AuthorizedKeysPath lists its public keys in authorized_keys format,
+// in a file or served at an http(s) URL.
+type UserCred struct {
+	Username           string `json:"username"`
+	PasswordHash       string `json:"password_hash,omitempty"`
+	AuthorizedKeysPath string `json:"authorized_keys_path,omitempty"`
+}
+
+// validateUsers checks that every user is named once, apart from username, and
+// can log in, either with a valid bcrypt hash, authorized keys or, when
+// haveCA is set, a certificate
+func validateUsers(users []UserCred, username string, haveCA bool) error {
+	seen := map[string]bool{username: username != ""}
+	for i, u := range users {
+		if u.Username == "" {
+			return fmt.Errorf("users[%d]: username is required", i)
+		}
+		if seen[u.Username] {
+			return fmt.Errorf("users[%d]: duplicate username %q", i, u.Username)
+		}
+		seen[u.Username] = true
+		if u.PasswordHash == "" && u.AuthorizedKeysPath == "" && !haveCA {
+			return fmt.Errorf("users[%d]: password_hash or authorized_keys_path must be set", i)
+		}
+		if u.PasswordHash != "" {
+			if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+				return fmt.Errorf("users[%d]: password_hash is not a bcrypt hash", i)
+			}
+		}
+	}
+	return nil
 }
 
 // Validate ensures the ServerParameters contains all required fields and valid values
@@ -159,8 +795,13 @@ func (sp *ServerParameters) Validate() error {
 	if sp.BindAddress == "" {
 		return fmt.Errorf("bind address is required")
 	}
-	if sp.BindPort <= 0 || sp.BindPort > 65535 {
-		return fmt.Errorf("bind port must be between 1 and 65535")
+	if sp.BindPort < 0 || sp.BindPort > 65535 {
+		return fmt.Errorf("bind port must be between 0 and 65535")
+	}
+	switch sp.ListenNetwork {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("listen_network must be tcp, tcp4 or tcp6")
 	}
 	if sp.PortRangeStart < 0 || sp.PortRangeStart > 65535 {
 		return fmt.Errorf("port_range_start must be between 0 and 65535")
@@ -168,15 +809,117 @@ func (sp *ServerParameters) Validate() error {
 	if sp.PortRangeEnd < sp.PortRangeStart || sp.PortRangeEnd > 65535 {
 		return fmt.Errorf("port_range_end must be between port_range_start and 65535")
 	}
-	if sp.Username == "" {
+	if sp.Username == "" && sp.AuthCommand == "" && len(sp.Users) == 0 {
 		return fmt.Errorf("username must be set for SSH server")
 	}
-	if sp.Password == "" && sp.AuthorizedKeysPath == "" {
+	if sp.Username != "" && sp.Password == "" && sp.PasswordHash == "" && sp.AuthorizedKeysPath == "" && sp.TrustedUserCAKeys == "" && sp.AuthCommand == "" {
 		return fmt.Errorf("password or authorized_keys must be set for SSH server")
 	}
+	if sp.Password != "" && sp.PasswordHash != "" {
+		return fmt.Errorf("password and password_hash must not both be set")
+	}
+	if sp.PasswordHash != "" {
+		if _, err := bcrypt.Cost([]byte(sp.PasswordHash)); err != nil {
+			return fmt.Errorf("password_hash is not a bcrypt hash")
+		}
+	}
+	if err := validateUsers(sp.Users, sp.Username, sp.TrustedUserCAKeys != ""); err != nil {
+		return err
+	}
 	if sp.PrivateRsaPath == "" && sp.PrivateEcdsaPath == "" && sp.PrivateEd25519Path == "" {
 		return fmt.Errorf("at least one host key path must be provided")
 	}
+	if err := validateRekeyThreshold(sp.RekeyThreshold); err != nil {
+		return err
+	}
+	if err := validateCiphers(sp.Ciphers); err != nil {
+		return err
+	}
+	if sp.PortReleaseGrace < 0 {
+		return fmt.Errorf("port_release_grace must not be negative")
+	}
+	if sp.ConfigWatchInterval < 0 {
+		return fmt.Errorf("config_watch_interval must not be negative")
+	}
+	if sp.MaxUptime < 0 {
+		return fmt.Errorf("max_uptime must not be negative")
+	}
+	if sp.MaxConnectionAge < 0 {
+		return fmt.Errorf("max_connection_age must not be negative")
+	}
+	if sp.AuthorizedKeysRefresh < 0 {
+		return fmt.Errorf("authorized_keys_refresh must not be negative")
+	}
+	if !sp.AllowInsecureKeysURL {
+		paths := []string{sp.AuthorizedKeysPath, sp.TrustedUserCAKeys}
+		for _, u := range sp.Users {
+			paths = append(paths, u.AuthorizedKeysPath)
+		}
+		for _, path := range paths {
+			if isInsecureKeysURL(path) {
+				return fmt.Errorf("%s is served over plain http, use https or set allow_insecure_keys_url", path)
+			}
+		}
+	}
+	if err := validateSocketBuffers(sp.SocketReadBuffer, sp.SocketWriteBuffer); err != nil {
+		return err
+	}
+	if sp.MaxConnDuration < 0 {
+		return fmt.Errorf("max_conn_duration must not be negative")
+	}
+	if sp.WarmupPeriod < 0 {
+		return fmt.Errorf("warmup_period must not be negative")
+	}
+	if sp.MinClientProtocol < 0 || sp.MinClientProtocol > int(protocol.Version) {
+		return fmt.Errorf("min_client_protocol must be between 0 and %d", protocol.Version)
+	}
+	if sp.MaxConnsPerForward < 0 {
+		return fmt.Errorf("max_conns_per_forward must not be negative")
+	}
+	if sp.MaxPortsPerIP < 0 {
+		return fmt.Errorf("max_ports_per_ip must not be negative")
+	}
+	if sp.HighWaterForwards < 0 || sp.LowWaterForwards < 0 {
+		return fmt.Errorf("high_water_forwards and low_water_forwards must not be negative")
+	}
+	if sp.LowWaterForwards > 0 && sp.LowWaterForwards >= sp.HighWaterForwards {
+		return fmt.Errorf("low_water_forwards must be below high_water_forwards")
+	}
+	if sp.ForwardBufferBytes < 0 {
+		return fmt.Errorf("forward_buffer_bytes must not be negative")
+	}
+	if sp.ProtocolPeekBytes < 0 || sp.ProtocolPeekBytes > MaxProtocolPeekBytes {
+		return fmt.Errorf("protocol_peek_bytes must be between 0 and %d", MaxProtocolPeekBytes)
+	}
+	if sp.HTTPAccessLog && sp.ProtocolPeekBytes == 0 {
+		return fmt.Errorf("http_access_log requires protocol_peek_bytes")
+	}
+	if sp.LogSampleRate < 0 || sp.LogSampleRate > 1 {
+		return fmt.Errorf("log_sample_rate must be between 0 and 1")
+	}
+	if sp.MaxWhitelistEntriesTotal < 0 {
+		return fmt.Errorf("max_whitelist_entries_total must not be negative")
+	}
+	if sp.MaxWhitelistCount < 0 {
+		return fmt.Errorf("max_whitelist_count must not be negative")
+	}
+	if err := validatePortPools(sp.PortPools, sp.UserPoolMap, sp.PortRangeStart, sp.PortRangeEnd); err != nil {
+		return err
+	}
+	for user, addr := range sp.ForwardBindByUser {
+		if addr == "" {
+			return fmt.Errorf("forward_bind_by_user: empty address for user %q", user)
+		}
+	}
+	if sp.RunAsGroup != "" && sp.RunAsUser == "" {
+		return fmt.Errorf("run_as_group requires run_as_user")
+	}
+	if sp.PublicBaseURL != "" {
+		u, err := url.Parse(ExpandPublicURL(sp.PublicBaseURL, 1))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("public_base_url must be an absolute URL")
+		}
+	}
 
 	err := sp.AssertHostKeyOrGenerate()
 	if err != nil {
@@ -186,6 +929,27 @@ func (sp *ServerParameters) Validate() error {
 	return nil
 }
 
+// ExpandPublicURL returns template with every {port} replaced by port
+func ExpandPublicURL(template string, port int) string {
+	return strings.ReplaceAll(template, "{port}", strconv.Itoa(port))
+}
+
+// validateSocketBuffers accepts socket buffer sizes from 0 (OS default) to MaxSocketBuffer
+func validateSocketBuffers(read, write int) error {
+	if read < 0 || read > MaxSocketBuffer || write < 0 || write > MaxSocketBuffer {
+		return fmt.Errorf("socket_read_buffer and socket_write_buffer must be between 0 and %d", MaxSocketBuffer)
+	}
+	return nil
+}
+
+// validateRekeyThreshold accepts 0 (library default) or a value within the allowed bounds
+func validateRekeyThreshold(threshold uint64) error {
+	if threshold != 0 && (threshold < MinRekeyThreshold || threshold > MaxRekeyThreshold) {
+		return fmt.Errorf("rekey_threshold must be 0 or between %d and %d bytes", MinRekeyThreshold, MaxRekeyThreshold)
+	}
+	return nil
+}
+
 func (sp *ServerParameters) AssertHostKeyOrGenerate() error {
 
 	if sp.PrivateRsaPath != "" {
@@ -196,7 +960,7 @@ func (sp *ServerParameters) AssertHostKeyOrGenerate() error {
 				return fmt.Errorf("failed to create directory for RSA key: %v", err)
 			}
 
-			_, err = util.GenerateAndSavePrivateKeyToFile(cleanPath, "rsa")
+			_, err = util.GenerateAndSavePrivateKeyToFile(cleanPath, "rsa", util.DefaultKeyFileMode)
 			if err != nil {
 				return fmt.Errorf("failed to generate RSA key: %v", err)
 			}
@@ -211,7 +975,7 @@ func (sp *ServerParameters) AssertHostKeyOrGenerate() error {
 				return fmt.Errorf("failed to create directory for ECDSA key: %v", err)
 			}
 
-			_, err = util.GenerateAndSavePrivateKeyToFile(cleanPath, "ecdsa")
+			_, err = util.GenerateAndSavePrivateKeyToFile(cleanPath, "ecdsa", util.DefaultKeyFileMode)
 			if err != nil {
 				return fmt.Errorf("failed to generate ECDSA key: %v", err)
 			}
@@ -226,7 +990,7 @@ func (sp *ServerParameters) AssertHostKeyOrGenerate() error {
 				return fmt.Errorf("failed to create directory for Ed25519 key: %v", err)
 			}
 
-			_, err = util.GenerateAndSavePrivateKeyToFile(cleanPath, "ed25519")
+			_, err = util.GenerateAndSavePrivateKeyToFile(cleanPath, "ed25519", util.DefaultKeyFileMode)
 			if err != nil {
 				return fmt.Errorf("failed to generate Ed25519 key: %v", err)
 			}
@@ -235,3 +999,30 @@ func (sp *ServerParameters) AssertHostKeyOrGenerate() error {
 
 	return nil
 }
+
+// validatePortPools checks that every pool lies within [start, end], that no
+// two pools share a port and that users are mapped to existing pools
+func validatePortPools(pools PortPoolMap, users StringMap, start, end int) error {
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		r := pools[name]
+		if r.Start > r.End || r.Start < start || r.End > end {
+			return fmt.Errorf("port_pools: pool %q must be within port_range_start and port_range_end", name)
+		}
+		for _, other := range names[:i] {
+			if o := pools[other]; r.Start <= o.End && o.Start <= r.End {
+				return fmt.Errorf("port_pools: pools %q and %q overlap", other, name)
+			}
+		}
+	}
+	for user, pool := range users {
+		if _, ok := pools[pool]; !ok {
+			return fmt.Errorf("user_pool_map: unknown pool %q for user %q", pool, user)
+		}
+	}
+	return nil
+}
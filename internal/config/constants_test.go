@@ -1,8 +1,11 @@
 package config
 
 import (
+	"encoding/json"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestStringArraySetAndString(t *testing.T) {
@@ -19,6 +22,149 @@ func TestStringArraySetAndString(t *testing.T) {
 	}
 }
 
+func TestStringMapSetAndString(t *testing.T) {
+	var m StringMap
+	if err := m.Set("bob=10.0.0.2, alice=10.0.0.1"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if err := m.Set("carol=10.0.0.3"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	expected := "alice=10.0.0.1,bob=10.0.0.2,carol=10.0.0.3"
+	if m.String() != expected {
+		t.Errorf("String() = %q; want %q", m.String(), expected)
+	}
+	for _, bad := range []string{"alice", "=10.0.0.1", "alice="} {
+		if err := m.Set(bad); err == nil {
+			t.Errorf("Set(%q) expected error, got nil", bad)
+		}
+	}
+}
+
+func TestPortPoolMapSetAndString(t *testing.T) {
+	var m PortPoolMap
+	if err := m.Set("team-b=50100-50199, team-a=50000-50099"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	expected := "team-a=50000-50099,team-b=50100-50199"
+	if m.String() != expected {
+		t.Errorf("String() = %q; want %q", m.String(), expected)
+	}
+	for _, bad := range []string{"team-a", "=50000-50099", "team-a=50000", "team-a=a-b"} {
+		if err := m.Set(bad); err == nil {
+			t.Errorf("Set(%q) expected error, got nil", bad)
+		}
+	}
+}
+
+func TestIntArraySetAndString(t *testing.T) {
+	var a IntArray
+	if err := a.Set("8081, 8082"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if err := a.Set("8083"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	expected := "8081,8082,8083"
+	if a.String() != expected {
+		t.Errorf("String() = %q; want %q", a.String(), expected)
+	}
+	for _, bad := range []string{"", "80a", "8081,"} {
+		if err := a.Set(bad); err == nil {
+			t.Errorf("Set(%q) expected error, got nil", bad)
+		}
+	}
+}
+
+func TestExpandPublicURL(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"https://service.example.com:{port}", "https://service.example.com:49152"},
+		{"https://example.com/tunnels/{port}/?p={port}", "https://example.com/tunnels/49152/?p=49152"},
+		{"https://service.example.com", "https://service.example.com"},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		if got := ExpandPublicURL(tc.template, 49152); got != tc.want {
+			t.Errorf("ExpandPublicURL(%q, 49152) = %q; want %q", tc.template, got, tc.want)
+		}
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	tests := []struct {
+		input string
+		want  time.Duration
+	}{
+		{`"30s"`, 30 * time.Second},
+		{`"1m30s"`, 90 * time.Second},
+		{`45`, 45 * time.Second},
+		{`0.5`, 500 * time.Millisecond},
+	}
+	for _, tc := range tests {
+		var d Duration
+		if err := json.Unmarshal([]byte(tc.input), &d); err != nil {
+			t.Errorf("Unmarshal(%s) error: %v", tc.input, err)
+			continue
+		}
+		if time.Duration(d) != tc.want {
+			t.Errorf("Unmarshal(%s) = %v; want %v", tc.input, time.Duration(d), tc.want)
+		}
+	}
+
+	var d Duration
+	if err := json.Unmarshal([]byte(`"soon"`), &d); err == nil {
+		t.Error("expected error for invalid duration string")
+	}
+
+	out, err := json.Marshal(Duration(2 * time.Minute))
+	if err != nil || string(out) != `"2m0s"` {
+		t.Errorf("Marshal = %s, %v; want \"2m0s\"", out, err)
+	}
+}
+
+func TestClientParametersRedacted(t *testing.T) {
+	cp := &ClientParameters{
+		Endpoint:       "example.com",
+		EndpointPort:   22,
+		Username:       "user",
+		Password:       "hunter2",
+		PrivateKeyPath: "/keys/id_ed25519",
+		LocalHost:      "localhost",
+		LocalPort:      8080,
+		RemoteHost:     "remote",
+		RemotePort:     9090,
+		HostKeyLevel:   2,
+		AllowedIPs:     StringArray{"10.0.0.1", "10.0.0.0/8"},
+	}
+
+	r := cp.Redacted()
+	if r.Password != "[redacted]" || cp.Password != "hunter2" {
+		t.Errorf("Redacted password = %q (original %q); want masked copy", r.Password, cp.Password)
+	}
+
+	summary := cp.Summary()
+	for _, want := range []string{"endpoint=example.com:22", "auth=password+key /keys/id_ed25519", "whitelist=2", "host_key=none", "host_key_level=2"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("Summary() = %q; missing %q", summary, want)
+		}
+	}
+	if strings.Contains(summary, "hunter2") {
+		t.Errorf("Summary() leaked the password: %q", summary)
+	}
+
+	if !cp.ShouldLogConfig() {
+		t.Error("ShouldLogConfig() = false; want default true")
+	}
+	disabled := false
+	cp.LogConfig = &disabled
+	if cp.ShouldLogConfig() {
+		t.Error("ShouldLogConfig() = true; want false when disabled")
+	}
+}
+
 func TestClientParametersValidate(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -77,6 +223,28 @@ func TestClientParametersValidate(t *testing.T) {
 			RemoteHost:     "remote",
 			RemotePort:     9090,
 		}, true, "either private_key or password must be set"},
+		{"certificate-without-key", &ClientParameters{
+			Endpoint:        "example.com",
+			EndpointPort:    22,
+			Username:        "user",
+			Password:        "pass",
+			CertificatePath: "id_ed25519-cert.pub",
+			LocalHost:       "localhost",
+			LocalPort:       8080,
+			RemoteHost:      "remote",
+			RemotePort:      9090,
+		}, true, "certificate requires private_key"},
+		{"invalid-preferred-auth", &ClientParameters{
+			Endpoint:      "example.com",
+			EndpointPort:  22,
+			Username:      "user",
+			Password:      "pass",
+			PreferredAuth: "keyboard",
+			LocalHost:     "localhost",
+			LocalPort:     8080,
+			RemoteHost:    "remote",
+			RemotePort:    9090,
+		}, true, "preferred_auth must be key, password or auto"},
 		{"missing-localhost", &ClientParameters{
 			Endpoint:     "example.com",
 			EndpointPort: 22,
@@ -97,6 +265,72 @@ func TestClientParametersValidate(t *testing.T) {
 			RemoteHost:   "remote",
 			RemotePort:   9090,
 		}, true, "local_port must be between 1 and 65535"},
+		{"invalid-local-port-fallback", &ClientParameters{
+			Endpoint:           "example.com",
+			EndpointPort:       22,
+			Username:           "user",
+			Password:           "pass",
+			LocalHost:          "localhost",
+			LocalPort:          8080,
+			LocalPortFallbacks: IntArray{8081, 70000},
+			RemoteHost:         "remote",
+			RemotePort:         9090,
+		}, true, "local_port_fallbacks must be between 1 and 65535"},
+		{"invalid-local-target-addr", &ClientParameters{
+			Endpoint:     "example.com",
+			EndpointPort: 22,
+			Username:     "user",
+			Password:     "pass",
+			LocalHost:    "localhost",
+			LocalPort:    8080,
+			LocalTargets: []WeightedTarget{{Addr: "10.0.0.1:8080"}, {Addr: "10.0.0.2"}},
+			RemoteHost:   "remote",
+			RemotePort:   9090,
+		}, true, "local_targets[1]: addr must be host:port"},
+		{"negative-local-target-weight", &ClientParameters{
+			Endpoint:     "example.com",
+			EndpointPort: 22,
+			Username:     "user",
+			Password:     "pass",
+			LocalHost:    "localhost",
+			LocalPort:    8080,
+			LocalTargets: []WeightedTarget{{Addr: "10.0.0.1:8080", Weight: -1}},
+			RemoteHost:   "remote",
+			RemotePort:   9090,
+		}, true, "local_targets[0]: weight must not be negative"},
+		{"negative-max-clock-skew", &ClientParameters{
+			Endpoint:     "example.com",
+			EndpointPort: 22,
+			Username:     "user",
+			Password:     "pass",
+			LocalHost:    "localhost",
+			LocalPort:    8080,
+			RemoteHost:   "remote",
+			RemotePort:   9090,
+			MaxClockSkew: Duration(-time.Second),
+		}, true, "max_clock_skew must not be negative"},
+		{"unsupported-cipher", &ClientParameters{
+			Endpoint:     "example.com",
+			EndpointPort: 22,
+			Username:     "user",
+			Password:     "pass",
+			LocalHost:    "localhost",
+			LocalPort:    8080,
+			RemoteHost:   "remote",
+			RemotePort:   9090,
+			Ciphers:      StringArray{"3des-cbc"},
+		}, true, `ciphers: unsupported cipher "3des-cbc"`},
+		{"negative-retry-budget", &ClientParameters{
+			Endpoint:     "example.com",
+			EndpointPort: 22,
+			Username:     "user",
+			Password:     "pass",
+			LocalHost:    "localhost",
+			LocalPort:    8080,
+			RemoteHost:   "remote",
+			RemotePort:   9090,
+			RetryBudget:  -1,
+		}, true, "retry_budget must not be negative"},
 		{"missing-remotehost", &ClientParameters{
 			Endpoint:     "example.com",
 			EndpointPort: 22,
@@ -106,7 +340,27 @@ func TestClientParametersValidate(t *testing.T) {
 			LocalPort:    8080,
 			RemoteHost:   "",
 			RemotePort:   9090,
-		}, true, "remote_host is required"},
+		}, false, ""},
+		{"remotehost-with-port", &ClientParameters{
+			Endpoint:     "example.com",
+			EndpointPort: 22,
+			Username:     "user",
+			Password:     "pass",
+			LocalHost:    "localhost",
+			LocalPort:    8080,
+			RemoteHost:   "0.0.0.0:9090",
+			RemotePort:   9090,
+		}, true, "remote_host must be a host name or IP without a port"},
+		{"remotehost-ipv6", &ClientParameters{
+			Endpoint:     "example.com",
+			EndpointPort: 22,
+			Username:     "user",
+			Password:     "pass",
+			LocalHost:    "localhost",
+			LocalPort:    8080,
+			RemoteHost:   "::1",
+			RemotePort:   9090,
+		}, false, ""},
 		{"invalid-remoteport", &ClientParameters{
 			Endpoint:     "example.com",
 			EndpointPort: 22,
@@ -117,6 +371,75 @@ func TestClientParametersValidate(t *testing.T) {
 			RemoteHost:   "remote",
 			RemotePort:   70000,
 		}, true, "remote_port must be between 0 and 65535"},
+		{"invalid-rekey-threshold", &ClientParameters{
+			Endpoint:       "example.com",
+			EndpointPort:   22,
+			Username:       "user",
+			Password:       "pass",
+			LocalHost:      "localhost",
+			LocalPort:      8080,
+			RemoteHost:     "remote",
+			RemotePort:     9090,
+			RekeyThreshold: MaxRekeyThreshold + 1,
+		}, true, "rekey_threshold must be 0 or between 1048576 and 1099511627776 bytes"},
+		{"invalid-register-webhook", &ClientParameters{
+			Endpoint:        "example.com",
+			EndpointPort:    22,
+			Username:        "user",
+			Password:        "pass",
+			LocalHost:       "localhost",
+			LocalPort:       8080,
+			RemoteHost:      "remote",
+			RemotePort:      9090,
+			RegisterWebhook: "ftp://registry.example.com/services",
+		}, true, "register_webhook must be an http or https URL"},
+		{"metrics-auth-user-without-pass", &ClientParameters{
+			Endpoint:        "example.com",
+			EndpointPort:    22,
+			Username:        "user",
+			Password:        "pass",
+			LocalHost:       "localhost",
+			LocalPort:       8080,
+			MetricsAuthUser: "prom",
+		}, true, "metrics_auth_user and metrics_auth_pass must be set together"},
+		{"metrics-addr-same-as-health-addr", &ClientParameters{
+			Endpoint:     "example.com",
+			EndpointPort: 22,
+			Username:     "user",
+			Password:     "pass",
+			LocalHost:    "localhost",
+			LocalPort:    8080,
+			HealthAddr:   ":9100",
+			MetricsAddr:  ":9100",
+		}, true, "metrics_addr must differ from health_addr, which serves /metrics too"},
+		{"negative-socket-write-buffer", &ClientParameters{
+			Endpoint:          "example.com",
+			EndpointPort:      22,
+			Username:          "user",
+			Password:          "pass",
+			LocalHost:         "localhost",
+			LocalPort:         8080,
+			SocketWriteBuffer: -1,
+		}, true, "socket_read_buffer and socket_write_buffer must be between 0 and 67108864"},
+		{"too-many-local-dial-retries", &ClientParameters{
+			Endpoint:         "example.com",
+			EndpointPort:     22,
+			Username:         "user",
+			Password:         "pass",
+			LocalHost:        "localhost",
+			LocalPort:        8080,
+			LocalDialRetries: MaxLocalDialRetries + 1,
+		}, true, "local_dial_retries must be between 0 and 10"},
+		{"too-long-local-dial-interval", &ClientParameters{
+			Endpoint:          "example.com",
+			EndpointPort:      22,
+			Username:          "user",
+			Password:          "pass",
+			LocalHost:         "localhost",
+			LocalPort:         8080,
+			LocalDialRetries:  3,
+			LocalDialInterval: Duration(time.Minute),
+		}, true, "local_dial_retry_interval must be between 0 and 2s"},
 	}
 	for _, tc := range tests {
 		err := tc.cp.Validate()
@@ -145,12 +468,39 @@ func TestServerParametersValidate(t *testing.T) {
 	}{
 		{"valid", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, false, ""},
 		{"missing-bindaddress", &ServerParameters{BindAddress: "", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "bind address is required"},
-		{"invalid-bindport", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 0, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "bind port must be between 1 and 65535"},
+		{"ephemeral-bindport", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 0, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, false, ""},
+		{"invalid-bindport", &ServerParameters{BindAddress: "0.0.0.0", BindPort: -1, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "bind port must be between 0 and 65535"},
 		{"invalid-range-start", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: -1, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "port_range_start must be between 0 and 65535"},
 		{"invalid-range-end", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 3000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "port_range_end must be between port_range_start and 65535"},
 		{"missing-username", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "username must be set for SSH server"},
 		{"missing-password-and-authorized-keys", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "password or authorized_keys must be set for SSH server"},
+		{"auth-command-only", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, AuthCommand: "/usr/local/bin/check-pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, false, ""},
 		{"missing-key", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: ""}, true, "at least one host key path must be provided"},
+		{"valid-rekey-threshold", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), RekeyThreshold: 64 << 20}, false, ""},
+		{"invalid-rekey-threshold", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), RekeyThreshold: 1024}, true, "rekey_threshold must be 0 or between 1048576 and 1099511627776 bytes"},
+		{"empty-forward-bind", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), ForwardBindByUser: StringMap{"alice": ""}}, true, "forward_bind_by_user: empty address for user \"alice\""},
+		{"valid-listen-network", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), ListenNetwork: "tcp6"}, false, ""},
+		{"invalid-listen-network", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), ListenNetwork: "udp"}, true, "listen_network must be tcp, tcp4 or tcp6"},
+		{"invalid-log-sample-rate", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), LogSampleRate: 1.5}, true, "log_sample_rate must be between 0 and 1"},
+		{"run-as-group-without-user", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), RunAsGroup: "nogroup"}, true, "run_as_group requires run_as_user"},
+		{"http-access-log-without-peek", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), HTTPAccessLog: true}, true, "http_access_log requires protocol_peek_bytes"},
+		{"negative-max-ports-per-ip", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), MaxPortsPerIP: -1}, true, "max_ports_per_ip must not be negative"},
+		{"unsupported-cipher", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), Ciphers: StringArray{"arcfour"}}, true, `ciphers: unsupported cipher "arcfour"`},
+		{"port-pool-outside-range", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), PortPools: PortPoolMap{"a": {Start: 1900, End: 2100}}}, true, `port_pools: pool "a" must be within port_range_start and port_range_end`},
+		{"overlapping-port-pools", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), PortPools: PortPoolMap{"a": {Start: 1000, End: 1099}, "b": {Start: 1099, End: 1199}}}, true, `port_pools: pools "a" and "b" overlap`},
+		{"unknown-user-pool", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), PortPools: PortPoolMap{"a": {Start: 1000, End: 1099}}, UserPoolMap: StringMap{"alice": "b"}}, true, `user_pool_map: unknown pool "b" for user "alice"`},
+		{"valid-port-pools", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), PortPools: PortPoolMap{"a": {Start: 1000, End: 1099}, "b": {Start: 1100, End: 1199}}, UserPoolMap: StringMap{"alice": "a"}}, false, ""},
+		{"oversized-socket-read-buffer", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), SocketReadBuffer: MaxSocketBuffer + 1}, true, "socket_read_buffer and socket_write_buffer must be between 0 and 67108864"},
+		{"negative-high-water-forwards", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), HighWaterForwards: -1}, true, "high_water_forwards and low_water_forwards must not be negative"},
+		{"low-water-not-below-high", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), HighWaterForwards: 10, LowWaterForwards: 10}, true, "low_water_forwards must be below high_water_forwards"},
+		{"low-water-without-high", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), LowWaterForwards: 5}, true, "low_water_forwards must be below high_water_forwards"},
+		{"negative-authorized-keys-refresh", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), AuthorizedKeysRefresh: -1}, true, "authorized_keys_refresh must not be negative"},
+		{"insecure-keys-url", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), Users: []UserCred{{Username: "bob", AuthorizedKeysPath: "http://keys.example/bob"}}}, true, "http://keys.example/bob is served over plain http, use https or set allow_insecure_keys_url"},
+		{"insecure-keys-url-allowed", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), AuthorizedKeysPath: "http://keys.example/keys", AllowInsecureKeysURL: true}, false, ""},
+		{"https-keys-url", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), AuthorizedKeysPath: "https://keys.example/keys"}, false, ""},
+		{"oversized-protocol-peek-bytes", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), ProtocolPeekBytes: MaxProtocolPeekBytes + 1}, true, "protocol_peek_bytes must be between 0 and 65536"},
+		{"valid-public-base-url", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), PublicBaseURL: "https://service.example.com:{port}"}, false, ""},
+		{"relative-public-base-url", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa"), PublicBaseURL: "service.example.com:{port}"}, true, "public_base_url must be an absolute URL"},
 	}
 	for _, tc := range tests {
 		err := tc.sp.Validate()
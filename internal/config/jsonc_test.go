@@ -0,0 +1,83 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStripJSONComments(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want map[string]string
+	}{
+		{"line comment", "// header\n{\"a\": \"1\"}", map[string]string{"a": "1"}},
+		{"end of line", "{\"a\": \"1\", // why\n\"b\": \"2\"}", map[string]string{"a": "1", "b": "2"}},
+		{"block comment", "{/* first */\"a\": /* value */ \"1\"}", map[string]string{"a": "1"}},
+		{"multi-line block", "{\n/*\n * field docs\n */\n\"a\": \"1\"}", map[string]string{"a": "1"}},
+		{"trailing comment", "{\"a\": \"1\"} // done", map[string]string{"a": "1"}},
+		{"slashes in string", `{"url": "http://example.com/*x*/"}`, map[string]string{"url": "http://example.com/*x*/"}},
+		{"escaped quote in string", `{"a": "say \"// hi\""}`, map[string]string{"a": `say "// hi"`}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := stripJSONComments([]byte(tc.in))
+			if err != nil {
+				t.Fatalf("stripJSONComments() error = %v", err)
+			}
+			if len(out) != len(tc.in) || strings.Count(string(out), "\n") != strings.Count(tc.in, "\n") {
+				t.Errorf("stripJSONComments() = %q; want offsets and lines kept", out)
+			}
+			var got map[string]string
+			if err := json.Unmarshal(out, &got); err != nil {
+				t.Fatalf("decode %q: %v", out, err)
+			}
+			for k, v := range tc.want {
+				if got[k] != v {
+					t.Errorf("%s = %q; want %q", k, got[k], v)
+				}
+			}
+			if len(got) != len(tc.want) {
+				t.Errorf("decoded %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStripJSONComments_Unterminated(t *testing.T) {
+	if _, err := stripJSONComments([]byte(`{"a": "1"} /* open`)); err == nil || !strings.Contains(err.Error(), "unterminated block comment") {
+		t.Errorf("stripJSONComments() error = %v; want unterminated block comment", err)
+	}
+}
+
+func TestLoadConfigFile_Comments(t *testing.T) {
+	body := "{\n  // client mode\n  \"type\": \"client\",\n  \"client\": {\n    \"endpoint\": \"commented.example.com\" /* prod */\n  }\n}\n"
+	dir := makeTempDir(t)
+	os.Unsetenv("PBP_TUNNEL_CONFIG_FORMAT")
+
+	for _, name := range []string{"config.json", "config.jsonc"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+			t.Fatalf("WriteFile returned error: %v", err)
+		}
+		cfg, err := LoadConfigFile(path)
+		if err != nil {
+			t.Fatalf("LoadConfigFile(%s) error = %v", name, err)
+		}
+		if cfg.Client == nil || cfg.Client.Endpoint != "commented.example.com" {
+			t.Errorf("LoadConfigFile(%s) client = %+v; want endpoint commented.example.com", name, cfg.Client)
+		}
+	}
+
+	// comments are only understood in .json and .jsonc files
+	path := filepath.Join(dir, "config")
+	if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	if _, err := LoadConfigFile(path); err == nil {
+		t.Error("LoadConfigFile() without extension error = nil; want a decoding error")
+	}
+}
@@ -1,15 +1,34 @@
 package config
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
 const envPrefix = "PBP_TUNNEL_"
 
+// EmbeddedProfile is a JSON AppConfig compiled into the binary, either raw or
+// base64-encoded, for example with:
+//
+//	go build -ldflags "-X github.com/poweredbypump/pbp-tunnel/internal/config.EmbeddedProfile=$(base64 -w0 profile.json)"
+//
+// LoadConfig falls back to it when neither the environment nor a config file
+// provide a configuration.
+var EmbeddedProfile = ""
+
+// ConfigFormat forces the decoder of the config file (json, yaml or toml), as set
+// by the --config-format flag. Empty falls back to PBP_TUNNEL_CONFIG_FORMAT, then
+// to the file extension.
+var ConfigFormat = ""
+
 // GetEnvValue fetches an environment variable PBP_TUNNEL_<KEY> or returns defaultValue if unset.
 // KEY should match the JSON tag in caps (e.g., "ENDPOINT", "REMOTE_HOST", etc.)
 func GetEnvValue(key, defaultValue string) string {
@@ -56,6 +75,12 @@ func LoadEnvConfig() *AppConfig {
 	if v := GetEnvValue(CpKeyPrivateKeyPath, ""); v != "" {
 		configuration.Client.PrivateKeyPath = v
 	}
+	if v := GetEnvValue(CpKeyCertificatePath, ""); v != "" {
+		configuration.Client.CertificatePath = v
+	}
+	if v := GetEnvValue(CpKeyPreferredAuth, ""); v != "" {
+		configuration.Client.PreferredAuth = v
+	}
 	if v := GetEnvValue(CpKeyHostKeyPath, ""); v != "" {
 		configuration.Client.HostKeyPath = v
 	}
@@ -67,6 +92,9 @@ func LoadEnvConfig() *AppConfig {
 			configuration.Client.LocalPort = p
 		}
 	}
+	if v := GetEnvValue(CpKeyLocalTargetFile, ""); v != "" {
+		configuration.Client.LocalTargetFile = v
+	}
 	if v := GetEnvValue(CpKeyRemoteHost, CpDefaultRemoteHost); v != "" {
 		configuration.Client.RemoteHost = v
 	}
@@ -80,9 +108,135 @@ func LoadEnvConfig() *AppConfig {
 			configuration.Client.HostKeyLevel = lvl
 		}
 	}
+	if v := GetEnvValue(CpKeyLocalFallbacks, ""); v != "" {
+		var ports IntArray
+		if err := ports.Set(v); err == nil {
+			configuration.Client.LocalPortFallbacks = ports
+		}
+	}
 	if v := GetEnvValue(CpKeyAllowedIPs, ""); v != "" {
 		configuration.Client.AllowedIPs = strings.Split(v, ",")
 	}
+	if v := GetEnvValue(CpKeyRekeyThreshold, ""); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			configuration.Client.RekeyThreshold = n
+		}
+	}
+	if v := GetEnvValue(CpKeyCiphers, ""); v != "" {
+		configuration.Client.Ciphers = strings.Split(v, ",")
+	}
+	if v := GetEnvValue(CpKeyFixedPortFailFast, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Client.FixedPortFailFast = b
+		}
+	}
+	if v := GetEnvValue(CpKeyMaxRetries, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Client.MaxRetries = n
+		}
+	}
+	if v := GetEnvValue(CpKeyRetryBudget, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Client.RetryBudget = n
+		}
+	}
+	if v := GetEnvValue(CpKeyHealthAddr, ""); v != "" {
+		configuration.Client.HealthAddr = v
+	}
+	if v := GetEnvValue(CpKeyMetricsAddr, ""); v != "" {
+		configuration.Client.MetricsAddr = v
+	}
+	if v := GetEnvValue(CpKeyMetricsAuthUser, ""); v != "" {
+		configuration.Client.MetricsAuthUser = v
+	}
+	if v := GetEnvValue(CpKeyMetricsAuthPass, ""); v != "" {
+		configuration.Client.MetricsAuthPass = v
+	}
+	if v := GetEnvValue(CpKeyRegisterWebhook, ""); v != "" {
+		configuration.Client.RegisterWebhook = v
+	}
+	if v := GetEnvValue(CpKeyPortOutputFile, ""); v != "" {
+		configuration.Client.PortOutputFile = v
+	}
+	if v := GetEnvValue(CpKeyRegisterLabel, ""); v != "" {
+		configuration.Client.RegisterLabel = v
+	}
+	if v := GetEnvValue(CpKeyLogConfig, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Client.LogConfig = &b
+		}
+	}
+	if v := GetEnvValue(CpKeyTCPNoDelay, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Client.TCPNoDelay = &b
+		}
+	}
+	if v := GetEnvValue(CpKeySocketReadBuffer, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Client.SocketReadBuffer = n
+		}
+	}
+	if v := GetEnvValue(CpKeySocketWriteBuffer, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Client.SocketWriteBuffer = n
+		}
+	}
+	if v := GetEnvValue(CpKeyLocalTLS, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Client.LocalTLS = b
+		}
+	}
+	if v := GetEnvValue(CpKeyLocalTLSServer, ""); v != "" {
+		configuration.Client.LocalTLSServerName = v
+	}
+	if v := GetEnvValue(CpKeyLocalTLSCA, ""); v != "" {
+		configuration.Client.LocalTLSCA = v
+	}
+	if v := GetEnvValue(CpKeyLocalTLSInsecure, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Client.LocalTLSInsecure = b
+		}
+	}
+	if v := GetEnvValue(CpKeyStartupSplay, ""); v != "" {
+		var d Duration
+		if err := d.Set(v); err == nil {
+			configuration.Client.StartupSplay = d
+		}
+	}
+	if v := GetEnvValue(CpKeyMaxClockSkew, ""); v != "" {
+		var d Duration
+		if err := d.Set(v); err == nil {
+			configuration.Client.MaxClockSkew = d
+		}
+	}
+	if v := GetEnvValue(CpKeyMinSessionTime, ""); v != "" {
+		var d Duration
+		if err := d.Set(v); err == nil {
+			configuration.Client.MinSessionDuration = d
+		}
+	}
+	if v := GetEnvValue(CpKeyMaxForwards, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Client.MaxConcurrentForwards = n
+		}
+	}
+	if v := GetEnvValue(CpKeyLocalDialRetries, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Client.LocalDialRetries = n
+		}
+	}
+	if v := GetEnvValue(CpKeyLocalDialInterval, ""); v != "" {
+		var d Duration
+		if err := d.Set(v); err == nil {
+			configuration.Client.LocalDialInterval = d
+		}
+	}
+	if v := GetEnvValue(CpKeyConnectTimeout, ""); v != "" {
+		var d Duration
+		if err := d.Set(v); err == nil {
+			configuration.Client.ConnectTimeout = d
+		}
+	}
 
 	// Server section
 	if v := GetEnvValue(SpKeyBindAddress, SpDefaultBindAddress); v != "" {
@@ -109,6 +263,9 @@ func LoadEnvConfig() *AppConfig {
 	if v := GetEnvValue(SpKeyPassword, ""); v != "" {
 		configuration.Server.Password = v
 	}
+	if v := GetEnvValue(SpKeyPasswordHash, ""); v != "" {
+		configuration.Server.PasswordHash = v
+	}
 	if v := GetEnvValue(SpKeyPrivateRsaPath, ""); v != "" {
 		configuration.Server.PrivateRsaPath = v
 	}
@@ -118,70 +275,391 @@ func LoadEnvConfig() *AppConfig {
 	if v := GetEnvValue(SpKeyPrivateEd25519Path, ""); v != "" {
 		configuration.Server.PrivateEd25519Path = v
 	}
+	if v := GetEnvValue(SpKeyStablePortByUser, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Server.StablePortByUser = b
+		}
+	}
+	if v := GetEnvValue(SpKeyPublicBaseURL, ""); v != "" {
+		configuration.Server.PublicBaseURL = v
+	}
+	if v := GetEnvValue(SpKeyRequireExplicitPort, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Server.RequireExplicitPort = b
+		}
+	}
+	if v := GetEnvValue(SpKeyListenNetwork, ""); v != "" {
+		configuration.Server.ListenNetwork = v
+	}
 	if v := GetEnvValue(SpKeyAuthorizedKeysPath, ""); v != "" {
 		configuration.Server.AuthorizedKeysPath = v
 	}
+	if v := GetEnvValue(SpKeyAuthorizedKeysRefresh, ""); v != "" {
+		var d Duration
+		if err := d.Set(v); err == nil {
+			configuration.Server.AuthorizedKeysRefresh = d
+		}
+	}
+	if v := GetEnvValue(SpKeyAllowInsecureKeysURL, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Server.AllowInsecureKeysURL = b
+		}
+	}
+	if v := GetEnvValue(SpKeyTrustedUserCAKeys, ""); v != "" {
+		configuration.Server.TrustedUserCAKeys = v
+	}
 	if v := GetEnvValue(SpKeyAllowedIPS, ""); v != "" {
 		configuration.Server.AllowedIPs = strings.Split(v, ",")
 	}
+	if v := GetEnvValue(SpKeyAllowedBindHosts, ""); v != "" {
+		configuration.Server.AllowedBindHosts = strings.Split(v, ",")
+	}
+	if v := GetEnvValue(SpKeyDeniedIPs, ""); v != "" {
+		configuration.Server.DeniedIPs = strings.Split(v, ",")
+	}
+	if v := GetEnvValue(SpKeyAllowClientWhitelistWiden, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Server.AllowClientWhitelistWiden = b
+		}
+	}
+	if v := GetEnvValue(SpKeyForwardBindByUser, ""); v != "" {
+		var m StringMap
+		if err := m.Set(v); err == nil {
+			configuration.Server.ForwardBindByUser = m
+		}
+	}
+	if v := GetEnvValue(SpKeyPortPools, ""); v != "" {
+		var m PortPoolMap
+		if err := m.Set(v); err == nil {
+			configuration.Server.PortPools = m
+		}
+	}
+	if v := GetEnvValue(SpKeyUserPoolMap, ""); v != "" {
+		var m StringMap
+		if err := m.Set(v); err == nil {
+			configuration.Server.UserPoolMap = m
+		}
+	}
+	if v := GetEnvValue(SpKeyRekeyThreshold, ""); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			configuration.Server.RekeyThreshold = n
+		}
+	}
+	if v := GetEnvValue(SpKeyCiphers, ""); v != "" {
+		configuration.Server.Ciphers = strings.Split(v, ",")
+	}
+	if v := GetEnvValue(SpKeyPortReleaseGrace, ""); v != "" {
+		var d Duration
+		if err := d.Set(v); err == nil {
+			configuration.Server.PortReleaseGrace = d
+		}
+	}
+	if v := GetEnvValue(SpKeyWarmupPeriod, ""); v != "" {
+		var d Duration
+		if err := d.Set(v); err == nil {
+			configuration.Server.WarmupPeriod = d
+		}
+	}
+	if v := GetEnvValue(SpKeyMaxConnsPerForward, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Server.MaxConnsPerForward = n
+		}
+	}
+	if v := GetEnvValue(SpKeyMaxPortsPerIP, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Server.MaxPortsPerIP = n
+		}
+	}
+	if v := GetEnvValue(SpKeyHighWaterForwards, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Server.HighWaterForwards = n
+		}
+	}
+	if v := GetEnvValue(SpKeyLowWaterForwards, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Server.LowWaterForwards = n
+		}
+	}
+	if v := GetEnvValue(SpKeyHighWaterHeapBytes, ""); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			configuration.Server.HighWaterHeapBytes = n
+		}
+	}
+	if v := GetEnvValue(SpKeyForwardBufferBytes, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Server.ForwardBufferBytes = n
+		}
+	}
+	if v := GetEnvValue(SpKeyProtocolPeekBytes, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Server.ProtocolPeekBytes = n
+		}
+	}
+	if v := GetEnvValue(SpKeyHTTPAccessLog, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Server.HTTPAccessLog = b
+		}
+	}
+	if v := GetEnvValue(SpKeySessionByteQuota, ""); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			configuration.Server.SessionByteQuota = n
+		}
+	}
+	if v := GetEnvValue(SpKeyNodeName, ""); v != "" {
+		configuration.Server.NodeName = v
+	}
+	if v := GetEnvValue(SpKeyStateFilePath, ""); v != "" {
+		configuration.Server.StateFilePath = v
+	}
+	if v := GetEnvValue(SpKeyRunAsUser, ""); v != "" {
+		configuration.Server.RunAsUser = v
+	}
+	if v := GetEnvValue(SpKeyRunAsGroup, ""); v != "" {
+		configuration.Server.RunAsGroup = v
+	}
+	if v := GetEnvValue(SpKeyMinClientProtocol, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Server.MinClientProtocol = n
+		}
+	}
+	if v := GetEnvValue(SpKeyTolerateExtraChannels, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Server.TolerateExtraChannels = b
+		}
+	}
+	if v := GetEnvValue(SpKeyAllowPortSharing, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Server.AllowPortSharing = b
+		}
+	}
+	if v := GetEnvValue(SpKeyMaxWhitelistEntriesTotal, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Server.MaxWhitelistEntriesTotal = n
+		}
+	}
+	if v := GetEnvValue(SpKeyMaxWhitelistCount, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Server.MaxWhitelistCount = n
+		}
+	}
+	if v := GetEnvValue(SpKeyLogSampleRate, ""); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			configuration.Server.LogSampleRate = f
+		}
+	}
+	if v := GetEnvValue(SpKeyPidFile, ""); v != "" {
+		configuration.Server.PidFile = v
+	}
+	if v := GetEnvValue(SpKeyConfigWatchInterval, ""); v != "" {
+		var d Duration
+		if err := d.Set(v); err == nil {
+			configuration.Server.ConfigWatchInterval = d
+		}
+	}
+	if v := GetEnvValue(SpKeyMaxUptime, ""); v != "" {
+		var d Duration
+		if err := d.Set(v); err == nil {
+			configuration.Server.MaxUptime = d
+		}
+	}
+	if v := GetEnvValue(SpKeyMaxConnDuration, ""); v != "" {
+		var d Duration
+		if err := d.Set(v); err == nil {
+			configuration.Server.MaxConnDuration = d
+		}
+	}
+	if v := GetEnvValue(SpKeyMaxConnectionAge, ""); v != "" {
+		var d Duration
+		if err := d.Set(v); err == nil {
+			configuration.Server.MaxConnectionAge = d
+		}
+	}
+	if v := GetEnvValue(SpKeyTCPNoDelay, ""); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			configuration.Server.TCPNoDelay = &b
+		}
+	}
+	if v := GetEnvValue(SpKeySocketReadBuffer, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Server.SocketReadBuffer = n
+		}
+	}
+	if v := GetEnvValue(SpKeySocketWriteBuffer, ""); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			configuration.Server.SocketWriteBuffer = n
+		}
+	}
+	if v := GetEnvValue(SpKeyAuthCommand, ""); v != "" {
+		configuration.Server.AuthCommand = v
+	}
 
 	return configuration
 }
 
-// LoadConfig reads JSON config from file (path from PBP_TUNNEL_CONFIG or "config.json"),
-// falling back to environment-only config if file is missing or invalid.
+// LoadConfig reads config from file (path from PBP_TUNNEL_CONFIG or "config.json",
+// format from --config-format, PBP_TUNNEL_CONFIG_FORMAT or the extension), falling back to environment-only config if
+// file is missing or invalid.
 func LoadConfig() *AppConfig {
 	envConfig := LoadEnvConfig()
 	if envConfig.Type != "" {
 		return envConfig
 	}
 
-	configFilepath := GetEnvValue("config", "")
+	configFilepath := ConfigFilePath()
+	hasDefaultValue := GetEnvValue("config", "") == ""
 
-	hasDefaultValue := false
-	if configFilepath == "" {
-		hasDefaultValue = true
-		configFilepath = "config.json"
-	}
+	fileConfig, err := LoadConfigFile(configFilepath)
+	if fileConfig == nil {
+		profile, hasProfile := loadEmbeddedProfile()
 
-	configBytes, err := os.ReadFile(configFilepath)
-	if err != nil {
 		if !hasDefaultValue {
 			_, _ = fmt.Fprintf(os.Stderr, "Error reading config file: %v\n", err)
-			_, _ = fmt.Fprintf(os.Stderr, "Falling back to environment variables.\n")
+			if hasProfile {
+				_, _ = fmt.Fprintf(os.Stderr, "Falling back to the embedded profile.\n")
+			} else {
+				_, _ = fmt.Fprintf(os.Stderr, "Falling back to environment variables.\n")
+			}
 		}
 
+		if hasProfile {
+			return profile
+		}
 		return envConfig
 	}
 
-	var fileConfig AppConfig
-	if err := json.Unmarshal(configBytes, &fileConfig); err != nil {
+	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "Error parsing config file: %v\n", err)
+	}
+
+	return fileConfig
+}
+
+// ConfigFilePath returns the config file path, from PBP_TUNNEL_CONFIG or "config.json"
+func ConfigFilePath() string {
+	if path := GetEnvValue("config", ""); path != "" {
+		return path
+	}
+	return "config.json"
+}
+
+// LoadConfigFile reads and decodes the config file at path in the format given by
+// configFormat. Comments are stripped from .json and .jsonc JSON files first. A read
+// error returns a nil config; on a decoding error the partially decoded config is
+// returned with the error.
+func LoadConfigFile(path string) (*AppConfig, error) {
+	configBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileConfig AppConfig
+	format := configFormat(path)
+	if format == "json" && allowsComments(path) {
+		if configBytes, err = stripJSONComments(configBytes); err != nil {
+			return &fileConfig, err
+		}
+	}
+	err = decodeConfig(configBytes, format, &fileConfig)
+	return &fileConfig, err
+}
 
-		return &fileConfig
+// configFormat returns the format of the config file at path: ConfigFormat, else
+// PBP_TUNNEL_CONFIG_FORMAT, else yaml or toml from the extension, else json
+func configFormat(path string) string {
+	format := ConfigFormat
+	if format == "" {
+		format = GetEnvValue("config_format", "")
+	}
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			return "yaml"
+		case ".toml":
+			return "toml"
+		}
+		return "json"
 	}
+	if format = strings.ToLower(format); format == "yml" {
+		return "yaml"
+	}
+	return format
+}
 
-	return &fileConfig
+// decodeConfig decodes a config file in the given format. YAML and TOML are decoded
+// to generic values and re-encoded as JSON, so every format goes through the same
+// field names and JSON decoders (durations, string lists...).
+func decodeConfig(data []byte, format string, out *AppConfig) error {
+	var generic map[string]any
+	switch format {
+	case "json":
+		return json.Unmarshal(data, out)
+	case "yaml":
+		if err := yaml.Unmarshal(data, &generic); err != nil {
+			return fmt.Errorf("yaml: %w", err)
+		}
+	case "toml":
+		if err := toml.Unmarshal(data, &generic); err != nil {
+			return fmt.Errorf("toml: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown config format %q (json, yaml or toml)", format)
+	}
+
+	data, err := json.Marshal(generic)
+	if err != nil {
+		return fmt.Errorf("%s: %w", format, err)
+	}
+	return json.Unmarshal(data, out)
+}
+
+// loadEmbeddedProfile parses EmbeddedProfile, reporting whether one is available
+func loadEmbeddedProfile() (*AppConfig, bool) {
+	if EmbeddedProfile == "" {
+		return nil, false
+	}
+
+	data := []byte(EmbeddedProfile)
+	if decoded, err := base64.StdEncoding.DecodeString(EmbeddedProfile); err == nil {
+		data = decoded
+	}
+
+	var profile AppConfig
+	if err := json.Unmarshal(data, &profile); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Error parsing embedded profile: %v\n", err)
+		return nil, false
+	}
+
+	return &profile, true
 }
 
 // LoadClientConfig returns the current client configuration from JSON or env.
-func LoadClientConfig() *ClientParameters {
+// Without a configured type an invalid configuration is taken as none at all:
+// it returns nil and no error, leaving the client to its flags. Otherwise the
+// validation error is returned.
+func LoadClientConfig() (*ClientParameters, error) {
 	configuration := LoadConfig()
 
 	if err := configuration.Client.Validate(); err != nil {
-		return nil
+		if configuration.Type == "" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("client configuration: %w", err)
 	}
 
-	return configuration.Client
+	return configuration.Client, nil
 }
 
-// LoadServerConfig returns the current server configuration from JSON or env.
-func LoadServerConfig() *ServerParameters {
+// LoadServerConfig returns the current server configuration from JSON or env,
+// with the same handling of an invalid configuration as LoadClientConfig
+func LoadServerConfig() (*ServerParameters, error) {
 	configuration := LoadConfig()
 
 	if err := configuration.Server.Validate(); err != nil {
-		return nil
+		if configuration.Type == "" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("server configuration: %w", err)
 	}
 
-	return configuration.Server
+	return configuration.Server, nil
 }
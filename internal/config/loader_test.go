@@ -1,11 +1,14 @@
 package config
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"github.com/poweredbypump/pbp-tunnel/internal/util"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetEnvValue(t *testing.T) {
@@ -102,6 +105,130 @@ func TestLoadConfig_ValidJSON(t *testing.T) {
 	}
 }
 
+// withEmbeddedProfile sets EmbeddedProfile and moves to an empty working directory for the test
+func withEmbeddedProfile(t *testing.T, profile string) string {
+	dir := makeTempDir(t)
+	oldWd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("failed to change working dir: %v", err)
+	}
+	old := EmbeddedProfile
+	EmbeddedProfile = profile
+	t.Cleanup(func() {
+		EmbeddedProfile = old
+		os.Chdir(oldWd)
+	})
+	return dir
+}
+
+func TestLoadConfig_ForcedFormat(t *testing.T) {
+	dir := makeTempDir(t)
+	filePath := filepath.Join(dir, "config")
+	yamlConfig := "type: client\nclient:\n  endpoint: noext.example.com\n  port: 2222\n" +
+		"  allowed_ips: [10.0.0.1, 10.0.0.2]\n  min_session_duration: 30s\n"
+	if err := os.WriteFile(filePath, []byte(yamlConfig), 0600); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	os.Clearenv()
+	t.Setenv("PBP_TUNNEL_CONFIG", filePath)
+
+	// without a forced format the extensionless file is read as JSON
+	if cfg := LoadConfig(); cfg.Client != nil {
+		t.Errorf("LoadConfig of YAML as JSON decoded %+v; want nothing", cfg.Client)
+	}
+
+	t.Setenv("PBP_TUNNEL_CONFIG_FORMAT", "YAML")
+	cfg := LoadConfig()
+	if cfg.Client == nil {
+		t.Fatal("LoadConfig with forced yaml format decoded no client")
+	}
+	if cfg.Client.Endpoint != "noext.example.com" || cfg.Client.EndpointPort != 2222 ||
+		len(cfg.Client.AllowedIPs) != 2 || cfg.Client.MinSessionDuration != Duration(30*time.Second) {
+		t.Errorf("LoadConfig with forced yaml format = %+v", cfg.Client)
+	}
+
+	// the flag takes precedence over the environment
+	ConfigFormat = "json"
+	t.Cleanup(func() { ConfigFormat = "" })
+	if cfg := LoadConfig(); cfg.Client != nil {
+		t.Errorf("LoadConfig with --config-format json decoded %+v; want nothing", cfg.Client)
+	}
+
+	ConfigFormat = "ini"
+	if _, err := LoadConfigFile(filePath); err == nil || !strings.Contains(err.Error(), "unknown config format") {
+		t.Errorf("LoadConfigFile with ini format error = %v; want unknown config format", err)
+	}
+}
+
+func TestLoadConfigFile_FormatFromExtension(t *testing.T) {
+	os.Clearenv()
+	dir := makeTempDir(t)
+	for name, data := range map[string]string{
+		"config.yml":  "type: server\nserver:\n  port: 2022\n",
+		"config.toml": "type = \"server\"\n[server]\nport = 2022\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("WriteFile returned error: %v", err)
+		}
+		cfg, err := LoadConfigFile(path)
+		if err != nil {
+			t.Errorf("LoadConfigFile(%s) error = %v", name, err)
+			continue
+		}
+		if cfg.Server == nil || cfg.Server.BindPort != 2022 {
+			t.Errorf("LoadConfigFile(%s) server = %+v; want port 2022", name, cfg.Server)
+		}
+	}
+}
+
+func TestLoadConfig_EmbeddedProfile(t *testing.T) {
+	os.Clearenv()
+	withEmbeddedProfile(t, `{"type":"client","client":{"endpoint":"embedded.example.com","port":2222}}`)
+
+	cfg := LoadConfig()
+	if cfg.Type != "client" || cfg.Client == nil || cfg.Client.Endpoint != "embedded.example.com" {
+		t.Fatalf("LoadConfig embedded profile = %+v; want client from embedded profile", cfg)
+	}
+	if cfg.Client.EndpointPort != 2222 {
+		t.Errorf("EndpointPort = %d; want %d", cfg.Client.EndpointPort, 2222)
+	}
+}
+
+func TestLoadConfig_EmbeddedProfileBase64(t *testing.T) {
+	os.Clearenv()
+	profile := base64.StdEncoding.EncodeToString([]byte(`{"type":"server","server":{"bind":"10.0.0.1"}}`))
+	withEmbeddedProfile(t, profile)
+
+	cfg := LoadConfig()
+	if cfg.Type != "server" || cfg.Server == nil || cfg.Server.BindAddress != "10.0.0.1" {
+		t.Errorf("LoadConfig base64 profile = %+v; want server from embedded profile", cfg)
+	}
+}
+
+func TestLoadConfig_EmbeddedProfileOverridden(t *testing.T) {
+	os.Clearenv()
+	dir := withEmbeddedProfile(t, `{"type":"client","client":{"endpoint":"embedded.example.com"}}`)
+
+	// environment configuration wins
+	t.Setenv("PBP_TUNNEL_TYPE", "client")
+	t.Setenv("PBP_TUNNEL_ENDPOINT", "env.example.com")
+	if cfg := LoadConfig(); cfg.Client == nil || cfg.Client.Endpoint != "env.example.com" {
+		t.Errorf("LoadConfig with env = %+v; want env endpoint", cfg.Client)
+	}
+	os.Unsetenv("PBP_TUNNEL_TYPE")
+	os.Unsetenv("PBP_TUNNEL_ENDPOINT")
+
+	// so does a config file
+	data := []byte(`{"type":"client","client":{"endpoint":"file.example.com"}}`)
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0600); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	if cfg := LoadConfig(); cfg.Client == nil || cfg.Client.Endpoint != "file.example.com" {
+		t.Errorf("LoadConfig with file = %+v; want file endpoint", cfg.Client)
+	}
+}
+
 func TestLoadClientConfig_ValidComplete(t *testing.T) {
 	// Test with a complete valid client configuration
 	os.Clearenv()
@@ -116,7 +243,10 @@ func TestLoadClientConfig_ValidComplete(t *testing.T) {
 	t.Setenv("PBP_TUNNEL_REMOTE_PORT", "8081")
 	t.Setenv("PBP_TUNNEL_HOST_KEY_LEVEL", "0")
 
-	clientCfg := LoadClientConfig()
+	clientCfg, err := LoadClientConfig()
+	if err != nil {
+		t.Fatalf("LoadClientConfig: complete valid configuration returned error: %v", err)
+	}
 	if clientCfg == nil {
 		t.Error("LoadClientConfig: complete valid configuration returned nil")
 	} else {
@@ -162,10 +292,13 @@ func TestLoadClientConfig_MissingEndpoint(t *testing.T) {
 	t.Setenv("PBP_TUNNEL_REMOTE_HOST", "localhost")
 	t.Setenv("PBP_TUNNEL_REMOTE_PORT", "8081")
 
-	invalidClientCfg := LoadClientConfig()
+	invalidClientCfg, err := LoadClientConfig()
 	if invalidClientCfg != nil {
 		t.Error("LoadClientConfig: configuration without endpoint didn't return nil")
 	}
+	if err == nil || !strings.Contains(err.Error(), "endpoint is required") {
+		t.Errorf("LoadClientConfig: configuration without endpoint returned error %v; want %q", err, "endpoint is required")
+	}
 }
 
 func TestLoadClientConfig_InvalidPort(t *testing.T) {
@@ -181,10 +314,13 @@ func TestLoadClientConfig_InvalidPort(t *testing.T) {
 	t.Setenv("PBP_TUNNEL_REMOTE_HOST", "localhost")
 	t.Setenv("PBP_TUNNEL_REMOTE_PORT", "8081")
 
-	invalidClientCfg := LoadClientConfig()
+	invalidClientCfg, err := LoadClientConfig()
 	if invalidClientCfg != nil {
 		t.Error("LoadClientConfig: configuration with invalid port didn't return nil")
 	}
+	if err == nil || !strings.Contains(err.Error(), "endpoint port must be between 1 and 65535") {
+		t.Errorf("LoadClientConfig: configuration with invalid port returned error %v; want %q", err, "endpoint port must be between 1 and 65535")
+	}
 }
 
 func TestLoadClientConfig_MissingUsername(t *testing.T) {
@@ -200,10 +336,13 @@ func TestLoadClientConfig_MissingUsername(t *testing.T) {
 	t.Setenv("PBP_TUNNEL_REMOTE_HOST", "localhost")
 	t.Setenv("PBP_TUNNEL_REMOTE_PORT", "8081")
 
-	invalidClientCfg := LoadClientConfig()
+	invalidClientCfg, err := LoadClientConfig()
 	if invalidClientCfg != nil {
 		t.Error("LoadClientConfig: configuration without username didn't return nil")
 	}
+	if err == nil || !strings.Contains(err.Error(), "username is required") {
+		t.Errorf("LoadClientConfig: configuration without username returned error %v; want %q", err, "username is required")
+	}
 }
 
 func TestLoadClientConfig_MissingAuth(t *testing.T) {
@@ -219,10 +358,13 @@ func TestLoadClientConfig_MissingAuth(t *testing.T) {
 	t.Setenv("PBP_TUNNEL_REMOTE_HOST", "localhost")
 	t.Setenv("PBP_TUNNEL_REMOTE_PORT", "8081")
 
-	invalidClientCfg := LoadClientConfig()
+	invalidClientCfg, err := LoadClientConfig()
 	if invalidClientCfg != nil {
 		t.Error("LoadClientConfig: configuration without password or private key didn't return nil")
 	}
+	if err == nil || !strings.Contains(err.Error(), "either private_key or password must be set") {
+		t.Errorf("LoadClientConfig: configuration without password or private key returned error %v; want %q", err, "either private_key or password must be set")
+	}
 }
 
 func TestLoadServerConfig_ValidComplete(t *testing.T) {
@@ -239,10 +381,13 @@ func TestLoadServerConfig_ValidComplete(t *testing.T) {
 	t.Setenv("PBP_TUNNEL_PASSWORD", "fake")
 	t.Setenv("PBP_TUNNEL_PRIVATE_RSA_PATH", "id_rsa")
 
-	util.GenerateAndSavePrivateKeyToFile(filepath.Join(tempDir, "id_rsa"), "rsa")
+	util.GenerateAndSavePrivateKeyToFile(filepath.Join(tempDir, "id_rsa"), "rsa", util.DefaultKeyFileMode)
 	defer os.Remove("id_rsa")
 
-	serverCfg := LoadServerConfig()
+	serverCfg, err := LoadServerConfig()
+	if err != nil {
+		t.Fatalf("LoadServerConfig: complete valid configuration returned error: %v", err)
+	}
 	if serverCfg == nil {
 		t.Error("LoadServerConfig: complete valid configuration returned nil")
 	} else {
@@ -283,10 +428,13 @@ func TestLoadServerConfig_MissingBindAddress(t *testing.T) {
 
 	t.Setenv("PBP_TUNNEL_BIND", "") // Missing bind address
 
-	invalidServerCfg := LoadServerConfig()
+	invalidServerCfg, err := LoadServerConfig()
 	if invalidServerCfg != nil {
 		t.Error("LoadServerConfig: configuration without bind address didn't return nil")
 	}
+	if err == nil || !strings.Contains(err.Error(), "bind address is required") {
+		t.Errorf("LoadServerConfig: configuration without bind address returned error %v; want %q", err, "bind address is required")
+	}
 }
 
 func TestLoadServerConfig_InvalidPort(t *testing.T) {
@@ -294,17 +442,20 @@ func TestLoadServerConfig_InvalidPort(t *testing.T) {
 	os.Clearenv()
 	t.Setenv("PBP_TUNNEL_TYPE", "server")
 	t.Setenv("PBP_TUNNEL_BIND", "0.0.0.0")
-	t.Setenv("PBP_TUNNEL_PORT", "0") // Invalid port
+	t.Setenv("PBP_TUNNEL_PORT", "70000") // Invalid port, 0 asks for an ephemeral one
 	t.Setenv("PBP_TUNNEL_PORT_RANGE_START", "49152")
 	t.Setenv("PBP_TUNNEL_PORT_RANGE_END", "65535")
 	t.Setenv("PBP_TUNNEL_USERNAME", "user")
 	t.Setenv("PBP_TUNNEL_PASSWORD", "fake")
 	t.Setenv("PBP_TUNNEL_PRIVATE_RSA_PATH", "id_rsa")
 
-	invalidServerCfg := LoadServerConfig()
+	invalidServerCfg, err := LoadServerConfig()
 	if invalidServerCfg != nil {
 		t.Error("LoadServerConfig: configuration with invalid port didn't return nil")
 	}
+	if err == nil || !strings.Contains(err.Error(), "bind port must be between 0 and 65535") {
+		t.Errorf("LoadServerConfig: configuration with invalid port returned error %v; want %q", err, "bind port must be between 0 and 65535")
+	}
 }
 
 func TestLoadServerConfig_InvalidPortRange(t *testing.T) {
@@ -319,10 +470,13 @@ func TestLoadServerConfig_InvalidPortRange(t *testing.T) {
 	t.Setenv("PBP_TUNNEL_PASSWORD", "fake")
 	t.Setenv("PBP_TUNNEL_PRIVATE_RSA_PATH", "id_rsa")
 
-	invalidServerCfg := LoadServerConfig()
+	invalidServerCfg, err := LoadServerConfig()
 	if invalidServerCfg != nil {
 		t.Error("LoadServerConfig: configuration with invalid port range didn't return nil")
 	}
+	if err == nil || !strings.Contains(err.Error(), "port_range_end must be between port_range_start and 65535") {
+		t.Errorf("LoadServerConfig: configuration with invalid port range returned error %v; want %q", err, "port_range_end must be between port_range_start and 65535")
+	}
 }
 
 func TestLoadServerConfig_NoHostKey(t *testing.T) {
@@ -337,8 +491,22 @@ func TestLoadServerConfig_NoHostKey(t *testing.T) {
 	t.Setenv("PBP_TUNNEL_PASSWORD", "fake")
 	// No host key (neither RSA, ECDSA, nor ED25519)
 
-	invalidServerCfg := LoadServerConfig()
+	invalidServerCfg, err := LoadServerConfig()
 	if invalidServerCfg != nil {
 		t.Error("LoadServerConfig: configuration without host key didn't return nil")
 	}
+	if err == nil || !strings.Contains(err.Error(), "at least one host key path must be provided") {
+		t.Errorf("LoadServerConfig: configuration without host key returned error %v; want %q", err, "at least one host key path must be provided")
+	}
+}
+
+func TestLoadClientConfig_Unconfigured(t *testing.T) {
+	// Test without any configuration - flags are left to apply
+	os.Clearenv()
+	withEmbeddedProfile(t, "")
+
+	cfg, err := LoadClientConfig()
+	if cfg != nil || err != nil {
+		t.Errorf("LoadClientConfig: unconfigured = %v, %v; want nil, nil", cfg, err)
+	}
 }
@@ -1,10 +1,24 @@
 package config
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
@@ -12,10 +26,9 @@ import (
 // buildSSHClientConfig creates ssh.ClientConfig from ClientParameters\
 
 func buildSSHClientConfig(params *ClientParameters) (*ssh.ClientConfig, error) {
-	authMethods := []ssh.AuthMethod{}
-
+	var passwordAuth, keyAuth ssh.AuthMethod
 	if params.Password != "" {
-		authMethods = append(authMethods, ssh.Password(params.Password))
+		passwordAuth = ssh.Password(params.Password)
 	}
 
 	if params.PrivateKeyPath != "" {
@@ -27,7 +40,25 @@ func buildSSHClientConfig(params *ClientParameters) (*ssh.ClientConfig, error) {
 		if err != nil {
 			return nil, fmt.Errorf("parse private key: %w", err)
 		}
-		authMethods = append(authMethods, ssh.PublicKeys(signer))
+		if params.CertificatePath != "" {
+			if signer, err = certSigner(params.CertificatePath, signer); err != nil {
+				return nil, err
+			}
+		}
+		keyAuth = ssh.PublicKeys(signer)
+	}
+
+	// Servers limiting auth attempts may disconnect before the second method
+	// is tried, so the preferred one goes first
+	order := []ssh.AuthMethod{passwordAuth, keyAuth}
+	if params.PreferredAuth == "key" {
+		order = []ssh.AuthMethod{keyAuth, passwordAuth}
+	}
+	authMethods := []ssh.AuthMethod{}
+	for _, m := range order {
+		if m != nil {
+			authMethods = append(authMethods, m)
+		}
 	}
 
 	hostKeyCallback := ssh.InsecureIgnoreHostKey()
@@ -37,10 +68,19 @@ func buildSSHClientConfig(params *ClientParameters) (*ssh.ClientConfig, error) {
 			hostKeyCallback = callback
 		}
 	}
+	timeout := time.Duration(params.ConnectTimeout)
+	if timeout == 0 {
+		timeout = time.Duration(CpDefaultConnectTimeout)
+	}
 	return &ssh.ClientConfig{
+		Config: ssh.Config{
+			Ciphers:        ciphersOrDefault(params.Ciphers),
+			RekeyThreshold: params.RekeyThreshold,
+		},
 		User:            params.Username,
 		Auth:            authMethods,
 		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
 	}, nil
 }
 
@@ -50,59 +90,134 @@ func GetClientConfig(params *ClientParameters) (*ssh.ClientConfig, string, error
 	if err != nil {
 		return nil, "", err
 	}
-	addr := fmt.Sprintf("%s:%d", params.Endpoint, params.EndpointPort)
+	addr := net.JoinHostPort(params.Endpoint, strconv.Itoa(params.EndpointPort))
 	return sshCfg, addr, nil
 }
 
+// GetLocalTLSConfig returns the TLS settings for dialing the local service,
+// or nil when LocalTLS is disabled
+func GetLocalTLSConfig(params *ClientParameters) (*tls.Config, error) {
+	if !params.LocalTLS {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         params.LocalTLSServerName,
+		InsecureSkipVerify: params.LocalTLSInsecure,
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = params.LocalHost
+	}
+
+	if params.LocalTLSCA != "" {
+		pemBytes, err := os.ReadFile(params.LocalTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("read local TLS CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("no certificates found in local TLS CA %s", params.LocalTLSCA)
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
 // buildSSHServerConfig creates ssh.ServerConfig from ServerParameters
-func buildSSHServerConfig(params *ServerParameters) (*ssh.ServerConfig, error) {
+func buildSSHServerConfig(params *ServerParameters, algorithms *HostKeyAlgorithms) (*ssh.ServerConfig, error) {
 	serverCfg := &ssh.ServerConfig{}
 
-	if params.Password != "" {
+	passwordHashes := map[string][]byte{}
+	if params.Username != "" && params.PasswordHash != "" {
+		passwordHashes[params.Username] = []byte(params.PasswordHash)
+	}
+	for _, u := range params.Users {
+		if u.PasswordHash != "" {
+			passwordHashes[u.Username] = []byte(u.PasswordHash)
+		}
+	}
+	if params.AuthCommand != "" {
+		serverCfg.PasswordCallback = commandPasswordCallback(params.AuthCommand)
+	} else if params.Password != "" || len(passwordHashes) > 0 {
 		serverCfg.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			if c.User() == params.Username && string(pass) == params.Password {
+			if hash, ok := passwordHashes[c.User()]; ok {
+				if bcrypt.CompareHashAndPassword(hash, pass) == nil {
+					return nil, nil
+				}
+			} else if params.Password != "" && c.User() == params.Username && string(pass) == params.Password {
 				return nil, nil
 			}
 			return nil, fmt.Errorf("password rejected for %q", c.User())
 		}
 	}
 
+	// Unusable host keys are skipped as long as at least one loads
+	var failures []string
+	loaded := 0
 	for _, path := range []string{params.PrivateRsaPath, params.PrivateEcdsaPath, params.PrivateEd25519Path} {
 		if path == "" {
 			continue
 		}
-		keyBytes, err := os.ReadFile(path)
+		signer, err := LoadHostKey(path, algorithms)
 		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", path, err))
 			continue
 		}
-		signer, err := ssh.ParsePrivateKey(keyBytes)
-		if err == nil {
-			serverCfg.AddHostKey(signer)
-		}
+		serverCfg.AddHostKey(signer)
+		loaded++
+	}
+	if loaded == 0 && len(failures) > 0 {
+		return nil, fmt.Errorf("no usable host keys loaded (tried: %s)", strings.Join(failures, "; "))
+	}
+	for _, failure := range failures {
+		log.Printf("[-] Skipping host key %s", failure)
 	}
 
-	if params.AuthorizedKeysPath != "" {
-		authorizedKeysBytes, err := os.ReadFile(params.AuthorizedKeysPath)
-		if err != nil {
-			return nil, fmt.Errorf("read authorized keys: %w", err)
+	usersHaveKeys := false
+	for _, u := range params.Users {
+		usersHaveKeys = usersHaveKeys || u.AuthorizedKeysPath != ""
+	}
+	if params.AuthorizedKeysPath != "" || params.TrustedUserCAKeys != "" || usersHaveKeys {
+		// authorized keys by user, for Username and every entry of Users
+		keysByUser := map[string]map[string]bool{}
+		if params.Username != "" {
+			keys, err := readAuthorizedKeys(params.AuthorizedKeysPath, params.AllowInsecureKeysURL)
+			if err != nil {
+				return nil, fmt.Errorf("read authorized keys: %w", err)
+			}
+			keysByUser[params.Username] = keys
 		}
-
-		authorizedKeysMap := map[string]bool{}
-		for len(authorizedKeysBytes) > 0 {
-			pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
+		for _, u := range params.Users {
+			keys, err := readAuthorizedKeys(u.AuthorizedKeysPath, params.AllowInsecureKeysURL)
 			if err != nil {
-				log.Fatalf("An error occurred while parsing authorized keys: %v", err)
+				return nil, fmt.Errorf("read authorized keys of %q: %w", u.Username, err)
 			}
-			authorizedKeysMap[string(pubKey.Marshal())] = true
-			authorizedKeysBytes = rest
+			keysByUser[u.Username] = keys
+		}
+		userCAKeysMap, err := readAuthorizedKeys(params.TrustedUserCAKeys, params.AllowInsecureKeysURL)
+		if err != nil {
+			return nil, fmt.Errorf("read trusted user CA keys: %w", err)
 		}
 
+		// Certificates must be signed by a trusted CA and list the user as a principal,
+		// plain keys must be in the user's authorized_keys
+		checker := &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				return userCAKeysMap[string(auth.Marshal())]
+			},
+			UserKeyFallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if keysByUser[c.User()][string(key.Marshal())] {
+					return &ssh.Permissions{}, nil
+				}
+				return nil, fmt.Errorf("public key rejected for %q", c.User())
+			},
+		}
 		serverCfg.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			if c.User() == params.Username && authorizedKeysMap[string(key.Marshal())] {
-				return &ssh.Permissions{}, nil
+			if _, ok := keysByUser[c.User()]; !ok {
+				return nil, fmt.Errorf("public key rejected for %q", c.User())
 			}
-
-			return nil, fmt.Errorf("public key rejected for %q", c.User())
+			return checker.Authenticate(c, key)
 		}
 	}
 
@@ -112,25 +227,224 @@ func buildSSHServerConfig(params *ServerParameters) (*ssh.ServerConfig, error) {
 	}
 	serverCfg.ServerVersion = "SSH-2.0"
 	serverCfg.Config = ssh.Config{
-		Ciphers: []string{
-			"aes128-ctr", "aes192-ctr", "aes256-ctr",
-			"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
-		},
+		Ciphers: ciphersOrDefault(params.Ciphers),
 		KeyExchanges: []string{
 			"curve25519-sha256", "curve25519-sha256@libssh.org",
 			"diffie-hellman-group14-sha256",
 		},
+		RekeyThreshold: params.RekeyThreshold,
 	}
 
 	return serverCfg, nil
 }
 
-// GetServerConfig returns an SSH server config and listen address
-func GetServerConfig(params *ServerParameters) (*ssh.ServerConfig, string, error) {
-	sshCfg, err := buildSSHServerConfig(params)
+// GetServerConfig returns an SSH server config and listen address. The host
+// key algorithms it negotiates are recorded in algorithms, if not nil.
+func GetServerConfig(params *ServerParameters, algorithms *HostKeyAlgorithms) (*ssh.ServerConfig, string, error) {
+	sshCfg, err := buildSSHServerConfig(params, algorithms)
 	if err != nil {
 		return nil, "", err
 	}
-	addr := fmt.Sprintf("%s:%d", params.BindAddress, params.BindPort)
+	addr := net.JoinHostPort(params.BindAddress, strconv.Itoa(params.BindPort))
 	return sshCfg, addr, nil
 }
+
+// LoadHostKey reads the private host key at path, recording the algorithms it
+// negotiates in algorithms, if not nil
+func LoadHostKey(path string, algorithms *HostKeyAlgorithms) (ssh.Signer, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if multi, ok := signer.(ssh.MultiAlgorithmSigner); ok && algorithms != nil {
+		signer = recordingSigner{multi, algorithms}
+	}
+	return signer, nil
+}
+
+// certSigner pairs signer with the SSH certificate stored at path
+func certSigner(path string, signer ssh.Signer) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read certificate: %w", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("parse certificate: %s is not an SSH certificate", path)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("certificate does not match private key: %w", err)
+	}
+	return certSigner, nil
+}
+
+// authorizedKeysFetchTimeout bounds the fetch of authorized keys served over HTTP
+var authorizedKeysFetchTimeout = 10 * time.Second
+
+// isKeysURL reports whether an authorized keys path is an http(s) URL to fetch
+func isKeysURL(path string) bool {
+	return isInsecureKeysURL(path) || strings.HasPrefix(path, "https://")
+}
+
+// isInsecureKeysURL reports whether an authorized keys path is a plain http URL,
+// only fetched with AllowInsecureKeysURL
+func isInsecureKeysURL(path string) bool {
+	return strings.HasPrefix(path, "http://")
+}
+
+// fetchAuthorizedKeys downloads the authorized keys served at url
+func fetchAuthorizedKeys(url string) ([]byte, error) {
+	client := &http.Client{Timeout: authorizedKeysFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", url, err)
+	}
+	return data, nil
+}
+
+// readAuthorizedKeys parses the authorized_keys formatted file at path, or
+// served at an http(s) URL, into a set of marshaled public keys. A plain http
+// URL is refused unless allowInsecure is set. An empty path yields an empty set.
+func readAuthorizedKeys(path string, allowInsecure bool) (map[string]bool, error) {
+	keys := map[string]bool{}
+	if path == "" {
+		return keys, nil
+	}
+	var data []byte
+	var err error
+	if isKeysURL(path) {
+		if isInsecureKeysURL(path) {
+			if !allowInsecure {
+				return nil, fmt.Errorf("refusing to fetch %s over plain http without allow_insecure_keys_url", path)
+			}
+			log.Printf("[-] Fetching authorized keys from %s over plain http, they can be tampered with in transit", path)
+		}
+		data, err = fetchAuthorizedKeys(path)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for len(bytes.TrimSpace(data)) > 0 {
+		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		keys[string(pubKey.Marshal())] = true
+		data = rest
+	}
+	return keys, nil
+}
+
+// authCommandTimeout bounds how long an auth command may take to decide
+var authCommandTimeout = 10 * time.Second
+
+// authCommandUserEnv names the variable carrying the username to the auth command
+const authCommandUserEnv = envPrefix + "AUTH_USER"
+
+// commandPasswordCallback validates passwords by running command with the username
+// in PBP_TUNNEL_AUTH_USER and the password on stdin, so neither shows up in argv
+// where a client-chosen name could pass as an option. Exit status 0 accepts the login.
+func commandPasswordCallback(command string) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+		// the password is read as one line, so a newline would end it early
+		if bytes.ContainsAny(pass, "\r\n") || strings.ContainsRune(c.User(), 0) {
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), authCommandTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, command)
+		cmd.Env = append(os.Environ(), authCommandUserEnv+"="+c.User())
+		cmd.Stdin = bytes.NewReader(append(append([]byte(nil), pass...), '\n'))
+		if err := cmd.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || ctx.Err() != nil {
+				log.Printf("[-] Auth command %s failed: %v", command, err)
+			}
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		}
+		return nil, nil
+	}
+}
+
+// maxPendingHostKeyAlgorithms bounds the number of unclaimed entries kept by
+// HostKeyAlgorithms, since rekeys record exchange hashes nobody asks for.
+const maxPendingHostKeyAlgorithms = 4096
+
+// HostKeyAlgorithms maps the key exchange hashes signed by a server's host keys
+// to the algorithm that signed them
+type HostKeyAlgorithms struct {
+	lock   sync.Mutex
+	byHash map[string]string
+}
+
+// NewHostKeyAlgorithms returns an empty HostKeyAlgorithms
+func NewHostKeyAlgorithms() *HostKeyAlgorithms {
+	return &HostKeyAlgorithms{byHash: make(map[string]string)}
+}
+
+func (n *HostKeyAlgorithms) record(hash []byte, algorithm string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if len(n.byHash) >= maxPendingHostKeyAlgorithms {
+		clear(n.byHash)
+	}
+	n.byHash[string(hash)] = algorithm
+}
+
+// Take returns the host key algorithm negotiated by the connection with the
+// given session ID, or an empty string if unknown. Each session is only
+// reported once.
+func (n *HostKeyAlgorithms) Take(sessionID []byte) string {
+	if n == nil {
+		return ""
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	algorithm := n.byHash[string(sessionID)]
+	delete(n.byHash, string(sessionID))
+	return algorithm
+}
+
+// recordingSigner wraps a host key to remember which signature algorithm each
+// key exchange negotiated. The hash signed during the first exchange of a
+// connection is its session ID.
+type recordingSigner struct {
+	ssh.MultiAlgorithmSigner
+	algorithms *HostKeyAlgorithms
+}
+
+func (r recordingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	sig, err := r.MultiAlgorithmSigner.Sign(rand, data)
+	if err == nil {
+		r.algorithms.record(data, sig.Format)
+	}
+	return sig, err
+}
+
+func (r recordingSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	sig, err := r.MultiAlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+	if err == nil {
+		r.algorithms.record(data, sig.Format)
+	}
+	return sig, err
+}
@@ -1,11 +1,24 @@
 package config
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"github.com/poweredbypump/pbp-tunnel/internal/util"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ssh"
+	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // dummyConn implements ssh.ConnMetadata for testing PasswordCallback
@@ -99,12 +112,12 @@ func TestClientParameters_Validate(t *testing.T) {
 		}, true, "local_port must be between 1 and 65535"},
 
 		// Remote connection tests
-		{"missing-remote-host", &ClientParameters{
+		{"missing-remote-host-server-decides", &ClientParameters{
 			Endpoint: "example.com", EndpointPort: 22,
 			Username: "user", Password: "pass",
 			LocalHost: "localhost", LocalPort: 8080,
 			RemotePort: 9090,
-		}, true, "remote_host is required"},
+		}, false, ""},
 
 		{"invalid-remote-port-minus-one", &ClientParameters{
 			Endpoint: "example.com", EndpointPort: 22,
@@ -150,7 +163,7 @@ func TestServerParameters_Validate(t *testing.T) {
 	}{
 		{"valid-parameters", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, false, ""},
 		{"missing-bind-address", &ServerParameters{BindAddress: "", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "bind address is required"},
-		{"invalid-bindport", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 0, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "bind port must be between 1 and 65535"},
+		{"invalid-bindport", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 70000, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "bind port must be between 0 and 65535"},
 		{"invalid-range-start", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: -1, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "port_range_start must be between 0 and 65535"},
 		{"range-start-too-high", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 70000, PortRangeEnd: 80000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "port_range_start must be between 0 and 65535"},
 		{"invalid-range-end", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 3000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "port_range_end must be between port_range_start and 65535"},
@@ -163,6 +176,15 @@ func TestServerParameters_Validate(t *testing.T) {
 		{"only-ecdsa-key", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: "", PrivateEcdsaPath: filepath.Join(tempDir, "/id_ecdsa")}, false, ""},
 		{"only-ed25519-key", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 1000, PortRangeEnd: 2000, Username: "user", Password: "pass", PrivateRsaPath: "", PrivateEd25519Path: filepath.Join(tempDir, "/id_ed25519")}, false, ""},
 		{"zero-port-range", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, PortRangeStart: 3000, PortRangeEnd: 3000, Username: "user", Password: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, false, ""},
+		{"users-only", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, Users: []UserCred{{Username: "alice", PasswordHash: testHash}, {Username: "bob", AuthorizedKeysPath: "/keys"}}, PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, false, ""},
+		{"user-without-name", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, Users: []UserCred{{PasswordHash: testHash}}, PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "users[0]: username is required"},
+		{"duplicate-user", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, Username: "alice", Password: "pass", Users: []UserCred{{Username: "alice", PasswordHash: testHash}}, PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, `users[0]: duplicate username "alice"`},
+		{"user-without-credentials", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, Users: []UserCred{{Username: "alice"}}, PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "users[0]: password_hash or authorized_keys_path must be set"},
+		{"user-with-ca-only", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, TrustedUserCAKeys: "/ca.pub", Users: []UserCred{{Username: "alice"}}, PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, false, ""},
+		{"password-hash", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, Username: "user", PasswordHash: testHash, PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, false, ""},
+		{"password-and-hash", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, Username: "user", Password: "pass", PasswordHash: testHash, PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "password and password_hash must not both be set"},
+		{"invalid-password-hash", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, Username: "user", PasswordHash: "pass", PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "password_hash is not a bcrypt hash"},
+		{"user-plaintext-password", &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, Users: []UserCred{{Username: "alice", PasswordHash: "secret"}}, PrivateRsaPath: filepath.Join(tempDir, "/id_rsa")}, true, "users[0]: password_hash is not a bcrypt hash"},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -208,6 +230,58 @@ func TestGetClientConfig_PasswordAuth(t *testing.T) {
 	}
 }
 
+func TestGetClientConfig_PreferredAuthOrder(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if _, err := util.GenerateAndSavePrivateKeyToFile(keyPath, "ed25519", util.DefaultKeyFileMode); err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tests := []struct {
+		preferred string
+		want      []string
+	}{
+		{"", []string{"ssh.passwordCallback", "ssh.publicKeyCallback"}},
+		{"auto", []string{"ssh.passwordCallback", "ssh.publicKeyCallback"}},
+		{"password", []string{"ssh.passwordCallback", "ssh.publicKeyCallback"}},
+		{"key", []string{"ssh.publicKeyCallback", "ssh.passwordCallback"}},
+	}
+	for _, tt := range tests {
+		sshCfg, _, err := GetClientConfig(&ClientParameters{
+			Username:       "testuser",
+			Password:       "secret",
+			PrivateKeyPath: keyPath,
+			PreferredAuth:  tt.preferred,
+			Endpoint:       "example.com",
+			EndpointPort:   2222,
+		})
+		if err != nil {
+			t.Fatalf("preferred %q: GetClientConfig returned error: %v", tt.preferred, err)
+		}
+		var got []string
+		for _, m := range sshCfg.Auth {
+			got = append(got, fmt.Sprintf("%T", m))
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("preferred %q: auth methods = %v; want %v", tt.preferred, got, tt.want)
+		}
+	}
+}
+
+func TestGetClientConfig_IPv6Endpoint(t *testing.T) {
+	params := &ClientParameters{
+		Username:     "testuser",
+		Password:     "secret",
+		Endpoint:     "::1",
+		EndpointPort: 2222,
+	}
+	_, addr, err := GetClientConfig(params)
+	if err != nil {
+		t.Fatalf("GetClientConfig returned error: %v", err)
+	}
+	if addr != "[::1]:2222" {
+		t.Errorf("addr = %q; want %q", addr, "[::1]:2222")
+	}
+}
+
 func TestGetClientConfig_PrivateKeyPathError(t *testing.T) {
 	params := &ClientParameters{
 		Username:       "testuser",
@@ -224,6 +298,44 @@ func TestGetClientConfig_PrivateKeyPathError(t *testing.T) {
 	}
 }
 
+func TestGetClientConfig_RekeyThreshold(t *testing.T) {
+	params := &ClientParameters{
+		Username:       "testuser",
+		Password:       "secret",
+		Endpoint:       "example.com",
+		EndpointPort:   22,
+		RekeyThreshold: 256 << 20,
+	}
+	sshCfg, _, err := GetClientConfig(params)
+	if err != nil {
+		t.Fatalf("GetClientConfig returned error: %v", err)
+	}
+	if sshCfg.RekeyThreshold != params.RekeyThreshold {
+		t.Errorf("RekeyThreshold = %d; want %d", sshCfg.RekeyThreshold, params.RekeyThreshold)
+	}
+}
+
+func TestGetClientConfig_ConnectTimeout(t *testing.T) {
+	params := &ClientParameters{
+		Username:     "testuser",
+		Password:     "secret",
+		Endpoint:     "example.com",
+		EndpointPort: 22,
+	}
+	sshCfg, _, err := GetClientConfig(params)
+	if err != nil {
+		t.Fatalf("GetClientConfig returned error: %v", err)
+	}
+	if sshCfg.Timeout != time.Duration(CpDefaultConnectTimeout) {
+		t.Errorf("default Timeout = %v; want %v", sshCfg.Timeout, time.Duration(CpDefaultConnectTimeout))
+	}
+
+	params.ConnectTimeout = Duration(3 * time.Second)
+	if sshCfg, _, _ = GetClientConfig(params); sshCfg.Timeout != 3*time.Second {
+		t.Errorf("Timeout = %v; want 3s", sshCfg.Timeout)
+	}
+}
+
 func TestGetServerConfig_PasswordCallback(t *testing.T) {
 	params := &ServerParameters{
 		BindAddress:    "0.0.0.0",
@@ -232,7 +344,7 @@ func TestGetServerConfig_PasswordCallback(t *testing.T) {
 		Password:       "passwd",
 		PrivateRsaPath: "", // no host key file
 	}
-	sshCfg, addr, err := GetServerConfig(params)
+	sshCfg, addr, err := GetServerConfig(params, nil)
 	if err != nil {
 		t.Fatalf("GetServerConfig returned error: %v", err)
 	}
@@ -254,6 +366,269 @@ func TestGetServerConfig_PasswordCallback(t *testing.T) {
 	}
 }
 
+// testHash is a bcrypt hash of "alice-pass"
+var testHash = func() string {
+	h, err := bcrypt.GenerateFromPassword([]byte("alice-pass"), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	return string(h)
+}()
+
+func TestGetServerConfig_PasswordHash(t *testing.T) {
+	sshCfg, _, err := GetServerConfig(&ServerParameters{
+		BindAddress:  "0.0.0.0",
+		BindPort:     2022,
+		Username:     "admin",
+		PasswordHash: testHash,
+	}, nil)
+	if err != nil {
+		t.Fatalf("GetServerConfig returned error: %v", err)
+	}
+	cb := sshCfg.PasswordCallback
+	if cb == nil {
+		t.Fatal("expected PasswordCallback to be set, got nil")
+	}
+	if _, err := cb(&dummyConn{user: "admin"}, []byte("alice-pass")); err != nil {
+		t.Errorf("PasswordCallback with the hashed password error = %v; want nil", err)
+	}
+	if _, err := cb(&dummyConn{user: "admin"}, []byte(testHash)); err == nil {
+		t.Error("PasswordCallback accepted the hash itself as the password")
+	}
+	if _, err := cb(&dummyConn{user: "other"}, []byte("alice-pass")); err == nil {
+		t.Error("PasswordCallback accepted another user")
+	}
+}
+
+func TestGetServerConfig_Users(t *testing.T) {
+	dir := t.TempDir()
+	bobKey, bobKeys := newTestCA(t, dir, "bob")
+	otherKey, _ := newTestCA(t, dir, "other")
+
+	sshCfg, _, err := GetServerConfig(&ServerParameters{
+		BindAddress: "0.0.0.0",
+		BindPort:    2022,
+		Username:    "admin",
+		Password:    "passwd",
+		Users: []UserCred{
+			{Username: "alice", PasswordHash: testHash},
+			{Username: "bob", AuthorizedKeysPath: bobKeys},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("GetServerConfig returned error: %v", err)
+	}
+
+	passwords := []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"admin", "passwd", true},
+		{"alice", "alice-pass", true},
+		{"alice", "passwd", false},
+		{"admin", "alice-pass", false},
+		{"bob", "alice-pass", false},
+		{"mallory", "alice-pass", false},
+	}
+	for _, tc := range passwords {
+		_, err := sshCfg.PasswordCallback(&dummyConn{user: tc.user}, []byte(tc.pass))
+		if (err == nil) != tc.ok {
+			t.Errorf("PasswordCallback(%s, %s) error = %v; want ok %v", tc.user, tc.pass, err, tc.ok)
+		}
+	}
+
+	keys := []struct {
+		user string
+		key  ssh.PublicKey
+		ok   bool
+	}{
+		{"bob", bobKey.PublicKey(), true},
+		{"bob", otherKey.PublicKey(), false},
+		{"alice", bobKey.PublicKey(), false},
+		{"admin", bobKey.PublicKey(), false},
+	}
+	for _, tc := range keys {
+		_, err := sshCfg.PublicKeyCallback(&dummyConn{user: tc.user}, tc.key)
+		if (err == nil) != tc.ok {
+			t.Errorf("PublicKeyCallback(%s) error = %v; want ok %v", tc.user, err, tc.ok)
+		}
+	}
+}
+
+func TestGetServerConfig_AuthorizedKeysURL(t *testing.T) {
+	dir := t.TempDir()
+	allowed, _ := newTestCA(t, dir, "allowed")
+	other, _ := newTestCA(t, dir, "other")
+	keys := ssh.MarshalAuthorizedKey(allowed.PublicKey())
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(keys)
+	}))
+	defer ts.Close()
+
+	sshCfg, _, err := GetServerConfig(&ServerParameters{
+		BindAddress:          "0.0.0.0",
+		BindPort:             2022,
+		Username:             "admin",
+		AuthorizedKeysPath:   ts.URL + "/keys",
+		AllowInsecureKeysURL: true,
+		Users:                []UserCred{{Username: "bob", AuthorizedKeysPath: ts.URL + "/bob"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("GetServerConfig returned error: %v", err)
+	}
+	for _, user := range []string{"admin", "bob"} {
+		if _, err := sshCfg.PublicKeyCallback(&dummyConn{user: user}, allowed.PublicKey()); err != nil {
+			t.Errorf("PublicKeyCallback(%s) with a served key error = %v; want nil", user, err)
+		}
+		if _, err := sshCfg.PublicKeyCallback(&dummyConn{user: user}, other.PublicKey()); err == nil {
+			t.Errorf("PublicKeyCallback(%s) accepted a key not served", user)
+		}
+	}
+}
+
+func TestGetServerConfig_AuthorizedKeysURLErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/garbage" {
+			w.Write([]byte("not a key\n"))
+			return
+		}
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		path, wantErr string
+	}{
+		{ts.URL + "/keys", "503 Service Unavailable"},
+		{ts.URL + "/garbage", "parse " + ts.URL + "/garbage"},
+	}
+	for _, tt := range tests {
+		_, _, err := GetServerConfig(&ServerParameters{
+			BindAddress:          "0.0.0.0",
+			BindPort:             2022,
+			Username:             "admin",
+			AuthorizedKeysPath:   tt.path,
+			AllowInsecureKeysURL: true,
+		}, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("GetServerConfig(%s) error = %v; want one containing %q", tt.path, err, tt.wantErr)
+		}
+	}
+}
+
+// TestGetServerConfig_AuthorizedKeysURLInsecure checks that keys served over
+// plain http are only fetched with AllowInsecureKeysURL, and with a warning
+func TestGetServerConfig_AuthorizedKeysURLInsecure(t *testing.T) {
+	var fetches atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+	}))
+	defer ts.Close()
+
+	params := &ServerParameters{BindAddress: "0.0.0.0", BindPort: 2022, Username: "admin", AuthorizedKeysPath: ts.URL}
+	if _, _, err := GetServerConfig(params, nil); err == nil || !strings.Contains(err.Error(), "allow_insecure_keys_url") {
+		t.Errorf("GetServerConfig over http error = %v; want allow_insecure_keys_url refusal", err)
+	}
+	if n := fetches.Load(); n != 0 {
+		t.Errorf("keys fetched %d times without opt-in; want 0", n)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	params.AllowInsecureKeysURL = true
+	if _, _, err := GetServerConfig(params, nil); err != nil {
+		t.Fatalf("GetServerConfig with allow_insecure_keys_url error = %v; want nil", err)
+	}
+	if !strings.Contains(logs.String(), "over plain http") {
+		t.Errorf("no plain http warning in logs: %q", logs.String())
+	}
+}
+
+func TestGetServerConfig_IPv6Bind(t *testing.T) {
+	params := &ServerParameters{
+		BindAddress: "::",
+		BindPort:    2022,
+		Username:    "admin",
+		Password:    "passwd",
+	}
+	_, addr, err := GetServerConfig(params, nil)
+	if err != nil {
+		t.Fatalf("GetServerConfig returned error: %v", err)
+	}
+	if addr != "[::]:2022" {
+		t.Errorf("addr = %q; want %q", addr, "[::]:2022")
+	}
+}
+
+func TestGetServerConfig_RekeyThreshold(t *testing.T) {
+	params := &ServerParameters{
+		BindAddress:    "127.0.0.1",
+		BindPort:       8022,
+		Username:       "admin",
+		Password:       "passwd",
+		RekeyThreshold: 512 << 20,
+	}
+	sshCfg, _, err := GetServerConfig(params, nil)
+	if err != nil {
+		t.Fatalf("GetServerConfig returned error: %v", err)
+	}
+	if sshCfg.RekeyThreshold != params.RekeyThreshold {
+		t.Errorf("RekeyThreshold = %d; want %d", sshCfg.RekeyThreshold, params.RekeyThreshold)
+	}
+	// cipher and key exchange restrictions must be preserved alongside the threshold
+	if len(sshCfg.Ciphers) == 0 || len(sshCfg.KeyExchanges) == 0 {
+		t.Errorf("expected ciphers and key exchanges to remain configured")
+	}
+}
+
+func TestGetServerConfig_NoUsableHostKeys(t *testing.T) {
+	tempDir := makeTempDir(t)
+	garbage := filepath.Join(tempDir, "garbage_key")
+	if err := os.WriteFile(garbage, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("write garbage key: %v", err)
+	}
+	missing := filepath.Join(tempDir, "missing_key")
+
+	params := &ServerParameters{
+		BindAddress:      "127.0.0.1",
+		BindPort:         8022,
+		Username:         "admin",
+		Password:         "passwd",
+		PrivateRsaPath:   missing,
+		PrivateEcdsaPath: garbage,
+	}
+	_, _, err := GetServerConfig(params, nil)
+	if err == nil {
+		t.Fatal("expected error when no host key loads, got nil")
+	}
+	for _, want := range []string{"no usable host keys loaded", missing, garbage} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestGetServerConfig_SkipsBadHostKey(t *testing.T) {
+	tempDir := makeTempDir(t)
+	good := filepath.Join(tempDir, "id_ed25519")
+	if _, err := util.GenerateAndSavePrivateKeyToFile(good, "ed25519", util.DefaultKeyFileMode); err != nil {
+		t.Fatalf("generate host key: %v", err)
+	}
+
+	params := &ServerParameters{
+		BindAddress:        "127.0.0.1",
+		BindPort:           8022,
+		Username:           "admin",
+		Password:           "passwd",
+		PrivateRsaPath:     filepath.Join(tempDir, "missing_key"),
+		PrivateEd25519Path: good,
+	}
+	if _, _, err := GetServerConfig(params, nil); err != nil {
+		t.Fatalf("expected a bad key to be skipped when another loads, got %v", err)
+	}
+}
+
 func TestGetServerConfig_NoAuth(t *testing.T) {
 	params := &ServerParameters{
 		BindAddress:    "127.0.0.1",
@@ -262,7 +637,7 @@ func TestGetServerConfig_NoAuth(t *testing.T) {
 		Password:       "",
 		PrivateRsaPath: "", // no host key
 	}
-	sshCfg, _, err := GetServerConfig(params)
+	sshCfg, _, err := GetServerConfig(params, nil)
 	if err != nil {
 		t.Fatalf("GetServerConfig returned error: %v", err)
 	}
@@ -271,3 +646,201 @@ func TestGetServerConfig_NoAuth(t *testing.T) {
 		t.Errorf("expected PasswordCallback to be nil, got non-nil")
 	}
 }
+
+func TestGetLocalTLSConfig(t *testing.T) {
+	cfg, err := GetLocalTLSConfig(&ClientParameters{LocalHost: "localhost"})
+	if cfg != nil || err != nil {
+		t.Errorf("disabled: got %v, %v; want nil, nil", cfg, err)
+	}
+
+	cfg, err = GetLocalTLSConfig(&ClientParameters{LocalHost: "backend.internal", LocalTLS: true})
+	if err != nil || cfg.ServerName != "backend.internal" {
+		t.Errorf("default server name: got %v, %v; want backend.internal", cfg, err)
+	}
+
+	badCA := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(badCA, []byte("not a certificate"), 0600)
+	if _, err := GetLocalTLSConfig(&ClientParameters{LocalHost: "localhost", LocalTLS: true, LocalTLSCA: badCA}); err == nil {
+		t.Error("expected an error for a CA file without certificates")
+	}
+}
+
+// newTestCA returns a CA signer and the path of a file holding its public key
+func newTestCA(t *testing.T, dir, name string) (ssh.Signer, string) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate CA key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("CA signer: %v", err)
+	}
+	path := filepath.Join(dir, name+".pub")
+	if err := os.WriteFile(path, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		t.Fatalf("write CA key: %v", err)
+	}
+	return signer, path
+}
+
+// writeUserCert signs key for principal with ca and writes the certificate to path
+func writeUserCert(t *testing.T, path string, ca ssh.Signer, key ssh.PublicKey, principal string) {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: []string{principal},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("sign certificate: %v", err)
+	}
+	if err := os.WriteFile(path, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+}
+
+func TestCertificateAuth(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "id_ed25519")
+	keyPem, err := util.GenerateAndSavePrivateKeyToFile(keyPath, "ed25519", 0)
+	if err != nil {
+		t.Fatalf("generate user key: %v", err)
+	}
+	userSigner, err := ssh.ParsePrivateKey(keyPem)
+	if err != nil {
+		t.Fatalf("parse user key: %v", err)
+	}
+	trustedCA, trustedPath := newTestCA(t, dir, "trusted_ca")
+	untrustedCA, _ := newTestCA(t, dir, "untrusted_ca")
+
+	serverCfg, _, err := GetServerConfig(&ServerParameters{
+		BindAddress:       "127.0.0.1",
+		BindPort:          2022,
+		Username:          "testuser",
+		TrustedUserCAKeys: trustedPath,
+	}, nil)
+	if err != nil {
+		t.Fatalf("GetServerConfig returned error: %v", err)
+	}
+	serverCfg.AddHostKey(trustedCA)
+
+	tests := []struct {
+		name      string
+		ca        ssh.Signer
+		principal string
+		wantErr   bool
+	}{
+		{"trusted-ca", trustedCA, "testuser", false},
+		{"untrusted-ca", untrustedCA, "testuser", true},
+		{"wrong-principal", trustedCA, "someone-else", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			certPath := filepath.Join(t.TempDir(), "id_ed25519-cert.pub")
+			writeUserCert(t, certPath, tc.ca, userSigner.PublicKey(), tc.principal)
+			clientCfg, _, err := GetClientConfig(&ClientParameters{
+				Endpoint:        "pipe",
+				EndpointPort:    22,
+				Username:        "testuser",
+				PrivateKeyPath:  keyPath,
+				CertificatePath: certPath,
+			})
+			if err != nil {
+				t.Fatalf("GetClientConfig returned error: %v", err)
+			}
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			defer ln.Close()
+			go func() {
+				serverEnd, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer serverEnd.Close()
+				if conn, _, _, err := ssh.NewServerConn(serverEnd, serverCfg); err == nil {
+					conn.Close()
+				}
+			}()
+			clientEnd, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer clientEnd.Close()
+			conn, _, _, err := ssh.NewClientConn(clientEnd, "pipe", clientCfg)
+			if err == nil {
+				conn.Close()
+			}
+			if (err != nil) != tc.wantErr {
+				t.Errorf("handshake error = %v; wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetClientConfig_CertificateMismatch(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "id_ed25519")
+	if _, err := util.GenerateAndSavePrivateKeyToFile(keyPath, "ed25519", 0); err != nil {
+		t.Fatalf("generate user key: %v", err)
+	}
+	ca, _ := newTestCA(t, dir, "ca")
+	certPath := filepath.Join(dir, "other-cert.pub")
+	writeUserCert(t, certPath, ca, ca.PublicKey(), "testuser")
+
+	_, _, err := GetClientConfig(&ClientParameters{
+		Endpoint:        "example.com",
+		EndpointPort:    22,
+		Username:        "testuser",
+		PrivateKeyPath:  keyPath,
+		CertificatePath: certPath,
+	})
+	if err == nil || !strings.Contains(err.Error(), "does not match private key") {
+		t.Errorf("GetClientConfig error = %v; want certificate mismatch", err)
+	}
+}
+
+func TestDefaultCiphers_IncludeChaCha20(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if _, err := util.GenerateAndSavePrivateKeyToFile(keyPath, "ed25519", util.DefaultKeyFileMode); err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	serverCfg, _, err := GetServerConfig(&ServerParameters{BindAddress: "127.0.0.1", BindPort: 2022, Username: "user", Password: "pass", PrivateEd25519Path: keyPath}, nil)
+	if err != nil {
+		t.Fatalf("GetServerConfig returned error: %v", err)
+	}
+	clientCfg, _, err := GetClientConfig(&ClientParameters{Username: "user", Password: "pass", Endpoint: "example.com", EndpointPort: 2222})
+	if err != nil {
+		t.Fatalf("GetClientConfig returned error: %v", err)
+	}
+	for name, ciphers := range map[string][]string{"server": serverCfg.Ciphers, "client": clientCfg.Ciphers} {
+		if !slices.Contains(ciphers, CipherChaCha20Poly1305) {
+			t.Errorf("%s ciphers = %v; want %s included", name, ciphers, CipherChaCha20Poly1305)
+		}
+	}
+
+	// ChaCha20 leads without AES acceleration and follows AES-GCM with it,
+	// and AES-CTR always comes after the AEAD ciphers
+	prev := aesHardware
+	t.Cleanup(func() { aesHardware = prev })
+	for _, hw := range []bool{true, false} {
+		aesHardware = hw
+		ciphers := DefaultCiphers()
+		if first := ciphers[0] == CipherChaCha20Poly1305; first == hw {
+			t.Errorf("aes hardware %v: ciphers = %v; want chacha20 first only without it", hw, ciphers)
+		}
+		if i := slices.Index(ciphers, CipherChaCha20Poly1305); i > slices.Index(ciphers, CipherAES128CTR) {
+			t.Errorf("aes hardware %v: ciphers = %v; want chacha20 before AES-CTR", hw, ciphers)
+		}
+	}
+
+	custom, _, err := GetClientConfig(&ClientParameters{Username: "user", Password: "pass", Endpoint: "example.com", EndpointPort: 2222, Ciphers: StringArray{CipherAES256CTR}})
+	if err != nil {
+		t.Fatalf("GetClientConfig returned error: %v", err)
+	}
+	if !slices.Equal(custom.Ciphers, []string{CipherAES256CTR}) {
+		t.Errorf("client ciphers = %v; want the configured [%s]", custom.Ciphers, CipherAES256CTR)
+	}
+}
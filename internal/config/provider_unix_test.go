@@ -0,0 +1,107 @@
+//go:build unix
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestGetServerConfig_AuthCommand checks that passwords are decided by the auth
+// command and that neither the username nor the password is passed on its command line
+func TestGetServerConfig_AuthCommand(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := filepath.Join(dir, "auth.sh")
+	body := "#!/bin/sh\n" +
+		"echo \"$@\" >> " + argsFile + "\n" +
+		"read -r pass\n" +
+		"[ \"$PBP_TUNNEL_AUTH_USER\" = alice ] && [ \"$pass\" = s3cret ]\n"
+	if err := os.WriteFile(script, []byte(body), 0700); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+
+	params := &ServerParameters{
+		BindAddress: "127.0.0.1",
+		BindPort:    2022,
+		Password:    "static",
+		AuthCommand: script,
+	}
+	sshCfg, _, err := GetServerConfig(params, nil)
+	if err != nil {
+		t.Fatalf("GetServerConfig returned error: %v", err)
+	}
+	cb := sshCfg.PasswordCallback
+
+	if _, err := cb(&dummyConn{user: "alice"}, []byte("s3cret")); err != nil {
+		t.Errorf("PasswordCallback(alice, s3cret) = %v; want nil", err)
+	}
+	if _, err := cb(&dummyConn{user: "alice"}, []byte("wrong")); err == nil {
+		t.Error("expected error for wrong password, got nil")
+	}
+	if _, err := cb(&dummyConn{user: "bob"}, []byte("s3cret")); err == nil {
+		t.Error("expected error for unknown user, got nil")
+	}
+	// The static password no longer applies
+	if _, err := cb(&dummyConn{user: "alice"}, []byte("static")); err == nil {
+		t.Error("expected static password to be ignored, got nil error")
+	}
+	// A username cannot pass as an option to the script
+	if _, err := cb(&dummyConn{user: "--help"}, []byte("s3cret")); err == nil {
+		t.Error("expected error for user --help, got nil")
+	}
+
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read args: %v", err)
+	}
+	if strings.Contains(string(args), "s3cret") {
+		t.Errorf("password leaked into argv: %q", args)
+	}
+	if strings.TrimSpace(string(args)) != "" {
+		t.Errorf("auth command got arguments %q; want none", args)
+	}
+}
+
+// TestGetServerConfig_AuthCommandRejectsNewline checks that a password spanning
+// several lines is refused without running the command, which reads only the first
+func TestGetServerConfig_AuthCommandRejectsNewline(t *testing.T) {
+	dir := t.TempDir()
+	ranFile := filepath.Join(dir, "ran")
+	script := filepath.Join(dir, "auth.sh")
+	body := "#!/bin/sh\n" +
+		"touch " + ranFile + "\n" +
+		"read -r pass\n" +
+		"[ \"$pass\" = s3cret ]\n"
+	if err := os.WriteFile(script, []byte(body), 0700); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+
+	sshCfg, _, err := GetServerConfig(&ServerParameters{BindAddress: "127.0.0.1", BindPort: 2022, AuthCommand: script}, nil)
+	if err != nil {
+		t.Fatalf("GetServerConfig returned error: %v", err)
+	}
+	if _, err := sshCfg.PasswordCallback(&dummyConn{user: "alice"}, []byte("s3cret\nextra")); err == nil {
+		t.Error("expected error for a password containing a newline, got nil")
+	}
+	if _, err := os.Stat(ranFile); !os.IsNotExist(err) {
+		t.Errorf("auth command ran for a password containing a newline (stat: %v)", err)
+	}
+}
+
+func TestGetServerConfig_AuthCommandMissing(t *testing.T) {
+	params := &ServerParameters{
+		BindAddress: "127.0.0.1",
+		BindPort:    2022,
+		AuthCommand: filepath.Join(t.TempDir(), "missing"),
+	}
+	sshCfg, _, err := GetServerConfig(params, nil)
+	if err != nil {
+		t.Fatalf("GetServerConfig returned error: %v", err)
+	}
+	if _, err := sshCfg.PasswordCallback(&dummyConn{user: "alice"}, []byte("s3cret")); err == nil {
+		t.Error("expected error when the auth command cannot run, got nil")
+	}
+}
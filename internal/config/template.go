@@ -2,12 +2,14 @@ package config
 
 import (
 	"bufio"
+	"bytes"
 	_ "embed"
+	"encoding/json"
 	"fmt"
-	"html/template"
 	"os"
 	"strconv"
 	"strings"
+	"text/template"
 )
 
 //go:embed templates/config.json.tmpl
@@ -29,7 +31,7 @@ func GenerateConfigTemplate() error {
 			Password:     ask("Password", "changeme"),
 			LocalHost:    ask("Local host to forward", "localhost"),
 			LocalPort:    askInt("Local port", 8080),
-			RemoteHost:   ask("Remote host to expose", "localhost"),
+			RemoteHost:   ask("Remote host to expose (empty for server's choice)", ""),
 			RemotePort:   askInt("Remote port to request", 0),
 		}
 	} else if mode == "server" {
@@ -54,19 +56,35 @@ func GenerateConfigTemplate() error {
 	}
 
 	outFile := ask("Output file path", "config.json")
-	f, err := os.Create(outFile)
+	size, err := writeConfigTemplate(outFile, &config)
 	if err != nil {
-		return fmt.Errorf("Error creating file: %w", err)
+		return err
 	}
-	defer f.Close()
 
+	fmt.Printf("Configuration written to %s (%d bytes)\n", outFile, size)
+	return nil
+}
+
+// writeConfigTemplate renders config through the JSON template, checks that the
+// result parses back into an AppConfig and writes it to outFile.
+// It returns the number of bytes written.
+func writeConfigTemplate(outFile string, config *AppConfig) (int, error) {
+	var buf bytes.Buffer
 	tmpl := template.Must(template.New("config").Parse(configJsonTemplate))
-	if err := tmpl.Execute(f, config); err != nil {
-		return fmt.Errorf("Error generating config: %w", err)
+	if err := tmpl.Execute(&buf, config); err != nil {
+		return 0, fmt.Errorf("Error generating config: %w", err)
 	}
 
-	fmt.Printf("Configuration written to %s\n", outFile)
-	return nil
+	var check AppConfig
+	if err := json.Unmarshal(buf.Bytes(), &check); err != nil {
+		return 0, fmt.Errorf("Error validating generated config: %w", err)
+	}
+
+	if err := os.WriteFile(outFile, buf.Bytes(), 0644); err != nil {
+		return 0, fmt.Errorf("Error creating file: %w", err)
+	}
+
+	return buf.Len(), nil
 }
 
 func ask(prompt, defaultVal string) string {
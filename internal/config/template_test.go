@@ -132,6 +132,12 @@ func TestGenerateConfigTemplate_ClientDefaults(t *testing.T) {
 	if cfg.Client.LocalPort != 8080 {
 		t.Errorf("LocalPort = %d; want %d", cfg.Client.LocalPort, 8080)
 	}
+	if cfg.Client.RemoteHost != "" {
+		t.Errorf("RemoteHost = %q; want empty", cfg.Client.RemoteHost)
+	}
+	if strings.Contains(string(data), "remote_host") {
+		t.Errorf("config.json should omit remote_host by default:\n%s", data)
+	}
 }
 
 func TestGenerateConfigTemplate_ServerDefaults(t *testing.T) {
@@ -172,3 +178,61 @@ func TestGenerateConfigTemplate_ServerDefaults(t *testing.T) {
 		t.Errorf("BindAddress = %q; want %q", cfg.Server.BindAddress, "0.0.0.0")
 	}
 }
+
+func TestWriteConfigTemplate_PreservesSpecialCharacters(t *testing.T) {
+	dir := makeTempDir(t)
+	out := filepath.Join(dir, "config.json")
+
+	password := "p&ss<w>rd"
+	cfg := &AppConfig{
+		Type: "server",
+		Server: &ServerParameters{
+			BindAddress:    "0.0.0.0",
+			BindPort:       52135,
+			PortRangeStart: 49152,
+			PortRangeEnd:   65535,
+			Username:       "user",
+			Password:       password,
+			PrivateRsaPath: "id_rsa",
+		},
+	}
+
+	size, err := writeConfigTemplate(out, cfg)
+	if err != nil {
+		t.Fatalf("writeConfigTemplate error: %v", err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("ReadFile error: %v", err)
+	}
+	if size != len(data) {
+		t.Errorf("reported size = %d; want %d", size, len(data))
+	}
+
+	var got AppConfig
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	if got.Server == nil || got.Server.Password != password {
+		t.Errorf("Password = %+v; want %q", got.Server, password)
+	}
+}
+
+func TestWriteConfigTemplate_InvalidJSON(t *testing.T) {
+	dir := makeTempDir(t)
+	out := filepath.Join(dir, "config.json")
+
+	// A double quote cannot be represented by the raw template and must be rejected
+	cfg := &AppConfig{
+		Type:   "client",
+		Client: &ClientParameters{Endpoint: "127.0.0.1", Password: `bad"quote`},
+	}
+
+	if _, err := writeConfigTemplate(out, cfg); err == nil {
+		t.Fatal("expected validation error for invalid generated JSON")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("config file should not be written when validation fails")
+	}
+}
@@ -0,0 +1,171 @@
+// Package protocol defines the wire constants shared by the pbp-tunnel client and server.
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrorCode is a status word sent as a 4-byte big-endian frame during the
+// tunnel handshake. Port assignment failures are sent with ErrMask set, so
+// they can be told apart from an assigned port number.
+type ErrorCode uint32
+
+const (
+	ErrSuccess         ErrorCode = 0
+	ErrPortUnavailable ErrorCode = 1
+	ErrIPNotAllowed    ErrorCode = 2
+	ErrPortOutOfRange  ErrorCode = 3
+	ErrInternal        ErrorCode = 4
+	// ErrProtocolMismatch rejects a client below the server's minimum protocol
+	// version; the minimum follows as a second 4-byte frame
+	ErrProtocolMismatch ErrorCode = 5
+	// ErrWarmingUp asks the client to retry later, while the server smooths
+	// the reconnect burst after a restart
+	ErrWarmingUp ErrorCode = 6
+	// ErrDraining refuses new forwards on a server that is being drained;
+	// the client should reconnect elsewhere
+	ErrDraining ErrorCode = 7
+	// ErrBindHostNotAllowed refuses a requested bind host missing from the
+	// server's allowed bind hosts
+	ErrBindHostNotAllowed ErrorCode = 8
+	// ErrWhitelistBudget refuses a client whitelist that would take the
+	// server over its budget of whitelist entries across all sessions
+	ErrWhitelistBudget ErrorCode = 9
+	// ErrWhitelistTooLarge refuses a client whitelist with more entries than
+	// the server reads in a handshake
+	ErrWhitelistTooLarge ErrorCode = 10
+	// ErrPortRequired refuses a request for port 0 on a server that only
+	// assigns the ports clients ask for
+	ErrPortRequired ErrorCode = 11
+	// ErrPortQuota refuses a port to a client IP that already holds the
+	// server's maximum number of ports
+	ErrPortQuota ErrorCode = 12
+	// ErrOverloaded asks the client to retry later, while the server sheds
+	// load until it is back below its low-water marks
+	ErrOverloaded ErrorCode = 13
+	// ErrWhitelistEmpty refuses a client whitelist whose entries are all
+	// empty, which would otherwise read as allow-all
+	ErrWhitelistEmpty ErrorCode = 14
+	ErrMask           ErrorCode = 0x80000000
+)
+
+// String returns a readable name for the code, e.g. "port unavailable"
+func (c ErrorCode) String() string {
+	if c&ErrMask != 0 && c != ErrMask {
+		return "error: " + (c &^ ErrMask).String()
+	}
+	switch c {
+	case ErrSuccess:
+		return "success"
+	case ErrPortUnavailable:
+		return "port unavailable"
+	case ErrIPNotAllowed:
+		return "ip not allowed"
+	case ErrPortOutOfRange:
+		return "port out of range"
+	case ErrInternal:
+		return "internal error"
+	case ErrProtocolMismatch:
+		return "protocol mismatch"
+	case ErrWarmingUp:
+		return "warming up"
+	case ErrDraining:
+		return "draining"
+	case ErrBindHostNotAllowed:
+		return "bind host not allowed"
+	case ErrWhitelistBudget:
+		return "whitelist budget exceeded"
+	case ErrWhitelistTooLarge:
+		return "whitelist too large"
+	case ErrPortRequired:
+		return "port required"
+	case ErrPortQuota:
+		return "port quota exceeded"
+	case ErrOverloaded:
+		return "overloaded"
+	case ErrWhitelistEmpty:
+		return "whitelist empty"
+	case ErrMask:
+		return "error"
+	default:
+		return fmt.Sprintf("code %d", uint32(c))
+	}
+}
+
+// Protocol versions are negotiated through the VersionRequest global request.
+// A peer that discards it speaks version 1.
+const (
+	Version        uint32 = 6
+	VersionRequest        = "protocol-version@pbp-tunnel"
+
+	// VersionTraceID adds a trace ID frame at the start of every back-channel
+	VersionTraceID uint32 = 2
+	// VersionBindHost adds the requested bind host, as a 4-byte length and the
+	// host, after the requested port
+	VersionBindHost uint32 = 3
+	// VersionPublicURL adds the public URL of the assigned port, as a 4-byte
+	// length and the URL (empty when unknown), after the port
+	VersionPublicURL uint32 = 4
+	// VersionServerTime adds the server clock, as 8-byte big-endian Unix
+	// milliseconds, after the public URL
+	VersionServerTime uint32 = 5
+	// VersionServerInfo adds the server build version, as a 4-byte length and
+	// the version string (empty when unknown), after the server time
+	VersionServerInfo uint32 = 6
+)
+
+// DirectTCPIP is the RFC 4254 direct-tcpip channel open payload: the address
+// the channel connects to and the address the connection originates from.
+// Peers of this project ignore it, but strict SSH implementations reject a
+// direct-tcpip open without one.
+type DirectTCPIP struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// NewDirectTCPIP builds the payload of a channel from origin to dest. An
+// address that does not carry a host and port is sent as an empty host on
+// port 0.
+func NewDirectTCPIP(dest, origin net.Addr) DirectTCPIP {
+	var p DirectTCPIP
+	p.DestAddr, p.DestPort = splitAddr(dest)
+	p.OriginAddr, p.OriginPort = splitAddr(origin)
+	return p
+}
+
+// Marshal encodes the payload for ssh.Conn.OpenChannel
+func (p DirectTCPIP) Marshal() []byte {
+	return ssh.Marshal(&p)
+}
+
+// ParseDirectTCPIP decodes a payload built by Marshal, as returned by
+// ssh.NewChannel.ExtraData
+func ParseDirectTCPIP(b []byte) (DirectTCPIP, error) {
+	var p DirectTCPIP
+	if err := ssh.Unmarshal(b, &p); err != nil {
+		return DirectTCPIP{}, fmt.Errorf("parse direct-tcpip payload: %w", err)
+	}
+	return p, nil
+}
+
+// splitAddr returns the host and port of a, or an empty host on port 0
+func splitAddr(a net.Addr) (string, uint32) {
+	if a == nil {
+		return "", 0
+	}
+	host, port, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return "", 0
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return host, 0
+	}
+	return host, uint32(n)
+}
@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+)
+
+func TestErrorCodeString(t *testing.T) {
+	tests := []struct {
+		code ErrorCode
+		want string
+	}{
+		{ErrSuccess, "success"},
+		{ErrPortUnavailable, "port unavailable"},
+		{ErrIPNotAllowed, "ip not allowed"},
+		{ErrPortOutOfRange, "port out of range"},
+		{ErrInternal, "internal error"},
+		{ErrProtocolMismatch, "protocol mismatch"},
+		{ErrWarmingUp, "warming up"},
+		{ErrDraining, "draining"},
+		{ErrBindHostNotAllowed, "bind host not allowed"},
+		{ErrWhitelistBudget, "whitelist budget exceeded"},
+		{ErrWhitelistTooLarge, "whitelist too large"},
+		{ErrPortRequired, "port required"},
+		{ErrPortQuota, "port quota exceeded"},
+		{ErrOverloaded, "overloaded"},
+		{ErrWhitelistEmpty, "whitelist empty"},
+		{ErrMask, "error"},
+		{ErrMask | ErrPortUnavailable, "error: port unavailable"},
+		{ErrMask | ErrInternal, "error: internal error"},
+		{ErrorCode(42), "code 42"},
+		{ErrMask | ErrorCode(42), "error: code 42"},
+	}
+	for _, tc := range tests {
+		if got := tc.code.String(); got != tc.want {
+			t.Errorf("ErrorCode(%#x).String() = %q; want %q", uint32(tc.code), got, tc.want)
+		}
+	}
+}
+
+// The values are part of the wire format: clients and servers of any release
+// must agree on them, so they must never be renumbered.
+func TestErrorCodeWireValues(t *testing.T) {
+	tests := []struct {
+		code ErrorCode
+		want uint32
+	}{
+		{ErrSuccess, 0},
+		{ErrPortUnavailable, 1},
+		{ErrIPNotAllowed, 2},
+		{ErrPortOutOfRange, 3},
+		{ErrInternal, 4},
+		{ErrProtocolMismatch, 5},
+		{ErrWarmingUp, 6},
+		{ErrDraining, 7},
+		{ErrBindHostNotAllowed, 8},
+		{ErrWhitelistBudget, 9},
+		{ErrWhitelistTooLarge, 10},
+		{ErrPortRequired, 11},
+		{ErrPortQuota, 12},
+		{ErrOverloaded, 13},
+		{ErrWhitelistEmpty, 14},
+		{ErrMask, 0x80000000},
+	}
+	for _, tc := range tests {
+		if uint32(tc.code) != tc.want {
+			t.Errorf("%s = %#x; want %#x", tc.code, uint32(tc.code), tc.want)
+		}
+	}
+}
+
+func TestDirectTCPIP_RoundTrip(t *testing.T) {
+	dest := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8080}
+	origin := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 51234}
+	want := DirectTCPIP{DestAddr: "2001:db8::1", DestPort: 8080, OriginAddr: "192.0.2.7", OriginPort: 51234}
+
+	p := NewDirectTCPIP(dest, origin)
+	if p != want {
+		t.Fatalf("NewDirectTCPIP() = %+v; want %+v", p, want)
+	}
+	got, err := ParseDirectTCPIP(p.Marshal())
+	if err != nil {
+		t.Fatalf("ParseDirectTCPIP() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("ParseDirectTCPIP() = %+v; want %+v", got, want)
+	}
+}
+
+func TestDirectTCPIP_WireFormat(t *testing.T) {
+	// RFC 4254 section 7.2: string host, uint32 port, string originator
+	// address, uint32 originator port
+	b := DirectTCPIP{DestAddr: "h", DestPort: 1, OriginAddr: "o", OriginPort: 2}.Marshal()
+	want := []byte{0, 0, 0, 1, 'h', 0, 0, 0, 1, 0, 0, 0, 1, 'o', 0, 0, 0, 2}
+	if string(b) != string(want) {
+		t.Errorf("Marshal() = %v; want %v", b, want)
+	}
+}
+
+func TestDirectTCPIP_Unaddressed(t *testing.T) {
+	if p := NewDirectTCPIP(nil, &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}); p != (DirectTCPIP{}) {
+		t.Errorf("NewDirectTCPIP() = %+v; want zero payload", p)
+	}
+}
+
+func TestParseDirectTCPIP_Truncated(t *testing.T) {
+	b := DirectTCPIP{DestAddr: "host", DestPort: 22}.Marshal()
+	if _, err := ParseDirectTCPIP(b[:len(b)-3]); err == nil {
+		t.Error("ParseDirectTCPIP() error = nil; want error")
+	}
+	if _, err := ParseDirectTCPIP(nil); err == nil {
+		t.Error("ParseDirectTCPIP(nil) error = nil; want error")
+	}
+}
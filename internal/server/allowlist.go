@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net"
+	"strings"
+)
+
+// AllowList is an IP list compiled once for matching, holding exact addresses
+// and CIDR networks. A nil AllowList is empty.
+type AllowList struct {
+	exact map[string]struct{}
+	nets  []*net.IPNet
+}
+
+// CompileAllowList parses entries (exact IPs or CIDRs). Invalid CIDRs are
+// skipped and other entries that are not IPs only match the same string.
+func CompileAllowList(entries []string) *AllowList {
+	l := &AllowList{exact: make(map[string]struct{}, len(entries))}
+	for _, e := range entries {
+		if strings.Contains(e, "/") {
+			if _, cidr, err := net.ParseCIDR(e); err == nil {
+				l.nets = append(l.nets, cidr)
+			}
+			continue
+		}
+		l.exact[e] = struct{}{}
+		if ip := net.ParseIP(e); ip != nil {
+			l.exact[ip.String()] = struct{}{}
+		}
+	}
+	return l
+}
+
+// Len returns the number of entries
+func (l *AllowList) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.exact) + len(l.nets)
+}
+
+// Contains reports whether ip equals an entry or falls within a CIDR entry
+func (l *AllowList) Contains(ip string) bool {
+	if l == nil {
+		return false
+	}
+	if _, ok := l.exact[ip]; ok {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	if _, ok := l.exact[parsed.String()]; ok {
+		return true
+	}
+	for _, cidr := range l.nets {
+		if cidr.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows is the compiled counterpart of isAllowed: an empty list allows everyone
+func (l *AllowList) allows(ip string) bool {
+	return l.Len() == 0 || l.Contains(ip)
+}
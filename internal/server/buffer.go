@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// errBufferClosed is returned when writing to a ringBuffer after closeWrite
+var errBufferClosed = errors.New("write to closed buffer")
+
+// ringBuffer is a bounded in-memory pipe. Writes block while it is full, so a
+// slow reader pushes back on the writer once the buffer is exhausted.
+type ringBuffer struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	start  int   // index of the first unread byte
+	length int   // number of unread bytes
+	closed bool  // no more writes; reads drain then return EOF
+	err    error // reader side failed; writes return it
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	rb := &ringBuffer{buf: make([]byte, size)}
+	rb.cond = sync.NewCond(&rb.mu)
+	return rb
+}
+
+// Write copies p into the buffer, blocking while it is full
+func (rb *ringBuffer) Write(p []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		for rb.length == len(rb.buf) && rb.err == nil && !rb.closed {
+			rb.cond.Wait()
+		}
+		if rb.err != nil {
+			return written, rb.err
+		}
+		if rb.closed {
+			return written, errBufferClosed
+		}
+
+		end := (rb.start + rb.length) % len(rb.buf)
+		free := len(rb.buf) - rb.length
+		if end+free > len(rb.buf) {
+			free = len(rb.buf) - end
+		}
+		n := copy(rb.buf[end:end+free], p[written:])
+		rb.length += n
+		written += n
+		rb.cond.Broadcast()
+	}
+	return written, nil
+}
+
+// Read copies buffered bytes into p, blocking while the buffer is empty
+func (rb *ringBuffer) Read(p []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	for rb.length == 0 && !rb.closed && rb.err == nil {
+		rb.cond.Wait()
+	}
+	if rb.err != nil {
+		return 0, rb.err
+	}
+	if rb.length == 0 {
+		return 0, io.EOF
+	}
+
+	chunk := rb.length
+	if rb.start+chunk > len(rb.buf) {
+		chunk = len(rb.buf) - rb.start
+	}
+	n := copy(p, rb.buf[rb.start:rb.start+chunk])
+	rb.start = (rb.start + n) % len(rb.buf)
+	rb.length -= n
+	rb.cond.Broadcast()
+	return n, nil
+}
+
+// closeWrite marks the end of the data; pending bytes can still be read
+func (rb *ringBuffer) closeWrite() {
+	rb.mu.Lock()
+	rb.closed = true
+	rb.mu.Unlock()
+	rb.cond.Broadcast()
+}
+
+// abort fails pending and future reads and writes with err
+func (rb *ringBuffer) abort(err error) {
+	rb.mu.Lock()
+	rb.err = err
+	rb.mu.Unlock()
+	rb.cond.Broadcast()
+}
+
+// bufferedCopy copies src to dst through a ringBuffer of size bytes, so short
+// stalls of dst do not stop src from being read. It returns the bytes written
+// to dst, and the error of src or dst.
+func bufferedCopy(dst io.Writer, src io.Reader, size int) (int64, error) {
+	rb := newRingBuffer(size)
+	go func() {
+		if _, err := io.Copy(rb, src); err != nil {
+			rb.abort(err)
+			return
+		}
+		rb.closeWrite()
+	}()
+
+	n, err := io.Copy(dst, rb)
+	if err != nil {
+		rb.abort(err)
+	}
+	return n, err
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+// drainSignals is empty: this platform has no SIGUSR1
+var drainSignals []os.Signal
+
+// resetStatsSignals is empty: this platform has no SIGUSR2
+var resetStatsSignals []os.Signal
+
+// reloadHostKeySignals is empty: this platform has no SIGHUP
+var reloadHostKeySignals []os.Signal
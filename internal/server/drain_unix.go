@@ -0,0 +1,17 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignals put the server into draining mode
+var drainSignals = []os.Signal{syscall.SIGUSR1}
+
+// resetStatsSignals zero the server's cumulative counters
+var resetStatsSignals = []os.Signal{syscall.SIGUSR2}
+
+// reloadHostKeySignals re-read the configured host keys for new connections
+var reloadHostKeySignals = []os.Signal{syscall.SIGHUP}
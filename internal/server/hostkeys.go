@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/poweredbypump/pbp-tunnel/internal/config"
+)
+
+// sshServerConfig returns the SSH configuration for new connections
+func (s *ForwardServer) sshServerConfig() *ssh.ServerConfig {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return s.sshConfig
+}
+
+// AddHostKey loads the private host key at path and offers it to new
+// connections, in place of any current key of the same type. Established
+// connections keep the key they negotiated, rekeys included.
+func (s *ForwardServer) AddHostKey(path string) error {
+	signer, err := config.LoadHostKey(path, s.hostKeyAlgorithms)
+	if err != nil {
+		return fmt.Errorf("load host key %s: %w", path, err)
+	}
+
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	keyType := signer.PublicKey().Type()
+	added := slices.DeleteFunc(slices.Clone(s.addedHostKeys), func(k ssh.Signer) bool {
+		return k.PublicKey().Type() == keyType
+	})
+	added = append(added, signer)
+	if err := s.rebuildSSHConfig(added); err != nil {
+		return err
+	}
+	log.Printf("[+] Added %s host key %s for new connections", keyType, ssh.FingerprintSHA256(signer.PublicKey()))
+	return nil
+}
+
+// rebuildSSHConfig replaces the SSH configuration of new connections with one
+// built afresh from s.sshParams, offering the added host keys. Established
+// connections share the host keys of the current configuration, so it is
+// never modified in place. The caller holds reloadLock.
+func (s *ForwardServer) rebuildSSHConfig(added []ssh.Signer) error {
+	sshCfg, _, err := config.GetServerConfig(s.sshParams, s.hostKeyAlgorithms)
+	if err != nil {
+		return fmt.Errorf("rebuild server config: %w", err)
+	}
+	for _, k := range added {
+		sshCfg.AddHostKey(k)
+	}
+	s.sshConfig = sshCfg
+	s.addedHostKeys = added
+	return nil
+}
+
+// reloadAuthorizedKeys reads the authorized keys again, from their files or
+// URLs, for new connections. The current keys are kept when they cannot be read.
+func (s *ForwardServer) reloadAuthorizedKeys() error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	return s.rebuildSSHConfig(s.addedHostKeys)
+}
+
+// refreshAuthorizedKeys calls reloadAuthorizedKeys every interval until stop is closed
+func (s *ForwardServer) refreshAuthorizedKeys(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.reloadAuthorizedKeys(); err != nil {
+				log.Printf("[-] Authorized keys refresh failed, keeping current keys: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reloadHostKeys adds the configured host keys again, so that keys replaced
+// on disk are offered to new connections
+func (s *ForwardServer) reloadHostKeys() {
+	for _, path := range []string{s.sshParams.PrivateRsaPath, s.sshParams.PrivateEcdsaPath, s.sshParams.PrivateEd25519Path} {
+		if path == "" {
+			continue
+		}
+		if err := s.AddHostKey(path); err != nil {
+			log.Printf("[-] Host key reload failed: %v", err)
+		}
+	}
+}
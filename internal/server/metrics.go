@@ -0,0 +1,76 @@
+package server
+
+import (
+	"log"
+	"maps"
+	"sync"
+)
+
+// maxRejectionLabels caps the number of peer IPs counted individually;
+// further peers are counted under rejectionOverflowLabel
+const maxRejectionLabels = 256
+
+// rejectionOverflowLabel collects rejections once maxRejectionLabels is reached
+const rejectionOverflowLabel = "other"
+
+// rejectionCounter counts rejected forward peers, in total and by IP
+type rejectionCounter struct {
+	mu    sync.Mutex
+	total uint64
+	byIP  map[string]uint64
+}
+
+// inc records a rejection of ip
+func (c *rejectionCounter) inc(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.byIP == nil {
+		c.byIP = make(map[string]uint64)
+	}
+	if _, seen := c.byIP[ip]; !seen && len(c.byIP) >= maxRejectionLabels {
+		ip = rejectionOverflowLabel
+	}
+	c.byIP[ip]++
+	c.total++
+}
+
+// snapshot returns the total and a copy of the per-IP counts
+func (c *rejectionCounter) snapshot() (uint64, map[string]uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total, maps.Clone(c.byIP)
+}
+
+// reset zeroes the total and forgets the per-IP counts
+func (c *rejectionCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total = 0
+	c.byIP = nil
+}
+
+// GetMetrics returns the server counters by metric name
+func (s *ForwardServer) GetMetrics() map[string]interface{} {
+	total, byIP := s.whitelistRejections.snapshot()
+	s.lock.Lock()
+	conns := s.snapshotConns()
+	s.lock.Unlock()
+	return map[string]interface{}{
+		"node_name":                          s.nodeName,
+		"forward_whitelist_rejections_total": total,
+		"forward_whitelist_rejections_by_ip": byIP,
+		"forward_ports_reclaimed_total":      s.portsReclaimed.Load(),
+		"forward_ports_assigned":             s.assignedPorts(),
+		"load_shedding":                      s.loadShedder.active(),
+		"forward_connections":                conns,
+	}
+}
+
+// ResetStats zeroes the cumulative counters, e.g. at the start of a billing
+// period. Active forwards and their byte counts are live state and are kept.
+func (s *ForwardServer) ResetStats() {
+	s.whitelistRejections.reset()
+	s.portsReclaimed.Store(0)
+	log.Printf("[*] Cumulative stats reset")
+}
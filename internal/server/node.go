@@ -0,0 +1,31 @@
+package server
+
+import (
+	"log"
+	"os"
+)
+
+// nodeName returns name, or the hostname when name is empty
+func nodeName(name string) string {
+	if name != "" {
+		return name
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "unknown"
+	}
+	return host
+}
+
+// tagLogs prefixes the messages of the standard logger with node, so lines
+// aggregated from many servers can be told apart. It returns a function
+// restoring the previous prefix.
+func tagLogs(node string) func() {
+	prefix, flags := log.Prefix(), log.Flags()
+	log.SetPrefix("node=" + node + " ")
+	log.SetFlags(flags | log.Lmsgprefix)
+	return func() {
+		log.SetPrefix(prefix)
+		log.SetFlags(flags)
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"log"
+	"runtime"
+	"sync"
+)
+
+// readHeapBytes returns the bytes of heap in use, replaced in tests
+var readHeapBytes = func() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// loadShedder refuses new forwards from the moment assigned ports or heap use
+// cross their high-water mark until both are back at their low-water mark.
+// A nil shedder never sheds.
+type loadShedder struct {
+	highForwards int
+	lowForwards  int
+	highHeap     uint64
+	lowHeap      uint64
+	mu           sync.Mutex
+	shedding     bool
+}
+
+// newLoadShedder returns a shedder for the given marks, or nil when neither
+// high-water mark is set. lowForwards 0 resumes at 90% of highForwards, heap
+// use always resumes below 90% of highHeap.
+func newLoadShedder(highForwards, lowForwards int, highHeap uint64) *loadShedder {
+	if highForwards == 0 && highHeap == 0 {
+		return nil
+	}
+	if lowForwards == 0 {
+		lowForwards = highForwards * 9 / 10
+	}
+	return &loadShedder{
+		highForwards: highForwards,
+		lowForwards:  lowForwards,
+		highHeap:     highHeap,
+		lowHeap:      highHeap / 10 * 9,
+	}
+}
+
+// shed reports whether a new forward should be refused with forwards ports
+// assigned, updating the shedding state
+func (l *loadShedder) shed(forwards int) bool {
+	if l == nil {
+		return false
+	}
+	var heap uint64
+	if l.highHeap > 0 {
+		heap = readHeapBytes()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.shedding {
+		if (l.highForwards > 0 && forwards >= l.highForwards) || (l.highHeap > 0 && heap >= l.highHeap) {
+			l.shedding = true
+			log.Printf("[-] Overloaded at %d ports and %d heap bytes, refusing new forwards", forwards, heap)
+		}
+	} else if (l.highForwards == 0 || forwards <= l.lowForwards) && (l.highHeap == 0 || heap <= l.lowHeap) {
+		l.shedding = false
+		log.Printf("[+] Load back to %d ports and %d heap bytes, accepting new forwards", forwards, heap)
+	}
+	return l.shedding
+}
+
+// active reports whether the shedder refused the last forward it was asked about
+func (l *loadShedder) active() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.shedding
+}
+
+// assignedPorts returns the number of ports currently assigned to clients
+func (s *ForwardServer) assignedPorts() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.active)
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+// protocolPeekTimeout bounds the wait for the first bytes of a forwarded
+// connection, so protocols where the service speaks first are not held up
+const protocolPeekTimeout = 500 * time.Millisecond
+
+// Protocols reported by detectProtocol
+const (
+	protocolHTTP = "http"
+	protocolTLS  = "tls"
+	protocolTCP  = "tcp"
+)
+
+// httpMethods are the request line prefixes recognised as HTTP
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "), []byte("PRI "),
+}
+
+// peekedConn is a net.Conn whose first bytes were read ahead and are
+// returned again by Read before the rest of the stream
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// peekConn reads the first chunk of c, up to n bytes, waiting at most timeout
+// for it, and returns a conn replaying it along with the bytes read. A
+// timeout or a closed peer leaves the peek empty; the replaying conn then
+// reports the error of the next read.
+func peekConn(c net.Conn, n int, timeout time.Duration) (net.Conn, []byte) {
+	r := bufio.NewReaderSize(c, n)
+	c.SetReadDeadline(time.Now().Add(timeout))
+	var head []byte
+	if _, err := r.Peek(1); err == nil {
+		head, _ = r.Peek(min(r.Buffered(), n))
+	}
+	c.SetReadDeadline(time.Time{})
+	return &peekedConn{Conn: c, r: r}, head
+}
+
+// detectProtocol names the protocol of a connection starting with head
+func detectProtocol(head []byte) string {
+	// TLS records start with the handshake content type, then a 3.x version
+	if len(head) >= 2 && head[0] == 0x16 && head[1] == 0x03 {
+		return protocolTLS
+	}
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(head, m) {
+			return protocolHTTP
+		}
+	}
+	return protocolTCP
+}
+
+// clfTimeFormat is the timestamp layout of Common Log Format lines
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// requestLine returns the HTTP request line at the start of head, when head
+// holds a complete one of the form "METHOD target HTTP/x"
+func requestLine(head []byte) (string, bool) {
+	end := bytes.IndexByte(head, '\n')
+	if end < 0 {
+		return "", false
+	}
+	line := string(bytes.TrimSuffix(head[:end], []byte("\r")))
+	if fields := bytes.Fields([]byte(line)); len(fields) != 3 || !bytes.HasPrefix(fields[2], []byte("HTTP/")) {
+		return "", false
+	}
+	return line, true
+}
+
+// accessLogLine formats a Common Log Format line for a request from peer,
+// started at start and answered with n bytes. The status is not parsed and
+// is logged as "-".
+func accessLogLine(peer, request string, start time.Time, n uint64) string {
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		host = peer
+	}
+	return fmt.Sprintf("%s - - [%s] %q - %d", host, start.Format(clfTimeFormat), request, n)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// writePidFile records the current PID at path. It refuses to overwrite the PID
+// file of a process that is still running, and replaces stale ones.
+func writePidFile(path string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid > 0 && pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("pid file %s belongs to running process %d", path, pid)
+		}
+		log.Printf("[*] Replacing stale pid file %s", path)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("read pid file: %w", err)
+	}
+
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("write pid file: %w", err)
+	}
+	return nil
+}
+
+// removePidFile deletes the PID file at path if it still holds the current PID
+func removePidFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		log.Printf("[*] Pid file %s was taken over by another process, leaving it", path)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("[-] Remove pid file %s: %v", path, err)
+	}
+}
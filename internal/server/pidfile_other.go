@@ -0,0 +1,15 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+// processAlive reports whether pid refers to an existing process
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
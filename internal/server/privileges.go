@@ -0,0 +1,38 @@
+package server
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// resolveRunAs looks up the uid and gid the server should switch to.
+// The group defaults to the user's primary group. Names and numeric ids are both accepted.
+func resolveRunAs(userName, groupName string) (int, int, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return 0, 0, fmt.Errorf("unknown user %q", userName)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %q has non-numeric uid %q", userName, u.Uid)
+	}
+
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("group of %q has non-numeric gid %q", userName, gidStr)
+	}
+	return uid, gid, nil
+}
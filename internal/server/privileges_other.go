@@ -0,0 +1,13 @@
+//go:build !unix
+
+package server
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// dropPrivileges is not available on this platform
+func dropPrivileges(uid, gid int) error {
+	return fmt.Errorf("dropping privileges is not supported on %s", runtime.GOOS)
+}
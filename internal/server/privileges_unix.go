@@ -0,0 +1,22 @@
+//go:build unix
+
+package server
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// dropPrivileges switches the process to uid/gid, clearing supplementary groups first
+func dropPrivileges(uid, gid int) error {
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", uid, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// sessionQuota counts the bytes relayed by all forwards of one SSH connection
+// and closes the connection once they exceed limit. A nil quota is unlimited.
+type sessionQuota struct {
+	limit uint64
+	used  atomic.Uint64
+	conn  io.Closer
+	once  sync.Once
+}
+
+// newSessionQuota returns a quota closing conn after limit bytes, or nil when limit is 0
+func newSessionQuota(limit uint64, conn io.Closer) *sessionQuota {
+	if limit == 0 {
+		return nil
+	}
+	return &sessionQuota{limit: limit, conn: conn}
+}
+
+// add records n relayed bytes and closes the connection when the quota is exceeded
+func (q *sessionQuota) add(n int) {
+	if q == nil {
+		return
+	}
+	if used := q.used.Add(uint64(n)); used > q.limit {
+		q.once.Do(func() {
+			log.Printf("[-] Session relayed %d bytes, over its quota of %d, closing", used, q.limit)
+			q.conn.Close()
+		})
+	}
+}
+
+// quotaWriter charges the bytes written to w against q
+type quotaWriter struct {
+	w io.Writer
+	q *sessionQuota
+}
+
+func (qw quotaWriter) Write(p []byte) (int, error) {
+	n, err := qw.w.Write(p)
+	qw.q.add(n)
+	return n, err
+}
+
+// whitelistBudget caps the client whitelist entries held by all sessions
+// together. A nil budget is unlimited.
+type whitelistBudget struct {
+	limit int
+	mu    sync.Mutex
+	used  int
+}
+
+// newWhitelistBudget returns a budget of limit entries, or nil when limit is 0
+func newWhitelistBudget(limit int) *whitelistBudget {
+	if limit == 0 {
+		return nil
+	}
+	return &whitelistBudget{limit: limit}
+}
+
+// reserve takes n entries from the budget and reports whether they fit
+func (b *whitelistBudget) reserve(n int) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.limit-b.used {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// release returns n entries reserved earlier
+func (b *whitelistBudget) release(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+}
+
+// remaining returns the entries still available, for error messages
+func (b *whitelistBudget) remaining() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit - b.used
+}
+
+// ipPortQuota counts the ports held by each client IP, backup registrations
+// included, and refuses claims beyond limit. A nil quota is unlimited.
+type ipPortQuota struct {
+	limit int
+	mu    sync.Mutex
+	held  map[string]int
+}
+
+// newIPPortQuota returns a quota of limit ports per IP, or nil when limit is 0
+func newIPPortQuota(limit int) *ipPortQuota {
+	if limit <= 0 {
+		return nil
+	}
+	return &ipPortQuota{limit: limit, held: make(map[string]int)}
+}
+
+// claim counts one more port for ip, or reports false when ip already holds limit ports
+func (q *ipPortQuota) claim(ip string) bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.held[ip] >= q.limit {
+		return false
+	}
+	q.held[ip]++
+	return true
+}
+
+// release returns a port claimed by ip
+func (q *ipPortQuota) release(ip string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.held[ip]--; q.held[ip] <= 0 {
+		delete(q.held, ip)
+	}
+}
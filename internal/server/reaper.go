@@ -0,0 +1,61 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// portReapInterval is how often the reaper looks for orphaned ports
+var portReapInterval = time.Minute
+
+// runPortReaper reaps orphaned ports every portReapInterval until stop is closed
+func (s *ForwardServer) runPortReaper(stop <-chan struct{}) {
+	ticker := time.NewTicker(portReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.reapOrphanedPorts()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reapOrphanedPorts frees ports marked in use that neither serve an active
+// forward nor are reserved for a disconnected client, as left behind by a
+// session that ended without releasing its port. A port is only freed once
+// two sweeps in a row find it orphaned, so a port between its assignment and
+// the start of its forward is never taken. It returns how many ports it freed.
+func (s *ForwardServer) reapOrphanedPorts() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	reserved := make(map[int]struct{})
+	for _, list := range s.reservations {
+		for _, r := range list {
+			reserved[r.port] = struct{}{}
+		}
+	}
+
+	suspects := make(map[int]struct{})
+	freed := 0
+	for port := range s.forwards {
+		if _, ok := s.active[port]; ok {
+			continue
+		}
+		if _, ok := reserved[port]; ok {
+			continue
+		}
+		if _, ok := s.orphanSuspects[port]; !ok {
+			suspects[port] = struct{}{}
+			continue
+		}
+		delete(s.forwards, port)
+		freed++
+		log.Printf("[-] Reclaimed orphaned port %d", port)
+	}
+	s.orphanSuspects = suspects
+	s.portsReclaimed.Add(uint64(freed))
+	return freed
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/poweredbypump/pbp-tunnel/internal/config"
+)
+
+// allowed returns the current compiled client whitelist
+func (s *ForwardServer) allowed() *AllowList {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return s.allowList
+}
+
+// denied returns the current compiled client blacklist
+func (s *ForwardServer) denied() *AllowList {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return s.denyList
+}
+
+// reloadConfig swaps in the hot-reloadable fields of sp; other changes need a restart
+func (s *ForwardServer) reloadConfig(sp *config.ServerParameters) {
+	allowList := CompileAllowList(sp.AllowedIPs)
+	denyList := CompileAllowList(sp.DeniedIPs)
+	s.reloadLock.Lock()
+	s.allowList = allowList
+	s.denyList = denyList
+	s.reloadLock.Unlock()
+	log.Printf("[*] Reloaded allowed IPs: %v, denied IPs: %v", sp.AllowedIPs, sp.DeniedIPs)
+}
+
+// watchConfig polls the modification time of the config file at path every interval
+// and passes its server parameters to reload whenever it changes, until stop is closed.
+// It works on every platform, unlike a signal-based reload.
+func watchConfig(path string, interval time.Duration, stop <-chan struct{}, reload func(*config.ServerParameters)) {
+	var lastMod time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastMod = info.ModTime()
+	}
+	log.Printf("[*] Watching %s for changes every %v", path, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+
+		cfg, err := config.LoadConfigFile(path)
+		if err != nil {
+			log.Printf("[-] Config reload from %s failed: %v", path, err)
+			continue
+		}
+		if cfg.Server == nil {
+			log.Printf("[-] Config reload from %s failed: no server configuration", path)
+			continue
+		}
+		log.Printf("[*] Config file %s changed, reloading", path)
+		reload(cfg.Server)
+	}
+}
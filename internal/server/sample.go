@@ -0,0 +1,26 @@
+package server
+
+import "math/rand/v2"
+
+// logSampler decides which events of a high-volume kind are logged. A nil
+// sampler logs every event.
+type logSampler struct {
+	rate float64
+}
+
+// newLogSampler returns a sampler keeping roughly rate of the events, or nil
+// when rate keeps them all (0 or 1 and above)
+func newLogSampler(rate float64) *logSampler {
+	if rate <= 0 || rate >= 1 {
+		return nil
+	}
+	return &logSampler{rate: rate}
+}
+
+// sample reports whether the next event should be logged
+func (l *logSampler) sample() bool {
+	if l == nil {
+		return true
+	}
+	return rand.Float64() < l.rate
+}
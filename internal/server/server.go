@@ -1,47 +1,231 @@
 package server
 
 import (
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/poweredbypump/pbp-tunnel/internal/config"
+	"github.com/poweredbypump/pbp-tunnel/internal/protocol"
+	"github.com/poweredbypump/pbp-tunnel/internal/util"
 	"golang.org/x/crypto/ssh"
 )
 
+// Bounds applied while reading the client whitelist during the handshake
 const (
-	ErrSuccess         uint32 = 0
-	ErrPortUnavailable uint32 = 1
-	ErrIPNotAllowed    uint32 = 2
-	ErrPortOutOfRange  uint32 = 3
-	ErrInternal        uint32 = 4
-	ErrMask            uint32 = 0x80000000
+	maxWhitelistEntryLength = 64 << 10
+	maxWhitelistPrealloc    = 256
 )
 
+// Version is the build version sent to clients from protocol.VersionServerInfo
+// on, set by the binary (empty = unknown)
+var Version string
+
+// handshakeBufPool holds scratch buffers for reading whitelist entries.
+// Buffers grow on demand up to maxWhitelistEntryLength.
+var handshakeBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
 type ForwardServer struct {
-	sshConfig      *ssh.ServerConfig
-	bindAddress    string
-	bindPort       int
-	portRangeStart int
-	portRangeEnd   int
-	allowedIPs     []string
-	forwards       map[int]struct{}
-	lock           sync.Mutex
+	sshConfig           *ssh.ServerConfig
+	sshParams           *config.ServerParameters
+	hostKeyAlgorithms   *config.HostKeyAlgorithms
+	addedHostKeys       []ssh.Signer
+	bindAddress         string
+	bindByUser          map[string]string
+	allowedBindHosts    []string
+	bindPort            int
+	listenNetwork       string
+	portRangeStart      int
+	portRangeEnd        int
+	stablePortByUser    bool
+	portPools           config.PortPoolMap
+	userPools           config.StringMap
+	requireExplicit     bool
+	publicBaseURL       string
+	allowList           *AllowList
+	reloadLock          sync.RWMutex
+	denyList            *AllowList
+	widenClientWL       bool
+	minClientProtocol   uint32
+	tolerateExtraChans  bool
+	allowPortSharing    bool
+	forwardLogSampler   *logSampler
+	whitelistBudget     *whitelistBudget
+	maxWhitelistCount   int
+	portReleaseGrace    time.Duration
+	maxConnsPerForward  int
+	portsPerIP          *ipPortQuota
+	loadShedder         *loadShedder
+	maxConnDuration     time.Duration
+	tcpNoDelay          *bool
+	socketReadBuffer    int
+	socketWriteBuffer   int
+	maxConnectionAge    time.Duration
+	forwardBufferBytes  int
+	protocolPeekBytes   int
+	httpAccessLog       bool
+	sessionByteQuota    uint64
+	nodeName            string
+	warmupUntil         time.Time
+	listener            net.Listener
+	ready               chan struct{}
+	readyOnce           sync.Once
+	OnReady             func()
+	draining            atomic.Bool
+	forwards            map[int]struct{}
+	shares              map[int]*portShare
+	reservations        map[string][]*portReservation
+	active              map[int]*activeForward
+	conns               map[uint64]*activeConn
+	orphanSuspects      map[int]struct{}
+	portsReclaimed      atomic.Uint64
+	lock                sync.Mutex
+	forwardIDs          atomic.Uint64
+	stateFilePath       string
+	stateLock           sync.Mutex
+	whitelistRejections rejectionCounter
 }
 
 // ForwardServer maintains state for port forwarding
-// sshConfig: SSH server configuration
-// bindAddress/Port: where to expose forwarded ports
+// sshConfig: SSH server configuration for new connections, replaced by AddHostKey
+// sshParams: parameters sshConfig is rebuilt from
+// hostKeyAlgorithms: host key algorithm negotiated by each new connection, recorded by sshConfig's keys
+// addedHostKeys: host keys added by AddHostKey, one per key type
+// bindAddress: where to expose forwarded ports
+// bindPort: port the SSH listener is bound to, as picked by the OS for BindPort 0
+// bindByUser: per-user overrides of bindAddress for forwarded ports
+// allowedBindHosts: hosts a client may request instead of bindAddress
+// listenNetwork: network forwarded ports are bound on (tcp, tcp4 or tcp6)
 // portRangeStart/End: allowed range
-// allowedIPs: client whitelist
+// stablePortByUser: try a port derived from the username before the first free one
+// portPools/userPools: named ranges within portRangeStart/End and the pool of each user
+// requireExplicit: refuse port 0 requests with ErrPortRequired
+// publicBaseURL: template of the public URL sent to clients with their port
+// allowList: compiled client whitelist, reloadable from the config file
+// reloadLock: protects allowList, denyList and the host keys against reloads
+// denyList: compiled client blacklist, checked before allowList, reloadable like it
+// widenClientWL: let a client whitelist replace allowList for its forward peers instead of narrowing it
+// minClientProtocol: lowest protocol version a client may speak (0 = any)
+// tolerateExtraChans: accept and close session channels rather than rejecting them
+// allowPortSharing: register clients requesting a port in use as backups of its client
+// forwardLogSampler: picks the forwards whose open/close events are logged (nil = all)
+// whitelistBudget: client whitelist entries held across all sessions (nil = unlimited)
+// maxWhitelistCount: entries of a single client whitelist (0 = unlimited)
+// portReleaseGrace: how long a disconnected client's port stays reserved
+// maxConnsPerForward: concurrent connections per assigned port, further ones queue (0 = unlimited)
+// portsPerIP: ports held by each client IP (nil = unlimited)
+// loadShedder: refuses new forwards with ErrOverloaded between the high- and low-water marks (nil = never)
+// maxConnDuration: lifetime of a forwarded connection, however active (0 = unlimited)
+// tcpNoDelay: TCP_NODELAY for accepted forwarded connections (nil = Go default)
+// socketReadBuffer/socketWriteBuffer: socket buffer sizes of accepted SSH connections (0 = OS default)
+// maxConnectionAge: age at which a client SSH connection is drained and closed (0 = unlimited)
+// forwardBufferBytes: buffer absorbing stalls of the client on service -> client data (0 = none)
+// protocolPeekBytes: bytes read ahead of each forwarded connection to detect its protocol (0 = disabled)
+// httpAccessLog: log a Common Log Format line for forwarded connections detected as HTTP
+// sessionByteQuota: bytes relayed per SSH connection, across its forwards, before it is closed (0 = unlimited)
+// nodeName: name of this server in log lines and metrics
+// warmupUntil: port assignments are refused with ErrWarmingUp before this time
+// listener: accepts SSH connections, closed by Drain
+// ready: closed by serve once listener accepts connections, see Ready
+// OnReady: called by serve once listener accepts connections, if set
+// draining: set by Drain, new forwards are refused with ErrDraining
 // forwards: map of in-use ports
-// lock: protects forwards
+// shares: clients serving each port in failover order, with allowPortSharing
+// reservations: ports held for disconnected clients, by client identity
+// active: assigned ports with their client and traffic, for the state file
+// conns: open forwarded connections by forward ID, for the state file and metrics
+// orphanSuspects: ports the last reaper sweep found in use without a forward or reservation
+// portsReclaimed: orphaned ports freed by the reaper
+// lock: protects forwards, shares, reservations, active, conns and orphanSuspects
+// forwardIDs: source of forward IDs, unique across all channels
+// whitelistRejections: forward peers turned away by the whitelist, by IP
+// stateFilePath: where active forwards are exported, if set
+// stateLock: serialises state file writes
+
+// portReservation is a port kept for a disconnected client during the grace period
+type portReservation struct {
+	port  int
+	timer *time.Timer
+}
+
+// newForwardServer builds a ForwardServer from validated parameters, their SSH
+// config and the host key algorithms it records. Run sets its listener and the
+// port the listener was bound to.
+func newForwardServer(sp *config.ServerParameters, sshCfg *ssh.ServerConfig, algorithms *config.HostKeyAlgorithms) *ForwardServer {
+	listenNetwork := sp.ListenNetwork
+	if listenNetwork == "" {
+		listenNetwork = config.SpDefaultListenNetwork
+	}
+	return &ForwardServer{
+		sshConfig:          sshCfg,
+		sshParams:          sp,
+		hostKeyAlgorithms:  algorithms,
+		bindAddress:        sp.BindAddress,
+		bindByUser:         sp.ForwardBindByUser,
+		allowedBindHosts:   sp.AllowedBindHosts,
+		bindPort:           sp.BindPort,
+		listenNetwork:      listenNetwork,
+		portRangeStart:     sp.PortRangeStart,
+		portRangeEnd:       sp.PortRangeEnd,
+		stablePortByUser:   sp.StablePortByUser,
+		portPools:          sp.PortPools,
+		userPools:          sp.UserPoolMap,
+		requireExplicit:    sp.RequireExplicitPort,
+		publicBaseURL:      sp.PublicBaseURL,
+		allowList:          CompileAllowList(sp.AllowedIPs),
+		denyList:           CompileAllowList(sp.DeniedIPs),
+		widenClientWL:      sp.AllowClientWhitelistWiden,
+		minClientProtocol:  uint32(sp.MinClientProtocol),
+		tolerateExtraChans: sp.TolerateExtraChannels,
+		allowPortSharing:   sp.AllowPortSharing,
+		forwardLogSampler:  newLogSampler(sp.LogSampleRate),
+		whitelistBudget:    newWhitelistBudget(sp.MaxWhitelistEntriesTotal),
+		maxWhitelistCount:  sp.MaxWhitelistCount,
+		portReleaseGrace:   time.Duration(sp.PortReleaseGrace),
+		maxConnsPerForward: sp.MaxConnsPerForward,
+		portsPerIP:         newIPPortQuota(sp.MaxPortsPerIP),
+		loadShedder:        newLoadShedder(sp.HighWaterForwards, sp.LowWaterForwards, sp.HighWaterHeapBytes),
+		maxConnDuration:    time.Duration(sp.MaxConnDuration),
+		tcpNoDelay:         sp.TCPNoDelay,
+		socketReadBuffer:   sp.SocketReadBuffer,
+		socketWriteBuffer:  sp.SocketWriteBuffer,
+		maxConnectionAge:   time.Duration(sp.MaxConnectionAge),
+		forwardBufferBytes: sp.ForwardBufferBytes,
+		protocolPeekBytes:  sp.ProtocolPeekBytes,
+		httpAccessLog:      sp.HTTPAccessLog,
+		sessionByteQuota:   sp.SessionByteQuota,
+		nodeName:           nodeName(sp.NodeName),
+		warmupUntil:        time.Now().Add(time.Duration(sp.WarmupPeriod)),
+		ready:              make(chan struct{}),
+		OnReady:            sp.OnReady,
+		forwards:           make(map[int]struct{}),
+		reservations:       make(map[string][]*portReservation),
+		active:             make(map[int]*activeForward),
+		conns:              make(map[uint64]*activeConn),
+		stateFilePath:      sp.StateFilePath,
+	}
+}
 
 // Run starts the SSH reverse-tunnel server
 func Run(spOverride *config.ServerParameters) error {
@@ -49,81 +233,365 @@ func Run(spOverride *config.ServerParameters) error {
 	if spOverride == nil {
 		flag.StringVar(&sp.BindAddress, config.SpKeyBindAddress, config.SpDefaultBindAddress, "bind address")
 		flag.IntVar(&sp.BindPort, config.SpKeyBindPort, config.SpDefaultBindPort, "bind port")
+		flag.StringVar(&sp.ListenNetwork, config.SpKeyListenNetwork, config.SpDefaultListenNetwork, "listen network: tcp, tcp4 or tcp6")
 		flag.IntVar(&sp.PortRangeStart, config.SpKeyPortRangeStart, config.SpDefaultPortRangeStart, "start port range")
 		flag.IntVar(&sp.PortRangeEnd, config.SpKeyPortRangeEnd, config.SpDefaultPortRangeEnd, "end port range")
+		flag.BoolVar(&sp.StablePortByUser, config.SpKeyStablePortByUser, config.SpDefaultStablePortByUser, "assign each user a port derived from its name when it requests port 0")
+		flag.Var(&sp.PortPools, config.SpKeyPortPools, "comma-separated name=start-end port pools within the port range")
+		flag.Var(&sp.UserPoolMap, config.SpKeyUserPoolMap, "comma-separated user=pool pairs assigning users their ports from a pool")
+		flag.BoolVar(&sp.RequireExplicitPort, config.SpKeyRequireExplicitPort, config.SpDefaultRequireExplicitPort, "refuse clients requesting port 0 instead of picking a port")
+		flag.StringVar(&sp.PublicBaseURL, config.SpKeyPublicBaseURL, config.SpDefaultPublicBaseURL, "URL clients are told their port is reachable at, {port} being replaced by it")
 		flag.StringVar(&sp.Username, config.SpKeyUsername, config.SpDefaultUsername, "SSH username")
 		flag.StringVar(&sp.Password, config.SpKeyPassword, config.SpDefaultPassword, "SSH password")
+		flag.StringVar(&sp.PasswordHash, config.SpKeyPasswordHash, config.SpDefaultPasswordHash, "bcrypt hash of the SSH password, instead of --password (see hash-password)")
 		flag.StringVar(&sp.PrivateRsaPath, config.SpKeyPrivateRsaPath, config.SpDefaultPrivateRsa, "path to RSA key")
 		flag.StringVar(&sp.PrivateEcdsaPath, config.SpKeyPrivateEcdsaPath, config.SpDefaultPrivateEcdsa, "path to ECDSA key")
 		flag.StringVar(&sp.PrivateEd25519Path, config.SpKeyPrivateEd25519Path, config.SpDefaultPrivateEd25519, "path to Ed25519 key")
-		flag.StringVar(&sp.AuthorizedKeysPath, config.SpKeyAuthorizedKeysPath, config.SpDefaultAuthorizedKeys, "path to authorized_keys")
+		flag.StringVar(&sp.AuthorizedKeysPath, config.SpKeyAuthorizedKeysPath, config.SpDefaultAuthorizedKeys, "path or http(s) URL of authorized_keys")
+		flag.Var(&sp.AuthorizedKeysRefresh, config.SpKeyAuthorizedKeysRefresh, "reload authorized keys this often, e.g. from their URL (0 = at startup only)")
+		flag.BoolVar(&sp.AllowInsecureKeysURL, config.SpKeyAllowInsecureKeysURL, config.SpDefaultAllowInsecureKeysURL, "accept authorized keys served over plain http")
+		flag.StringVar(&sp.TrustedUserCAKeys, config.SpKeyTrustedUserCAKeys, config.SpDefaultTrustedUserCAKeys, "path to CA public keys trusted to sign user certificates")
+		flag.StringVar(&sp.AuthCommand, config.SpKeyAuthCommand, config.SpDefaultAuthCommand, "command validating passwords: username in PBP_TUNNEL_AUTH_USER, password on stdin, exit 0 to accept")
 		flag.Var(&sp.AllowedIPs, config.SpKeyAllowedIPS, "comma-separated list of allowed IPs")
+		flag.Var(&sp.ForwardBindByUser, config.SpKeyForwardBindByUser, "comma-separated user=address pairs binding a user's forwarded ports")
+		flag.Var(&sp.DeniedIPs, config.SpKeyDeniedIPs, "comma-separated list of denied IPs, checked before allowed IPs")
+		flag.Var(&sp.AllowedBindHosts, config.SpKeyAllowedBindHosts, "comma-separated list of hosts clients may request to bind their port on")
+		flag.BoolVar(&sp.AllowClientWhitelistWiden, config.SpKeyAllowClientWhitelistWiden, config.SpDefaultAllowClientWhitelistWiden, "let a client whitelist admit forward peers outside allowed IPs")
+		flag.IntVar(&sp.MinClientProtocol, config.SpKeyMinClientProtocol, config.SpDefaultMinClientProtocol, "reject clients speaking an older protocol version (0 = any)")
+		flag.BoolVar(&sp.TolerateExtraChannels, config.SpKeyTolerateExtraChannels, config.SpDefaultTolerateExtraChannels, "accept and close session channels instead of rejecting them")
+		flag.BoolVar(&sp.AllowPortSharing, config.SpKeyAllowPortSharing, config.SpDefaultAllowPortSharing, "register clients requesting a port in use as failover backups")
+		flag.Float64Var(&sp.LogSampleRate, config.SpKeyLogSampleRate, config.SpDefaultLogSampleRate, "fraction of forward open/close events logged (0 = all)")
+		flag.IntVar(&sp.MaxWhitelistEntriesTotal, config.SpKeyMaxWhitelistEntriesTotal, config.SpDefaultMaxWhitelistEntriesTotal, "client whitelist entries held across all sessions (0 = unlimited)")
+		flag.IntVar(&sp.MaxWhitelistCount, config.SpKeyMaxWhitelistCount, config.SpDefaultMaxWhitelistCount, "entries of a single client whitelist (0 = unlimited)")
+		flag.Uint64Var(&sp.RekeyThreshold, config.SpKeyRekeyThreshold, config.SpDefaultRekeyThreshold, "bytes sent or received before rekeying (0 = default)")
+		flag.Var(&sp.Ciphers, config.SpKeyCiphers, "SSH ciphers accepted, in order of preference (comma-separated)")
+		sp.PortReleaseGrace = config.SpDefaultPortReleaseGrace
+		flag.Var(&sp.PortReleaseGrace, config.SpKeyPortReleaseGrace, "how long to keep a disconnected client's port reserved (e.g. 30s)")
+		flag.Var(&sp.WarmupPeriod, config.SpKeyWarmupPeriod, "after startup, ask clients to retry port requests for this long (e.g. 30s)")
+		flag.IntVar(&sp.MaxConnsPerForward, config.SpKeyMaxConnsPerForward, config.SpDefaultMaxConnsPerForward, "concurrent connections per forwarded port, further ones queue (0 = unlimited)")
+		flag.IntVar(&sp.MaxPortsPerIP, config.SpKeyMaxPortsPerIP, config.SpDefaultMaxPortsPerIP, "ports held at once by a client IP (0 = unlimited)")
+		flag.IntVar(&sp.HighWaterForwards, config.SpKeyHighWaterForwards, config.SpDefaultHighWaterForwards, "refuse new forwards, asking clients to retry, once this many ports are assigned (0 = disabled)")
+		flag.IntVar(&sp.LowWaterForwards, config.SpKeyLowWaterForwards, config.SpDefaultLowWaterForwards, "accept new forwards again once assigned ports drop to this (0 = 90% of high-water-forwards)")
+		flag.Uint64Var(&sp.HighWaterHeapBytes, config.SpKeyHighWaterHeapBytes, config.SpDefaultHighWaterHeapBytes, "refuse new forwards while the Go heap is over this many bytes (0 = disabled)")
+		flag.IntVar(&sp.ForwardBufferBytes, config.SpKeyForwardBufferBytes, config.SpDefaultForwardBufferBytes, "bytes buffered per forward when the client is slow (0 = no buffer)")
+		flag.IntVar(&sp.ProtocolPeekBytes, config.SpKeyProtocolPeekBytes, config.SpDefaultProtocolPeekBytes, "bytes peeked from forwarded connections to detect HTTP or TLS (0 = disabled)")
+		flag.BoolVar(&sp.HTTPAccessLog, config.SpKeyHTTPAccessLog, config.SpDefaultHTTPAccessLog, "log HTTP forwards in Common Log Format (requires protocol-peek-bytes)")
+		flag.Uint64Var(&sp.SessionByteQuota, config.SpKeySessionByteQuota, config.SpDefaultSessionByteQuota, "bytes relayed per SSH connection before it is closed (0 = unlimited)")
+		flag.StringVar(&sp.NodeName, config.SpKeyNodeName, config.SpDefaultNodeName, "name tagging log lines and metrics (default: hostname)")
+		flag.StringVar(&sp.StateFilePath, config.SpKeyStateFilePath, config.SpDefaultStateFilePath, "path to a JSON file exporting active forwards")
+		flag.StringVar(&sp.RunAsUser, config.SpKeyRunAsUser, config.SpDefaultRunAsUser, "user to switch to after binding")
+		flag.StringVar(&sp.RunAsGroup, config.SpKeyRunAsGroup, config.SpDefaultRunAsGroup, "group to switch to after binding (default: the user's primary group)")
+		flag.StringVar(&sp.PidFile, config.SpKeyPidFile, config.SpDefaultPidFile, "file to write the server PID to, removed on shutdown")
+		flag.Var(&sp.ConfigWatchInterval, config.SpKeyConfigWatchInterval, "poll the config file this often and reload allowed IPs when it changes (e.g. 10s)")
+		flag.Var(&sp.MaxUptime, config.SpKeyMaxUptime, "drain and exit after running this long, for scheduled restarts (e.g. 24h)")
+		flag.Var(&sp.MaxConnDuration, config.SpKeyMaxConnDuration, "close forwarded connections open this long, even if active (e.g. 1h)")
+		flag.Var(&sp.MaxConnectionAge, config.SpKeyMaxConnectionAge, "drain and close client SSH connections this old so they reconnect (e.g. 24h)")
+		flag.IntVar(&sp.SocketReadBuffer, config.SpKeySocketReadBuffer, config.SpDefaultSocketReadBuffer, "receive buffer size of accepted SSH connections' sockets in bytes (0 = OS default)")
+		flag.IntVar(&sp.SocketWriteBuffer, config.SpKeySocketWriteBuffer, config.SpDefaultSocketWriteBuffer, "send buffer size of accepted SSH connections' sockets in bytes (0 = OS default)")
+		noDelay := flag.Bool(config.SpKeyTCPNoDelay, config.SpDefaultTCPNoDelay, "set TCP_NODELAY on forwarded connections (false enables Nagle's algorithm)")
 		flag.Parse()
+		sp.TCPNoDelay = noDelay
 	} else {
 		sp = *spOverride
 	}
 
 	// 1) Validate configuration
-	if err := sp.Validate(); err != nil {
+	err := sp.Validate()
+	if err != nil {
 		return fmt.Errorf("invalid server parameters: %w", err)
 	}
+	node := nodeName(sp.NodeName)
+	defer tagLogs(node)()
+	var uid, gid int
+	if sp.RunAsUser != "" {
+		if uid, gid, err = resolveRunAs(sp.RunAsUser, sp.RunAsGroup); err != nil {
+			return fmt.Errorf("invalid run_as_user/run_as_group: %w", err)
+		}
+	}
+	if sp.PidFile != "" {
+		if err := writePidFile(sp.PidFile); err != nil {
+			return err
+		}
+		defer removePidFile(sp.PidFile)
+	}
 	// 2) Build SSH config
-	sshCfg, addr, err := config.GetServerConfig(&sp)
+	algorithms := config.NewHostKeyAlgorithms()
+	sshCfg, addr, err := config.GetServerConfig(&sp, algorithms)
 	if err != nil {
 		return fmt.Errorf("failed to build server config: %w", err)
 	}
-	// 3) Listen
-	ln, err := net.Listen("tcp", addr)
+	// 3) Listen, preferring a socket passed by systemd
+	listenNetwork := sp.ListenNetwork
+	if listenNetwork == "" {
+		listenNetwork = config.SpDefaultListenNetwork
+	}
+	ln, activated, err := systemdListener()
 	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		return fmt.Errorf("systemd socket activation: %w", err)
 	}
+	if !activated {
+		if ln, err = listen(listenNetwork, addr); err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+	}
+	// the listener's address holds the port the OS picked for BindPort 0
+	addr = ln.Addr().String()
 	defer ln.Close()
-	log.Printf("[+] SSH server listening on %s", addr)
-
-	srv := &ForwardServer{
-		sshConfig:      sshCfg,
-		bindAddress:    sp.BindAddress,
-		bindPort:       sp.BindPort,
-		portRangeStart: sp.PortRangeStart,
-		portRangeEnd:   sp.PortRangeEnd,
-		allowedIPs:     sp.AllowedIPs,
-		forwards:       make(map[int]struct{}),
-	}
-	// 4) Accept loop
+	if activated {
+		log.Printf("[+] SSH server listening on %s (systemd socket)", addr)
+	} else {
+		log.Printf("[+] SSH server listening on %s", addr)
+	}
+	// Forwarded ports are bound later, so they must be usable by the unprivileged user
+	if sp.RunAsUser != "" {
+		if err := dropPrivileges(uid, gid); err != nil {
+			return fmt.Errorf("failed to drop privileges to %s: %w", sp.RunAsUser, err)
+		}
+		log.Printf("[+] Dropped privileges to %s (uid=%d gid=%d)", sp.RunAsUser, uid, gid)
+	}
+
+	srv := newForwardServer(&sp, sshCfg, algorithms)
+	srv.listener = ln
+	srv.bindPort = listenerPort(ln, sp.BindPort)
+	if srv.stateFilePath != "" {
+		logStaleState(srv.stateFilePath)
+		srv.writeState()
+	}
+	// Stop accepting on SIGINT/SIGTERM so deferred cleanup such as the pid file runs,
+	// drain on SIGUSR1, reset stats on SIGUSR2, reload host keys on SIGHUP, drain and stop
+	// once MaxUptime is reached
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	drainSigs := make(chan os.Signal, 1)
+	if len(drainSignals) > 0 {
+		signal.Notify(drainSigs, drainSignals...)
+		defer signal.Stop(drainSigs)
+	}
+	statsSigs := make(chan os.Signal, 1)
+	if len(resetStatsSignals) > 0 {
+		signal.Notify(statsSigs, resetStatsSignals...)
+		defer signal.Stop(statsSigs)
+	}
+	hostKeySigs := make(chan os.Signal, 1)
+	if len(reloadHostKeySignals) > 0 {
+		signal.Notify(hostKeySigs, reloadHostKeySignals...)
+		defer signal.Stop(hostKeySigs)
+	}
+	var maxUptime <-chan time.Time
+	if sp.MaxUptime > 0 {
+		t := time.NewTimer(time.Duration(sp.MaxUptime))
+		defer t.Stop()
+		maxUptime = t.C
+	}
+	shutdown := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-maxUptime:
+				log.Printf("[*] Reached max uptime of %v, draining and shutting down", time.Duration(sp.MaxUptime))
+				srv.Drain()
+				close(shutdown)
+				return
+			case sig := <-drainSigs:
+				log.Printf("[*] Received %v, draining", sig)
+				srv.Drain()
+			case sig := <-statsSigs:
+				log.Printf("[*] Received %v, resetting stats", sig)
+				srv.ResetStats()
+			case sig := <-hostKeySigs:
+				log.Printf("[*] Received %v, reloading host keys", sig)
+				srv.reloadHostKeys()
+			case sig := <-sigs:
+				log.Printf("[*] Received %v, shutting down", sig)
+				ln.Close()
+				close(shutdown)
+				return
+			}
+		}
+	}()
+	go srv.runPortReaper(shutdown)
+	if srv.stateFilePath != "" {
+		go srv.persistState(shutdown)
+	}
+	if sp.AuthorizedKeysRefresh > 0 {
+		go srv.refreshAuthorizedKeys(time.Duration(sp.AuthorizedKeysRefresh), shutdown)
+	}
+	if sp.ConfigWatchInterval > 0 {
+		go watchConfig(config.ConfigFilePath(), time.Duration(sp.ConfigWatchInterval), shutdown, srv.reloadConfig)
+	}
+	// 4) Accept loop, then keep existing forwards running until shutdown once drained
+	srv.serve()
+	if srv.draining.Load() {
+		log.Printf("[*] Drained, existing forwards stay up until shutdown")
+		<-shutdown
+	}
+	return nil
+}
+
+// BoundPort returns the port the SSH server listens on, as chosen by the OS
+// when BindPort is 0
+func (s *ForwardServer) BoundPort() int {
+	return s.bindPort
+}
+
+// listenerPort returns the TCP port ln is bound to, or fallback for a
+// listener without one
+func listenerPort(ln net.Listener, fallback int) int {
+	if a, ok := ln.Addr().(*net.TCPAddr); ok {
+		return a.Port
+	}
+	return fallback
+}
+
+// serve signals Ready, then accepts SSH connections until the listener is closed
+func (s *ForwardServer) serve() {
+	s.markReady()
 	for {
-		nc, err := ln.Accept()
+		nc, err := s.listener.Accept()
 		if err != nil {
+			if listenerClosed(err) {
+				return
+			}
 			log.Printf("[-] Accept error: %v", err)
 			time.Sleep(100 * time.Millisecond)
 			continue
 		}
-		go srv.handleSSHConnection(nc)
+		go s.handleSSHConnection(nc)
+	}
+}
+
+// Ready returns a channel closed once the server is set up and its accept
+// loop runs, a more reliable signal than the "listening on" log line
+func (s *ForwardServer) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// markReady closes the ready channel and calls OnReady, once
+func (s *ForwardServer) markReady() {
+	s.readyOnce.Do(func() {
+		if s.ready != nil {
+			close(s.ready)
+		}
+		if s.OnReady != nil {
+			s.OnReady()
+		}
+	})
+}
+
+// Drain stops accepting SSH connections and refuses new forwards, while the
+// forwards already assigned keep relaying
+func (s *ForwardServer) Drain() {
+	if s.draining.Swap(true) {
+		return
+	}
+	log.Printf("[*] Draining: refusing new connections and forwards")
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+// connAgeDrainTimeout bounds how long a connection past maxConnectionAge waits
+// for its open forwards before it is closed
+var connAgeDrainTimeout = 30 * time.Second
+
+// listen opens the SSH and forward listeners, replaced in tests
+var listen = net.Listen
+
+// maxBindRetries is how many other ports an automatic assignment is moved to
+// when its port cannot be bound
+const maxBindRetries = 3
+
+// sdListenFdsStart is the first file descriptor passed by systemd (SD_LISTEN_FDS_START)
+var sdListenFdsStart = 3
+
+// systemdListener returns the listener inherited through systemd socket activation.
+// It reports false when LISTEN_FDS is unset or addressed to another process.
+func systemdListener() (net.Listener, bool, error) {
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, false, nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, false, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, false, fmt.Errorf("invalid LISTEN_FDS %q", fds)
 	}
+	if n > 1 {
+		log.Printf("[*] systemd passed %d sockets, using the first one", n)
+	}
+
+	// Keep the variables from leaking into child processes
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(sdListenFdsStart), "LISTEN_FD_"+strconv.Itoa(sdListenFdsStart))
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, false, fmt.Errorf("inherited fd %d: %w", sdListenFdsStart, err)
+	}
+	return ln, true, nil
 }
 
 // handleSSHConnection manages SSH handshake and channels
 func (s *ForwardServer) handleSSHConnection(nc net.Conn) {
 	defer nc.Close()
-	sshConn, chans, reqs, err := ssh.NewServerConn(nc, s.sshConfig)
+	if err := util.SetSocketBuffers(nc, s.socketReadBuffer, s.socketWriteBuffer); err != nil {
+		log.Printf("[-] Socket buffers for %s: %v", nc.RemoteAddr(), err)
+	}
+	sshConn, chans, reqs, err := ssh.NewServerConn(nc, s.sshServerConfig())
 	if err != nil {
 		log.Printf("[-] SSH handshake failed: %v", err)
 		return
 	}
 	defer sshConn.Close()
-	go ssh.DiscardRequests(reqs)
 
 	rAddr := sshConn.RemoteAddr().String()
+	var protocolVersion atomic.Uint32
+	protocolVersion.Store(1)
+	go handleGlobalRequests(rAddr, reqs, &protocolVersion)
+
 	host, _, _ := net.SplitHostPort(rAddr)
 	log.Printf("[+] New SSH connection from %s", rAddr)
-	// initial IP check
-	if len(s.allowedIPs) > 0 && !isAllowed(host, s.allowedIPs) {
+
+	hostKeyAlgorithm := s.hostKeyAlgorithms.Take(sshConn.SessionID())
+	if hostKeyAlgorithm == "" {
+		hostKeyAlgorithm = "unknown"
+	}
+	log.Printf("[*] SSH client %s negotiated host key algorithm %s", rAddr, hostKeyAlgorithm)
+	// initial IP check, deny-list first
+	if s.denied().Contains(host) {
+		log.Printf("[-] SSH client %s denied", host)
+		return
+	}
+	if !s.allowed().allows(host) {
 		log.Printf("[-] SSH client %s not allowed", host)
 		return
 	}
-	// channel loop
+	// past maxConnectionAge the connection is recycled: handleChannel drains the
+	// port it serves, a connection serving none is closed straight away
+	var aged chan struct{}
+	var serving atomic.Bool
+	if s.maxConnectionAge > 0 {
+		aged = make(chan struct{})
+		t := time.AfterFunc(s.maxConnectionAge, func() {
+			close(aged)
+			if !serving.Load() {
+				log.Printf("[*] SSH connection %s reached max age of %v, closing", rAddr, s.maxConnectionAge)
+				sshConn.Close()
+			}
+		})
+		defer t.Stop()
+	}
+	// channel loop, all forwards of this connection share its byte quota
+	quota := newSessionQuota(s.sessionByteQuota, sshConn)
 	for newCh := range chans {
 		if newCh.ChannelType() != "direct-tcpip" {
-			newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			s.handleExtraChannel(rAddr, newCh)
 			continue
 		}
 		ch, reqs2, err := newCh.Accept()
@@ -131,69 +599,226 @@ func (s *ForwardServer) handleSSHConnection(nc net.Conn) {
 			log.Printf("[-] Accept channel failed: %v", err)
 			continue
 		}
-		go ssh.DiscardRequests(reqs2)
-		s.handleChannel(sshConn, ch)
+		go refuseRequests(rAddr, reqs2)
+		serving.Store(true)
+		s.handleChannel(sshConn, ch, protocolVersion.Load(), quota, aged)
+		serving.Store(false)
+	}
+}
+
+// refuseRequests rejects every request on a channel, such as exec, shell or
+// agent forwarding, logging it as a possible misuse
+func refuseRequests(rAddr string, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		log.Printf("[*] Refused channel request %q from %s", req.Type, rAddr)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// handleExtraChannel turns down a channel other than direct-tcpip. Session channels,
+// opened by some clients for keepalives, are accepted and closed straight away
+// when tolerateExtraChans is set, so those clients do not report an error.
+func (s *ForwardServer) handleExtraChannel(rAddr string, newCh ssh.NewChannel) {
+	if s.tolerateExtraChans && newCh.ChannelType() == "session" {
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			log.Printf("[-] Accept session channel from %s failed: %v", rAddr, err)
+			return
+		}
+		go refuseRequests(rAddr, reqs)
+		ch.Close()
+		log.Printf("[*] Closed session channel from %s", rAddr)
+		return
+	}
+	log.Printf("[*] Rejected unsupported channel type %q from %s", newCh.ChannelType(), rAddr)
+	newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+}
+
+// handleGlobalRequests answers protocol version negotiation and rejects any other
+// global request, such as tcpip-forward, logging it as a possible misuse
+func handleGlobalRequests(rAddr string, reqs <-chan *ssh.Request, protocolVersion *atomic.Uint32) {
+	for req := range reqs {
+		if req.Type != protocol.VersionRequest || len(req.Payload) < 4 {
+			log.Printf("[*] Refused global request %q from %s", req.Type, rAddr)
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		version := min(binary.BigEndian.Uint32(req.Payload), protocol.Version)
+		protocolVersion.Store(version)
+
+		var reply [4]byte
+		binary.BigEndian.PutUint32(reply[:], protocol.Version)
+		req.Reply(true, reply[:])
+		log.Printf("[*] Negotiated protocol version %d", version)
 	}
 }
 
 // handleChannel manages port-forward handshake, assignment, and data forwarding
-func (s *ForwardServer) handleChannel(sshConn *ssh.ServerConn, channel ssh.Channel) {
+func (s *ForwardServer) handleChannel(sshConn *ssh.ServerConn, channel ssh.Channel, protocolVersion uint32, quota *sessionQuota, aged <-chan struct{}) {
 	defer channel.Close()
 	var hb [4]byte
 
-	// 1) Handshake and whitelist
+	// 1) Handshake and whitelist, refusing clients below the minimum protocol
 	host, _, _ := net.SplitHostPort(sshConn.RemoteAddr().String())
-	clientWL, err := processHandshake(channel, host, s.allowedIPs)
+	if protocolVersion < s.minClientProtocol {
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrMask|protocol.ErrProtocolMismatch))
+		channel.Write(hb[:])
+		binary.BigEndian.PutUint32(hb[:], s.minClientProtocol)
+		channel.Write(hb[:])
+		log.Printf("[-] Client %s speaks protocol %d, below the minimum %d", host, protocolVersion, s.minClientProtocol)
+		return
+	}
+	hs, err := processHandshake(channel, host, s.allowed(), s.denied(), s.whitelistBudget, s.maxWhitelistCount)
 	if err != nil {
 		log.Printf("[-] Handshake error: %v", err)
 		return
 	}
-	log.Printf("[+] Whitelist accepted: %v", clientWL)
+	defer s.whitelistBudget.release(len(hs.Whitelist))
+	log.Printf("[+] Whitelist accepted: %v", hs.Whitelist)
+	clientList := CompileAllowList(hs.Whitelist)
 
-	// 2) Read requested port
-	if _, err := io.ReadFull(channel, hb[:]); err != nil {
-		log.Printf("[-] Read requested port failed: %v", err)
+	// 2) Read requested port and bind host
+	if err := hs.readForwardRequest(channel, protocolVersion); err != nil {
+		log.Printf("[-] Forward request error: %v", err)
 		return
 	}
-	reqPort := int(binary.BigEndian.Uint32(hb[:]))
+	reqPort, reqHost := hs.RequestedPort, hs.BindHost
 	log.Printf("[*] Client requested port %d", reqPort)
+	bindAddr, ok := s.bindAddressFor(sshConn.User(), reqHost)
+	if !ok {
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrMask|protocol.ErrBindHostNotAllowed))
+		channel.Write(hb[:])
+		log.Printf("[-] Client %s requested bind host %s, not in allowed bind hosts", host, reqHost)
+		return
+	}
 
-	// 3) Assign port
-	port, mask := assignPort(reqPort, s.portRangeStart, s.portRangeEnd, s.forwards, &s.lock)
-	if mask != 0 {
-		binary.BigEndian.PutUint32(hb[:], mask)
+	// 3) Assign port, preferring one still reserved for this client, once warmed up
+	if s.draining.Load() {
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrMask|protocol.ErrDraining))
+		channel.Write(hb[:])
+		log.Printf("[-] Draining, refused forward for %s", host)
+		return
+	}
+	if remaining := time.Until(s.warmupUntil); remaining > 0 {
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrMask|protocol.ErrWarmingUp))
+		channel.Write(hb[:])
+		log.Printf("[*] Warming up for another %v, asked %s to retry", remaining.Round(time.Second), host)
+		return
+	}
+	if s.loadShedder.shed(s.assignedPorts()) {
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrMask|protocol.ErrOverloaded))
+		channel.Write(hb[:])
+		log.Printf("[-] Overloaded, asked %s to retry", host)
+		return
+	}
+	if reqPort == 0 && s.requireExplicit {
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrMask|protocol.ErrPortRequired))
+		channel.Write(hb[:])
+		log.Printf("[-] Refused forward for %s: an explicit port is required", host)
+		return
+	}
+	if !s.portsPerIP.claim(host) {
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrMask|protocol.ErrPortQuota))
+		channel.Write(hb[:])
+		log.Printf("[-] Refused forward for %s: it already holds %d ports", host, s.portsPerIP.limit)
+		return
+	}
+	defer s.portsPerIP.release(host)
+	identity := clientIdentity(sshConn)
+	port, mask := s.reclaimPort(identity, reqPort), protocol.ErrSuccess
+	if port != 0 {
+		log.Printf("[+] Reclaimed reserved port %d for %s", port, identity)
+	} else {
+		port, mask = s.assignPortFor(sshConn.User(), reqPort)
+	}
+	if mask == protocol.ErrMask|protocol.ErrPortUnavailable && reqPort != 0 {
+		backup := &portBackend{conn: sshConn, protocolVersion: protocolVersion, quota: quota}
+		if s.joinShare(reqPort, backup) {
+			s.serveBackup(channel, sshConn, reqPort, backup)
+			return
+		}
+	}
+	if mask != protocol.ErrSuccess {
+		binary.BigEndian.PutUint32(hb[:], uint32(mask))
 		channel.Write(hb[:])
-		log.Printf("[-] Port assignment failed: mask %08x", mask)
+		s.logAssignFailure(host, sshConn.User(), reqPort, mask)
 		return
 	}
 	log.Printf("[+] Assigned port %d", port)
 
-	// 4) Bind listener for forwarded connections
-	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.bindAddress, port))
+	// 4) Bind listener for forwarded connections. Ports that cannot be bound are
+	// freed again, an automatic assignment moves on to another port.
+	ln, err := listen(s.listenNetwork, net.JoinHostPort(bindAddr, strconv.Itoa(port)))
+	var unbound []int
+	for err != nil {
+		log.Printf("[-] Bind port %d on %s failed: %v", port, bindAddr, err)
+		unbound = append(unbound, port)
+		if reqPort != 0 || len(unbound) > maxBindRetries {
+			break
+		}
+		// the unbound ports stay marked in use until here, so they are not picked again
+		if port, mask = s.assignPortFor(sshConn.User(), 0); mask != protocol.ErrSuccess {
+			s.logAssignFailure(host, sshConn.User(), 0, mask)
+			break
+		}
+		log.Printf("[*] Retrying forward for %s on port %d", host, port)
+		ln, err = listen(s.listenNetwork, net.JoinHostPort(bindAddr, strconv.Itoa(port)))
+	}
+	s.freePorts(unbound)
 	if err != nil {
-		binary.BigEndian.PutUint32(hb[:], ErrMask|ErrInternal)
+		if mask == protocol.ErrSuccess {
+			mask = protocol.ErrMask | protocol.ErrInternal
+		}
+		binary.BigEndian.PutUint32(hb[:], uint32(mask))
 		channel.Write(hb[:])
-		log.Printf("[-] Bind port %d failed: %v", port, err)
 		return
 	}
 	defer ln.Close()
 
 	// 5) Notify client of assigned port
-	binary.BigEndian.PutUint32(hb[:], uint32(port))
-	channel.Write(hb[:])
+	s.writeAssignment(channel, port, protocolVersion)
 	log.Printf("[+] Notified client of port %d", port)
+	stats := s.trackForward(port, host)
+	owner := &portBackend{conn: sshConn, protocolVersion: protocolVersion, quota: quota}
+	share := s.openShare(port, owner)
 
-	// 6) Serve until client disconnects
+	// 6) Serve until client disconnects, or with port sharing until its backups do too
 	done := make(chan struct{})
 	go func() {
 		_ = sshConn.Wait()
+		if share != nil {
+			if remaining := s.leaveShare(port, owner); remaining > 0 {
+				log.Printf("[*] Client of port %d disconnected, %d backup(s) keep serving it", port, remaining)
+			}
+			<-share.empty
+		}
 		ln.Close()
 		close(done)
 	}()
+	// once the connection is aged, stop accepting; open forwards drain at RELEASE
+	retiring := make(chan struct{})
+	go func() {
+		select {
+		case <-aged:
+			log.Printf("[*] SSH connection %s reached max age of %v, draining port %d", sshConn.RemoteAddr(), s.maxConnectionAge, port)
+			close(retiring)
+			ln.Close()
+		case <-done:
+		}
+	}()
 
 	var wg sync.WaitGroup
 	var doWaitForConnection = true
-	for id := 0; ; id++ {
+	var slots chan struct{}
+	if s.maxConnsPerForward > 0 {
+		slots = make(chan struct{}, s.maxConnsPerForward)
+	}
+	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			select {
@@ -201,9 +826,13 @@ func (s *ForwardServer) handleChannel(sshConn *ssh.ServerConn, channel ssh.Chann
 				// client disconnected
 				goto RELEASE
 
+			case <-retiring:
+				// max connection age reached
+				goto RELEASE
+
 			default:
 				log.Printf("[-] Forward accept error: %v", err)
-				if strings.Contains(err.Error(), "use of closed network connection") {
+				if listenerClosed(err) {
 					// listener closed
 					doWaitForConnection = false
 				}
@@ -213,89 +842,471 @@ func (s *ForwardServer) handleChannel(sshConn *ssh.ServerConn, channel ssh.Chann
 		}
 		// whitelist forwarded peer
 		peer, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-		accepted := len(clientWL) == 0
-		for _, entry := range clientWL {
-			if strings.Contains(entry, "/") {
-				if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(net.ParseIP(peer)) {
-					accepted = true
-					break
-				}
-			} else if entry == peer {
-				accepted = true
-				break
-			}
-		}
-		if !accepted {
+		if !s.peerAllowed(peer, clientList) {
+			s.whitelistRejections.inc(peer)
 			log.Printf("[-] Connection from %s rejected by whitelist", peer)
 			conn.Close()
 			continue
 		}
+		if err := util.SetNoDelay(conn, s.tcpNoDelay); err != nil {
+			log.Printf("[-] Set TCP_NODELAY for %s: %v", conn.RemoteAddr(), err)
+		}
+
+		// queue behind the per-forward limit, without blocking disconnect handling
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				log.Printf("[*] Port %d at %d concurrent connections, queueing %s", port, cap(slots), conn.RemoteAddr())
+				select {
+				case slots <- struct{}{}:
+				case <-done:
+					conn.Close()
+					goto RELEASE
+				}
+			}
+		}
 
 		wg.Add(1)
-		go func(c net.Conn, idx int) {
+		go func(c net.Conn, idx uint64) {
 			defer wg.Done()
 			defer c.Close()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+
+			// open/close events are sampled on busy servers, errors are not
+			traceID := newTraceID()
+			logged := s.forwardLogSampler.sample()
+			if logged {
+				log.Printf("[+] Forward %d accepted from %s (trace=%s)", idx, c.RemoteAddr(), traceID)
+			}
+			// detect the protocol from the first bytes, replayed to the client
+			var proto, request string
+			if s.protocolPeekBytes > 0 {
+				var head []byte
+				c, head = peekConn(c, s.protocolPeekBytes, protocolPeekTimeout)
+				proto = detectProtocol(head)
+				if logged {
+					log.Printf("[*] Forward %d detected as %s (trace=%s)", idx, proto, traceID)
+				}
+				if s.httpAccessLog && proto == protocolHTTP {
+					request, _ = requestLine(head)
+				}
+			}
+			connStats := s.trackConn(idx, port, c.RemoteAddr().String(), traceID, proto)
+			if request != "" {
+				// c is the requester here, so bytesToService is the response size
+				defer func() {
+					log.Printf("[*] %s", accessLogLine(c.RemoteAddr().String(), request, connStats.startedAt, connStats.bytesToService.Load()))
+				}()
+			}
+			defer s.untrackConn(idx)
 
-			ch2, reqs3, err := sshConn.OpenChannel("direct-tcpip", nil)
+			ch2, reqs3, backend, err := s.openBackChannel(port, share, owner, protocol.NewDirectTCPIP(c.LocalAddr(), c.RemoteAddr()).Marshal())
 			if err != nil {
-				log.Printf("[-] Open back-channel failed: %v", err)
+				log.Printf("[-] Open back-channel for forward %d failed (trace=%s): %v", idx, traceID, err)
 				return
 			}
-			go ssh.DiscardRequests(reqs3)
+			go refuseRequests(backend.conn.RemoteAddr().String(), reqs3)
+			go discardExtendedData(ch2, idx)
+			quota := backend.quota
 
+			if backend.protocolVersion >= protocol.VersionTraceID {
+				if err := writeTraceID(ch2, traceID); err != nil {
+					log.Printf("[-] Send trace ID for forward %d failed (trace=%s): %v", idx, traceID, err)
+					ch2.Close()
+					return
+				}
+			}
+
+			// close both ends at the deadline, however active the connection is
+			if s.maxConnDuration > 0 {
+				deadline := time.AfterFunc(s.maxConnDuration, func() {
+					log.Printf("[*] Forward %d reached max duration of %v, closing (trace=%s)", idx, s.maxConnDuration, traceID)
+					c.Close()
+					ch2.Close()
+				})
+				defer deadline.Stop()
+			}
+
+			// a reset from the public peer or a broken back-channel fails one copy;
+			// closing c and ch2 stops the other, which the client would keep open
+			abort := func(dir string, err error) {
+				// net.ErrClosed: the other copy aborted first and closed c
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("[-] Copy to %s for forward %d failed, closing (trace=%s): %v", dir, idx, traceID, err)
+				}
+				c.Close()
+				ch2.Close()
+			}
 			var cc sync.WaitGroup
 			cc.Add(2)
 			// service -> client
 			go func() {
 				defer cc.Done()
-				n, _ := io.Copy(ch2, c)
-				log.Printf("[*] Copied %d bytes to client for forward %d", n, idx)
-				ch2.CloseWrite()
+				var n int64
+				var err error
+				if s.forwardBufferBytes > 0 {
+					n, err = bufferedCopy(quotaWriter{countingWriter{countingWriter{ch2, &stats.bytesToClient}, &connStats.bytesToClient}, quota}, c, s.forwardBufferBytes)
+				} else {
+					n, err = io.Copy(quotaWriter{countingWriter{countingWriter{ch2, &stats.bytesToClient}, &connStats.bytesToClient}, quota}, c)
+				}
+				if logged {
+					log.Printf("[*] Copied %d bytes to client for forward %d (trace=%s)", n, idx, traceID)
+				}
+				if err != nil {
+					abort("client", err)
+				} else {
+					ch2.CloseWrite()
+				}
 			}()
 			// client -> service
 			go func() {
 				defer cc.Done()
-				n, _ := io.Copy(c, ch2)
-				log.Printf("[*] Copied %d bytes to service for forward %d", n, idx)
+				n, err := io.Copy(quotaWriter{countingWriter{countingWriter{c, &stats.bytesToService}, &connStats.bytesToService}, quota}, ch2)
+				if logged {
+					log.Printf("[*] Copied %d bytes to service for forward %d (trace=%s)", n, idx, traceID)
+				}
+				if err != nil {
+					abort("service", err)
+				}
 			}()
 			cc.Wait()
-			log.Printf("[+] Forward %d closed", idx)
-		}(conn, port)
+			if logged {
+				log.Printf("[+] Forward %d closed (trace=%s)", idx, traceID)
+			}
+		}(conn, s.forwardIDs.Add(1))
 	}
 
 RELEASE:
+	select {
+	case <-retiring:
+		drained := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(connAgeDrainTimeout):
+			log.Printf("[-] Port %d still has open forwards after %v, closing anyway", port, connAgeDrainTimeout)
+		}
+		sshConn.Close()
+	default:
+	}
 	if doWaitForConnection {
 		wg.Wait()
 	}
 
 	log.Printf("[*] Waiting for lock to release port %d", port)
+	s.releasePort(identity, port)
+	s.untrackForward(port)
+}
+
+// serveBackup confirms port to a client registered as its backup and keeps
+// it registered until the client disconnects
+func (s *ForwardServer) serveBackup(channel ssh.Channel, sshConn *ssh.ServerConn, port int, b *portBackend) {
+	s.writeAssignment(channel, port, b.protocolVersion)
+	log.Printf("[+] Registered %s as backup for port %d", sshConn.RemoteAddr(), port)
+
+	_ = sshConn.Wait()
+	s.leaveShare(port, b)
+	log.Printf("[*] Backup %s for port %d disconnected", sshConn.RemoteAddr(), port)
+}
+
+// writeAssignment sends the assigned port, followed by the frames that come
+// with it from protocolVersion on
+func (s *ForwardServer) writeAssignment(w io.Writer, port int, protocolVersion uint32) {
+	var hb [4]byte
+	binary.BigEndian.PutUint32(hb[:], uint32(port))
+	w.Write(hb[:])
+	if protocolVersion >= protocol.VersionPublicURL {
+		s.writePublicURL(w, port)
+	}
+	if protocolVersion >= protocol.VersionServerTime {
+		var tb [8]byte
+		binary.BigEndian.PutUint64(tb[:], uint64(time.Now().UnixMilli()))
+		w.Write(tb[:])
+	}
+	if protocolVersion >= protocol.VersionServerInfo {
+		var hb [4]byte
+		binary.BigEndian.PutUint32(hb[:], uint32(len(Version)))
+		w.Write(append(hb[:], Version...))
+	}
+}
+
+// writePublicURL sends the length-prefixed public URL of port, empty without publicBaseURL
+func (s *ForwardServer) writePublicURL(w io.Writer, port int) {
+	var u string
+	if s.publicBaseURL != "" {
+		u = config.ExpandPublicURL(s.publicBaseURL, port)
+	}
+	var hb [4]byte
+	binary.BigEndian.PutUint32(hb[:], uint32(len(u)))
+	w.Write(append(hb[:], u...))
+}
+
+// discardExtendedData drains the extended-data (stderr) stream of a
+// back-channel, which is unused but shares the channel window: left unread,
+// it would stall the forwarded data once the window is used up
+func discardExtendedData(ch ssh.Channel, idx uint64) {
+	if n, _ := io.Copy(io.Discard, ch.Stderr()); n > 0 {
+		log.Printf("[*] Discarded %d bytes of extended data for forward %d", n, idx)
+	}
+}
+
+// listenerClosed reports whether an Accept error means the listener was closed
+func listenerClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
+
+// forwardBindAddress returns the address user's forwarded ports are bound to
+func (s *ForwardServer) forwardBindAddress(user string) string {
+	if addr, ok := s.bindByUser[user]; ok {
+		return addr
+	}
+	return s.bindAddress
+}
+
+// readForwardRequest reads the requested port, then from protocolVersion
+// VersionBindHost on the requested bind host, into res
+func (res *HandshakeResult) readForwardRequest(r io.Reader, protocolVersion uint32) error {
+	var hb [4]byte
+	if _, err := io.ReadFull(r, hb[:]); err != nil {
+		return fmt.Errorf("read requested port: %w", err)
+	}
+	res.RequestedPort = int(binary.BigEndian.Uint32(hb[:]))
+	if protocolVersion >= protocol.VersionBindHost {
+		host, err := readBindHost(r)
+		if err != nil {
+			return fmt.Errorf("read requested bind host: %w", err)
+		}
+		res.BindHost = host
+	}
+	return nil
+}
+
+// readBindHost reads the length-prefixed bind host a client requests
+func readBindHost(r io.Reader) (string, error) {
+	var hb [4]byte
+	if _, err := io.ReadFull(r, hb[:]); err != nil {
+		return "", err
+	}
+	length := binary.BigEndian.Uint32(hb[:])
+	if length > maxWhitelistEntryLength {
+		return "", fmt.Errorf("bind host too long: %d bytes", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// bindAddressFor returns where user's forwarded port is bound: the requested host
+// when it is an allowed bind host, or the configured address when none is requested
+// or the server allows none. It reports false for a host outside allowedBindHosts.
+func (s *ForwardServer) bindAddressFor(user, reqHost string) (string, bool) {
+	if reqHost == "" {
+		return s.forwardBindAddress(user), true
+	}
+	if len(s.allowedBindHosts) == 0 {
+		log.Printf("[*] Ignoring requested bind host %s, no allowed bind hosts configured", reqHost)
+		return s.forwardBindAddress(user), true
+	}
+	if slices.Contains(s.allowedBindHosts, reqHost) {
+		return reqHost, true
+	}
+	return "", false
+}
+
+// newTraceID returns a short random ID correlating a forward in client and server logs
+func newTraceID() string {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// writeTraceID sends the trace ID frame (length then bytes) on a back-channel
+func writeTraceID(w io.Writer, traceID string) error {
+	frame := make([]byte, 4+len(traceID))
+	binary.BigEndian.PutUint32(frame, uint32(len(traceID)))
+	copy(frame[4:], traceID)
+	_, err := w.Write(frame)
+	return err
+}
+
+// clientIdentity identifies a client across reconnects by SSH user and source IP
+func clientIdentity(conn ssh.ConnMetadata) string {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return conn.User() + "@" + host
+}
+
+// releasePort frees port, or keeps it reserved for identity during the grace period
+func (s *ForwardServer) releasePort(identity string, port int) {
 	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	log.Printf("[*] Client disconnected, freed port %d", port)
-	delete(s.forwards, port)
+	if s.portReleaseGrace <= 0 {
+		log.Printf("[*] Client disconnected, freed port %d", port)
+		delete(s.forwards, port)
+		return
+	}
+
+	r := &portReservation{port: port}
+	r.timer = time.AfterFunc(s.portReleaseGrace, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.removeReservation(identity, r) {
+			log.Printf("[*] Grace period expired, freed port %d", port)
+			delete(s.forwards, port)
+		}
+	})
+	if s.reservations == nil {
+		s.reservations = make(map[string][]*portReservation)
+	}
+	s.reservations[identity] = append(s.reservations[identity], r)
+	log.Printf("[*] Client disconnected, holding port %d for %s during %v", port, identity, s.portReleaseGrace)
+}
+
+// freePorts releases assigned ports that were never bound
+func (s *ForwardServer) freePorts(ports []int) {
+	if len(ports) == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, port := range ports {
+		delete(s.forwards, port)
+	}
+}
+
+// reclaimPort hands back a port reserved for identity that matches reqPort
+// (any reserved port when reqPort is 0). It returns 0 if there is none.
+func (s *ForwardServer) reclaimPort(identity string, reqPort int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, r := range s.reservations[identity] {
+		if reqPort == 0 || reqPort == r.port {
+			r.timer.Stop()
+			s.removeReservation(identity, r)
+			return r.port
+		}
+	}
+	return 0
+}
+
+// removeReservation drops r from the reservations of identity and reports
+// whether it was still present. The caller must hold s.lock.
+func (s *ForwardServer) removeReservation(identity string, r *portReservation) bool {
+	list := s.reservations[identity]
+	for i, candidate := range list {
+		if candidate == r {
+			list = append(list[:i], list[i+1:]...)
+			if len(list) == 0 {
+				delete(s.reservations, identity)
+			} else {
+				s.reservations[identity] = list
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// portRangeFor returns the range user's ports are assigned from: its pool
+// when userPools maps it to one, or else the whole range
+func (s *ForwardServer) portRangeFor(user string) (start, end int) {
+	if name, ok := s.userPools[user]; ok {
+		if pool, ok := s.portPools[name]; ok {
+			return pool.Start, pool.End
+		}
+	}
+	return s.portRangeStart, s.portRangeEnd
+}
+
+// assignPortFor assigns reqPort, or for reqPort 0 the user's stable port when
+// stablePortByUser is set and that port is free, or else the first free port,
+// all within the range of user
+func (s *ForwardServer) assignPortFor(user string, reqPort int) (int, protocol.ErrorCode) {
+	start, end := s.portRangeFor(user)
+	if reqPort == 0 && s.stablePortByUser && start > 0 && start <= end {
+		stable := stablePort(user, start, end)
+		if port, mask := assignPort(stable, start, end, s.forwards, &s.lock); mask == protocol.ErrSuccess {
+			return port, mask
+		}
+		log.Printf("[*] Stable port %d of %s is taken, picking another", stable, user)
+	}
+	return assignPort(reqPort, start, end, s.forwards, &s.lock)
+}
+
+// logAssignFailure logs why a port could not be assigned to host for user,
+// with the user's range and how much of it is in use, so capacity problems
+// show in the logs
+func (s *ForwardServer) logAssignFailure(host, user string, reqPort int, mask protocol.ErrorCode) {
+	start, end := s.portRangeFor(user)
+	var reason string
+	switch {
+	case start > end:
+		reason = "invalid-range"
+	case mask == protocol.ErrMask|protocol.ErrPortOutOfRange:
+		reason = "out-of-range"
+	case reqPort != 0:
+		reason = "unavailable"
+	default:
+		reason = "range-exhausted"
+	}
+	size := max(end-start+1, 0)
+	log.Printf("[-] Port assignment failed for %s: reason=%s requested=%d range=%d-%d used=%d/%d mask=%08x (%s)",
+		host, reason, reqPort, start, end, s.portsInRange(start, end), size, uint32(mask), mask)
+}
 
-	s.lock.Unlock()
+// portsInUse returns how many ports of the range are assigned
+func (s *ForwardServer) portsInUse() int {
+	return s.portsInRange(s.portRangeStart, s.portRangeEnd)
+}
+
+// portsInRange returns how many ports of [start, end] are assigned
+func (s *ForwardServer) portsInRange(start, end int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for port := range s.forwards {
+		if port >= start && port <= end {
+			n++
+		}
+	}
+	return n
+}
+
+// stablePort maps user to a port in [start, end] with an FNV-1a hash
+func stablePort(user string, start, end int) int {
+	h := fnv.New32a()
+	h.Write([]byte(user))
+	return start + int(h.Sum32()%uint32(end-start+1))
 }
 
 // assignPort reserves or picks a port within range using the forwards map under lock.
 // It returns the assigned port or 0 and an error mask if no port could be assigned.
-func assignPort(reqPort, start, end int, forwards map[int]struct{}, lock *sync.Mutex) (int, uint32) {
+func assignPort(reqPort, start, end int, forwards map[int]struct{}, lock *sync.Mutex) (int, protocol.ErrorCode) {
 	// invalid range
 	if start > end {
-		return 0, ErrMask | ErrPortUnavailable
+		return 0, protocol.ErrMask | protocol.ErrPortUnavailable
 	}
 	// specific port requested
 	if reqPort != 0 {
 		if reqPort < start || reqPort > end {
-			return 0, ErrMask | ErrPortOutOfRange
+			return 0, protocol.ErrMask | protocol.ErrPortOutOfRange
 		}
 		lock.Lock()
 		defer lock.Unlock()
 		if _, used := forwards[reqPort]; used {
-			return 0, ErrMask | ErrPortUnavailable
+			return 0, protocol.ErrMask | protocol.ErrPortUnavailable
 		}
 		forwards[reqPort] = struct{}{}
-		return reqPort, 0
+		return reqPort, protocol.ErrSuccess
 	}
 	// pick first available
 	lock.Lock()
@@ -303,50 +1314,120 @@ func assignPort(reqPort, start, end int, forwards map[int]struct{}, lock *sync.M
 	for p := start; p <= end; p++ {
 		if _, used := forwards[p]; !used {
 			forwards[p] = struct{}{}
-			return p, 0
+			return p, protocol.ErrSuccess
 		}
 	}
-	return 0, ErrMask | ErrPortUnavailable
+	return 0, protocol.ErrMask | protocol.ErrPortUnavailable
+}
+
+// HandshakeResult is what a client asks for on its control channel: the
+// whitelist from processHandshake, then the forward it requests
+type HandshakeResult struct {
+	Whitelist     []string
+	RequestedPort int
+	BindHost      string // protocol.VersionBindHost and later, empty = server's choice
 }
 
 // processHandshake performs the SSH handshake steps for IP and whitelist.
 // It sends ErrIPNotAllowed or ErrSuccess, reads whitelist count and entries, then confirms with ErrSuccess.
-func processHandshake(rw io.ReadWriter, remoteHost string, allowed []string) ([]string, error) {
+// A denied IP is rejected even when the allow-list matches it. The entries are
+// reserved against budget, which the caller releases once the session ends; a
+// whitelist over budget is refused with ErrWhitelistBudget. A count above
+// maxCount (0 = unlimited) is refused with ErrWhitelistTooLarge before any
+// entry is read, and one made only of empty entries with ErrWhitelistEmpty.
+func processHandshake(rw io.ReadWriter, remoteHost string, allowed, denied *AllowList, budget *whitelistBudget, maxCount int) (res HandshakeResult, err error) {
 	var hb [4]byte
 	// 1) IP check
-	if len(allowed) > 0 && !isAllowed(remoteHost, allowed) {
-		binary.BigEndian.PutUint32(hb[:], ErrIPNotAllowed)
+	if denied.Contains(remoteHost) {
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrIPNotAllowed))
 		rw.Write(hb[:])
-		return nil, fmt.Errorf("IP %s not allowed", remoteHost)
+		return HandshakeResult{}, fmt.Errorf("IP %s denied", remoteHost)
+	}
+	if !allowed.allows(remoteHost) {
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrIPNotAllowed))
+		rw.Write(hb[:])
+		return HandshakeResult{}, fmt.Errorf("IP %s not allowed", remoteHost)
 	}
 	// IP OK
-	binary.BigEndian.PutUint32(hb[:], ErrSuccess)
+	binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrSuccess))
 	rw.Write(hb[:])
 
 	// 2) Read whitelist count
 	if _, err := io.ReadFull(rw, hb[:]); err != nil {
-		return nil, fmt.Errorf("read whitelist count: %w", err)
+		return HandshakeResult{}, fmt.Errorf("read whitelist count: %w", err)
 	}
 	count := int(binary.BigEndian.Uint32(hb[:]))
+	if maxCount > 0 && count > maxCount {
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrWhitelistTooLarge))
+		rw.Write(hb[:])
+		return HandshakeResult{}, fmt.Errorf("whitelist of %d entries exceeds the maximum of %d", count, maxCount)
+	}
+	if !budget.reserve(count) {
+		binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrWhitelistBudget))
+		rw.Write(hb[:])
+		return HandshakeResult{}, fmt.Errorf("whitelist of %d entries exceeds the remaining budget of %d", count, budget.remaining())
+	}
+	defer func() {
+		if err != nil {
+			budget.release(count)
+		}
+	}()
 
-	// 3) Read entries
-	wl := make([]string, 0, count)
+	// 3) Read entries through a pooled scratch buffer, so the only per-entry
+	// allocation is the resulting string
+	scratch := handshakeBufPool.Get().(*[]byte)
+	defer handshakeBufPool.Put(scratch)
+
+	wl := make([]string, 0, min(count, maxWhitelistPrealloc))
 	for i := 0; i < count; i++ {
 		if _, err := io.ReadFull(rw, hb[:]); err != nil {
-			return nil, fmt.Errorf("read whitelist entry length: %w", err)
+			return HandshakeResult{}, fmt.Errorf("read whitelist entry length: %w", err)
 		}
 		length := int(binary.BigEndian.Uint32(hb[:]))
-		buf := make([]byte, length)
+		if length > maxWhitelistEntryLength {
+			return HandshakeResult{}, fmt.Errorf("whitelist entry too long: %d bytes", length)
+		}
+		if cap(*scratch) < length {
+			*scratch = make([]byte, length)
+		}
+		buf := (*scratch)[:length]
 		if _, err := io.ReadFull(rw, buf); err != nil {
-			return nil, fmt.Errorf("read whitelist entry: %w", err)
+			return HandshakeResult{}, fmt.Errorf("read whitelist entry: %w", err)
+		}
+		if length == 0 {
+			continue
 		}
 		wl = append(wl, string(buf))
 	}
 
+	// Empty entries match no peer: drop them and hand their budget back. A
+	// whitelist left with no entries is refused rather than read as allow-all.
+	if skipped := count - len(wl); skipped > 0 {
+		log.Printf("[*] Skipped %d empty whitelist entries from %s", skipped, remoteHost)
+		if len(wl) == 0 {
+			binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrWhitelistEmpty))
+			rw.Write(hb[:])
+			return HandshakeResult{}, fmt.Errorf("all %d whitelist entries are empty", count)
+		}
+		budget.release(skipped)
+	}
+
 	// 4) Confirm whitelist
-	binary.BigEndian.PutUint32(hb[:], ErrSuccess)
+	binary.BigEndian.PutUint32(hb[:], uint32(protocol.ErrSuccess))
 	rw.Write(hb[:])
-	return wl, nil
+	return HandshakeResult{Whitelist: wl}, nil
+}
+
+// peerAllowed decides whether a forwarded peer may connect. The client whitelist
+// narrows the server's allowList, unless widenClientWL lets it replace them.
+func (s *ForwardServer) peerAllowed(peer string, clientWL *AllowList) bool {
+	if !clientWL.allows(peer) {
+		return false
+	}
+	if s.widenClientWL && clientWL.Len() > 0 {
+		return true
+	}
+	return s.allowed().allows(peer)
 }
 
 // isAllowed checks if ip matches allowed list entries (exact or CIDR)
@@ -354,13 +1435,26 @@ func isAllowed(ip string, allowed []string) bool {
 	if len(allowed) == 0 {
 		return true
 	}
+	return matchesAny(ip, allowed)
+}
+
+// isDenied checks if ip matches denied list entries (exact or CIDR)
+func isDenied(ip string, denied []string) bool {
+	if len(denied) == 0 {
+		return false
+	}
+	return matchesAny(ip, denied)
+}
+
+// matchesAny reports whether ip equals an entry or falls within a CIDR entry
+func matchesAny(ip string, entries []string) bool {
 	parsed := net.ParseIP(ip)
-	for _, a := range allowed {
-		if strings.Contains(a, "/") {
-			if _, cidr, err := net.ParseCIDR(a); err == nil && cidr.Contains(parsed) {
+	for _, e := range entries {
+		if strings.Contains(e, "/") {
+			if _, cidr, err := net.ParseCIDR(e); err == nil && cidr.Contains(parsed) {
 				return true
 			}
-		} else if a == ip {
+		} else if e == ip {
 			return true
 		}
 	}
@@ -1,15 +1,37 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
+
+	"github.com/poweredbypump/pbp-tunnel/internal/client"
+	"github.com/poweredbypump/pbp-tunnel/internal/config"
+	"github.com/poweredbypump/pbp-tunnel/internal/protocol"
+	"github.com/poweredbypump/pbp-tunnel/internal/util"
+	"golang.org/x/crypto/ssh"
 )
 
 // --- Tests for assignPort ---
@@ -29,7 +51,7 @@ func TestAssignPort_SpecificUnavailable(t *testing.T) {
 	forwards := map[int]struct{}{1500: {}}
 	var lock sync.Mutex
 	port, mask := assignPort(1500, 1500, 1502, forwards, &lock)
-	if port != 0 || mask&(ErrMask|ErrPortUnavailable) == 0 {
+	if port != 0 || mask&(protocol.ErrMask|protocol.ErrPortUnavailable) == 0 {
 		t.Errorf("expected unavailable mask on duplicate assign, got port=%d mask=%08x", port, mask)
 	}
 }
@@ -38,7 +60,7 @@ func TestAssignPort_OutOfRange(t *testing.T) {
 	forwards := make(map[int]struct{})
 	var lock sync.Mutex
 	port, mask := assignPort(1400, 1500, 1502, forwards, &lock)
-	if port != 0 || mask&(ErrMask|ErrPortOutOfRange) == 0 {
+	if port != 0 || mask&(protocol.ErrMask|protocol.ErrPortOutOfRange) == 0 {
 		t.Errorf("expected out-of-range mask, got port=%d mask=%08x", port, mask)
 	}
 }
@@ -56,7 +78,7 @@ func TestAssignPort_NoneAvailable(t *testing.T) {
 	forwards := map[int]struct{}{1500: {}, 1501: {}, 1502: {}}
 	var lock sync.Mutex
 	port, mask := assignPort(0, 1500, 1502, forwards, &lock)
-	if port != 0 || mask&(ErrMask|ErrPortUnavailable) == 0 {
+	if port != 0 || mask&(protocol.ErrMask|protocol.ErrPortUnavailable) == 0 {
 		t.Errorf("expected none-available mask, got port=%d mask=%08x", port, mask)
 	}
 }
@@ -65,11 +87,41 @@ func TestAssignPort_InvalidRange(t *testing.T) {
 	forwards := make(map[int]struct{})
 	var lock sync.Mutex
 	port, mask := assignPort(0, 2000, 1000, forwards, &lock)
-	if port != 0 || mask&(ErrMask|ErrPortUnavailable) == 0 {
+	if port != 0 || mask&(protocol.ErrMask|protocol.ErrPortUnavailable) == 0 {
 		t.Errorf("expected invalid-range mask, got port=%d mask=%08x", port, mask)
 	}
 }
 
+func TestLogAssignFailure(t *testing.T) {
+	logs := captureLog(t)
+	s := &ForwardServer{portRangeStart: 40000, portRangeEnd: 40001, forwards: map[int]struct{}{40000: {}, 40001: {}, 52135: {}}}
+
+	_, mask := s.assignPortFor("alice", 0)
+	s.logAssignFailure("10.0.0.1", "alice", 0, mask)
+	if want := "Port assignment failed for 10.0.0.1: reason=range-exhausted requested=0 range=40000-40001 used=2/2"; !strings.Contains(logs.String(), want) {
+		t.Errorf("log missing %q:\n%s", want, logs.String())
+	}
+
+	_, mask = s.assignPortFor("alice", 40000)
+	s.logAssignFailure("10.0.0.1", "alice", 40000, mask)
+	if want := "reason=unavailable requested=40000"; !strings.Contains(logs.String(), want) {
+		t.Errorf("log missing %q:\n%s", want, logs.String())
+	}
+
+	_, mask = s.assignPortFor("alice", 50000)
+	s.logAssignFailure("10.0.0.1", "alice", 50000, mask)
+	if want := "reason=out-of-range requested=50000"; !strings.Contains(logs.String(), want) {
+		t.Errorf("log missing %q:\n%s", want, logs.String())
+	}
+
+	s.portRangeStart, s.portRangeEnd = 40001, 40000
+	_, mask = s.assignPortFor("alice", 0)
+	s.logAssignFailure("10.0.0.1", "alice", 0, mask)
+	if want := "reason=invalid-range requested=0 range=40001-40000 used=0/0"; !strings.Contains(logs.String(), want) {
+		t.Errorf("log missing %q:\n%s", want, logs.String())
+	}
+}
+
 func TestAssignPort_SpecificPortRequest(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -78,7 +130,7 @@ func TestAssignPort_SpecificPortRequest(t *testing.T) {
 		end      int
 		forwards map[int]struct{}
 		wantPort int
-		wantMask uint32
+		wantMask protocol.ErrorCode
 	}{
 		{
 			name:     "port available in range",
@@ -96,7 +148,7 @@ func TestAssignPort_SpecificPortRequest(t *testing.T) {
 			end:      9000,
 			forwards: map[int]struct{}{8080: {}},
 			wantPort: 0,
-			wantMask: ErrMask | ErrPortUnavailable,
+			wantMask: protocol.ErrMask | protocol.ErrPortUnavailable,
 		},
 		{
 			name:     "port out of range",
@@ -105,7 +157,7 @@ func TestAssignPort_SpecificPortRequest(t *testing.T) {
 			end:      9000,
 			forwards: map[int]struct{}{},
 			wantPort: 0,
-			wantMask: ErrMask | ErrPortOutOfRange,
+			wantMask: protocol.ErrMask | protocol.ErrPortOutOfRange,
 		},
 		{
 			name:     "invalid range",
@@ -114,7 +166,7 @@ func TestAssignPort_SpecificPortRequest(t *testing.T) {
 			end:      8000,
 			forwards: map[int]struct{}{},
 			wantPort: 0,
-			wantMask: ErrMask | ErrPortUnavailable,
+			wantMask: protocol.ErrMask | protocol.ErrPortUnavailable,
 		},
 	}
 
@@ -146,8 +198,8 @@ func TestAssignPort_AutomaticAssignment(t *testing.T) {
 	}
 
 	port, mask = assignPort(0, 8000, 9000, forwards, lock)
-	if port != 0 || mask != (ErrMask|ErrPortUnavailable) {
-		t.Errorf("assignPort with full range = (%d, %d); want (0, %d)", port, mask, ErrMask|ErrPortUnavailable)
+	if port != 0 || mask != (protocol.ErrMask|protocol.ErrPortUnavailable) {
+		t.Errorf("assignPort with full range = (%d, %d); want (0, %d)", port, mask, protocol.ErrMask|protocol.ErrPortUnavailable)
 	}
 }
 
@@ -193,7 +245,7 @@ func TestAssignPort_ConcurrentSafety(t *testing.T) {
 // --- Tests for processHandshake ---
 type stubRW struct {
 	buf        *bytes.Buffer
-	written    []uint32
+	written    []protocol.ErrorCode
 	readCount  int
 	errorAfter int // after how many Read calls to error
 }
@@ -219,7 +271,7 @@ func (s *stubRW) Read(p []byte) (int, error) {
 
 func (s *stubRW) Write(p []byte) (int, error) {
 	if len(p) >= 4 {
-		code := binary.BigEndian.Uint32(p[:4])
+		code := protocol.ErrorCode(binary.BigEndian.Uint32(p[:4]))
 		s.written = append(s.written, code)
 	}
 	return len(p), nil
@@ -230,46 +282,48 @@ func (s *stubRW) Close() error { return nil }
 func TestProcessHandshake_SuccessWithEntries(t *testing.T) {
 	entries := []string{"127.0.0.1", "10.0.0.0/8"}
 	rw := newStubRW(entries, -1)
-	got, err := processHandshake(rw, "127.0.0.1", entries)
+	res, err := processHandshake(rw, "127.0.0.1", CompileAllowList(entries), nil, nil, 0)
+	got := res.Whitelist
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if len(got) != len(entries) {
 		t.Errorf("expected %d entries, got %d", len(entries), len(got))
 	}
-	if len(rw.written) < 2 || rw.written[0] != ErrSuccess || rw.written[1] != ErrSuccess {
-		t.Errorf("expected two ErrSuccess writes, got %v", rw.written)
+	if len(rw.written) < 2 || rw.written[0] != protocol.ErrSuccess || rw.written[1] != protocol.ErrSuccess {
+		t.Errorf("expected two protocol.ErrSuccess writes, got %v", rw.written)
 	}
 }
 
 func TestProcessHandshake_NoEntries(t *testing.T) {
 	rw := newStubRW(nil, -1)
-	got, err := processHandshake(rw, "1.2.3.4", nil)
+	res, err := processHandshake(rw, "1.2.3.4", nil, nil, nil, 0)
+	got := res.Whitelist
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if len(got) != 0 {
 		t.Errorf("expected zero entries, got %d", len(got))
 	}
-	if len(rw.written) < 2 || rw.written[0] != ErrSuccess || rw.written[1] != ErrSuccess {
-		t.Errorf("expected two ErrSuccess writes, got %v", rw.written)
+	if len(rw.written) < 2 || rw.written[0] != protocol.ErrSuccess || rw.written[1] != protocol.ErrSuccess {
+		t.Errorf("expected two protocol.ErrSuccess writes, got %v", rw.written)
 	}
 }
 
 func TestProcessHandshake_IPNotAllowed(t *testing.T) {
 	rw := newStubRW(nil, -1)
-	_, err := processHandshake(rw, "8.8.8.8", []string{"9.9.9.9"})
+	_, err := processHandshake(rw, "8.8.8.8", CompileAllowList([]string{"9.9.9.9"}), nil, nil, 0)
 	if err == nil || !strings.Contains(err.Error(), "not allowed") {
 		t.Errorf("expected IP not allowed error, got %v", err)
 	}
-	if len(rw.written) == 0 || rw.written[0] != ErrIPNotAllowed {
-		t.Errorf("expected ErrIPNotAllowed write, got %v", rw.written)
+	if len(rw.written) == 0 || rw.written[0] != protocol.ErrIPNotAllowed {
+		t.Errorf("expected protocol.ErrIPNotAllowed write, got %v", rw.written)
 	}
 }
 
 func TestProcessHandshake_CountReadError(t *testing.T) {
 	rw := newStubRW(nil, 0) // error on first Read (count)
-	_, err := processHandshake(rw, "127.0.0.1", nil)
+	_, err := processHandshake(rw, "127.0.0.1", nil, nil, nil, 0)
 	if err == nil || !strings.Contains(err.Error(), "read whitelist count") {
 		t.Errorf("expected read count error, got %v", err)
 	}
@@ -278,7 +332,7 @@ func TestProcessHandshake_CountReadError(t *testing.T) {
 func TestProcessHandshake_EntryLengthReadError(t *testing.T) {
 	entries := []string{"a"}
 	rw := newStubRW(entries, 1) // error on second Read (first read = count OK)
-	_, err := processHandshake(rw, "127.0.0.1", nil)
+	_, err := processHandshake(rw, "127.0.0.1", nil, nil, nil, 0)
 	if err == nil || !strings.Contains(err.Error(), "read whitelist entry length") {
 		t.Errorf("expected entry length read error, got %v", err)
 	}
@@ -289,7 +343,9 @@ func TestProcessHandshake_WithWhitelist(t *testing.T) {
 	entries := []string{"10.0.0.1", "192.168.1.0/24"}
 	rw := newStubRW(entries, -1)
 
-	got, err := processHandshake(rw, "192.168.1.5", []string{})
+	res, err := processHandshake(rw, "192.168.1.5", nil, nil, nil, 0)
+
+	got := res.Whitelist
 
 	if err != nil {
 		t.Fatalf("processHandshake returned error: %v", err)
@@ -305,7 +361,7 @@ func TestProcessHandshake_WithWhitelist(t *testing.T) {
 func TestProcessHandshake_ReadError(t *testing.T) {
 	// Test read error during whitelist count
 	rw := newStubRW(nil, 0) // Error after 0 reads
-	_, err := processHandshake(rw, "192.168.1.1", []string{})
+	_, err := processHandshake(rw, "192.168.1.1", nil, nil, nil, 0)
 
 	if err == nil {
 		t.Fatal("expected error, got nil")
@@ -319,7 +375,7 @@ func TestProcessHandshake_EntryReadError(t *testing.T) {
 	// Setup to succeed on count and length reads but fail on the entry content
 	rw := newStubRW([]string{"entry-will-fail"}, 2)
 
-	_, err := processHandshake(rw, "127.0.0.1", []string{})
+	_, err := processHandshake(rw, "127.0.0.1", nil, nil, nil, 0)
 
 	if err == nil {
 		t.Fatal("expected error, got nil")
@@ -335,7 +391,8 @@ func TestProcessHandshake_LongWhitelistEntries(t *testing.T) {
 	entries := []string{longEntry, "10.0.0.1"}
 
 	rw := newStubRW(entries, -1)
-	got, err := processHandshake(rw, "10.0.0.1", []string{})
+	res, err := processHandshake(rw, "10.0.0.1", nil, nil, nil, 0)
+	got := res.Whitelist
 
 	if err != nil {
 		t.Fatalf("processHandshake returned error: %v", err)
@@ -349,6 +406,15 @@ func TestProcessHandshake_LongWhitelistEntries(t *testing.T) {
 	}
 }
 
+func TestProcessHandshake_EntryTooLong(t *testing.T) {
+	entries := []string{"10.0.0.1", strings.Repeat("a", maxWhitelistEntryLength+1)}
+	rw := newStubRW(entries, -1)
+	_, err := processHandshake(rw, "10.0.0.1", nil, nil, nil, 0)
+	if err == nil || !strings.Contains(err.Error(), "whitelist entry too long") {
+		t.Errorf("processHandshake error = %v; want entry too long", err)
+	}
+}
+
 // --- Tests for isAllowed ---
 func TestIsAllowed_ManyEntriesPerformance(t *testing.T) {
 	// Generate a large number of allowed entries
@@ -401,6 +467,222 @@ func TestIsAllowed_CIDRMatches(t *testing.T) {
 	}
 }
 
+func TestIsDenied(t *testing.T) {
+	tests := []struct {
+		name   string
+		ip     string
+		denied []string
+		want   bool
+	}{
+		{name: "exact IP match", ip: "203.0.113.7", denied: []string{"203.0.113.7"}, want: true},
+		{name: "CIDR match", ip: "203.0.113.7", denied: []string{"203.0.113.0/24"}, want: true},
+		{name: "no match", ip: "198.51.100.1", denied: []string{"203.0.113.0/24"}, want: false},
+		{name: "empty denied list", ip: "198.51.100.1", denied: nil, want: false}, // empty list should deny nothing
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isDenied(tc.ip, tc.denied); got != tc.want {
+				t.Errorf("isDenied(%q, %v) = %v; want %v", tc.ip, tc.denied, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPeerAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		server []string
+		client []string
+		widen  bool
+		peer   string
+		want   bool
+	}{
+		{name: "no policy", peer: "198.51.100.1", want: true},
+		{name: "server policy only", server: []string{"10.0.0.0/8"}, peer: "198.51.100.1", want: false},
+		{name: "client narrows", server: []string{"10.0.0.0/8"}, client: []string{"10.1.0.0/16"}, peer: "10.1.2.3", want: true},
+		{name: "client narrows, peer outside", server: []string{"10.0.0.0/8"}, client: []string{"10.1.0.0/16"}, peer: "10.2.0.1", want: false},
+		{name: "client cannot widen", server: []string{"10.0.0.0/8"}, client: []string{"198.51.100.1"}, peer: "198.51.100.1", want: false},
+		{name: "intersection of overlapping ranges", server: []string{"10.0.0.0/16"}, client: []string{"10.0.1.0/24", "10.1.0.0/24"}, peer: "10.1.0.5", want: false},
+		{name: "widening allowed", server: []string{"10.0.0.0/8"}, client: []string{"198.51.100.1"}, widen: true, peer: "198.51.100.1", want: true},
+		{name: "widening allowed, no client list", server: []string{"10.0.0.0/8"}, widen: true, peer: "198.51.100.1", want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &ForwardServer{allowList: CompileAllowList(tc.server), widenClientWL: tc.widen}
+			if got := s.peerAllowed(tc.peer, CompileAllowList(tc.client)); got != tc.want {
+				t.Errorf("peerAllowed(%q, %v) with server %v, widen=%v = %v; want %v", tc.peer, tc.client, tc.server, tc.widen, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProcessHandshake_DenyOverridesAllow(t *testing.T) {
+	allowed := CompileAllowList([]string{"10.0.0.0/8"})
+	denied := CompileAllowList([]string{"10.1.2.3"})
+
+	rw := newStubRW(nil, -1)
+	if _, err := processHandshake(rw, "10.1.2.3", allowed, denied, nil, 0); err == nil {
+		t.Fatal("expected denied IP inside the allowed range to be rejected")
+	}
+	if len(rw.written) != 1 || rw.written[0] != protocol.ErrIPNotAllowed {
+		t.Errorf("expected single protocol.ErrIPNotAllowed write, got %v", rw.written)
+	}
+
+	rw = newStubRW(nil, -1)
+	if _, err := processHandshake(rw, "10.1.2.4", allowed, denied, nil, 0); err != nil {
+		t.Errorf("expected neighbouring allowed IP to pass, got %v", err)
+	}
+
+	// With no allow-list everything except the denied entries passes
+	rw = newStubRW(nil, -1)
+	if _, err := processHandshake(rw, "10.1.2.3", nil, denied, nil, 0); err == nil {
+		t.Error("expected denied IP to be rejected with an empty allow-list")
+	}
+}
+
+func TestHandshakeResult_ReadForwardRequest(t *testing.T) {
+	frame := func(port uint32, host string) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		_ = binary.Write(buf, binary.BigEndian, port)
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(host)))
+		buf.WriteString(host)
+		return buf
+	}
+
+	var res HandshakeResult
+	if err := res.readForwardRequest(frame(40001, "10.0.0.5"), protocol.VersionBindHost); err != nil {
+		t.Fatalf("readForwardRequest: %v", err)
+	}
+	if res.RequestedPort != 40001 || res.BindHost != "10.0.0.5" {
+		t.Errorf("result = %+v; want port 40001 on 10.0.0.5", res)
+	}
+
+	// older clients send the port alone
+	res = HandshakeResult{}
+	if err := res.readForwardRequest(frame(40002, "ignored"), protocol.VersionTraceID); err != nil {
+		t.Fatalf("readForwardRequest: %v", err)
+	}
+	if res.RequestedPort != 40002 || res.BindHost != "" {
+		t.Errorf("result = %+v; want port 40002 without bind host", res)
+	}
+
+	if err := res.readForwardRequest(bytes.NewReader([]byte{0, 0}), protocol.Version); err == nil || !strings.Contains(err.Error(), "read requested port") {
+		t.Errorf("truncated port error = %v; want read requested port", err)
+	}
+}
+
+func TestProcessHandshake_WhitelistBudget(t *testing.T) {
+	budget := newWhitelistBudget(5)
+	first := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+
+	if _, err := processHandshake(newStubRW(first, -1), "127.0.0.1", nil, nil, budget, 0); err != nil {
+		t.Fatalf("first session within budget: %v", err)
+	}
+
+	rw := newStubRW(first, -1)
+	if _, err := processHandshake(rw, "127.0.0.1", nil, nil, budget, 0); err == nil || !strings.Contains(err.Error(), "exceeds the remaining budget of 2") {
+		t.Fatalf("over-budget session error = %v; want budget rejection", err)
+	}
+	if len(rw.written) != 2 || rw.written[1] != protocol.ErrWhitelistBudget {
+		t.Errorf("over-budget writes = %v; want ErrSuccess then ErrWhitelistBudget", rw.written)
+	}
+
+	// a failed handshake gives its reservation back
+	if _, err := processHandshake(newStubRW([]string{"10.0.0.4", "10.0.0.5"}, 3), "127.0.0.1", nil, nil, budget, 0); err == nil {
+		t.Fatal("expected truncated whitelist to fail")
+	}
+	if got := budget.remaining(); got != 2 {
+		t.Errorf("remaining after failed handshake = %d; want 2", got)
+	}
+
+	// once the first session releases its entries the second one fits
+	budget.release(len(first))
+	if _, err := processHandshake(newStubRW(first, -1), "127.0.0.1", nil, nil, budget, 0); err != nil {
+		t.Errorf("session after release: %v", err)
+	}
+}
+
+func TestProcessHandshake_MaxWhitelistCount(t *testing.T) {
+	// only the count is sent: an over-count whitelist must be refused before
+	// the server tries to read any entry
+	buf := &bytes.Buffer{}
+	_ = binary.Write(buf, binary.BigEndian, uint32(5000))
+	rw := &stubRW{buf: buf, errorAfter: -1}
+	budget := newWhitelistBudget(10000)
+
+	_, err := processHandshake(rw, "127.0.0.1", nil, nil, budget, 100)
+	if err == nil || !strings.Contains(err.Error(), "5000 entries exceeds the maximum of 100") {
+		t.Fatalf("over-count error = %v; want maximum rejection", err)
+	}
+	if rw.readCount != 1 {
+		t.Errorf("reads = %d; want only the count", rw.readCount)
+	}
+	if len(rw.written) != 2 || rw.written[1] != protocol.ErrWhitelistTooLarge {
+		t.Errorf("writes = %v; want ErrSuccess then ErrWhitelistTooLarge", rw.written)
+	}
+	if got := budget.remaining(); got != 10000 {
+		t.Errorf("budget remaining = %d; want 10000 untouched", got)
+	}
+
+	// a whitelist at the maximum is accepted
+	entries := []string{"10.0.0.1", "10.0.0.2"}
+	if res, err := processHandshake(newStubRW(entries, -1), "127.0.0.1", nil, nil, nil, len(entries)); err != nil || len(res.Whitelist) != 2 {
+		t.Errorf("whitelist at the maximum = %v, %v; want accepted", res.Whitelist, err)
+	}
+}
+
+func TestProcessHandshake_SkipsEmptyEntries(t *testing.T) {
+	budget := newWhitelistBudget(10)
+	entries := []string{"", "10.0.0.1", "", "10.0.0.2", ""}
+	res, err := processHandshake(newStubRW(entries, -1), "127.0.0.1", nil, nil, budget, 0)
+	if err != nil {
+		t.Fatalf("processHandshake: %v", err)
+	}
+	if want := []string{"10.0.0.1", "10.0.0.2"}; !slices.Equal(res.Whitelist, want) {
+		t.Errorf("whitelist = %q; want %q", res.Whitelist, want)
+	}
+	if got := budget.remaining(); got != 8 {
+		t.Errorf("budget remaining = %d; want 8, empty entries released", got)
+	}
+
+	// only empty entries must not turn into an allow-all whitelist
+	rw := newStubRW([]string{"", ""}, -1)
+	if _, err := processHandshake(rw, "127.0.0.1", nil, nil, budget, 0); err == nil {
+		t.Fatal("all-empty whitelist accepted")
+	}
+	if n := len(rw.written); n == 0 || rw.written[n-1] != protocol.ErrWhitelistEmpty {
+		t.Errorf("writes = %v; want ErrWhitelistEmpty last", rw.written)
+	}
+	if got := budget.remaining(); got != 8 {
+		t.Errorf("budget remaining = %d; want 8 after refusal", got)
+	}
+}
+
+func TestHandleSSHConnection_DeniedClient(t *testing.T) {
+	logs := captureLog(t)
+	sp := testServerParameters(t)
+	sp.AllowedIPs = config.StringArray{"127.0.0.0/8"}
+	sp.DeniedIPs = config.StringArray{"127.0.0.1"}
+	srv := newTestForwardServer(t, sp)
+
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+
+	c, chans, reqs, err := ssh.NewClientConn(clientEnd, "pipe", testClientConfig())
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	sshClient := ssh.NewClient(c, chans, reqs)
+	defer sshClient.Close()
+
+	waitForLog(t, logs, "SSH client 127.0.0.1 denied", 2*time.Second)
+	if err := sshClient.Wait(); err == nil {
+		t.Error("expected the server to close the denied connection")
+	}
+}
+
 func TestIsAllowed_ValidIPAddress(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -563,7 +845,7 @@ func TestProcessHandshake_StressTest(t *testing.T) {
 				}
 
 				rw := newStubRW(entries, -1)
-				_, err := processHandshake(rw, "192.168.1.1", []string{})
+				_, err := processHandshake(rw, "192.168.1.1", nil, nil, nil, 0)
 
 				if err != nil {
 					errors <- fmt.Errorf("goroutine %d request %d failed: %v", goroutineID, j, err)
@@ -654,7 +936,7 @@ func TestProcessHandshake_ErrorRecovery(t *testing.T) {
 	for _, tc := range errorCases {
 		t.Run(tc.name, func(t *testing.T) {
 			rw := newStubRW(tc.entries, tc.errorAfter)
-			_, err := processHandshake(rw, "127.0.0.1", []string{})
+			_, err := processHandshake(rw, "127.0.0.1", nil, nil, nil, 0)
 
 			if err == nil {
 				t.Errorf("Expected error for case %s", tc.name)
@@ -709,7 +991,8 @@ func TestProcessHandshake_MemoryLimits(t *testing.T) {
 	entries := []string{veryLongEntry}
 
 	rw := newStubRW(entries, -1)
-	result, err := processHandshake(rw, "127.0.0.1", []string{})
+	res, err := processHandshake(rw, "127.0.0.1", nil, nil, nil, 0)
+	result := res.Whitelist
 
 	if err != nil {
 		t.Errorf("processHandshake failed with long entry: %v", err)
@@ -780,7 +1063,9 @@ func TestProcessHandshake_ResourceMonitoring(t *testing.T) {
 		rw := newStubRW(entries, -1)
 		start := time.Now()
 
-		result, err := processHandshake(rw, "192.168.1.1", []string{})
+		res, err := processHandshake(rw, "192.168.1.1", nil, nil, nil, 0)
+
+		result := res.Whitelist
 		duration := time.Since(start)
 
 		if err != nil {
@@ -830,7 +1115,7 @@ func TestAssignPort_ConfigurationLimits(t *testing.T) {
 
 			port, mask := assignPort(tc.reqPort, tc.start, tc.end, forwards, &lock)
 
-			hasError := (mask & ErrMask) != 0
+			hasError := (mask & protocol.ErrMask) != 0
 			if tc.expectErr != hasError {
 				t.Errorf("Expected error: %v, got error: %v (mask: %d)", tc.expectErr, hasError, mask)
 			}
@@ -854,7 +1139,9 @@ func TestProcessHandshake_LargeWhitelist(t *testing.T) {
 	rw := newStubRW(entries, -1)
 	start := time.Now()
 
-	result, err := processHandshake(rw, "192.168.1.1", []string{})
+	res, err := processHandshake(rw, "192.168.1.1", nil, nil, nil, 0)
+
+	result := res.Whitelist
 	duration := time.Since(start)
 
 	if err != nil {
@@ -914,7 +1201,8 @@ func TestProcessHandshake_NetworkLatency(t *testing.T) {
 			}
 
 			start := time.Now()
-			result, err := processHandshake(rw, "192.168.1.1", []string{})
+			res, err := processHandshake(rw, "192.168.1.1", nil, nil, nil, 0)
+			result := res.Whitelist
 			duration := time.Since(start)
 
 			if err != nil {
@@ -934,3 +1222,2551 @@ func TestProcessHandshake_NetworkLatency(t *testing.T) {
 		})
 	}
 }
+
+// --- Helpers for connection-level tests ---
+
+// tcpPipe returns both ends of a loopback TCP connection
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c2 := <-accepted
+	if c2 == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return c1, c2
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use as a log output
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog redirects the standard logger to a buffer for the duration of the test
+func captureLog(t *testing.T) *syncBuffer {
+	buf := &syncBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+// waitForLog polls the captured logs until they contain substr or the timeout expires
+func waitForLog(t *testing.T, logs *syncBuffer, substr string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if strings.Contains(logs.String(), substr) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %q in logs:\n%s", substr, logs.String())
+}
+
+// testServerParameters returns valid server parameters with an Ed25519 host key in a temp dir
+func testServerParameters(t *testing.T) *config.ServerParameters {
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if _, err := util.GenerateAndSavePrivateKeyToFile(keyPath, "ed25519", util.DefaultKeyFileMode); err != nil {
+		t.Fatalf("generate host key: %v", err)
+	}
+	return &config.ServerParameters{
+		BindAddress:        "127.0.0.1",
+		BindPort:           2022,
+		PortRangeStart:     40000,
+		PortRangeEnd:       40100,
+		Username:           "user",
+		Password:           "pass",
+		PrivateEd25519Path: keyPath,
+	}
+}
+
+// newTestForwardServer builds a ForwardServer from the given parameters
+func newTestForwardServer(t *testing.T, sp *config.ServerParameters) *ForwardServer {
+	algorithms := config.NewHostKeyAlgorithms()
+	sshCfg, _, err := config.GetServerConfig(sp, algorithms)
+	if err != nil {
+		t.Fatalf("GetServerConfig: %v", err)
+	}
+	return newForwardServer(sp, sshCfg, algorithms)
+}
+
+// testClientConfig returns an SSH client config matching testServerParameters
+func testClientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.Password("pass")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+}
+
+// --- Tests for handleSSHConnection ---
+func TestHandleSSHConnection_LogsHostKeyAlgorithm(t *testing.T) {
+	logs := captureLog(t)
+	srv := newTestForwardServer(t, testServerParameters(t))
+
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+
+	clientCfg := testClientConfig()
+	clientCfg.HostKeyAlgorithms = []string{ssh.KeyAlgoED25519}
+	c, chans, reqs, err := ssh.NewClientConn(clientEnd, "pipe", clientCfg)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+
+	waitForLog(t, logs, "negotiated host key algorithm "+ssh.KeyAlgoED25519, 2*time.Second)
+}
+
+// --- Tests for the port release grace period ---
+func TestReleasePort_NoGraceFreesImmediately(t *testing.T) {
+	s := &ForwardServer{forwards: map[int]struct{}{40000: {}}}
+	s.releasePort("user@10.0.0.1", 40000)
+	if _, used := s.forwards[40000]; used {
+		t.Errorf("port 40000 should be freed without a grace period")
+	}
+}
+
+func TestReleasePort_ReconnectWithinGraceKeepsPort(t *testing.T) {
+	s := &ForwardServer{
+		portReleaseGrace: time.Second,
+		forwards:         map[int]struct{}{40000: {}},
+	}
+	s.releasePort("user@10.0.0.1", 40000)
+
+	// another client cannot take the reserved port
+	if port := s.reclaimPort("user@10.0.0.2", 0); port != 0 {
+		t.Errorf("reclaimPort for another client = %d; want 0", port)
+	}
+	if port, mask := assignPort(40000, 40000, 40001, s.forwards, &s.lock); mask == 0 {
+		t.Errorf("reserved port was reassigned as %d", port)
+	}
+
+	if port := s.reclaimPort("user@10.0.0.1", 0); port != 40000 {
+		t.Fatalf("reclaimPort = %d; want 40000", port)
+	}
+
+	// the reclaimed port must survive the original grace deadline
+	time.Sleep(1200 * time.Millisecond)
+	s.lock.Lock()
+	_, used := s.forwards[40000]
+	s.lock.Unlock()
+	if !used {
+		t.Errorf("reclaimed port 40000 was freed by the expired grace timer")
+	}
+}
+
+func TestReleasePort_GraceExpiryFreesPort(t *testing.T) {
+	s := &ForwardServer{
+		portReleaseGrace: 50 * time.Millisecond,
+		forwards:         map[int]struct{}{40000: {}},
+	}
+	s.releasePort("user@10.0.0.1", 40000)
+
+	time.Sleep(200 * time.Millisecond)
+
+	s.lock.Lock()
+	_, used := s.forwards[40000]
+	pending := len(s.reservations)
+	s.lock.Unlock()
+	if used || pending != 0 {
+		t.Errorf("after grace expiry used=%v reservations=%d; want freed", used, pending)
+	}
+	if port := s.reclaimPort("user@10.0.0.1", 0); port != 0 {
+		t.Errorf("reclaimPort after expiry = %d; want 0", port)
+	}
+}
+
+func TestReclaimPort_MatchesRequestedPort(t *testing.T) {
+	s := &ForwardServer{
+		portReleaseGrace: time.Second,
+		forwards:         map[int]struct{}{40000: {}, 40001: {}},
+	}
+	s.releasePort("user@10.0.0.1", 40000)
+	s.releasePort("user@10.0.0.1", 40001)
+
+	if port := s.reclaimPort("user@10.0.0.1", 40001); port != 40001 {
+		t.Errorf("reclaimPort(40001) = %d; want 40001", port)
+	}
+	if port := s.reclaimPort("user@10.0.0.1", 40005); port != 0 {
+		t.Errorf("reclaimPort(40005) = %d; want 0", port)
+	}
+}
+
+// --- Tests for forwardBindAddress ---
+func TestForwardBindAddress(t *testing.T) {
+	sp := testServerParameters(t)
+	sp.BindAddress = "0.0.0.0"
+	sp.ForwardBindByUser = config.StringMap{"alice": "10.0.0.1", "bob": "10.0.0.2"}
+	srv := newTestForwardServer(t, sp)
+
+	tests := []struct {
+		user string
+		want string
+	}{
+		{"alice", "10.0.0.1"},
+		{"bob", "10.0.0.2"},
+		{"carol", "0.0.0.0"}, // no mapping falls back to the global bind address
+	}
+	for _, tc := range tests {
+		if got := srv.forwardBindAddress(tc.user); got != tc.want {
+			t.Errorf("forwardBindAddress(%q) = %q; want %q", tc.user, got, tc.want)
+		}
+	}
+}
+
+func TestForwardBindAddress_NoMapping(t *testing.T) {
+	srv := newTestForwardServer(t, testServerParameters(t))
+	if got := srv.forwardBindAddress("user"); got != "127.0.0.1" {
+		t.Errorf("forwardBindAddress = %q; want the global bind address", got)
+	}
+}
+
+// --- Tests for trace IDs ---
+
+// freePort returns a loopback TCP port that was free at the time of the call
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// echoService accepts connections on loopback and echoes everything back
+func echoService(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// replyService answers every connection with reply once it has read a full
+// HTTP request head, then closes it
+func replyService(t *testing.T, reply string) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == "\r\n" {
+						break
+					}
+				}
+				_, _ = io.WriteString(c, reply)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// startTunnelSession connects a real client to srv over a loopback pair and waits
+// until it has been assigned port. The client sends whitelist as its allowed IPs.
+// Closing the returned conn ends the session.
+func startTunnelSession(t *testing.T, srv *ForwardServer, logs *syncBuffer, port int, whitelist ...string) net.Conn {
+	return startTunnelSessionTo(t, srv, logs, port, echoService(t), whitelist...)
+}
+
+// startTunnelSessionTo is startTunnelSession with the client forwarding to
+// localPort instead of an echo service
+func startTunnelSessionTo(t *testing.T, srv *ForwardServer, logs *syncBuffer, port, localPort int, whitelist ...string) net.Conn {
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+
+	cp := &config.ClientParameters{
+		Endpoint:     "pipe",
+		EndpointPort: 22,
+		Username:     "user",
+		Password:     "pass",
+		LocalHost:    "127.0.0.1",
+		LocalPort:    localPort,
+		RemoteHost:   "127.0.0.1",
+		AllowedIPs:   whitelist,
+	}
+	before := strings.Count(logs.String(), fmt.Sprintf("Notified client of port %d", port))
+	go func() { _ = client.RunConn(clientEnd, cp) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.Count(logs.String(), fmt.Sprintf("Notified client of port %d", port)) == before {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for port %d to be assigned:\n%s", port, logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return clientEnd
+}
+
+// pingForward sends a round trip through the forwarded port
+func pingForward(t *testing.T, port int) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v; want \"ping\"", buf, err)
+	}
+}
+
+func TestTraceID_AppearsInClientAndServerLogs(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	srv := newTestForwardServer(t, sp)
+
+	startTunnelSession(t, srv, logs, port)
+	pingForward(t, port)
+
+	match := regexp.MustCompile(`accepted from \S+ \(trace=([0-9a-f]+)\)`).FindStringSubmatch(logs.String())
+	if match == nil {
+		t.Fatalf("no server trace ID in logs:\n%s", logs.String())
+	}
+	waitForLog(t, logs, "linked to server forward (trace="+match[1]+")", 2*time.Second)
+
+	// the client's later lines for the forward carry the same ID
+	linked := regexp.MustCompile(`Forward #(\d+) linked to server forward`).FindStringSubmatch(logs.String())
+	if linked == nil {
+		t.Fatalf("no client forward ID in logs:\n%s", logs.String())
+	}
+	waitForLog(t, logs, fmt.Sprintf("Forward #%s closed (trace=%s)", linked[1], match[1]), 2*time.Second)
+	for _, dir := range []string{"local", "server"} {
+		if want := fmt.Sprintf("bytes to %s for forward #%s (trace=%s)", dir, linked[1], match[1]); !strings.Contains(logs.String(), want) {
+			t.Errorf("no %q in logs:\n%s", want, logs.String())
+		}
+	}
+}
+
+func TestForward_PeerResetClosesBothDirections(t *testing.T) {
+	for _, bufferBytes := range []int{0, 4096} {
+		t.Run(fmt.Sprintf("buffer=%d", bufferBytes), func(t *testing.T) {
+			logs := captureLog(t)
+
+			// a local service that reads and never answers nor closes: only the
+			// reset may end the forward
+			sink, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			t.Cleanup(func() { sink.Close() })
+			go func() {
+				for {
+					c, err := sink.Accept()
+					if err != nil {
+						return
+					}
+					t.Cleanup(func() { c.Close() })
+					go io.Copy(io.Discard, c)
+				}
+			}()
+
+			port := freePort(t)
+			sp := testServerParameters(t)
+			sp.PortRangeStart, sp.PortRangeEnd = port, port
+			sp.ForwardBufferBytes = bufferBytes
+			srv := newTestForwardServer(t, sp)
+			startTunnelSessionTo(t, srv, logs, port, sink.Addr().(*net.TCPAddr).Port)
+
+			conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if err != nil {
+				t.Fatalf("dial forward: %v", err)
+			}
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			waitForLog(t, logs, "Forward 1 accepted", 2*time.Second)
+			// a zero linger makes Close reset the connection instead of ending it cleanly
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+
+			// the reset surfaces as a copy error, bufferedCopy included, and
+			// "closed" is logged once both copy goroutines have returned
+			waitForLog(t, logs, "Copy to client for forward 1 failed, closing", 5*time.Second)
+			waitForLog(t, logs, "Forward 1 closed", 5*time.Second)
+		})
+	}
+}
+
+func TestForwardIDs_UniqueAcrossChannels(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	srv := newTestForwardServer(t, sp)
+
+	// Two sessions in a row, so each forward goes through a separate handleChannel
+	for session := 0; session < 2; session++ {
+		conn := startTunnelSession(t, srv, logs, port)
+		pingForward(t, port)
+		pingForward(t, port)
+		waitForLog(t, logs, fmt.Sprintf("Forward %d closed", 2*session+2), 2*time.Second)
+		conn.Close()
+		waitForLog(t, logs, fmt.Sprintf("Waiting for lock to release port %d", port), 2*time.Second)
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range regexp.MustCompile(`Forward (\d+) accepted`).FindAllStringSubmatch(logs.String(), -1) {
+		if seen[m[1]] {
+			t.Errorf("forward ID %s reused", m[1])
+		}
+		seen[m[1]] = true
+	}
+	if len(seen) != 4 {
+		t.Errorf("got %d distinct forward IDs; want 4\n%s", len(seen), logs.String())
+	}
+}
+
+func TestForwardID_ThreadsThroughAcceptCopyClose(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	srv := newTestForwardServer(t, sp)
+
+	startTunnelSession(t, srv, logs, port)
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+
+	match := regexp.MustCompile(`Forward (\d+) accepted from \S+ \(trace=([0-9a-f]+)\)`).FindStringSubmatch(logs.String())
+	if match == nil {
+		t.Fatalf("no accepted forward in logs:\n%s", logs.String())
+	}
+	id, traceID := match[1], match[2]
+
+	conns := srv.GetMetrics()["forward_connections"].([]ConnectionState)
+	if len(conns) != 1 || strconv.FormatUint(conns[0].ID, 10) != id || conns[0].TraceID != traceID {
+		t.Fatalf("forward_connections = %+v; want forward %s (trace=%s)", conns, id, traceID)
+	}
+	if conns[0].Port != port {
+		t.Errorf("forward_connections[0].Port = %d; want %d", conns[0].Port, port)
+	}
+
+	conn.Close()
+	waitForLog(t, logs, fmt.Sprintf("Copied 4 bytes to client for forward %s (trace=%s)", id, traceID), 2*time.Second)
+	waitForLog(t, logs, fmt.Sprintf("Copied 4 bytes to service for forward %s (trace=%s)", id, traceID), 2*time.Second)
+	waitForLog(t, logs, fmt.Sprintf("Forward %s closed (trace=%s)", id, traceID), 2*time.Second)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(srv.GetMetrics()["forward_connections"].([]ConnectionState)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("forward %s still listed after close", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDetectProtocol(t *testing.T) {
+	tests := []struct {
+		head []byte
+		want string
+	}{
+		{[]byte("GET / HTTP/1.1\r\n"), protocolHTTP},
+		{[]byte("POST /api HTTP/1.1\r\n"), protocolHTTP},
+		{[]byte("PRI * HTTP/2.0\r\n"), protocolHTTP},
+		{[]byte{0x16, 0x03, 0x01, 0x02, 0x00}, protocolTLS},
+		{[]byte("SSH-2.0-OpenSSH_9.6\r\n"), protocolTCP},
+		{[]byte("GETX"), protocolTCP},
+		{nil, protocolTCP},
+	}
+	for _, tt := range tests {
+		if got := detectProtocol(tt.head); got != tt.want {
+			t.Errorf("detectProtocol(%q) = %q; want %q", tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestPeekConn_ReplaysPeekedBytes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	const payload = "GET / HTTP/1.1\r\nHost: example\r\n\r\n"
+	go func() {
+		client.Write([]byte(payload))
+		client.Close()
+	}()
+
+	conn, head := peekConn(server, 8, time.Second)
+	if string(head) != payload[:8] {
+		t.Errorf("head = %q; want %q", head, payload[:8])
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != payload {
+		t.Errorf("replayed %q; want %q", got, payload)
+	}
+}
+
+func TestPeekConn_TimeoutLeavesStreamIntact(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn, head := peekConn(server, 8, 20*time.Millisecond)
+	if len(head) != 0 {
+		t.Errorf("head = %q; want none", head)
+	}
+	go client.Write([]byte("late"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "late" {
+		t.Errorf("read after timeout = %q, %v; want \"late\"", buf, err)
+	}
+}
+
+func TestProtocolPeek_ReplaysToDownstream(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.ProtocolPeekBytes = 16
+	srv := newTestForwardServer(t, sp)
+
+	startTunnelSession(t, srv, logs, port)
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	const request = "GET /index.html HTTP/1.1\r\nHost: example\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len(request))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != request {
+		t.Fatalf("echo = %q, %v; want %q", buf, err, request)
+	}
+	waitForLog(t, logs, "detected as http", 2*time.Second)
+
+	conns := srv.GetMetrics()["forward_connections"].([]ConnectionState)
+	if len(conns) != 1 || conns[0].Protocol != protocolHTTP {
+		t.Errorf("forward_connections = %+v; want one http connection", conns)
+	}
+}
+
+// bufferConn records the socket buffer sizes set on it
+type bufferConn struct {
+	net.Conn
+	read, write atomic.Int64
+}
+
+func (c *bufferConn) SetReadBuffer(bytes int) error {
+	c.read.Store(int64(bytes))
+	return nil
+}
+
+func (c *bufferConn) SetWriteBuffer(bytes int) error {
+	c.write.Store(int64(bytes))
+	return nil
+}
+
+func TestHandleSSHConnection_SetsSocketBuffers(t *testing.T) {
+	sp := testServerParameters(t)
+	sp.SocketReadBuffer, sp.SocketWriteBuffer = 1<<20, 2<<20
+	srv := newTestForwardServer(t, sp)
+
+	clientEnd, serverEnd := tcpPipe(t)
+	conn := &bufferConn{Conn: serverEnd}
+	go srv.handleSSHConnection(conn)
+
+	c, chans, reqs, err := ssh.NewClientConn(clientEnd, "pipe", testClientConfig())
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer ssh.NewClient(c, chans, reqs).Close()
+	if read, write := conn.read.Load(), conn.write.Load(); read != 1<<20 || write != 2<<20 {
+		t.Errorf("socket buffers = %d/%d; want %d/%d", read, write, 1<<20, 2<<20)
+	}
+}
+
+func TestRequestLine(t *testing.T) {
+	tests := []struct {
+		head   string
+		want   string
+		wantOK bool
+	}{
+		{"GET /index.html HTTP/1.1\r\nHost: example\r\n", "GET /index.html HTTP/1.1", true},
+		{"POST /api HTTP/1.0\n", "POST /api HTTP/1.0", true},
+		{"GET /index.html HTTP/1.1", "", false}, // truncated by the peek
+		{"GET /index.html\r\n", "", false},
+		{"GET / FTP/1.0\r\n", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := requestLine([]byte(tt.head))
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("requestLine(%q) = %q, %v; want %q, %v", tt.head, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestAccessLogLine(t *testing.T) {
+	start := time.Date(2026, time.March, 4, 5, 6, 7, 0, time.FixedZone("", -7*3600))
+	got := accessLogLine("192.0.2.7:51000", "GET /index.html HTTP/1.1", start, 2326)
+	want := `192.0.2.7 - - [04/Mar/2026:05:06:07 -0700] "GET /index.html HTTP/1.1" - 2326`
+	if got != want {
+		t.Errorf("accessLogLine = %q; want %q", got, want)
+	}
+}
+
+func TestHTTPAccessLog_LogsRequestAndRelaysBytes(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.ProtocolPeekBytes = 256
+	sp.HTTPAccessLog = true
+	srv := newTestForwardServer(t, sp)
+
+	const (
+		request  = "GET /index.html HTTP/1.1\r\nHost: example\r\n\r\n"
+		response = "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello"
+	)
+	startTunnelSessionTo(t, srv, logs, port, replyService(t, response))
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len(response))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != response {
+		t.Fatalf("response = %q, %v; want %q", buf, err, response)
+	}
+	conn.Close()
+
+	// the size field is the response relayed to the requester, not the request
+	waitForLog(t, logs, fmt.Sprintf(`] "GET /index.html HTTP/1.1" - %d`, len(response)), 2*time.Second)
+	if !regexp.MustCompile(`127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET`).MatchString(logs.String()) {
+		t.Errorf("no Common Log Format line in logs:\n%s", logs.String())
+	}
+}
+
+func TestHandleGlobalRequests_NegotiatesVersion(t *testing.T) {
+	srv := newTestForwardServer(t, testServerParameters(t))
+
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+
+	c, chans, reqs, err := ssh.NewClientConn(clientEnd, "pipe", testClientConfig())
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	sshClient := ssh.NewClient(c, chans, reqs)
+	defer sshClient.Close()
+
+	payload := binary.BigEndian.AppendUint32(nil, protocol.Version+1)
+	ok, reply, err := sshClient.SendRequest(protocol.VersionRequest, true, payload)
+	if err != nil || !ok {
+		t.Fatalf("SendRequest = %v, %v; want accepted", ok, err)
+	}
+	if len(reply) != 4 || binary.BigEndian.Uint32(reply) != protocol.Version {
+		t.Errorf("reply = %x; want server version %d", reply, protocol.Version)
+	}
+
+	if ok, _, _ := sshClient.SendRequest("unknown@pbp-tunnel", true, nil); ok {
+		t.Error("expected unknown global request to be rejected")
+	}
+}
+
+func TestMinClientProtocol_RejectsOlderClient(t *testing.T) {
+	logs := captureLog(t)
+	sp := testServerParameters(t)
+	sp.MinClientProtocol = int(protocol.Version)
+	srv := newTestForwardServer(t, sp)
+
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+
+	// a version 1 client never sends the version request
+	c, chans, reqs, err := ssh.NewClientConn(clientEnd, "pipe", testClientConfig())
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	sshClient := ssh.NewClient(c, chans, reqs)
+	defer sshClient.Close()
+
+	ch, chReqs, err := sshClient.OpenChannel("direct-tcpip", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(chReqs)
+
+	var frames [8]byte
+	if _, err := io.ReadFull(ch, frames[:]); err != nil {
+		t.Fatalf("read rejection: %v", err)
+	}
+	if code := protocol.ErrorCode(binary.BigEndian.Uint32(frames[:4])); code != protocol.ErrMask|protocol.ErrProtocolMismatch {
+		t.Errorf("code = %s; want %s", code, protocol.ErrMask|protocol.ErrProtocolMismatch)
+	}
+	if minimum := binary.BigEndian.Uint32(frames[4:]); minimum != protocol.Version {
+		t.Errorf("minimum = %d; want %d", minimum, protocol.Version)
+	}
+	waitForLog(t, logs, "speaks protocol 1, below the minimum", 2*time.Second)
+}
+
+func TestMinClientProtocol_AcceptsCurrentClient(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.MinClientProtocol = int(protocol.Version)
+	srv := newTestForwardServer(t, sp)
+
+	startTunnelSession(t, srv, logs, port)
+	pingForward(t, port)
+}
+
+// --- Tests for systemd socket activation ---
+func TestSystemdListener_NotActivated(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "")
+	ln, activated, err := systemdListener()
+	if err != nil || activated || ln != nil {
+		t.Fatalf("systemdListener() = %v, %v, %v; want nil, false, nil", ln, activated, err)
+	}
+}
+
+func TestSystemdListener_OtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()+1))
+	if _, activated, err := systemdListener(); err != nil || activated {
+		t.Fatalf("expected fds addressed to another pid to be ignored, got activated=%v err=%v", activated, err)
+	}
+}
+
+// --- Tests for the state file ---
+
+// readStateFile decodes the state file at path
+func readStateFile(t *testing.T, path string) ServerState {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read state file: %v", err)
+	}
+	var state ServerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("decode state file: %v", err)
+	}
+	return state
+}
+
+// waitForState polls the state file until it lists want forwards
+func waitForState(t *testing.T, path string, want int) ServerState {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		state := readStateFile(t, path)
+		if len(state.Forwards) == want {
+			return state
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state file lists %d forwards; want %d", len(state.Forwards), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStateFile_TracksAssignAndRelease(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.StateFilePath = filepath.Join(t.TempDir(), "state.json")
+	srv := newTestForwardServer(t, sp)
+
+	conn := startTunnelSession(t, srv, logs, port)
+	state := waitForState(t, sp.StateFilePath, 1)
+	if f := state.Forwards[0]; f.Port != port || f.ClientIP != "127.0.0.1" || f.StartedAt.IsZero() {
+		t.Errorf("forward = %+v; want port %d from 127.0.0.1", f, port)
+	}
+
+	pingForward(t, port)
+	waitForLog(t, logs, "Forward 1 closed", 2*time.Second)
+	srv.writeState()
+	if f := readStateFile(t, sp.StateFilePath).Forwards[0]; f.BytesToClient != 4 || f.BytesToService != 4 {
+		t.Errorf("bytes = %d to client, %d to service; want 4 each", f.BytesToClient, f.BytesToService)
+	}
+
+	conn.Close()
+	waitForState(t, sp.StateFilePath, 0)
+}
+
+func TestPersistState_StopsOnShutdown(t *testing.T) {
+	sp := testServerParameters(t)
+	sp.StateFilePath = filepath.Join(t.TempDir(), "state.json")
+	srv := newTestForwardServer(t, sp)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		srv.persistState(stop)
+		close(done)
+	}()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("persistState still running after shutdown")
+	}
+}
+
+func TestLogStaleState(t *testing.T) {
+	logs := captureLog(t)
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	logStaleState(path)
+	if logs.String() != "" {
+		t.Errorf("expected no log for a missing state file, got %q", logs.String())
+	}
+
+	state := ServerState{UpdatedAt: time.Now(), Forwards: []ForwardState{{Port: 40000}, {Port: 40001}}}
+	if err := writeStateFile(path, state); err != nil {
+		t.Fatalf("writeStateFile: %v", err)
+	}
+	logStaleState(path)
+	if !strings.Contains(logs.String(), "with 2 forwards (not restored)") {
+		t.Errorf("expected stale state to be reported, got %q", logs.String())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("expected only the state file in its directory, got %d entries", len(entries))
+	}
+}
+
+// --- Benchmarks for processHandshake ---
+func BenchmarkProcessHandshake_LargeWhitelist(b *testing.B) {
+	for _, size := range []int{16, 1024} {
+		entries := make([]string, 1000)
+		for i := range entries {
+			entries[i] = fmt.Sprintf("%0*d", size, i)
+		}
+		b.Run(fmt.Sprintf("entry=%dB", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				rw := newStubRW(entries, -1)
+				b.StartTimer()
+				if _, err := processHandshake(rw, "127.0.0.1", nil, nil, nil, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowList_MatchesLikeIsAllowed(t *testing.T) {
+	entries := []string{"192.168.1.10", "10.0.0.0/8", "2001:db8::/32", "::1", "not-an-ip", "bad/cidr"}
+	l := CompileAllowList(entries)
+	for _, ip := range []string{
+		"192.168.1.10", "192.168.1.11", "10.20.30.40", "11.0.0.1",
+		"2001:db8::1", "2001:db9::1", "::1", "not-an-ip", "",
+	} {
+		if got, want := l.Contains(ip), isAllowed(ip, entries); got != want {
+			t.Errorf("Contains(%q) = %v; isAllowed = %v", ip, got, want)
+		}
+	}
+
+	// Exact entries match any spelling of the same address
+	if !l.Contains("0:0:0:0:0:0:0:1") {
+		t.Error("Contains(0:0:0:0:0:0:0:1) = false; want true for entry ::1")
+	}
+	var empty *AllowList
+	if empty.Len() != 0 || empty.Contains("127.0.0.1") || !empty.allows("127.0.0.1") {
+		t.Error("nil AllowList should be empty and allow everyone")
+	}
+}
+
+// BenchmarkIsAllowed compares per-call parsing with the precompiled AllowList
+func BenchmarkIsAllowed(b *testing.B) {
+	entries := make([]string, 10000)
+	for i := range entries {
+		if i%2 == 0 {
+			entries[i] = fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)
+		} else {
+			entries[i] = fmt.Sprintf("192.168.%d.%d", i/255, i%255)
+		}
+	}
+	const ip = "172.16.0.1" // no match, so every entry is checked
+
+	b.Run("strings", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			isAllowed(ip, entries)
+		}
+	})
+	b.Run("compiled", func(b *testing.B) {
+		l := CompileAllowList(entries)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			l.allows(ip)
+		}
+	})
+}
+
+func TestMaxConnDuration_ClosesSteadyConnection(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.MaxConnDuration = config.Duration(300 * time.Millisecond)
+	srv := newTestForwardServer(t, sp)
+
+	startTunnelSession(t, srv, logs, port)
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	defer conn.Close()
+
+	// keep the connection busy: it must be closed at the deadline anyway
+	start := time.Now()
+	conn.SetDeadline(start.Add(3 * time.Second))
+	buf := make([]byte, 4)
+	for {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("connection closed after %v; want about 300ms", elapsed)
+	}
+	waitForLog(t, logs, "reached max duration of 300ms", 2*time.Second)
+}
+
+func TestMaxConnectionAge_DrainsThenCloses(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.MaxConnectionAge = config.Duration(300 * time.Millisecond)
+	srv := newTestForwardServer(t, sp)
+
+	startTunnelSession(t, srv, logs, port)
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("dial forward: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	echo := func() error {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+	if err := echo(); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+
+	waitForLog(t, logs, fmt.Sprintf("reached max age of 300ms, draining port %d", port), 2*time.Second)
+	// the port no longer accepts, but the open forward keeps working
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("port still accepting after max connection age")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := echo(); err != nil {
+		t.Fatalf("echo while draining: %v", err)
+	}
+
+	// once the forward ends the connection is closed and the port released
+	conn.Close()
+	waitForLog(t, logs, fmt.Sprintf("Waiting for lock to release port %d", port), 2*time.Second)
+	deadline = time.Now().Add(2 * time.Second)
+	for srv.portsInUse() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("port %d still assigned after the connection was recycled", port)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForLog(t, logs, fmt.Sprintf("Client disconnected, freed port %d", port), 2*time.Second)
+}
+
+func TestMaxConnsPerForward_BoundsConcurrency(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.MaxConnsPerForward = 2
+	srv := newTestForwardServer(t, sp)
+
+	startTunnelSession(t, srv, logs, port)
+
+	dialEcho := func() net.Conn {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatalf("dial forward: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		return conn
+	}
+	readEcho := func(conn net.Conn, timeout time.Duration) error {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(conn, buf)
+		return err
+	}
+
+	first, second := dialEcho(), dialEcho()
+	for _, c := range []net.Conn{first, second} {
+		if err := readEcho(c, 2*time.Second); err != nil {
+			t.Fatalf("echo within limit: %v", err)
+		}
+	}
+
+	third := dialEcho()
+	if err := readEcho(third, 300*time.Millisecond); err == nil {
+		t.Fatal("third connection was served while the limit was reached")
+	}
+	waitForLog(t, logs, fmt.Sprintf("Port %d at 2 concurrent connections", port), 2*time.Second)
+
+	first.Close()
+	if err := readEcho(third, 2*time.Second); err != nil {
+		t.Fatalf("queued connection not served after a slot freed: %v", err)
+	}
+}
+
+func TestWritePidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pbp-tunnel.pid")
+	if err := writePidFile(path); err != nil {
+		t.Fatalf("writePidFile: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read pid file: %v", err)
+	}
+	if got := strings.TrimSpace(string(data)); got != strconv.Itoa(os.Getpid()) {
+		t.Errorf("pid file = %q; want %d", got, os.Getpid())
+	}
+
+	removePidFile(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("pid file still present after removal: %v", err)
+	}
+}
+
+func TestRemovePidFile_KeepsForeignPid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pbp-tunnel.pid")
+	if err := os.WriteFile(path, []byte("1\n"), 0644); err != nil {
+		t.Fatalf("write pid file: %v", err)
+	}
+	removePidFile(path)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("pid file of another process was removed: %v", err)
+	}
+}
+
+func TestListenerClosed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ln.Close()
+
+	_, err = ln.Accept()
+	if !listenerClosed(err) {
+		t.Errorf("listenerClosed(%v) = false; want true after Close", err)
+	}
+	if !listenerClosed(fmt.Errorf("accept: %w", err)) {
+		t.Error("listenerClosed = false for a wrapped close error; want true")
+	}
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer tl.Close()
+	tl.(*net.TCPListener).SetDeadline(time.Now())
+	if _, err := tl.Accept(); listenerClosed(err) {
+		t.Errorf("listenerClosed(%v) = true for a timeout; want false", err)
+	}
+}
+
+func TestWhitelistRejections_Counted(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	srv := newTestForwardServer(t, sp)
+
+	startTunnelSession(t, srv, logs, port, "192.0.2.1")
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatalf("dial forward: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read from rejected connection: %v; want EOF", err)
+		}
+		conn.Close()
+	}
+
+	metrics := srv.GetMetrics()
+	if got := metrics["forward_whitelist_rejections_total"]; got != uint64(2) {
+		t.Errorf("forward_whitelist_rejections_total = %v; want 2", got)
+	}
+	byIP := metrics["forward_whitelist_rejections_by_ip"].(map[string]uint64)
+	if byIP["127.0.0.1"] != 2 {
+		t.Errorf("rejections by IP = %v; want 127.0.0.1: 2", byIP)
+	}
+	if state := srv.snapshotState(); state.WhitelistRejections != 2 {
+		t.Errorf("state file rejections = %d; want 2", state.WhitelistRejections)
+	}
+}
+
+func TestResetStats_KeepsActiveForwards(t *testing.T) {
+	srv := newTestForwardServer(t, testServerParameters(t))
+	srv.whitelistRejections.inc("192.0.2.1")
+	srv.whitelistRejections.inc("192.0.2.2")
+	fwd := &activeForward{clientIP: "192.0.2.3", startedAt: time.Now()}
+	fwd.bytesToClient.Store(100)
+	srv.active[40000] = fwd
+
+	srv.ResetStats()
+
+	metrics := srv.GetMetrics()
+	if got := metrics["forward_whitelist_rejections_total"]; got != uint64(0) {
+		t.Errorf("forward_whitelist_rejections_total = %v; want 0", got)
+	}
+	if byIP := metrics["forward_whitelist_rejections_by_ip"].(map[string]uint64); len(byIP) != 0 {
+		t.Errorf("rejections by IP = %v; want none", byIP)
+	}
+	state := srv.snapshotState()
+	if len(state.Forwards) != 1 || state.Forwards[0].BytesToClient != 100 {
+		t.Errorf("forwards after reset = %+v; want the active forward with its bytes", state.Forwards)
+	}
+
+	// counting resumes after a reset
+	srv.whitelistRejections.inc("192.0.2.1")
+	if got := srv.GetMetrics()["forward_whitelist_rejections_total"]; got != uint64(1) {
+		t.Errorf("forward_whitelist_rejections_total = %v; want 1", got)
+	}
+}
+
+func TestReapOrphanedPorts(t *testing.T) {
+	srv := newTestForwardServer(t, testServerParameters(t))
+	srv.forwards[40000] = struct{}{} // leaked by a session that never released it
+	srv.forwards[40001] = struct{}{}
+	srv.active[40001] = &activeForward{clientIP: "192.0.2.1", startedAt: time.Now()}
+	srv.forwards[40002] = struct{}{}
+	srv.reservations["user@192.0.2.2"] = []*portReservation{{port: 40002, timer: time.NewTimer(time.Hour)}}
+
+	// the first sweep only marks the orphan, as it could be a port between
+	// assignment and the start of its forward
+	if n := srv.reapOrphanedPorts(); n != 0 {
+		t.Fatalf("first sweep freed %d ports; want 0", n)
+	}
+	if n := srv.reapOrphanedPorts(); n != 1 {
+		t.Fatalf("second sweep freed %d ports; want 1", n)
+	}
+	if _, used := srv.forwards[40000]; used {
+		t.Error("orphaned port 40000 still in use")
+	}
+	for _, port := range []int{40001, 40002} {
+		if _, used := srv.forwards[port]; !used {
+			t.Errorf("port %d freed; want it kept for its forward or reservation", port)
+		}
+	}
+	if got := srv.GetMetrics()["forward_ports_reclaimed_total"]; got != uint64(1) {
+		t.Errorf("forward_ports_reclaimed_total = %v; want 1", got)
+	}
+
+	// the port can be assigned again
+	if port, mask := srv.assignPortFor("user", 40000); mask != protocol.ErrSuccess || port != 40000 {
+		t.Errorf("assignPortFor(40000) = %d, %s; want the reclaimed port", port, mask)
+	}
+}
+
+func TestReapOrphanedPorts_SpareForwardsStartingUp(t *testing.T) {
+	srv := newTestForwardServer(t, testServerParameters(t))
+	srv.forwards[40000] = struct{}{}
+	srv.reapOrphanedPorts()
+
+	// the forward started between the sweeps
+	srv.active[40000] = &activeForward{clientIP: "192.0.2.1", startedAt: time.Now()}
+	srv.reapOrphanedPorts()
+	delete(srv.active, 40000)
+
+	if n := srv.reapOrphanedPorts(); n != 0 {
+		t.Errorf("sweep freed %d ports; want 0, the port was not orphaned twice in a row", n)
+	}
+}
+
+func TestRejectionCounter_CapsLabels(t *testing.T) {
+	var c rejectionCounter
+	for i := 0; i < maxRejectionLabels+10; i++ {
+		c.inc(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	c.inc("10.0.0.0")
+
+	total, byIP := c.snapshot()
+	if total != maxRejectionLabels+11 {
+		t.Errorf("total = %d; want %d", total, maxRejectionLabels+11)
+	}
+	if len(byIP) != maxRejectionLabels+1 {
+		t.Errorf("got %d labels; want %d plus the overflow label", len(byIP), maxRejectionLabels)
+	}
+	if byIP[rejectionOverflowLabel] != 10 || byIP["10.0.0.0"] != 2 {
+		t.Errorf("overflow = %d, 10.0.0.0 = %d; want 10 and 2", byIP[rejectionOverflowLabel], byIP["10.0.0.0"])
+	}
+}
+
+// --- Tests for the forward buffer ---
+
+func TestBufferedCopy_PreservesData(t *testing.T) {
+	data := make([]byte, 256<<10)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+
+	var dst bytes.Buffer
+	// small uneven reads and a buffer smaller than the data force many wrap-arounds
+	n, err := bufferedCopy(&dst, iotest.HalfReader(bytes.NewReader(data)), 1000)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("bufferedCopy = %d, %v; want %d, nil", n, err, len(data))
+	}
+	if !bytes.Equal(dst.Bytes(), data) {
+		t.Fatal("data lost or reordered through the buffer")
+	}
+}
+
+func TestRingBuffer_BackPressure(t *testing.T) {
+	rb := newRingBuffer(8)
+
+	wrote := make(chan int, 1)
+	go func() {
+		n, _ := rb.Write([]byte("0123456789abcdef"))
+		wrote <- n
+	}()
+
+	select {
+	case n := <-wrote:
+		t.Fatalf("Write of 16 bytes into an 8 byte buffer returned %d without a reader", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	buf := make([]byte, 16)
+	got := 0
+	for got < 16 {
+		n, err := rb.Read(buf[got:])
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		got += n
+	}
+	if n := <-wrote; n != 16 {
+		t.Errorf("Write returned %d; want 16", n)
+	}
+	if string(buf) != "0123456789abcdef" {
+		t.Errorf("read %q; want 0123456789abcdef", buf)
+	}
+
+	rb.closeWrite()
+	if _, err := rb.Read(buf); err != io.EOF {
+		t.Errorf("Read after closeWrite = %v; want EOF", err)
+	}
+}
+
+func TestRingBuffer_AbortUnblocksWriter(t *testing.T) {
+	rb := newRingBuffer(4)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rb.Write([]byte("more than four bytes"))
+		errc <- err
+	}()
+
+	boom := errors.New("client gone")
+	time.Sleep(20 * time.Millisecond)
+	rb.abort(boom)
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, boom) {
+			t.Errorf("Write error = %v; want %v", err, boom)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write still blocked after abort")
+	}
+}
+
+func TestForwardBuffer_EndToEnd(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.ForwardBufferBytes = 3
+	srv := newTestForwardServer(t, sp)
+
+	startTunnelSession(t, srv, logs, port)
+	pingForward(t, port)
+}
+
+func TestWarmupPeriod_DefersAssignment(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.WarmupPeriod = config.Duration(300 * time.Millisecond)
+	srv := newTestForwardServer(t, sp)
+
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+	cp := &config.ClientParameters{
+		Endpoint:     "pipe",
+		EndpointPort: 22,
+		Username:     "user",
+		Password:     "pass",
+		LocalHost:    "127.0.0.1",
+		LocalPort:    echoService(t),
+		RemoteHost:   "127.0.0.1",
+	}
+	if err := client.RunConn(clientEnd, cp); !errors.Is(err, client.ErrServerWarmingUp) {
+		t.Fatalf("RunConn during warmup = %v; want ErrServerWarmingUp", err)
+	}
+	if strings.Contains(logs.String(), "Assigned port") {
+		t.Errorf("port assigned during warmup:\n%s", logs.String())
+	}
+
+	time.Sleep(time.Until(srv.warmupUntil))
+	startTunnelSession(t, srv, logs, port)
+	pingForward(t, port)
+}
+
+func TestRequireExplicitPort(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.RequireExplicitPort = true
+	srv := newTestForwardServer(t, sp)
+
+	cp := &config.ClientParameters{
+		Endpoint:     "pipe",
+		EndpointPort: 22,
+		Username:     "user",
+		Password:     "pass",
+		LocalHost:    "127.0.0.1",
+		LocalPort:    echoService(t),
+		RemoteHost:   "127.0.0.1",
+	}
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+	if err := client.RunConn(clientEnd, cp); !errors.Is(err, client.ErrInvalidConfig) {
+		t.Fatalf("RunConn requesting port 0 = %v; want ErrInvalidConfig", err)
+	}
+	waitForLog(t, logs, "an explicit port is required", 2*time.Second)
+	if strings.Contains(logs.String(), "Assigned port") {
+		t.Errorf("port assigned for a port 0 request:\n%s", logs.String())
+	}
+
+	cp.RemotePort = port
+	clientEnd, serverEnd = tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+	go func() { _ = client.RunConn(clientEnd, cp) }()
+	waitForLog(t, logs, fmt.Sprintf("Notified client of port %d", port), 2*time.Second)
+	pingForward(t, port)
+}
+
+func TestPublicBaseURL_SentToClient(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.PublicBaseURL = "https://service.example.com:{port}"
+	srv := newTestForwardServer(t, sp)
+
+	startTunnelSession(t, srv, logs, port)
+	waitForLog(t, logs, fmt.Sprintf("Public URL: https://service.example.com:%d", port), 2*time.Second)
+	pingForward(t, port)
+}
+
+func TestWritePublicURL(t *testing.T) {
+	for _, tc := range []struct {
+		template string
+		want     string
+	}{
+		{"https://service.example.com:{port}", "https://service.example.com:40001"},
+		{"", ""},
+	} {
+		var buf bytes.Buffer
+		(&ForwardServer{publicBaseURL: tc.template}).writePublicURL(&buf, 40001)
+		frame := buf.Bytes()
+		if len(frame) < 4 || int(binary.BigEndian.Uint32(frame)) != len(frame)-4 || string(frame[4:]) != tc.want {
+			t.Errorf("writePublicURL with %q = %q; want length-prefixed %q", tc.template, frame, tc.want)
+		}
+	}
+}
+
+func TestMaxPortsPerIP(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port+1
+	sp.MaxPortsPerIP = 1
+	srv := newTestForwardServer(t, sp)
+
+	first := startTunnelSession(t, srv, logs, port)
+
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+	cp := &config.ClientParameters{
+		Endpoint:     "pipe",
+		EndpointPort: 22,
+		Username:     "user",
+		Password:     "pass",
+		LocalHost:    "127.0.0.1",
+		LocalPort:    echoService(t),
+		RemoteHost:   "127.0.0.1",
+	}
+	if err := client.RunConn(clientEnd, cp); !errors.Is(err, client.ErrPortQuotaExceeded) {
+		t.Fatalf("RunConn over the port quota = %v; want ErrPortQuotaExceeded", err)
+	}
+	waitForLog(t, logs, "Refused forward for 127.0.0.1: it already holds 1 ports", 2*time.Second)
+	if n := srv.portsInUse(); n != 1 {
+		t.Errorf("portsInUse() = %d; want 1", n)
+	}
+
+	// the quota is given back with the port
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		srv.portsPerIP.mu.Lock()
+		held := srv.portsPerIP.held["127.0.0.1"]
+		srv.portsPerIP.mu.Unlock()
+		if held == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("127.0.0.1 still holds %d ports after its session ended", held)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	startTunnelSession(t, srv, logs, port)
+}
+
+func TestLoadShedder_Hysteresis(t *testing.T) {
+	captureLog(t)
+	l := newLoadShedder(10, 6, 0)
+
+	steps := []struct {
+		forwards int
+		want     bool
+	}{
+		{9, false},
+		{10, true}, // high-water mark reached
+		{8, true},  // still above the low-water mark
+		{7, true},
+		{6, false}, // back at the low-water mark
+		{9, false},
+	}
+	for i, step := range steps {
+		if got := l.shed(step.forwards); got != step.want {
+			t.Errorf("step %d: shed(%d) = %v; want %v", i, step.forwards, got, step.want)
+		}
+	}
+}
+
+func TestLoadShedder_Heap(t *testing.T) {
+	captureLog(t)
+	var heap uint64
+	old := readHeapBytes
+	readHeapBytes = func() uint64 { return heap }
+	defer func() { readHeapBytes = old }()
+
+	l := newLoadShedder(0, 0, 1000)
+	for _, step := range []struct {
+		heap uint64
+		want bool
+	}{{999, false}, {1000, true}, {901, true}, {900, false}} {
+		heap = step.heap
+		if got := l.shed(0); got != step.want {
+			t.Errorf("shed with %d heap bytes = %v; want %v", step.heap, got, step.want)
+		}
+	}
+	if newLoadShedder(0, 0, 0) != nil {
+		t.Error("newLoadShedder without high-water marks is not nil")
+	}
+}
+
+func TestHighWaterForwards_ShedsUntilLowWater(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port+1
+	sp.HighWaterForwards = 1
+	srv := newTestForwardServer(t, sp)
+
+	first := startTunnelSession(t, srv, logs, port)
+
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+	cp := &config.ClientParameters{
+		Endpoint:     "pipe",
+		EndpointPort: 22,
+		Username:     "user",
+		Password:     "pass",
+		LocalHost:    "127.0.0.1",
+		LocalPort:    echoService(t),
+		RemoteHost:   "127.0.0.1",
+	}
+	if err := client.RunConn(clientEnd, cp); !errors.Is(err, client.ErrServerOverloaded) {
+		t.Fatalf("RunConn at the high-water mark = %v; want ErrServerOverloaded", err)
+	}
+	waitForLog(t, logs, "Overloaded, asked 127.0.0.1 to retry", 2*time.Second)
+	if shedding := srv.GetMetrics()["load_shedding"]; shedding != true {
+		t.Errorf("load_shedding = %v; want true", shedding)
+	}
+
+	// back below the low-water mark once the first port is released
+	first.Close()
+	waitForLog(t, logs, fmt.Sprintf("Waiting for lock to release port %d", port), 2*time.Second)
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.assignedPorts() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("port %d still assigned after its session ended", port)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	startTunnelSession(t, srv, logs, port)
+	waitForLog(t, logs, "Load back to 0 ports", 2*time.Second)
+	if shedding := srv.GetMetrics()["load_shedding"]; shedding != false {
+		t.Errorf("load_shedding = %v; want false", shedding)
+	}
+}
+
+func TestWriteAssignment_ServerTime(t *testing.T) {
+	srv := &ForwardServer{}
+
+	var old bytes.Buffer
+	srv.writeAssignment(&old, 40001, protocol.VersionServerTime-1)
+	var cur bytes.Buffer
+	before := time.Now().UnixMilli()
+	srv.writeAssignment(&cur, 40001, protocol.VersionServerTime)
+	after := time.Now().UnixMilli()
+
+	if cur.Len() != old.Len()+8 || !bytes.HasPrefix(cur.Bytes(), old.Bytes()) {
+		t.Fatalf("assignment frames = %x; want %x followed by the server time", cur.Bytes(), old.Bytes())
+	}
+	if ms := int64(binary.BigEndian.Uint64(cur.Bytes()[old.Len():])); ms < before || ms > after {
+		t.Errorf("server time = %d; want between %d and %d", ms, before, after)
+	}
+}
+
+func TestWriteAssignment_ServerVersion(t *testing.T) {
+	prev := Version
+	Version = "1.4.2"
+	t.Cleanup(func() { Version = prev })
+	srv := &ForwardServer{}
+
+	var old bytes.Buffer
+	srv.writeAssignment(&old, 40001, protocol.VersionServerInfo-1)
+	var cur bytes.Buffer
+	srv.writeAssignment(&cur, 40001, protocol.VersionServerInfo)
+
+	want := append(binary.BigEndian.AppendUint32(nil, 5), "1.4.2"...)
+	if got := cur.Bytes()[min(old.Len(), cur.Len()):]; !bytes.Equal(got, want) {
+		t.Errorf("version frame = %x; want %x", got, want)
+	}
+}
+
+// readyCheckListener records whether ready was closed when Accept was first called
+type readyCheckListener struct {
+	net.Listener
+	ready      <-chan struct{}
+	once       sync.Once
+	readyFirst atomic.Bool
+}
+
+func (l *readyCheckListener) Accept() (net.Conn, error) {
+	l.once.Do(func() {
+		select {
+		case <-l.ready:
+			l.readyFirst.Store(true)
+		default:
+		}
+	})
+	return l.Listener.Accept()
+}
+
+func TestServe_SignalsReadyBeforeAccepting(t *testing.T) {
+	captureLog(t)
+	var onReady atomic.Int32
+	sp := testServerParameters(t)
+	sp.OnReady = func() { onReady.Add(1) }
+	srv := newTestForwardServer(t, sp)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	check := &readyCheckListener{Listener: ln, ready: srv.Ready()}
+	srv.listener = check
+
+	select {
+	case <-srv.Ready():
+		t.Fatal("Ready closed before serve")
+	default:
+	}
+	go srv.serve()
+	defer srv.Drain()
+
+	select {
+	case <-srv.Ready():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Ready not closed once serving")
+	}
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial once ready: %v", err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, "ready", testClientConfig())
+	if err != nil {
+		t.Fatalf("SSH handshake once ready: %v", err)
+	}
+	ssh.NewClient(c, chans, reqs).Close()
+
+	if !check.readyFirst.Load() {
+		t.Error("listener accepted before Ready was closed")
+	}
+	if n := onReady.Load(); n != 1 {
+		t.Errorf("OnReady called %d times; want 1", n)
+	}
+}
+
+func TestDrain_StopsNewConnectionsKeepsForwards(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port+1
+	srv := newTestForwardServer(t, sp)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv.listener = ln
+	served := make(chan struct{})
+	go func() {
+		srv.serve()
+		close(served)
+	}()
+
+	startTunnelSession(t, srv, logs, port)
+	srv.Drain()
+
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve still running after Drain")
+	}
+	if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("SSH listener still accepts connections after Drain")
+	}
+	pingForward(t, port)
+
+	// a new forward on an already established connection is refused
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+	cp := &config.ClientParameters{
+		Endpoint:     "pipe",
+		EndpointPort: 22,
+		Username:     "user",
+		Password:     "pass",
+		LocalHost:    "127.0.0.1",
+		LocalPort:    echoService(t),
+		RemoteHost:   "127.0.0.1",
+	}
+	if err := client.RunConn(clientEnd, cp); !errors.Is(err, client.ErrServerDraining) {
+		t.Errorf("RunConn while draining = %v; want ErrServerDraining", err)
+	}
+	waitForLog(t, logs, "Draining, refused forward", 2*time.Second)
+	pingForward(t, port)
+}
+
+func TestSessionByteQuota_ClosesConnectionAcrossForwards(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.SessionByteQuota = 10000
+	srv := newTestForwardServer(t, sp)
+
+	startTunnelSession(t, srv, logs, port)
+
+	// each forward echoes 2000 bytes (4000 relayed), only together they exceed the quota
+	payload := bytes.Repeat([]byte("x"), 2000)
+	for i := 0; i < 3; i++ {
+		if strings.Contains(logs.String(), "over its quota") {
+			t.Fatalf("quota exceeded after %d forwards:\n%s", i, logs.String())
+		}
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatalf("dial forward %d: %v", i, err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write(payload); err != nil {
+			t.Fatalf("write forward %d: %v", i, err)
+		}
+		if i < 2 {
+			if _, err := io.ReadFull(conn, make([]byte, len(payload))); err != nil {
+				t.Fatalf("echo forward %d: %v", i, err)
+			}
+		}
+	}
+
+	waitForLog(t, logs, "over its quota of 10000", 2*time.Second)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("forwarded port still open after the session quota was exceeded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// recordListen replaces listen for the duration of the test and records the networks it is called with
+func recordListen(t *testing.T, err error) *[]string {
+	var mu sync.Mutex
+	networks := []string{}
+	orig := listen
+	listen = func(network, addr string) (net.Listener, error) {
+		mu.Lock()
+		networks = append(networks, network)
+		mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return orig(network, addr)
+	}
+	t.Cleanup(func() { listen = orig })
+	return &networks
+}
+
+// failListen makes listen fail for port for the duration of the test; other
+// listeners are bound to an ephemeral port instead of the requested one
+func failListen(t *testing.T, port int) {
+	orig := listen
+	listen = func(network, addr string) (net.Listener, error) {
+		if strings.HasSuffix(addr, fmt.Sprintf(":%d", port)) {
+			return nil, fmt.Errorf("listen %s: address already in use", addr)
+		}
+		return orig(network, "127.0.0.1:0")
+	}
+	t.Cleanup(func() { listen = orig })
+}
+
+func TestHandleChannel_BindFailureFreesPort(t *testing.T) {
+	logs := captureLog(t)
+
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = 41200, 41201
+	srv := newTestForwardServer(t, sp)
+	failListen(t, 41200)
+
+	// an automatic assignment moves on to the next port
+	startTunnelSession(t, srv, logs, 41201)
+	srv.lock.Lock()
+	_, leaked := srv.forwards[41200]
+	_, assigned := srv.forwards[41201]
+	srv.lock.Unlock()
+	if leaked || !assigned {
+		t.Errorf("41200 in use = %v, 41201 in use = %v; want only 41201 after the bind of 41200 failed", leaked, assigned)
+	}
+
+	// an explicit request fails and frees its port
+	srv = newTestForwardServer(t, sp)
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+	cp := &config.ClientParameters{
+		Endpoint:     "pipe",
+		EndpointPort: 22,
+		Username:     "user",
+		Password:     "pass",
+		LocalHost:    "127.0.0.1",
+		LocalPort:    echoService(t),
+		RemoteHost:   "127.0.0.1",
+		RemotePort:   41200,
+	}
+	if err := client.RunConn(clientEnd, cp); err == nil || !strings.Contains(err.Error(), "internal error") {
+		t.Fatalf("RunConn with an unbindable port = %v; want internal error", err)
+	}
+	if n := srv.portsInUse(); n != 0 {
+		t.Errorf("portsInUse() = %d after a failed bind; want 0", n)
+	}
+}
+
+func TestListenNetwork_ForwardListener(t *testing.T) {
+	logs := captureLog(t)
+	networks := recordListen(t, nil)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.ListenNetwork = "tcp4"
+	srv := newTestForwardServer(t, sp)
+
+	startTunnelSession(t, srv, logs, port)
+	pingForward(t, port)
+	if len(*networks) != 1 || (*networks)[0] != "tcp4" {
+		t.Errorf("forward listen networks = %v; want [tcp4]", *networks)
+	}
+}
+
+func TestListenNetwork_SSHListener(t *testing.T) {
+	captureLog(t)
+	networks := recordListen(t, errors.New("listen stub"))
+
+	sp := testServerParameters(t)
+	sp.ListenNetwork = "tcp6"
+	err := Run(sp)
+	if err == nil || !strings.Contains(err.Error(), "listen stub") {
+		t.Fatalf("Run = %v; want the stubbed listen error", err)
+	}
+	if len(*networks) != 1 || (*networks)[0] != "tcp6" {
+		t.Errorf("SSH listen networks = %v; want [tcp6]", *networks)
+	}
+}
+
+func TestWatchConfig_ReloadsOnChange(t *testing.T) {
+	captureLog(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(ip, denied string, mod time.Time) {
+		data := fmt.Sprintf(`{"type":"server","server":{"allowed_ips":[%q],"denied_ips":[%q]}}`, ip, denied)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+	start := time.Now()
+	write("10.0.0.1", "10.0.1.0/24", start)
+
+	srv := &ForwardServer{
+		allowList: CompileAllowList([]string{"10.0.0.1"}),
+		denyList:  CompileAllowList([]string{"10.0.1.0/24"}),
+	}
+	reloaded := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchConfig(path, 10*time.Millisecond, stop, func(sp *config.ServerParameters) {
+		srv.reloadConfig(sp)
+		reloaded <- struct{}{}
+	})
+
+	time.Sleep(30 * time.Millisecond)
+	select {
+	case <-reloaded:
+		t.Fatal("reloaded before the config file changed")
+	default:
+	}
+
+	write("10.0.0.2", "10.0.2.0/24", start.Add(time.Second))
+	select {
+	case <-reloaded:
+	case <-time.After(2 * time.Second):
+		t.Fatal("config change not picked up")
+	}
+	if srv.peerAllowed("10.0.0.1", nil) || !srv.peerAllowed("10.0.0.2", nil) {
+		t.Error("allowed IPs after reload do not match [10.0.0.2]")
+	}
+	if srv.denied().Contains("10.0.1.5") || !srv.denied().Contains("10.0.2.5") {
+		t.Error("denied IPs after reload do not match [10.0.2.0/24]")
+	}
+}
+
+func TestStablePortByUser(t *testing.T) {
+	captureLog(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = 41000, 41099
+	sp.StablePortByUser = true
+
+	// the same user gets the same port, even from another server
+	alice, mask := newTestForwardServer(t, sp).assignPortFor("alice", 0)
+	if mask != protocol.ErrSuccess {
+		t.Fatalf("assignPortFor(alice) mask = %v", mask)
+	}
+	if again, _ := newTestForwardServer(t, sp).assignPortFor("alice", 0); again != alice {
+		t.Errorf("alice got port %d, then %d; want the same port", alice, again)
+	}
+	if alice != stablePort("alice", 41000, 41099) {
+		t.Errorf("alice got port %d; want stable port %d", alice, stablePort("alice", 41000, 41099))
+	}
+
+	// a taken stable port falls back to the first free one
+	srv := newTestForwardServer(t, sp)
+	srv.forwards[alice] = struct{}{}
+	port, mask := srv.assignPortFor("alice", 0)
+	if mask != protocol.ErrSuccess || port == alice || port < 41000 || port > 41099 {
+		t.Errorf("assignPortFor(alice) with its port taken = (%d, %v); want another port in range", port, mask)
+	}
+
+	// an explicit request wins over the stable port
+	if port, _ := newTestForwardServer(t, sp).assignPortFor("alice", 41050); port != 41050 {
+		t.Errorf("assignPortFor(alice, 41050) = %d; want 41050", port)
+	}
+}
+
+func TestAssignPortFor_UserPools(t *testing.T) {
+	logs := captureLog(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = 41000, 41099
+	sp.PortPools = config.PortPoolMap{"team-a": {Start: 41010, End: 41011}, "team-b": {Start: 41020, End: 41029}}
+	sp.UserPoolMap = config.StringMap{"alice": "team-a", "bob": "team-b"}
+	srv := newTestForwardServer(t, sp)
+
+	// pooled users get the first free port of their pool, others the whole range
+	for _, tc := range []struct {
+		user string
+		want int
+	}{{"alice", 41010}, {"bob", 41020}, {"alice", 41011}, {"carol", 41000}} {
+		if port, mask := srv.assignPortFor(tc.user, 0); mask != protocol.ErrSuccess || port != tc.want {
+			t.Errorf("assignPortFor(%s) = (%d, %v); want %d", tc.user, port, mask, tc.want)
+		}
+	}
+
+	// a port outside the pool is out of range, even when free in the whole range
+	if _, mask := srv.assignPortFor("alice", 41050); mask != protocol.ErrMask|protocol.ErrPortOutOfRange {
+		t.Errorf("assignPortFor(alice, 41050) mask = %v; want out of range", mask)
+	}
+
+	// team-a is exhausted while team-b and the rest of the range still have ports
+	_, mask := srv.assignPortFor("alice", 0)
+	if mask != protocol.ErrMask|protocol.ErrPortUnavailable {
+		t.Fatalf("assignPortFor(alice) on an exhausted pool mask = %v; want unavailable", mask)
+	}
+	srv.logAssignFailure("10.0.0.1", "alice", 0, mask)
+	if want := "reason=range-exhausted requested=0 range=41010-41011 used=2/2"; !strings.Contains(logs.String(), want) {
+		t.Errorf("log missing %q:\n%s", want, logs.String())
+	}
+	if port, mask := srv.assignPortFor("bob", 0); mask != protocol.ErrSuccess || port != 41021 {
+		t.Errorf("assignPortFor(bob) = (%d, %v); want 41021", port, mask)
+	}
+}
+
+func TestHandleSSHConnection_SessionChannel(t *testing.T) {
+	for _, tolerate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tolerate=%v", tolerate), func(t *testing.T) {
+			logs := captureLog(t)
+			sp := testServerParameters(t)
+			sp.TolerateExtraChannels = tolerate
+			srv := newTestForwardServer(t, sp)
+
+			clientEnd, serverEnd := tcpPipe(t)
+			go srv.handleSSHConnection(serverEnd)
+			c, chans, reqs, err := ssh.NewClientConn(clientEnd, "pipe", testClientConfig())
+			if err != nil {
+				t.Fatalf("NewClientConn: %v", err)
+			}
+			client := ssh.NewClient(c, chans, reqs)
+			defer client.Close()
+
+			ch, chReqs, err := client.OpenChannel("session", nil)
+			if !tolerate {
+				var openErr *ssh.OpenChannelError
+				if !errors.As(err, &openErr) || openErr.Reason != ssh.UnknownChannelType {
+					t.Fatalf("OpenChannel(session) = %v; want UnknownChannelType", err)
+				}
+				waitForLog(t, logs, `Rejected unsupported channel type "session"`, 2*time.Second)
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenChannel(session) = %v; want accepted", err)
+			}
+			go ssh.DiscardRequests(chReqs)
+			// the server closes the channel right away
+			if _, err := ch.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("read from session channel = %v; want io.EOF", err)
+			}
+			waitForLog(t, logs, "Closed session channel", 2*time.Second)
+		})
+	}
+}
+
+func TestAllowedBindHosts(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowed    []string
+		remoteHost string
+		wantHost   string // "" when the request is refused
+	}{
+		{"allowed host", []string{"127.0.0.2"}, "127.0.0.2", "127.0.0.2"},
+		{"no host requested", []string{"127.0.0.2"}, "", "127.0.0.1"},
+		{"no allowed hosts", nil, "127.0.0.2", "127.0.0.1"},
+		{"host not allowed", []string{"127.0.0.2"}, "127.0.0.3", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLog(t)
+			port := freePort(t)
+			sp := testServerParameters(t)
+			sp.PortRangeStart, sp.PortRangeEnd = port, port
+			sp.AllowedBindHosts = tc.allowed
+			srv := newTestForwardServer(t, sp)
+
+			clientEnd, serverEnd := tcpPipe(t)
+			go srv.handleSSHConnection(serverEnd)
+			cp := &config.ClientParameters{
+				Endpoint:     "pipe",
+				EndpointPort: 22,
+				Username:     "user",
+				Password:     "pass",
+				LocalHost:    "127.0.0.1",
+				LocalPort:    echoService(t),
+				RemoteHost:   tc.remoteHost,
+			}
+			errc := make(chan error, 1)
+			go func() { errc <- client.RunConn(clientEnd, cp) }()
+
+			if tc.wantHost == "" {
+				select {
+				case err := <-errc:
+					if err == nil || !strings.Contains(err.Error(), "not allowed") {
+						t.Errorf("RunConn = %v; want bind host not allowed", err)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("RunConn did not fail for a host outside the allowed bind hosts")
+				}
+				return
+			}
+			waitForLog(t, logs, fmt.Sprintf("Notified client of port %d", port), 2*time.Second)
+			addr := net.JoinHostPort(tc.wantHost, strconv.Itoa(port))
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("forward not bound on %s: %v", addr, err)
+			}
+			conn.Close()
+		})
+	}
+}
+
+// openRecorder is an ssh.Conn whose OpenChannel fails with err, counting attempts
+type openRecorder struct {
+	ssh.Conn
+	name   string
+	err    error
+	opened int
+}
+
+func (c *openRecorder) OpenChannel(string, []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	c.opened++
+	return nil, nil, c.err
+}
+
+func (c *openRecorder) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestOpenBackChannel_Failover(t *testing.T) {
+	primary := &portBackend{conn: &openRecorder{name: "primary"}}
+	backup := &portBackend{conn: &openRecorder{name: "backup"}}
+	second := &portBackend{conn: &openRecorder{name: "second"}}
+
+	srv := newTestForwardServer(t, testServerParameters(t))
+	srv.allowPortSharing = true
+	share := srv.openShare(40000, primary)
+	for _, b := range []*portBackend{backup, second} {
+		if !srv.joinShare(40000, b) {
+			t.Fatal("joinShare() = false; want true for a served port")
+		}
+	}
+	if srv.joinShare(40001, &portBackend{}) {
+		t.Error("joinShare() = true for a port nobody serves")
+	}
+
+	selected := func() string {
+		t.Helper()
+		_, _, b, err := srv.openBackChannel(40000, share, primary, nil)
+		if err != nil {
+			return "error"
+		}
+		return b.conn.(*openRecorder).name
+	}
+
+	if got := selected(); got != "primary" {
+		t.Errorf("healthy primary: selected %s; want primary", got)
+	}
+	primary.conn.(*openRecorder).err = errors.New("open failed")
+	if got := selected(); got != "backup" {
+		t.Errorf("failing primary: selected %s; want backup", got)
+	}
+	backup.conn.(*openRecorder).err = errors.New("open failed")
+	if got := selected(); got != "second" {
+		t.Errorf("failing primary and backup: selected %s; want second", got)
+	}
+	second.conn.(*openRecorder).err = errors.New("open failed")
+	if got := selected(); got != "error" {
+		t.Errorf("all failing: selected %s; want error", got)
+	}
+
+	// once the primary leaves, the backup is tried first
+	primary.conn.(*openRecorder).err = nil
+	backup.conn.(*openRecorder).err = nil
+	srv.leaveShare(40000, primary)
+	before := primary.conn.(*openRecorder).opened
+	if got := selected(); got != "backup" {
+		t.Errorf("after primary left: selected %s; want backup", got)
+	}
+	if primary.conn.(*openRecorder).opened != before {
+		t.Error("primary tried after leaving the share")
+	}
+
+	srv.leaveShare(40000, backup)
+	srv.leaveShare(40000, second)
+	select {
+	case <-share.empty:
+	default:
+		t.Error("share not closed after its last client left")
+	}
+}
+
+func TestPortSharing_BackupTakesOver(t *testing.T) {
+	logs := captureLog(t)
+
+	port := freePort(t)
+	sp := testServerParameters(t)
+	sp.PortRangeStart, sp.PortRangeEnd = port, port
+	sp.AllowPortSharing = true
+	srv := newTestForwardServer(t, sp)
+
+	startSharingClient := func(marker string) net.Conn {
+		clientEnd, serverEnd := tcpPipe(t)
+		go srv.handleSSHConnection(serverEnd)
+		cp := &config.ClientParameters{
+			Endpoint:     "pipe",
+			EndpointPort: 22,
+			Username:     "user",
+			Password:     "pass",
+			LocalHost:    "127.0.0.1",
+			LocalPort:    echoService(t),
+			RemotePort:   port,
+		}
+		go func() { _ = client.RunConn(clientEnd, cp) }()
+		waitForLog(t, logs, marker, 2*time.Second)
+		return clientEnd
+	}
+
+	primary := startSharingClient(fmt.Sprintf("Notified client of port %d", port))
+	startSharingClient(fmt.Sprintf("as backup for port %d", port))
+	pingForward(t, port)
+	if strings.Contains(logs.String(), "failed over") {
+		t.Errorf("forward failed over while the primary was up:\n%s", logs.String())
+	}
+
+	primary.Close()
+	waitForLog(t, logs, "backup(s) keep serving it", 2*time.Second)
+	pingForward(t, port)
+}
+
+func TestLogSampler_Fraction(t *testing.T) {
+	if newLogSampler(0) != nil || newLogSampler(1) != nil {
+		t.Error("newLogSampler(0 or 1) != nil; want a sampler logging everything")
+	}
+	if !(*logSampler)(nil).sample() {
+		t.Error("nil sampler dropped an event")
+	}
+
+	const events = 20000
+	for _, rate := range []float64{0.1, 0.5, 0.9} {
+		sampler := newLogSampler(rate)
+		logged := 0
+		for i := 0; i < events; i++ {
+			if sampler.sample() {
+				logged++
+			}
+		}
+		if got := float64(logged) / events; got < rate-0.02 || got > rate+0.02 {
+			t.Errorf("rate %.1f: logged %.3f of events; want within 0.02", rate, got)
+		}
+	}
+}
+
+func TestHandleSSHConnection_RefusesAndLogsRequests(t *testing.T) {
+	logs := captureLog(t)
+	srv := newTestForwardServer(t, testServerParameters(t))
+
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+	c, chans, reqs, err := ssh.NewClientConn(clientEnd, "pipe", testClientConfig())
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+
+	ok, _, err := client.SendRequest("tcpip-forward", true, ssh.Marshal(struct {
+		Addr string
+		Port uint32
+	}{"0.0.0.0", 8080}))
+	if err != nil || ok {
+		t.Errorf("tcpip-forward = %v, %v; want refused", ok, err)
+	}
+	waitForLog(t, logs, `Refused global request "tcpip-forward"`, 2*time.Second)
+
+	ch, chReqs, err := client.OpenChannel("direct-tcpip", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(chReqs)
+	ok, err = ch.SendRequest("exec", true, ssh.Marshal(struct{ Command string }{"id"}))
+	if err != nil || ok {
+		t.Errorf("exec = %v, %v; want refused", ok, err)
+	}
+	waitForLog(t, logs, `Refused channel request "exec"`, 2*time.Second)
+}
+
+func TestRun_MaxUptimeDrainsAndStops(t *testing.T) {
+	logs := captureLog(t)
+	sp := testServerParameters(t)
+	sp.BindAddress = "127.0.0.1"
+	sp.BindPort = freePort(t)
+	sp.MaxUptime = config.Duration(200 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() { done <- Run(sp) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run = %v; want nil after max uptime", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run still running after max uptime")
+	}
+	out := logs.String()
+	if !strings.Contains(out, "Reached max uptime of 200ms") || !strings.Contains(out, "Draining: refusing new connections") {
+		t.Errorf("expected max uptime drain in logs:\n%s", out)
+	}
+	if conn, err := net.Dial("tcp", net.JoinHostPort(sp.BindAddress, strconv.Itoa(sp.BindPort))); err == nil {
+		conn.Close()
+		t.Error("SSH listener still accepting after Run returned")
+	}
+}
+
+func TestRun_EphemeralBindPort(t *testing.T) {
+	logs := captureLog(t)
+	sp := testServerParameters(t)
+	sp.BindAddress = "127.0.0.1"
+	sp.BindPort = 0
+	sp.MaxUptime = config.Duration(time.Second)
+
+	done := make(chan error, 1)
+	go func() { done <- Run(sp) }()
+	waitForLog(t, logs, "SSH server listening on", 2*time.Second)
+
+	m := regexp.MustCompile(`SSH server listening on 127\.0\.0\.1:(\d+)`).FindStringSubmatch(logs.String())
+	if m == nil || m[1] == "0" {
+		t.Fatalf("listening log without a bound port:\n%s", logs.String())
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(sp.BindAddress, m[1]))
+	if err != nil {
+		t.Errorf("dial bound port %s: %v", m[1], err)
+	} else {
+		conn.Close()
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Run = %v", err)
+	}
+}
+
+func TestForwardServer_BoundPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	srv := &ForwardServer{bindPort: listenerPort(ln, 0), listener: ln}
+	if got, want := srv.BoundPort(), ln.Addr().(*net.TCPAddr).Port; got == 0 || got != want {
+		t.Errorf("BoundPort() = %d; want %d", got, want)
+	}
+}
+
+// dialHostKey opens an SSH connection to srv offering only algorithms (all when
+// empty) and returns it with the host key the server presented
+func dialHostKey(t *testing.T, srv *ForwardServer, algorithms ...string) (ssh.Conn, ssh.PublicKey, error) {
+	clientEnd, serverEnd := tcpPipe(t)
+	go srv.handleSSHConnection(serverEnd)
+
+	var hostKey ssh.PublicKey
+	conn, _, reqs, err := ssh.NewClientConn(clientEnd, "pipe", &ssh.ClientConfig{
+		User:              "user",
+		Auth:              []ssh.AuthMethod{ssh.Password("pass")},
+		HostKeyAlgorithms: algorithms,
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return nil
+		},
+		Timeout: 2 * time.Second,
+	})
+	if err != nil {
+		clientEnd.Close()
+		return nil, nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	t.Cleanup(func() { conn.Close() })
+	return conn, hostKey, nil
+}
+
+func TestAddHostKey_OfferedToNewConnections(t *testing.T) {
+	captureLog(t)
+	sp := testServerParameters(t)
+	srv := newTestForwardServer(t, sp)
+
+	established, oldKey, err := dialHostKey(t, srv)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if _, _, err := dialHostKey(t, srv, ssh.KeyAlgoECDSA256); err == nil {
+		t.Fatal("ECDSA host key negotiated before it was added")
+	}
+
+	dir := t.TempDir()
+	ecdsaPath := filepath.Join(dir, "id_ecdsa")
+	ed25519Path := filepath.Join(dir, "id_ed25519")
+	for path, keyType := range map[string]string{ecdsaPath: "ecdsa", ed25519Path: "ed25519"} {
+		if _, err := util.GenerateAndSavePrivateKeyToFile(path, keyType, util.DefaultKeyFileMode); err != nil {
+			t.Fatalf("generate %s host key: %v", keyType, err)
+		}
+		if err := srv.AddHostKey(path); err != nil {
+			t.Fatalf("AddHostKey(%s): %v", path, err)
+		}
+	}
+
+	if _, key, err := dialHostKey(t, srv, ssh.KeyAlgoECDSA256); err != nil {
+		t.Errorf("dial with added ECDSA host key: %v", err)
+	} else if key.Type() != ssh.KeyAlgoECDSA256 {
+		t.Errorf("host key type = %s; want %s", key.Type(), ssh.KeyAlgoECDSA256)
+	}
+	// a key of a type already served replaces the current one
+	if _, key, err := dialHostKey(t, srv, ssh.KeyAlgoED25519); err != nil {
+		t.Errorf("dial with rotated Ed25519 host key: %v", err)
+	} else if bytes.Equal(key.Marshal(), oldKey.Marshal()) {
+		t.Error("new connection still negotiated the replaced Ed25519 host key")
+	}
+
+	if _, _, err := established.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("established connection lost after adding host keys: %v", err)
+	}
+}
+
+func TestAddHostKey_InvalidKeyKeepsConfig(t *testing.T) {
+	captureLog(t)
+	srv := newTestForwardServer(t, testServerParameters(t))
+	before := srv.sshServerConfig()
+
+	if err := srv.AddHostKey(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("AddHostKey with a missing key file returned nil")
+	}
+	if srv.sshServerConfig() != before {
+		t.Error("failed AddHostKey replaced the SSH configuration")
+	}
+}
+
+// keyConn is the ssh.ConnMetadata of a public key authentication attempt by user
+type keyConn struct{ user string }
+
+func (c *keyConn) User() string          { return c.user }
+func (c *keyConn) SessionID() []byte     { return nil }
+func (c *keyConn) ClientVersion() []byte { return nil }
+func (c *keyConn) ServerVersion() []byte { return nil }
+func (c *keyConn) RemoteAddr() net.Addr  { return nil }
+func (c *keyConn) LocalAddr() net.Addr   { return nil }
+
+func TestReloadAuthorizedKeys_FetchesURLAgain(t *testing.T) {
+	captureLog(t)
+	var served atomic.Value
+	served.Store([]byte{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(served.Load().([]byte))
+	}))
+	defer ts.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+
+	sp := testServerParameters(t)
+	sp.AuthorizedKeysPath = ts.URL
+	sp.AllowInsecureKeysURL = true
+	srv := newTestForwardServer(t, sp)
+	conn := &keyConn{user: sp.Username}
+	if _, err := srv.sshServerConfig().PublicKeyCallback(conn, signer.PublicKey()); err == nil {
+		t.Fatal("key accepted before it was served")
+	}
+
+	served.Store(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	if err := srv.reloadAuthorizedKeys(); err != nil {
+		t.Fatalf("reloadAuthorizedKeys: %v", err)
+	}
+	if _, err := srv.sshServerConfig().PublicKeyCallback(conn, signer.PublicKey()); err != nil {
+		t.Errorf("served key rejected after reload: %v", err)
+	}
+
+	// a failed fetch keeps the keys loaded last
+	ts.Close()
+	before := srv.sshServerConfig()
+	if err := srv.reloadAuthorizedKeys(); err == nil {
+		t.Error("reloadAuthorizedKeys with the keys URL down returned nil")
+	}
+	if srv.sshServerConfig() != before {
+		t.Error("failed reload replaced the SSH configuration")
+	}
+}
+
+func TestNodeName_TagsLogLinesAndMetrics(t *testing.T) {
+	logs := captureLog(t)
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skipf("no hostname: %v", err)
+	}
+	if got := nodeName(""); got != host {
+		t.Errorf("nodeName(\"\") = %q; want hostname %q", got, host)
+	}
+	if got := nodeName("edge-1"); got != "edge-1" {
+		t.Errorf("nodeName(\"edge-1\") = %q; want edge-1", got)
+	}
+
+	restore := tagLogs("edge-1")
+	log.Printf("[*] tagged")
+	restore()
+	log.Printf("[*] untagged")
+	if !strings.Contains(logs.String(), "node=edge-1 [*] tagged") {
+		t.Errorf("log line not tagged with the node name:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "node=edge-1 [*] untagged") {
+		t.Errorf("node name still tagged after restore:\n%s", logs.String())
+	}
+
+	if got := newTestForwardServer(t, testServerParameters(t)).GetMetrics()["node_name"]; got != host {
+		t.Errorf("node_name = %v; want hostname %q", got, host)
+	}
+}
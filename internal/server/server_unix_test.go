@@ -0,0 +1,138 @@
+//go:build unix
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSystemdListener_InheritedFd(t *testing.T) {
+	orig, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer orig.Close()
+	f, err := orig.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("listener file: %v", err)
+	}
+	defer f.Close()
+
+	// Simulate the descriptor systemd would have passed at SD_LISTEN_FDS_START;
+	// systemdListener takes ownership of it
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("dup: %v", err)
+	}
+	prev := sdListenFdsStart
+	sdListenFdsStart = fd
+	t.Cleanup(func() { sdListenFdsStart = prev })
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()))
+
+	ln, activated, err := systemdListener()
+	if err != nil || !activated {
+		t.Fatalf("systemdListener() = %v, %v; want activated", activated, err)
+	}
+	defer ln.Close()
+	if ln.Addr().String() != orig.Addr().String() {
+		t.Errorf("listener addr = %s; want %s", ln.Addr(), orig.Addr())
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS should be cleared after activation")
+	}
+
+	go func() {
+		if c, err := net.Dial("tcp", orig.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept on inherited listener: %v", err)
+	}
+	c.Close()
+}
+
+func TestResolveRunAs(t *testing.T) {
+	me, err := user.Current()
+	if err != nil {
+		t.Skipf("current user unavailable: %v", err)
+	}
+	wantUID, _ := strconv.Atoi(me.Uid)
+	wantGID, _ := strconv.Atoi(me.Gid)
+
+	for _, name := range []string{me.Username, me.Uid} {
+		uid, gid, err := resolveRunAs(name, "")
+		if err != nil {
+			t.Fatalf("resolveRunAs(%q) error: %v", name, err)
+		}
+		if uid != wantUID || gid != wantGID {
+			t.Errorf("resolveRunAs(%q) = %d:%d; want %d:%d", name, uid, gid, wantUID, wantGID)
+		}
+	}
+
+	if _, gid, err := resolveRunAs(me.Username, me.Gid); err != nil || gid != wantGID {
+		t.Errorf("resolveRunAs with numeric group = %d, %v; want %d", gid, err, wantGID)
+	}
+}
+
+func TestResolveRunAs_Unknown(t *testing.T) {
+	if _, _, err := resolveRunAs("pbp-tunnel-no-such-user", ""); err == nil {
+		t.Error("expected error for unknown user")
+	}
+
+	me, err := user.Current()
+	if err != nil {
+		t.Skipf("current user unavailable: %v", err)
+	}
+	if _, _, err := resolveRunAs(me.Username, "pbp-tunnel-no-such-group"); err == nil {
+		t.Error("expected error for unknown group")
+	}
+}
+
+func TestWritePidFile_RunningProcess(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start helper process: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	path := filepath.Join(t.TempDir(), "pbp-tunnel.pid")
+	os.WriteFile(path, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644)
+
+	err := writePidFile(path)
+	if err == nil || !strings.Contains(err.Error(), "running process") {
+		t.Fatalf("writePidFile error = %v; want running process", err)
+	}
+}
+
+func TestWritePidFile_StalePid(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run helper process: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "pbp-tunnel.pid")
+	os.WriteFile(path, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644)
+
+	if err := writePidFile(path); err != nil {
+		t.Fatalf("writePidFile with a stale pid: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if got := strings.TrimSpace(string(data)); got != strconv.Itoa(os.Getpid()) {
+		t.Errorf("pid file = %q; want %d", got, os.Getpid())
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"log"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// portBackend is a client serving an assigned port
+type portBackend struct {
+	conn            ssh.Conn
+	protocolVersion uint32
+	quota           *sessionQuota
+}
+
+// portShare lists the clients serving a shared port, in failover order: the
+// client that bound the port first, then backups in the order they joined.
+// empty is closed once the last of them leaves.
+type portShare struct {
+	backends []*portBackend
+	empty    chan struct{}
+}
+
+// openShare registers owner as the primary of port when port sharing is
+// enabled, and returns nil otherwise
+func (s *ForwardServer) openShare(port int, owner *portBackend) *portShare {
+	if !s.allowPortSharing {
+		return nil
+	}
+	share := &portShare{backends: []*portBackend{owner}, empty: make(chan struct{})}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shares == nil {
+		s.shares = make(map[int]*portShare)
+	}
+	s.shares[port] = share
+	return share
+}
+
+// joinShare registers b as a backup of port and reports whether port is
+// currently served by a client it can back up
+func (s *ForwardServer) joinShare(port int, b *portBackend) bool {
+	if !s.allowPortSharing {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	share, ok := s.shares[port]
+	if !ok || len(share.backends) == 0 {
+		return false
+	}
+	share.backends = append(share.backends, b)
+	return true
+}
+
+// leaveShare removes b from the clients serving port, closing the share once
+// none remain. It returns how many clients still serve port.
+func (s *ForwardServer) leaveShare(port int, b *portBackend) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	share, ok := s.shares[port]
+	if !ok {
+		return 0
+	}
+	for i, candidate := range share.backends {
+		if candidate == b {
+			share.backends = append(share.backends[:i:i], share.backends[i+1:]...)
+			break
+		}
+	}
+	if len(share.backends) == 0 {
+		delete(s.shares, port)
+		close(share.empty)
+	}
+	return len(share.backends)
+}
+
+// backendsFor returns the clients serving port in failover order. Without a
+// share only owner serves it.
+func (s *ForwardServer) backendsFor(share *portShare, owner *portBackend) []*portBackend {
+	if share == nil {
+		return []*portBackend{owner}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*portBackend(nil), share.backends...)
+}
+
+// openBackChannel opens the back-channel of a forwarded connection on the
+// first client of port that accepts it, preferring the primary and failing
+// over to backups. payload is the direct-tcpip open payload.
+func (s *ForwardServer) openBackChannel(port int, share *portShare, owner *portBackend, payload []byte) (ssh.Channel, <-chan *ssh.Request, *portBackend, error) {
+	var lastErr error = fmt.Errorf("no client serving port %d", port)
+	for i, b := range s.backendsFor(share, owner) {
+		ch, reqs, err := b.conn.OpenChannel("direct-tcpip", payload)
+		if err == nil {
+			if i > 0 {
+				log.Printf("[*] Port %d failed over to backup client %s", port, b.conn.RemoteAddr())
+			}
+			return ch, reqs, b, nil
+		}
+		log.Printf("[-] Open back-channel on %s for port %d failed: %v", b.conn.RemoteAddr(), port, err)
+		lastErr = err
+	}
+	return nil, nil, nil, lastErr
+}
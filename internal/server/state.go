@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// stateFileInterval is how often the state file is refreshed between assigns and releases
+const stateFileInterval = 30 * time.Second
+
+// activeForward is the live record of an assigned port, kept for the state file
+type activeForward struct {
+	clientIP       string
+	startedAt      time.Time
+	bytesToClient  atomic.Uint64
+	bytesToService atomic.Uint64
+}
+
+// activeConn is the live record of a forwarded connection, keyed by its forward ID
+type activeConn struct {
+	port           int
+	peer           string
+	traceID        string
+	protocol       string
+	startedAt      time.Time
+	bytesToClient  atomic.Uint64
+	bytesToService atomic.Uint64
+}
+
+// ForwardState is one forward as written to the state file
+type ForwardState struct {
+	Port           int       `json:"port"`
+	ClientIP       string    `json:"client_ip"`
+	StartedAt      time.Time `json:"started_at"`
+	BytesToClient  uint64    `json:"bytes_to_client"`
+	BytesToService uint64    `json:"bytes_to_service"`
+}
+
+// ConnectionState is one forwarded connection as written to the state file
+type ConnectionState struct {
+	ID             uint64    `json:"id"`
+	Port           int       `json:"port"`
+	Peer           string    `json:"peer"`
+	TraceID        string    `json:"trace_id"`
+	Protocol       string    `json:"protocol,omitempty"`
+	StartedAt      time.Time `json:"started_at"`
+	BytesToClient  uint64    `json:"bytes_to_client"`
+	BytesToService uint64    `json:"bytes_to_service"`
+}
+
+// ServerState is the JSON document written to the state file
+type ServerState struct {
+	UpdatedAt                   time.Time         `json:"updated_at"`
+	Forwards                    []ForwardState    `json:"forwards"`
+	Connections                 []ConnectionState `json:"connections"`
+	WhitelistRejections         uint64            `json:"forward_whitelist_rejections_total"`
+	WhitelistRejectionsByPeerIP map[string]uint64 `json:"forward_whitelist_rejections_by_ip,omitempty"`
+}
+
+// countingWriter adds the number of bytes written to n
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Uint64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(uint64(n))
+	return n, err
+}
+
+// trackForward records port as active for clientIP and returns its record
+func (s *ForwardServer) trackForward(port int, clientIP string) *activeForward {
+	af := &activeForward{clientIP: clientIP, startedAt: time.Now()}
+	s.lock.Lock()
+	s.active[port] = af
+	s.lock.Unlock()
+	s.writeState()
+	return af
+}
+
+// untrackForward removes port from the active forwards
+func (s *ForwardServer) untrackForward(port int) {
+	s.lock.Lock()
+	delete(s.active, port)
+	s.lock.Unlock()
+	s.writeState()
+}
+
+// trackConn records forward id on port as open and returns its record;
+// protocol is empty unless it was detected
+func (s *ForwardServer) trackConn(id uint64, port int, peer, traceID, protocol string) *activeConn {
+	ac := &activeConn{port: port, peer: peer, traceID: traceID, protocol: protocol, startedAt: time.Now()}
+	s.lock.Lock()
+	s.conns[id] = ac
+	s.lock.Unlock()
+	return ac
+}
+
+// untrackConn removes forward id from the open connections
+func (s *ForwardServer) untrackConn(id uint64) {
+	s.lock.Lock()
+	delete(s.conns, id)
+	s.lock.Unlock()
+}
+
+// snapshotConns copies the open connections, sorted by ID. The caller holds s.lock.
+func (s *ForwardServer) snapshotConns() []ConnectionState {
+	conns := make([]ConnectionState, 0, len(s.conns))
+	for id, ac := range s.conns {
+		conns = append(conns, ConnectionState{
+			ID:             id,
+			Port:           ac.port,
+			Peer:           ac.peer,
+			TraceID:        ac.traceID,
+			Protocol:       ac.protocol,
+			StartedAt:      ac.startedAt,
+			BytesToClient:  ac.bytesToClient.Load(),
+			BytesToService: ac.bytesToService.Load(),
+		})
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// snapshotState copies the active forwards, sorted by port
+func (s *ForwardServer) snapshotState() ServerState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := ServerState{UpdatedAt: time.Now(), Forwards: make([]ForwardState, 0, len(s.active))}
+	for port, af := range s.active {
+		state.Forwards = append(state.Forwards, ForwardState{
+			Port:           port,
+			ClientIP:       af.clientIP,
+			StartedAt:      af.startedAt,
+			BytesToClient:  af.bytesToClient.Load(),
+			BytesToService: af.bytesToService.Load(),
+		})
+	}
+	sort.Slice(state.Forwards, func(i, j int) bool { return state.Forwards[i].Port < state.Forwards[j].Port })
+	state.Connections = s.snapshotConns()
+	state.WhitelistRejections, state.WhitelistRejectionsByPeerIP = s.whitelistRejections.snapshot()
+	return state
+}
+
+// writeState replaces the state file with a fresh snapshot. It is a no-op without a state file.
+func (s *ForwardServer) writeState() {
+	if s.stateFilePath == "" {
+		return
+	}
+	// serialise writers so an older snapshot never replaces a newer one
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	if err := writeStateFile(s.stateFilePath, s.snapshotState()); err != nil {
+		log.Printf("[-] Write state file failed: %v", err)
+	}
+}
+
+// persistState refreshes the state file every stateFileInterval so byte counts stay
+// current, until stop is closed
+func (s *ForwardServer) persistState(stop <-chan struct{}) {
+	ticker := time.NewTicker(stateFileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.writeState()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// writeStateFile atomically writes state to path through a temp file and rename
+func writeStateFile(path string, state ServerState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename temp file: %w", err)
+	}
+	return nil
+}
+
+// logStaleState reports a state file left by a previous run. Its forwards are not restored.
+func logStaleState(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[-] Read state file %s failed: %v", path, err)
+		}
+		return
+	}
+	var state ServerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("[-] Ignoring unreadable state file %s: %v", path, err)
+		return
+	}
+	log.Printf("[*] Found stale state file %s from %s with %d forwards (not restored)",
+		path, state.UpdatedAt.Format(time.RFC3339), len(state.Forwards))
+}
@@ -29,12 +29,13 @@ func c(str, color string) string {
 // PrintHelp prints the global help message
 func PrintHelp() {
 	fmt.Println(c("Usage:", colorBlue))
-	fmt.Println("  pbp-tunnel [client|server|generate] [flags]")
+	fmt.Println("  pbp-tunnel [client|server|generate|hash-password] [flags]")
 
 	fmt.Println(c("Modes:", colorBlue))
 	fmt.Printf("  %s\t%s\n", c("client", colorYellow), "Run the client to establish a reverse SSH tunnel")
 	fmt.Printf("  %s\t%s\n", c("server", colorYellow), "Run the server to receive SSH tunnel connections")
 	fmt.Printf("  %s\t%s\n", c("generate", colorYellow), "Generate a configuration template file")
+	fmt.Printf("  %s\t%s\n", c("hash-password", colorYellow), "Print the bcrypt hash of a password read from stdin")
 
 	fmt.Println()
 	fmt.Println(c("Options:", colorBlue))
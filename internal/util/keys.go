@@ -13,7 +13,16 @@ import (
 	"os"
 )
 
-func GenerateAndSavePrivateKeyToFile(filePath, keyType string) ([]byte, error) {
+// DefaultKeyFileMode is the permission used for generated private keys
+const DefaultKeyFileMode os.FileMode = 0600
+
+// GenerateAndSavePrivateKeyToFile generates a key of keyType and writes it to filePath
+// with the given mode (0 for DefaultKeyFileMode). World-readable modes are rejected.
+func GenerateAndSavePrivateKeyToFile(filePath, keyType string, mode os.FileMode) ([]byte, error) {
+	if err := checkKeyFileMode(mode); err != nil {
+		return nil, err
+	}
+
 	var keyBytes []byte
 
 	switch keyType {
@@ -51,7 +60,7 @@ func GenerateAndSavePrivateKeyToFile(filePath, keyType string) ([]byte, error) {
 		return nil, fmt.Errorf("unsupported key type: %s", keyType)
 	}
 
-	return savePrivateKeyPemToFile(filePath, keyBytes)
+	return savePrivateKeyPemToFile(filePath, keyBytes, mode)
 }
 
 func GenerateRSAPrivateKey() (*rsa.PrivateKey, error) {
@@ -120,11 +129,31 @@ func EncodeED25519PrivateKeyToPEM(privateKey crypto.PrivateKey) ([]byte, error)
 	return pem.EncodeToMemory(block), nil
 }
 
-func savePrivateKeyPemToFile(filePath string, privateKeyBytes []byte) ([]byte, error) {
-	err := os.WriteFile(filePath, privateKeyBytes, 0600)
+// checkKeyFileMode refuses modes that would let any local user read the key
+func checkKeyFileMode(mode os.FileMode) error {
+	if mode&0004 != 0 {
+		return fmt.Errorf("insecure key file mode %#o: must not be world-readable", mode.Perm())
+	}
+	return nil
+}
+
+func savePrivateKeyPemToFile(filePath string, privateKeyBytes []byte, mode os.FileMode) ([]byte, error) {
+	if mode == 0 {
+		mode = DefaultKeyFileMode
+	}
+	if err := checkKeyFileMode(mode); err != nil {
+		return nil, err
+	}
+
+	err := os.WriteFile(filePath, privateKeyBytes, mode)
 	if err != nil {
 		return nil, fmt.Errorf("failed to write private key to file: %v", err)
 	}
 
+	// WriteFile is subject to the umask and keeps the mode of an existing file
+	if err := os.Chmod(filePath, mode); err != nil {
+		return nil, fmt.Errorf("failed to set private key permissions: %v", err)
+	}
+
 	return privateKeyBytes, nil
 }
@@ -187,7 +187,7 @@ func TestSavePrivateKeyPemToFile(t *testing.T) {
 	testContent := []byte("TEST PRIVATE KEY CONTENT")
 
 	// Test saving the key
-	savedBytes, err := savePrivateKeyPemToFile(testFilePath, testContent)
+	savedBytes, err := savePrivateKeyPemToFile(testFilePath, testContent, DefaultKeyFileMode)
 	if err != nil {
 		t.Fatalf("savePrivateKeyPemToFile failed: %v", err)
 	}
@@ -227,7 +227,7 @@ func TestGenerateAndSavePrivateKeyToFile(t *testing.T) {
 		t.Run(keyType, func(t *testing.T) {
 			testFilePath := filepath.Join(tempDir, keyType+"-key.pem")
 
-			keyBytes, err := GenerateAndSavePrivateKeyToFile(testFilePath, keyType)
+			keyBytes, err := GenerateAndSavePrivateKeyToFile(testFilePath, keyType, DefaultKeyFileMode)
 			if err != nil {
 				t.Fatalf("Failed to generate and save %s key: %v", keyType, err)
 			}
@@ -272,7 +272,7 @@ func TestGenerateAndSavePrivateKeyToFile(t *testing.T) {
 	// Test with unsupported key type
 	t.Run("unsupported", func(t *testing.T) {
 		testFilePath := filepath.Join(tempDir, "unsupported-key.pem")
-		_, err := GenerateAndSavePrivateKeyToFile(testFilePath, "unsupported")
+		_, err := GenerateAndSavePrivateKeyToFile(testFilePath, "unsupported", DefaultKeyFileMode)
 		if err == nil {
 			t.Fatal("Expected error for unsupported key type, got nil")
 		}
@@ -285,7 +285,7 @@ func TestGenerateAndSavePrivateKeyToFile(t *testing.T) {
 // TestErrorCases tests various error conditions
 func TestErrorCases(t *testing.T) {
 	// Test with invalid file path
-	_, err := savePrivateKeyPemToFile("/invalid/path/that/should/not/exist", []byte("test"))
+	_, err := savePrivateKeyPemToFile("/invalid/path/that/should/not/exist", []byte("test"), DefaultKeyFileMode)
 	if err == nil {
 		t.Error("Expected error for invalid file path, got nil")
 	}
@@ -0,0 +1,57 @@
+//go:build unix
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSavePrivateKeyPemToFile_DefaultMode checks that generated keys are owner-only
+func TestSavePrivateKeyPemToFile_DefaultMode(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+
+	if _, err := GenerateAndSavePrivateKeyToFile(keyPath, "ed25519", 0); err != nil {
+		t.Fatalf("GenerateAndSavePrivateKeyToFile failed: %v", err)
+	}
+
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Mode().Perm() != DefaultKeyFileMode {
+		t.Errorf("Expected mode %#o, got %#o", DefaultKeyFileMode, info.Mode().Perm())
+	}
+}
+
+// TestSavePrivateKeyPemToFile_GroupReadable checks that a group-readable mode is honoured
+func TestSavePrivateKeyPemToFile_GroupReadable(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+
+	if _, err := GenerateAndSavePrivateKeyToFile(keyPath, "ed25519", 0640); err != nil {
+		t.Fatalf("GenerateAndSavePrivateKeyToFile failed: %v", err)
+	}
+
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640, got %#o", info.Mode().Perm())
+	}
+}
+
+// TestSavePrivateKeyPemToFile_WorldReadable checks that world-readable modes are refused
+func TestSavePrivateKeyPemToFile_WorldReadable(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+
+	_, err := GenerateAndSavePrivateKeyToFile(keyPath, "ed25519", 0644)
+	if err == nil || !strings.Contains(err.Error(), "world-readable") {
+		t.Fatalf("Expected world-readable error, got: %v", err)
+	}
+	if _, err := os.Stat(keyPath); !os.IsNotExist(err) {
+		t.Error("Key file was written despite the insecure mode")
+	}
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"fmt"
+	"net"
+)
+
+// SetNoDelay sets TCP_NODELAY on c to *noDelay when c is a TCP connection.
+// nil keeps the Go default, which already disables Nagle's algorithm.
+func SetNoDelay(c net.Conn, noDelay *bool) error {
+	tcp, ok := c.(*net.TCPConn)
+	if noDelay == nil || !ok {
+		return nil
+	}
+	return tcp.SetNoDelay(*noDelay)
+}
+
+// socketBuffers is implemented by connections with resizable socket buffers,
+// such as *net.TCPConn
+type socketBuffers interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// SetSocketBuffers sizes the receive and send buffers of c's socket. A size
+// of 0 keeps the OS default, as do connections without socket buffers.
+func SetSocketBuffers(c net.Conn, read, write int) error {
+	sb, ok := c.(socketBuffers)
+	if !ok {
+		return nil
+	}
+	if read > 0 {
+		if err := sb.SetReadBuffer(read); err != nil {
+			return fmt.Errorf("set read buffer: %w", err)
+		}
+	}
+	if write > 0 {
+		if err := sb.SetWriteBuffer(write); err != nil {
+			return fmt.Errorf("set write buffer: %w", err)
+		}
+	}
+	return nil
+}
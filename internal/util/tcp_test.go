@@ -0,0 +1,54 @@
+package util
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// bufferConn records the socket buffer sizes set on it
+type bufferConn struct {
+	net.Conn
+	read, write int
+	err         error
+}
+
+func (c *bufferConn) SetReadBuffer(bytes int) error {
+	c.read = bytes
+	return c.err
+}
+
+func (c *bufferConn) SetWriteBuffer(bytes int) error {
+	c.write = bytes
+	return c.err
+}
+
+func TestSetSocketBuffers(t *testing.T) {
+	c := &bufferConn{}
+	if err := SetSocketBuffers(c, 1<<20, 2<<20); err != nil {
+		t.Fatalf("SetSocketBuffers: %v", err)
+	}
+	if c.read != 1<<20 || c.write != 2<<20 {
+		t.Errorf("buffers = %d/%d; want %d/%d", c.read, c.write, 1<<20, 2<<20)
+	}
+
+	// 0 keeps the OS default
+	c = &bufferConn{}
+	if err := SetSocketBuffers(c, 0, 4096); err != nil || c.read != 0 || c.write != 4096 {
+		t.Errorf("SetSocketBuffers(0, 4096) = %v, buffers %d/%d; want read untouched", err, c.read, c.write)
+	}
+
+	c = &bufferConn{err: errors.New("no buffer space")}
+	if err := SetSocketBuffers(c, 4096, 0); err == nil || !strings.Contains(err.Error(), "set read buffer") {
+		t.Errorf("SetSocketBuffers with a failing socket = %v; want set read buffer error", err)
+	}
+
+	// connections without socket buffers are left alone
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	if err := SetSocketBuffers(p1, 4096, 4096); err != nil {
+		t.Errorf("SetSocketBuffers on a pipe = %v; want nil", err)
+	}
+}
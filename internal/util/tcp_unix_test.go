@@ -0,0 +1,66 @@
+//go:build unix
+
+package util
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// noDelay reads TCP_NODELAY back from the socket of c
+func noDelay(t *testing.T, c *net.TCPConn) bool {
+	t.Helper()
+	raw, err := c.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	var v int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		v, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	}); err != nil {
+		t.Fatalf("Control: %v", err)
+	}
+	if sockErr != nil {
+		t.Fatalf("getsockopt: %v", sockErr)
+	}
+	return v != 0
+}
+
+func TestSetNoDelay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	tcp := c.(*net.TCPConn)
+
+	off, on := false, true
+	if err := SetNoDelay(c, &off); err != nil {
+		t.Fatalf("SetNoDelay(false): %v", err)
+	}
+	if noDelay(t, tcp) {
+		t.Error("TCP_NODELAY set after SetNoDelay(false)")
+	}
+	// nil leaves the socket as it is
+	if err := SetNoDelay(c, nil); err != nil || noDelay(t, tcp) {
+		t.Errorf("SetNoDelay(nil) = %v, changed TCP_NODELAY", err)
+	}
+	if err := SetNoDelay(c, &on); err != nil || !noDelay(t, tcp) {
+		t.Errorf("SetNoDelay(true) = %v, TCP_NODELAY not set", err)
+	}
+
+	// connections other than TCP are left alone
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	if err := SetNoDelay(p1, &on); err != nil {
+		t.Errorf("SetNoDelay on a pipe = %v; want nil", err)
+	}
+}